@@ -0,0 +1,322 @@
+package main
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrRegister = errors.New("Registration failed")
+	ErrErased   = errors.New("Device erased")
+)
+
+// How the simulated device responds to a command.
+const (
+	BEHAVE_OK     = "ok"     // perform the command and ack it
+	BEHAVE_FAIL   = "fail"   // reply with an error
+	BEHAVE_IGNORE = "ignore" // never reply
+)
+
+type replyType map[string]interface{}
+
+// A simulated device.
+type device struct {
+	sim         *simulator
+	ID          string
+	email       string
+	hawk        *wmf.HawkClient
+	wake        chan bool
+	step        int
+	hasPasscode bool
+	trackUntil  time.Time
+}
+
+func newDevice(sim *simulator, n int) (self *device) {
+	id, _ := util.GenUUID4()
+	return &device{
+		sim:         sim,
+		ID:          id,
+		email:       fmt.Sprintf("fmdsim_%s@example.com", id[:12]),
+		wake:        make(chan bool, 1),
+		step:        n,
+		hasPasscode: sim.opts.Passcode,
+	}
+}
+
+// Build an unsigned assertion. Only useful against a server running with
+// auth.disabled=true.
+func (self *device) fakeAssertion() string {
+	enc := func(v interface{}) string {
+		js, _ := json.Marshal(v)
+		return base64.StdEncoding.EncodeToString(js)
+	}
+	now := time.Now().Unix()
+	return fmt.Sprintf("%s.%s.%s",
+		enc(replyType{"alg": "fake"}),
+		enc(replyType{"public-key": replyType{"algorithm": "None"},
+			"iat":       now,
+			"exp":       now + 300,
+			"principal": replyType{"email": self.email},
+			"iss":       "login.example.org"}),
+		"InvalidKey")
+}
+
+// Register the device and pick up the HAWK secret.
+func (self *device) register() (err error) {
+	assertion := self.sim.opts.Assertion
+	if assertion == "" {
+		assertion = self.fakeAssertion()
+	}
+	accepts := []string{}
+	for _, c := range self.sim.opts.Accepts {
+		accepts = append(accepts, string(c))
+	}
+	body, err := json.Marshal(replyType{
+		"assert":       assertion,
+		"pushurl":      self.sim.pushUrl(self.ID),
+		"deviceid":     self.ID,
+		"has_passcode": strconv.FormatBool(self.hasPasscode),
+		"accepts":      accepts})
+	if err != nil {
+		return err
+	}
+	resp, err := self.sim.client.Post(self.sim.url("register", ""),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		self.sim.logf("%s: register returned %d: %s", self.ID,
+			resp.StatusCode, raw)
+		return ErrRegister
+	}
+	cred := make(map[string]string)
+	if err = json.Unmarshal(raw, &cred); err != nil {
+		return err
+	}
+	if cred["deviceid"] != self.ID || cred["secret"] == "" {
+		return ErrRegister
+	}
+	self.hawk = wmf.NewHawkClient(self.ID, cred["secret"], self.sim.client)
+	self.hawk.Port = self.sim.opts.HawkPort
+	return nil
+}
+
+// The current position report.
+func (self *device) position() replyType {
+	var pos fix
+	if self.sim.track != nil {
+		pos = self.sim.track.at(self.step)
+	} else {
+		pos = geoWalk(self.sim.opts.Latitude, self.sim.opts.Longitude)
+	}
+	self.step++
+	return replyType{
+		"ok": true,
+		"la": pos.Latitude,
+		"lo": pos.Longitude,
+		"al": pos.Altitude,
+		"ac": pos.Accuracy,
+		"ti": time.Now().Unix(),
+		"ha": self.hasPasscode}
+}
+
+// Send the reply to the server and return the next command (if any).
+func (self *device) cmd(reply replyType) (command replyType, err error) {
+	body := []byte{}
+	if reply != nil {
+		if body, err = json.Marshal(reply); err != nil {
+			return nil, err
+		}
+	}
+	self.sim.stats.inc("cmd.sent")
+	raw, status, err := self.hawk.Do("POST", self.sim.url("cmd", self.ID), body)
+	switch {
+	case err == wmf.ErrInvalidSignature || err == wmf.ErrNoAuth:
+		self.sim.stats.inc("error.hawk")
+		return nil, err
+	case err != nil:
+		self.sim.stats.inc("error.cmd")
+		return nil, err
+	case status == http.StatusUnauthorized:
+		// The server forgets erased devices.
+		return nil, ErrErased
+	case status != http.StatusOK:
+		self.sim.stats.inc("error.cmd")
+		return nil, fmt.Errorf("Cmd returned %d: %s", status, raw)
+	}
+	command = make(replyType)
+	if err = json.Unmarshal(raw, &command); err != nil {
+		self.sim.stats.inc("error.cmd")
+		return nil, err
+	}
+	return command, nil
+}
+
+// Act on a command from the server. Returns the reply to send back.
+func (self *device) process(command replyType) (reply replyType, erased bool) {
+	reply = make(replyType)
+	for c, a := range command {
+		args, _ := a.(map[string]interface{})
+		self.sim.stats.inc("cmd.recv." + c)
+		self.sim.debugf("%s: received %s %v", self.ID, c, args)
+		var behavior string
+		switch c {
+		case "l":
+			behavior = self.sim.opts.Lock
+		case "r":
+			behavior = self.sim.opts.Ring
+		case "t":
+			behavior = self.sim.opts.Track
+		case "e":
+			behavior = self.sim.opts.Erase
+		default:
+			reply[c] = replyType{"ok": false, "error": "Unknown command"}
+			continue
+		}
+		switch behavior {
+		case BEHAVE_IGNORE:
+			continue
+		case BEHAVE_FAIL:
+			reply[c] = replyType{"ok": false, "error": "Simulated failure"}
+			continue
+		}
+		switch c {
+		case "l":
+			if _, ok := args["c"]; ok {
+				self.hasPasscode = true
+			}
+			reply[c] = replyType{"ok": true}
+		case "r":
+			reply[c] = replyType{"ok": true}
+		case "t":
+			d, _ := args["d"].(float64)
+			if d > 0 {
+				self.trackUntil = time.Now().Add(time.Duration(d) * time.Second)
+				reply[c] = self.position()
+			} else {
+				self.trackUntil = time.Time{}
+				reply[c] = replyType{"ok": true}
+			}
+		case "e":
+			reply[c] = replyType{"ok": true}
+			erased = true
+		}
+	}
+	if len(reply) == 0 {
+		return nil, erased
+	}
+	return reply, erased
+}
+
+// Exchange with the server until there is nothing left to say.
+func (self *device) exchange(reply replyType) (err error) {
+	var command replyType
+	for {
+		if command, err = self.cmd(reply); err != nil {
+			return err
+		}
+		if len(command) == 0 {
+			return nil
+		}
+		var erased bool
+		reply, erased = self.process(command)
+		if erased {
+			// Ack the wipe, then go away. The server deletes the device
+			// once it has the ack.
+			if reply != nil {
+				self.cmd(reply)
+			}
+			return ErrErased
+		}
+		if reply == nil {
+			return nil
+		}
+	}
+}
+
+// Device main loop.
+func (self *device) run(quit chan bool) {
+	defer self.sim.done.Done()
+	if err := self.register(); err != nil {
+		self.sim.stats.inc("error.register")
+		self.sim.logf("%s: could not register: %s", self.ID, err.Error())
+		return
+	}
+	self.sim.stats.inc("registered")
+	self.sim.addDevice(self)
+	defer self.sim.rmDevice(self)
+
+	// Report in, like a freshly started device.
+	if err := self.exchange(replyType{"t": self.position()}); err != nil {
+		self.sim.logf("%s: initial report failed: %s", self.ID, err.Error())
+		if err == ErrErased {
+			return
+		}
+	}
+
+	var poll <-chan time.Time
+	if self.sim.opts.Poll > 0 {
+		ticker := time.NewTicker(time.Duration(self.sim.opts.Poll) * time.Second)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	trackTicker := time.NewTicker(time.Duration(self.sim.opts.TrackInterval) * time.Second)
+	defer trackTicker.Stop()
+
+	for {
+		var reply replyType
+		select {
+		case <-quit:
+			return
+		case <-self.wake:
+			self.sim.stats.inc("push.recv")
+		case <-poll:
+		case <-trackTicker.C:
+			if self.trackUntil.IsZero() {
+				continue
+			}
+			if time.Now().After(self.trackUntil) {
+				self.trackUntil = time.Time{}
+				continue
+			}
+			reply = replyType{"t": self.position()}
+			self.sim.stats.inc("position.sent")
+		}
+		if err := self.exchange(reply); err != nil {
+			if err == ErrErased {
+				self.sim.stats.inc("erased")
+				self.sim.logf("%s: erased", self.ID)
+				return
+			}
+			self.sim.logf("%s: %s", self.ID, err.Error())
+		}
+	}
+}
+
+// Nudge the device (non-blocking, pushes coalesce).
+func (self *device) push() {
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
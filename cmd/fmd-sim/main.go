@@ -0,0 +1,237 @@
+package main
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* fmd-sim: pretend to be one or more devices.
+
+   Registers fake devices with a Find My Device server, listens for the
+   push notifications the server sends to them, and answers the commands
+   it hands out. Useful for local development and load testing.
+
+   The devices use fake assertions, so the server needs to be running with
+   auth.disabled=true (or pass a real assertion with --assertion).
+*/
+
+import (
+	flags "github.com/jessevdk/go-flags"
+
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type options struct {
+	Server        string  `short:"s" long:"server" default:"http://localhost:8080" description:"FMD server root URL"`
+	Api           string  `long:"api" default:"1" description:"API version root"`
+	Devices       int     `short:"n" long:"devices" default:"1" description:"Number of devices to simulate"`
+	Ramp          int     `long:"ramp" default:"10" description:"Milliseconds between device registrations"`
+	Listen        string  `long:"listen" default:"127.0.0.1:8081" description:"Address for the fake push endpoint"`
+	PushUrl       string  `long:"pushurl" description:"Push URL root the server should use (defaults to http://<listen>)"`
+	Poll          int     `long:"poll" default:"0" description:"Also poll for commands every N seconds (0 = push only)"`
+	Assertion     string  `long:"assertion" description:"Assertion to register with (default: fake, per device)"`
+	Accepts       string  `long:"accepts" default:"elrth" description:"Commands the devices accept"`
+	Passcode      bool    `long:"passcode" description:"Devices start with a passcode set"`
+	HawkPort      string  `long:"hawkport" description:"Port to sign HAWK requests with (see hawk.port)"`
+	Lock          string  `long:"lock" default:"ok" description:"Lock behavior (ok|fail|ignore)"`
+	Ring          string  `long:"ring" default:"ok" description:"Ring behavior (ok|fail|ignore)"`
+	Track         string  `long:"track" default:"ok" description:"Track behavior (ok|fail|ignore)"`
+	Erase         string  `long:"erase" default:"ok" description:"Erase behavior (ok|fail|ignore)"`
+	TrackFile     string  `long:"trackfile" description:"Scripted track (lat,lon[,accuracy[,altitude]] per line)"`
+	TrackInterval int     `long:"trackinterval" default:"10" description:"Seconds between position reports while tracking"`
+	Latitude      float64 `long:"lat" default:"37.3883" description:"Base latitude for random positions"`
+	Longitude     float64 `long:"lon" default:"-122.0615" description:"Base longitude for random positions"`
+	Report        int     `long:"report" default:"10" description:"Seconds between stats reports (0 = only at exit)"`
+	Verbose       bool    `short:"v" long:"verbose" description:"Log every command"`
+}
+
+// Simple counters.
+type stats struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func (self *stats) inc(key string) {
+	self.Lock()
+	self.counts[key]++
+	self.Unlock()
+}
+
+func (self *stats) String() string {
+	self.Lock()
+	defer self.Unlock()
+	keys := make([]string, 0, len(self.counts))
+	for k := range self.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, fmt.Sprintf("%s=%d", k, self.counts[k]))
+	}
+	return strings.Join(out, " ")
+}
+
+type simulator struct {
+	opts    *options
+	client  *http.Client
+	track   *track
+	stats   *stats
+	done    sync.WaitGroup
+	muDev   sync.RWMutex
+	devices map[string]*device
+}
+
+func (self *simulator) logf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (self *simulator) debugf(format string, args ...interface{}) {
+	if self.opts.Verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// Build a server URL for the given API call.
+func (self *simulator) url(call, devId string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", strings.TrimRight(self.opts.Server, "/"),
+		self.opts.Api, call, devId)
+}
+
+// The push URL handed to the server for a device.
+func (self *simulator) pushUrl(devId string) string {
+	root := self.opts.PushUrl
+	if root == "" {
+		root = "http://" + self.opts.Listen
+	}
+	return strings.TrimRight(root, "/") + "/push/" + devId
+}
+
+func (self *simulator) addDevice(dev *device) {
+	self.muDev.Lock()
+	self.devices[dev.ID] = dev
+	self.muDev.Unlock()
+}
+
+func (self *simulator) rmDevice(dev *device) {
+	self.muDev.Lock()
+	delete(self.devices, dev.ID)
+	self.muDev.Unlock()
+}
+
+// The fake push server. The server PUTs to the push URL to wake a device.
+func (self *simulator) Push(resp http.ResponseWriter, req *http.Request) {
+	bits := strings.Split(strings.TrimRight(req.URL.Path, "/"), "/")
+	self.muDev.RLock()
+	dev, ok := self.devices[bits[len(bits)-1]]
+	self.muDev.RUnlock()
+	if !ok {
+		self.stats.inc("push.unknown")
+		http.Error(resp, "Unknown endpoint", http.StatusNotFound)
+		return
+	}
+	dev.push()
+}
+
+func checkBehavior(name, val string) {
+	switch val {
+	case BEHAVE_OK, BEHAVE_FAIL, BEHAVE_IGNORE:
+		return
+	}
+	log.Fatalf("Invalid --%s behavior %q (use ok, fail or ignore)", name, val)
+}
+
+func main() {
+	var opts options
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+	checkBehavior("lock", opts.Lock)
+	checkBehavior("ring", opts.Ring)
+	checkBehavior("track", opts.Track)
+	checkBehavior("erase", opts.Erase)
+	if opts.TrackInterval < 1 {
+		opts.TrackInterval = 1
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	sim := &simulator{
+		opts: &opts,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: opts.Devices,
+			},
+		},
+		stats:   &stats{counts: make(map[string]int64)},
+		devices: make(map[string]*device),
+	}
+	if opts.TrackFile != "" {
+		var err error
+		if sim.track, err = readTrack(opts.TrackFile); err != nil {
+			log.Fatalf("Could not read track: %s", err.Error())
+		}
+	}
+
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		log.Fatalf("Could not start push listener: %s", err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push/", sim.Push)
+	go http.Serve(listener, mux)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	log.Printf("Starting %d device(s) against %s", opts.Devices, opts.Server)
+	quit := make(chan bool)
+	for n := 0; n < opts.Devices; n++ {
+		sim.done.Add(1)
+		go newDevice(sim, n).run(quit)
+		if opts.Ramp > 0 {
+			time.Sleep(time.Duration(opts.Ramp) * time.Millisecond)
+		}
+	}
+
+	// Stop once every device is gone (e.g. erased) or on a signal.
+	finished := make(chan bool)
+	go func() {
+		sim.done.Wait()
+		close(finished)
+	}()
+	var report <-chan time.Time
+	if opts.Report > 0 {
+		ticker := time.NewTicker(time.Duration(opts.Report) * time.Second)
+		defer ticker.Stop()
+		report = ticker.C
+	}
+	for {
+		select {
+		case <-report:
+			sim.muDev.RLock()
+			active := len(sim.devices)
+			sim.muDev.RUnlock()
+			log.Printf("active=%d %s", active, sim.stats)
+		case <-sigChan:
+			log.Printf("Shutting down...")
+			close(quit)
+			<-finished
+			log.Printf("Final: %s", sim.stats)
+			return
+		case <-finished:
+			log.Printf("No devices left. Final: %s", sim.stats)
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrEmptyTrack = errors.New("Track file contains no positions")
+
+// A single GPS fix.
+type fix struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+	Accuracy  float64
+}
+
+// A scripted track. Each device walks the track from its own offset,
+// wrapping around at the end.
+type track struct {
+	fixes []fix
+}
+
+// Read a track file. One fix per line as
+//
+//	latitude,longitude[,accuracy[,altitude]]
+//
+// Blank lines and lines starting with '#' are skipped.
+func readTrack(filename string) (self *track, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	self = &track{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected latitude,longitude",
+				filename, line)
+		}
+		var vals [4]float64
+		// default accuracy (meters)
+		vals[2] = 10
+		for i, field := range fields {
+			if i >= len(vals) {
+				break
+			}
+			if vals[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filename, line, err.Error())
+			}
+		}
+		self.fixes = append(self.fixes, fix{
+			Latitude:  vals[0],
+			Longitude: vals[1],
+			Accuracy:  vals[2],
+			Altitude:  vals[3]})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(self.fixes) == 0 {
+		return nil, ErrEmptyTrack
+	}
+	return self, nil
+}
+
+// Return the fix at step n (wrapping).
+func (self *track) at(n int) fix {
+	return self.fixes[n%len(self.fixes)]
+}
+
+// Return a randomish location within a mile or so of a location.
+// (Used when no track file is provided.)
+func geoWalk(lat, lon float64) fix {
+	return fix{
+		Latitude:  lat + float64(rand.Intn(1000))*0.000001,
+		Longitude: lon + float64(rand.Intn(1000))*0.000001,
+		Accuracy:  float64(5 + rand.Intn(50)),
+	}
+}
@@ -7,7 +7,6 @@ package main
 import (
 	"io/ioutil"
 
-	"code.google.com/p/go.net/websocket"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/mozilla-services/FindMyDevice/util"
 	"github.com/mozilla-services/FindMyDevice/wmf"
@@ -106,12 +105,8 @@ func main() {
 		}
 	}
 
-	// Partner cert pool contains the various self-signed certs that
-	// partners may require to access their servers (for Proprietary
-	// wake mechanisms like UDP)
-	// This would be where you collect the certs and store them into
-	// the config map as something like:
-	// config["partnerCertPool"] = self.loadCerts()
+	// Partner certificates (for proprietary wake mechanisms) are
+	// configured with push.tls.* and push.webhook.*.tls.*
 
 	if opts.Profile != "" {
 		log.Printf("Creating profile %s...\n", opts.Profile)
@@ -155,66 +150,11 @@ func main() {
 	}
 
 	// Signal handler
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
 
-	var RESTMux = http.DefaultServeMux
-	var WSMux = http.DefaultServeMux
 	var verRoot = strings.SplitN(VERSION, ".", 2)[0]
-
-	// REST calls
-
-	RESTMux.HandleFunc(fmt.Sprintf("/%s/register/", verRoot),
-		handlers.Register)
-	RESTMux.HandleFunc(fmt.Sprintf("/%s/cmd/", verRoot),
-		handlers.Cmd)
-	// Web UI calls
-	RESTMux.HandleFunc(fmt.Sprintf("/%s/queue/", verRoot),
-		handlers.RestQueue)
-	RESTMux.HandleFunc(fmt.Sprintf("/%s/state/", verRoot),
-		handlers.State)
-	// Static files (served by nginx in production)
-	if config.GetFlag("use_insecure_static") {
-		RESTMux.HandleFunc("/bower_components/",
-			handlers.Static)
-		RESTMux.HandleFunc("/images/",
-			handlers.Static)
-		RESTMux.HandleFunc("/scripts/",
-			handlers.Static)
-		RESTMux.HandleFunc("/styles/",
-			handlers.Static)
-	}
-	// Metrics
-	RESTMux.HandleFunc("/metrics/",
-		handlers.Metrics)
-	// Operations call
-	RESTMux.HandleFunc("/status/",
-		handlers.Status)
-	//Signin
-	// set state nonce & check if valid at signin
-	RESTMux.HandleFunc("/signin/",
-		handlers.Signin)
-	//Signout
-	RESTMux.HandleFunc("/signout/",
-		handlers.Signout)
-	// Config option because there are other teams involved.
-	auth := config.Get("fxa.redir_uri", "/oauth/")
-	RESTMux.HandleFunc(auth, handlers.OAuthCallback)
-
-	WSMux.Handle(fmt.Sprintf("/%s/ws/", verRoot),
-		websocket.Handler(handlers.WSSocketHandler))
-	// Handle root calls as webUI
-	// Get a list of registered devices for the currently logged in user
-	RESTMux.HandleFunc(fmt.Sprintf("/%s/devices/", verRoot),
-		handlers.UserDevices)
-	// Get an object describing the data for a user's device
-	// e.g. http://host/0/data/0123deviceid
-	RESTMux.HandleFunc(fmt.Sprintf("/%s/data/", verRoot),
-		handlers.InitDataJson)
-	RESTMux.HandleFunc(fmt.Sprintf("/%s/validate/", verRoot),
-		handlers.Validate)
-	RESTMux.HandleFunc("/",
-		handlers.Index)
+	handlers.HandleRoutes(http.DefaultServeMux, verRoot)
 
 	logger.Info("main", "startup...",
 		util.Fields{"host": host, "port": port, "version": fullVers})
@@ -226,9 +166,10 @@ func main() {
 	select {
 	case err := <-errChan:
 		if err != nil {
-			log.Fatalf("ListenAndServe: " + err.Error())
+			log.Fatalf("ListenAndServe: %s", err.Error())
 		}
 	case <-sigChan:
 		logger.Info("main", "Shutting down...", nil)
 	}
+	handlers.Close()
 }
@@ -1,19 +1,49 @@
 create table if not exists userToDeviceMap (userId varchar, deviceId varchar, name varchar, date date);
-create table if not exists deviceInfo (deviceId varchar unique, lockable boolean, loggedin boolean, lastExchange timestamp, hawkSecret varchar, pushurl varchar, accepts varchar, accesstoken varchar);
-create table if not exists pendingCommands (id bigserial, deviceId varchar, time timestamp, cmd varchar, type varchar);
+create table if not exists deviceInfo (deviceId varchar unique, lockable boolean, loggedin boolean, lastExchange timestamp, hawkSecret varchar, pushurl varchar, pushkey varchar, pushauth varchar, pushtype varchar, accepts varchar, accesstoken varchar, unreachable boolean default false, lostmode varchar, erasing timestamp, passcodepolicy varchar, bestposition varchar);
+create table if not exists pendingCommands (id bigserial, deviceId varchar, time timestamp, cmd varchar, type varchar, cmdId varchar);
+create table if not exists scheduledCommands (id bigserial, deviceId varchar, time timestamp, created timestamp, cmd varchar, args varchar, attempts int default 0, scheduledBy varchar);
+create table if not exists trackingSessions (deviceId varchar unique, startedBy varchar, started timestamp, expires timestamp, reportInterval int, unwatched timestamp);
+create table if not exists geofences (id bigserial, deviceId varchar, name varchar, latitude double precision, longitude double precision, radius double precision, polygon varchar, state varchar, created timestamp);
+create table if not exists shares (id varchar unique, deviceId varchar, createdBy varchar, created timestamp, expires timestamp);
+create table if not exists deviceAccess (deviceId varchar, userId varchar, role varchar, grantedBy varchar, created timestamp);
+create table if not exists invitations (id varchar unique, deviceId varchar, role varchar, email varchar, invitedBy varchar, created timestamp, expires timestamp);
+create table if not exists deviceStatus (deviceId varchar unique, time timestamp, battery int, charging boolean, network varchar, carrier varchar, appVersion varchar, osVersion varchar);
+create table if not exists userInfo (userId varchar unique, email varchar);
 create table if not exists position (id bigserial, deviceId varchar, time  timestamp, latitude real, longitude real, altitude real, accuracy real);
 create or replace function update_time() returns trigger as $$ begin new.lastexchange = now(); return new; end; $$ language 'plpgsql';
 drop trigger if exists update_le on deviceinfo;
 create trigger update_le before update on deviceinfo for each row execute procedure update_time();
 create table if not exists meta (key varchar, value varchar);
 create table if not exists nonce (key varchar, val varchar, time timestamp);
+create table if not exists tombstones (id varchar unique, kind varchar, deleted timestamp);
+create table if not exists auditLog (id bigserial, time timestamp, userId varchar, deviceId varchar, owner varchar, action varchar, args varchar, source varchar, result varchar);
+create table if not exists webhooks (id varchar unique, userId varchar, url varchar, secret varchar, events varchar, created timestamp);
+create table if not exists webhookDeliveries (id bigserial, webhookId varchar, delivery varchar, event varchar, deviceId varchar, time timestamp, attempt int, status int, error varchar);
+create table if not exists notifyPrefs (userId varchar unique, locale varchar, email boolean, muted varchar);
 create index "usertodevicemap_userid_idx" on userToDeviceMap (userId);
 create index "usertodevicemap_deviceid_idx" on userToDeviceMap (deviceId);
 create unique index "usertodevicemap_userid_deviceid_idx" on userToDeviceMap (userId, deviceId);
 create index "deviceinfo_deviceid_idx" on deviceInfo (deviceId);
 create index "pendingcommands_deviceid_idx" on pendingCommands (deviceId);
 create index "position_deviceid_idx" on position (deviceId);
+create index "devicestatus_deviceid_idx" on deviceStatus (deviceId);
+create index "userinfo_userid_idx" on userInfo (userId);
+create index "scheduledcommands_deviceid_idx" on scheduledCommands (deviceId);
+create index "scheduledcommands_time_idx" on scheduledCommands (time);
+create index "trackingsessions_expires_idx" on trackingSessions (expires);
+create index "geofences_deviceid_idx" on geofences (deviceId);
+create index "shares_deviceid_idx" on shares (deviceId);
+create unique index "deviceaccess_deviceid_userid_idx" on deviceAccess (deviceId, userId);
+create index "deviceaccess_userid_idx" on deviceAccess (userId);
+create index "invitations_deviceid_idx" on invitations (deviceId);
 create index "meta_key_idx" on meta (key);
 create index "nonce_key_idx" on nonce (key);
 create index "nonce_time_idx" on nonce (time);
+create index "tombstones_deleted_idx" on tombstones (deleted);
+create index "auditlog_deviceid_id_idx" on auditLog (deviceId, id);
+create index "auditlog_userid_idx" on auditLog (userId);
+create index "auditlog_owner_idx" on auditLog (owner);
+create index "webhooks_userid_idx" on webhooks (userId);
+create index "webhookdeliveries_webhookid_id_idx" on webhookDeliveries (webhookId, id);
+create index "webhookdeliveries_time_idx" on webhookDeliveries (time);
 set time zone utc;
@@ -0,0 +1,14 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(column_name) into x from information_schema.columns where table_name='deviceinfo' and column_name='pushkey';
+    if x = 0 then
+        alter table deviceinfo add column pushkey varchar;
+        alter table deviceinfo add column pushauth varchar;
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
@@ -0,0 +1,14 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='devicestatus';
+    if x = 0 then
+        create table deviceStatus (deviceId varchar unique, time timestamp, battery int, charging boolean, network varchar, carrier varchar, appVersion varchar, osVersion varchar);
+        create index "devicestatus_deviceid_idx" on deviceStatus (deviceId);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
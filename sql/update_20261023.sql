@@ -0,0 +1,15 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='scheduledcommands';
+    if x = 0 then
+        create table scheduledCommands (id bigserial, deviceId varchar, time timestamp, created timestamp, cmd varchar, args varchar);
+        create index "scheduledcommands_deviceid_idx" on scheduledCommands (deviceId);
+        create index "scheduledcommands_time_idx" on scheduledCommands (time);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
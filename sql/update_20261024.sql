@@ -0,0 +1,20 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+    r int := 0;
+BEGIN
+    select count(column_name) into x from information_schema.columns where table_name='deviceinfo' and column_name='erasing';
+    if x = 0 then
+        alter table deviceinfo add column erasing timestamp;
+        r := 1;
+    end if;
+    select count(table_name) into x from information_schema.tables where table_name='userinfo';
+    if x = 0 then
+        create table userInfo (userId varchar unique, email varchar);
+        create index "userinfo_userid_idx" on userInfo (userId);
+        r := 1;
+    end if;
+    return r;
+END;
+$$;
+select update_db()
@@ -0,0 +1,14 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='trackingsessions';
+    if x = 0 then
+        create table trackingSessions (deviceId varchar unique, startedBy varchar, started timestamp, expires timestamp, reportInterval int, unwatched timestamp);
+        create index "trackingsessions_expires_idx" on trackingSessions (expires);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
@@ -0,0 +1,14 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='geofences';
+    if x = 0 then
+        create table geofences (id bigserial, deviceId varchar, name varchar, latitude double precision, longitude double precision, radius double precision, polygon varchar, state varchar, created timestamp);
+        create index "geofences_deviceid_idx" on geofences (deviceId);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
@@ -0,0 +1,14 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='shares';
+    if x = 0 then
+        create table shares (id varchar unique, deviceId varchar, createdBy varchar, created timestamp, expires timestamp);
+        create index "shares_deviceid_idx" on shares (deviceId);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
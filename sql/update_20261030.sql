@@ -0,0 +1,17 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='deviceaccess';
+    if x = 0 then
+        create table deviceAccess (deviceId varchar, userId varchar, role varchar, grantedBy varchar, created timestamp);
+        create unique index "deviceaccess_deviceid_userid_idx" on deviceAccess (deviceId, userId);
+        create index "deviceaccess_userid_idx" on deviceAccess (userId);
+        create table invitations (id varchar unique, deviceId varchar, role varchar, email varchar, invitedBy varchar, created timestamp, expires timestamp);
+        create index "invitations_deviceid_idx" on invitations (deviceId);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
@@ -0,0 +1,14 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='tombstones';
+    if x = 0 then
+        create table tombstones (id varchar unique, kind varchar, deleted timestamp);
+        create index "tombstones_deleted_idx" on tombstones (deleted);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
@@ -0,0 +1,16 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='auditlog';
+    if x = 0 then
+        create table auditLog (id bigserial, time timestamp, userId varchar, deviceId varchar, owner varchar, action varchar, args varchar, source varchar, result varchar);
+        create index "auditlog_deviceid_id_idx" on auditLog (deviceId, id);
+        create index "auditlog_userid_idx" on auditLog (userId);
+        create index "auditlog_owner_idx" on auditLog (owner);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
@@ -0,0 +1,17 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='webhooks';
+    if x = 0 then
+        create table webhooks (id varchar unique, userId varchar, url varchar, secret varchar, events varchar, created timestamp);
+        create table webhookDeliveries (id bigserial, webhookId varchar, delivery varchar, event varchar, deviceId varchar, time timestamp, attempt int, status int, error varchar);
+        create index "webhooks_userid_idx" on webhooks (userId);
+        create index "webhookdeliveries_webhookid_id_idx" on webhookDeliveries (webhookId, id);
+        create index "webhookdeliveries_time_idx" on webhookDeliveries (time);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
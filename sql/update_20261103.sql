@@ -0,0 +1,13 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(table_name) into x from information_schema.tables where table_name='notifyprefs';
+    if x = 0 then
+        create table notifyPrefs (userId varchar unique, locale varchar, email boolean, muted varchar);
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
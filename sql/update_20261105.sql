@@ -0,0 +1,13 @@
+create or replace function update_db() returns int language plpgsql as $$
+DECLARE
+    x int;
+BEGIN
+    select count(column_name) into x from information_schema.columns where table_name='scheduledcommands' and column_name='scheduledby';
+    if x = 0 then
+        alter table scheduledCommands add column scheduledBy varchar;
+        return 1;
+    end if;
+    return 0;
+END;
+$$;
+select update_db()
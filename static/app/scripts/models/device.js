@@ -20,7 +20,7 @@ define([
 
     // Convert attributes to lowercase
     parse: function (resp, xhr) {
-      return { id: resp.ID, name: resp.Name, url: resp.URL };
+      return { id: resp.ID, name: resp.Name, url: resp.URL, role: resp.Role };
     },
 
     onWebSocketUpdate: function (message) {
@@ -34,6 +34,33 @@ define([
           attrs = this.parseCommand(data.Cmd);
         }
 
+        if (data.Status) {
+          attrs = _.extend(attrs || {}, this.parseStatus(data));
+        }
+
+        // The best known location, which may not be the fix just reported
+        if (data.Best) {
+          attrs = _.extend(attrs || {}, {
+            bestLatitude: data.Best.Latitude,
+            bestLongitude: data.Best.Longitude,
+            bestAccuracy: data.Best.Accuracy,
+            bestStale: !!data.Best.Stale
+          });
+        }
+
+        // e.g. "Portland, Oregon", if the server can name the place
+        if (data.Near) {
+          attrs = _.extend(attrs || {}, {
+            near: data.Near.Name + (data.Near.Admin ? ', ' + data.Near.Admin : '')
+          });
+        }
+
+        if (data.Geofences) {
+          _.each(data.Geofences, function (crossing) {
+            this.trigger('geofence:' + crossing.Event, crossing);
+          }, this);
+        }
+
         if (data.Time > 0) {
           attrs.time = new Date(data.Time);
         }
@@ -114,6 +141,20 @@ define([
       return attrs;
     },
 
+    parseStatus: function (data) {
+      var status = data.Status;
+
+      if (data.LowBattery) {
+        this.trigger('status:lowBattery', status);
+      }
+
+      return {
+        battery: status.Battery,
+        charging: status.Charging,
+        network: status.Network
+      };
+    },
+
     locationTimedout: function () {
       this.set('located', false);
     },
@@ -152,7 +193,180 @@ define([
         dataType: 'json',
         type: 'PUT',
         url: '/1/queue/' + this.get('id')
+      }).fail(function (xhr) {
+        // Some commands need the user to sign in again first.
+        if (xhr.status === 403) {
+          var challenge = JSON.parse(xhr.responseText);
+
+          if (challenge.reauth) {
+            window.location = challenge.reauth;
+          }
+        }
       });
+    },
+
+    // Commands waiting for their "at" or "delay" time
+    fetchScheduled: function () {
+      return $.ajax({
+        dataType: 'json',
+        type: 'GET',
+        url: '/1/scheduled/' + this.get('id')
+      }).done(_.bind(function (resp) {
+        this.set('scheduled', resp.scheduled);
+      }, this));
+    },
+
+    cancelScheduled: function (id) {
+      return $.ajax({
+        dataType: 'json',
+        type: 'DELETE',
+        url: '/1/scheduled/' + this.get('id') + '?id=' + encodeURIComponent(id)
+      }).done(_.bind(function (resp) {
+        this.set('scheduled', resp.scheduled);
+      }, this));
+    },
+
+    // The device's tracking session, if any
+    fetchTracking: function () {
+      return $.ajax({
+        dataType: 'json',
+        type: 'GET',
+        url: '/1/tracking/' + this.get('id')
+      }).done(_.bind(function (resp) {
+        this.set('tracking', resp.tracking);
+      }, this));
+    },
+
+    fetchGeofences: function () {
+      return $.ajax({
+        dataType: 'json',
+        type: 'GET',
+        url: '/1/geofences/' + this.get('id')
+      }).done(_.bind(function (resp) {
+        this.set('geofences', resp.geofences);
+      }, this));
+    },
+
+    // A circle ({name, lat, lon, radius}) or polygon ({name, polygon})
+    addGeofence: function (geofence) {
+      return $.ajax({
+        contentType: 'application/json',
+        data: JSON.stringify(geofence),
+        dataType: 'json',
+        type: 'POST',
+        url: '/1/geofences/' + this.get('id')
+      }).done(_.bind(function (resp) {
+        this.set('geofences', resp.geofences);
+      }, this));
+    },
+
+    removeGeofence: function (id) {
+      return $.ajax({
+        dataType: 'json',
+        type: 'DELETE',
+        url: '/1/geofences/' + this.get('id') + '?id=' + encodeURIComponent(id)
+      }).done(_.bind(function (resp) {
+        this.set('geofences', resp.geofences);
+      }, this));
+    },
+
+    fetchShares: function () {
+      return $.ajax({
+        dataType: 'json',
+        type: 'GET',
+        url: '/1/shares/' + this.get('id')
+      }).done(_.bind(function (resp) {
+        this.set('shares', resp.shares);
+      }, this));
+    },
+
+    // Resolves with the new link ({ID, Expires, Token, URL})
+    shareLocation: function (seconds) {
+      return $.ajax({
+        contentType: 'application/json',
+        data: JSON.stringify({ duration: seconds }),
+        dataType: 'json',
+        type: 'POST',
+        url: '/1/shares/' + this.get('id')
+      }).done(_.bind(function () {
+        this.fetchShares();
+      }, this));
+    },
+
+    revokeShare: function (id) {
+      return $.ajax({
+        dataType: 'json',
+        type: 'DELETE',
+        url: '/1/shares/' + this.get('id') + '?id=' + encodeURIComponent(id)
+      }).done(_.bind(function (resp) {
+        this.set('shares', resp.shares);
+      }, this));
+    },
+
+    // Who else can use the device, and open invitations (owners only)
+    fetchAccess: function () {
+      return $.ajax({
+        dataType: 'json',
+        type: 'GET',
+        url: '/1/access/' + this.get('id')
+      }).done(_.bind(function (resp) {
+        this.set({ access: resp.access, invitations: resp.invitations });
+      }, this));
+    },
+
+    // Resolves with the invitation ({ID, Email, Role, Token, URL}) to send
+    inviteUser: function (email, role) {
+      return $.ajax({
+        contentType: 'application/json',
+        data: JSON.stringify({ email: email, role: role }),
+        dataType: 'json',
+        type: 'POST',
+        url: '/1/access/' + this.get('id')
+      }).done(_.bind(function () {
+        this.fetchAccess();
+      }, this));
+    },
+
+    // Removing the signed in user gives up their own access
+    revokeAccess: function (userId) {
+      return $.ajax({
+        dataType: 'json',
+        type: 'DELETE',
+        url: '/1/access/' + this.get('id') + '?user=' + encodeURIComponent(userId)
+      }).done(_.bind(function (resp) {
+        this.set({ access: resp.access, invitations: resp.invitations });
+      }, this));
+    },
+
+    withdrawInvitation: function (id) {
+      return $.ajax({
+        dataType: 'json',
+        type: 'DELETE',
+        url: '/1/access/' + this.get('id') + '?invitation=' + encodeURIComponent(id)
+      }).done(_.bind(function (resp) {
+        this.set({ access: resp.access, invitations: resp.invitations });
+      }, this));
+    },
+
+    // Resolves with { events: [...], next: id }; pass next back as before
+    // for older events (0 when there are none).
+    fetchAudit: function (before) {
+      return $.ajax({
+        data: before ? { before: before } : {},
+        dataType: 'json',
+        type: 'GET',
+        url: '/1/audit/' + this.get('id')
+      });
+    },
+
+    stopTracking: function () {
+      return $.ajax({
+        dataType: 'json',
+        type: 'DELETE',
+        url: '/1/tracking/' + this.get('id')
+      }).always(_.bind(function () {
+        this.set('tracking', null);
+      }, this));
     }
   });
 
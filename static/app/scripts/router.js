@@ -3,19 +3,21 @@
  * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
 
 define([
+  'underscore',
   'jquery',
   'backbone',
   'models/device',
   'views/device',
   'views/device_not_found',
   'lib/notifier'
-], function ($, Backbone, Device, DeviceView, DeviceNotFoundView, Notifier) {
+], function (_, $, Backbone, Device, DeviceView, DeviceNotFoundView, Notifier) {
   'use strict';
 
   var Router = Backbone.Router.extend({
     routes: {
       '': 'showIndex',
-      'devices/:id': 'showDevice'
+      'devices/:id': 'showDevice',
+      'invite/:token': 'acceptInvitation'
     },
 
     initialize: function () {
@@ -49,6 +51,23 @@ define([
       }
     },
 
+    // Someone has shared their device with this user
+    acceptInvitation: function (token) {
+      $.ajax({
+        dataType: 'json',
+        type: 'POST',
+        url: '/1/invitations/' + encodeURIComponent(token)
+      }).done(_.bind(function (resp) {
+        window.devices.fetch().done(_.bind(function () {
+          this.navigate('devices/' + resp.deviceid, { trigger: true });
+        }, this));
+      }, this)).fail(_.bind(function () {
+        Notifier.notify('Sorry, that invitation is no longer valid.');
+
+        this.navigate('', { trigger: true });
+      }, this));
+    },
+
     showDeviceNotFound: function () {
       this.setStage(new DeviceNotFoundView());
     },
@@ -66,6 +66,7 @@ define([
       this.listenTo(this.model, 'command:received:lock', this.lockReceived);
       this.listenTo(this.model, 'command:received:ring', this.ringReceived);
       this.listenTo(this.model, 'command:received:track', this.trackReceived);
+      this.listenTo(this.model, 'status:lowBattery', this.lowBatteryReceived);
 
       // Listen just once for these model changes
       this.listenToOnce(this.model, 'command:received:hasPasscode command:received:track', this.updateLocatingMessage);
@@ -108,6 +109,10 @@ define([
       }
     },
 
+    lowBatteryReceived: function (status) {
+      this.notify('Battery ' + status.Battery + '%, locate your device now.');
+    },
+
     notify: function (message) {
       Notifier.notify(message);
     },
@@ -151,7 +151,7 @@ func (self HekaLogger) Log(level int32, mtype, payload string, fields Fields) (e
 			dump += fmt.Sprintf(" [%s:%s %s]", caller["file"],
 				caller["line"], caller["name"])
 		}
-		log.Printf(dump)
+		log.Print(dump)
 
 		// Don't send an error if there's nothing to do
 		if self.sender == nil {
@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadMzConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "fmd_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`# comment
+; also a comment
+host = 0.0.0.0
+fxa.login_url={{.Host}}?a=b&state={{.State}}
+flag.on=true
+flag.bad=maybe
+no value here
+`)
+	file.Close()
+
+	config, err := ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := config.Get("host", ""); v != "0.0.0.0" {
+		t.Errorf("host: got %q", v)
+	}
+	if v := config.Get("fxa.login_url", ""); v != "{{.Host}}?a=b&state={{.State}}" {
+		t.Errorf("values should only split on the first '=': got %q", v)
+	}
+	if v := config.Get("missing", "default"); v != "default" {
+		t.Errorf("missing: got %q", v)
+	}
+	if !config.GetFlag("flag.on") || config.GetFlag("flag.bad") ||
+		config.GetFlag("flag.missing") {
+		t.Error("Unexpected flag values")
+	}
+	if v := config.SetDefault("host", "localhost"); v != "0.0.0.0" {
+		t.Errorf("SetDefault replaced an existing value: %q", v)
+	}
+	if old := config.Override("host", "localhost"); old != "0.0.0.0" ||
+		config.Get("host", "") != "localhost" {
+		t.Errorf("Override failed: old %q", old)
+	}
+	if _, err = ReadMzConfig(file.Name() + ".missing"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
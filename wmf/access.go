@@ -0,0 +1,348 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* Shared device access.
+   The user who registered a device owns it, and can let other accounts
+   use it too, with a role:
+       viewer    can locate the device ("t") and see its state
+       operator  can also ring, lock and otherwise control it
+       owner     can also erase it, and manage who has access
+   Each command says which role it needs (Command.Role), and Queue checks
+   it for the user sending the command, so the REST queue and the
+   websocket are held to the same rules.
+
+   Owners invite people by email with POST {"email": "...", "role":
+   "viewer"} to /1/access/<deviceid>, and get back a link
+       {"ID": "...", "Token": "<id>.<sig>", "URL": ".../#invite/<id>.<sig>", ...}
+   to send them. The web app accepts the invitation by POSTing the token
+   to /1/invitations/<token> while signed in with that email. It lapses
+   after access.invite_ttl. GET /1/access/<deviceid> lists who has
+   access and the open invitations. DELETE ?user=<userid> takes someone's
+   access away (anyone can remove themselves), and ?invitation=<id>
+   withdraws an invitation.
+*/
+
+const (
+	ROLE_VIEWER   = "viewer"
+	ROLE_OPERATOR = "operator"
+	ROLE_OWNER    = "owner"
+)
+
+var roleRank = map[string]int{
+	ROLE_VIEWER:   1,
+	ROLE_OPERATOR: 2,
+	ROLE_OWNER:    3,
+}
+
+// Is role enough for something that needs the need role?
+func roleAllows(role, need string) bool {
+	return roleRank[role] > 0 && roleRank[role] >= roleRank[need]
+}
+
+// The user acting on a device, and their role. An empty role means no
+// access.
+type deviceUser struct {
+	ID   string
+	Role string
+}
+
+// The user's role for the device, "" if they have none.
+func (self *Handler) deviceRole(devRec *storage.Device, userId string) (role string, err error) {
+	if userId == "" {
+		return "", nil
+	}
+	if devRec.User == userId {
+		return ROLE_OWNER, nil
+	}
+	access, err := self.store.GetAccess(devRec.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, rec := range access {
+		if rec.UserId == userId {
+			return rec.Role, nil
+		}
+	}
+	return "", nil
+}
+
+// Refuse the request if the user's role isn't enough.
+func (self *Handler) allowed(resp http.ResponseWriter, devRec *storage.Device, user deviceUser, need string) bool {
+	if roleAllows(user.Role, need) {
+		return true
+	}
+	self.logger.Warn(self.logCat, "Role not allowed",
+		util.Fields{"deviceId": devRec.ID,
+			"userId": user.ID,
+			"role":   user.Role,
+			"need":   need})
+	self.metrics.Increment("access.denied")
+	http.Error(resp, "\"Forbidden\"", http.StatusForbidden)
+	return false
+}
+
+// Disconnect the user's pages for the device on this server.
+func closeUser(devId, userId string) {
+	muClient.RLock()
+	defer muClient.RUnlock()
+	for _, sock := range Clients[devId] {
+		if sock.Share == "" && sock.UserId == userId {
+			sock.Socket.Close()
+		}
+	}
+}
+
+// What the owner is told about an invitation.
+type inviteLink struct {
+	storage.Invitation
+	Token string
+	URL   string
+}
+
+func (self *Handler) inviteLink(invite storage.Invitation) inviteLink {
+	token := invite.ID + "." + self.tokenSig("invite", invite.ID)
+	return inviteLink{Invitation: invite,
+		Token: token,
+		URL:   self.config.Get("share.url", "") + "/#invite/" + token}
+}
+
+// List (GET), invite (POST), or remove (DELETE ?user=<userid> or
+// ?invitation=<id>) the people who can access the device.
+func (self *Handler) Access(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Access"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	devRec, _, user := self.userDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	store := self.store
+	switch req.Method {
+	case "GET":
+		if !self.allowed(resp, devRec, user, ROLE_OWNER) {
+			return
+		}
+	case "POST":
+		if !self.allowed(resp, devRec, user, ROLE_OWNER) {
+			return
+		}
+		args := make(replyType)
+		if err := json.NewDecoder(io.LimitReader(req.Body,
+			1024)).Decode(&args); err != nil {
+			http.Error(resp, "\"Invalid Invitation\"", http.StatusBadRequest)
+			return
+		}
+		email, _ := args["email"].(string)
+		email = strings.TrimSpace(email)
+		role, _ := args["role"].(string)
+		reason := ""
+		switch {
+		case roleRank[role] == 0:
+			reason = "The role must be viewer, operator or owner"
+		case len(email) > 254 || strings.Map(emailFilter, email) != email ||
+			strings.Count(email, "@") != 1:
+			reason = "A valid email is required"
+		}
+		invites, err := store.GetInvitations(devRec.ID)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		access, err := store.GetAccess(devRec.ID)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if reason == "" && int64(len(invites)+len(access)) >=
+			getInt(self.config, "access.max", 10) {
+			reason = "Too many people have access to this device"
+		}
+		if reason != "" {
+			output, _ := json.Marshal(replyType{"error": "Invalid invitation",
+				"reason": reason})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+		ib := make([]byte, SHARE_ID_LEN/2)
+		if _, err = rand.Read(ib); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		now := time.Now().UTC()
+		invite := storage.Invitation{ID: hex.EncodeToString(ib),
+			DeviceId:  devRec.ID,
+			Role:      role,
+			Email:     email,
+			InvitedBy: user.ID,
+			Created:   now.Unix(),
+			Expires: now.Add(getDuration(self.config, "access.invite_ttl",
+				"168h")).Unix()}
+		if err = store.AddInvitation(invite); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		self.logger.Info(self.logCat, "Access invitation sent",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": user.ID,
+				"id":     invite.ID,
+				"role":   role})
+		self.metrics.Increment("access.invite")
+		output, _ := json.Marshal(self.inviteLink(invite))
+		resp.Write(output)
+		return
+	case "DELETE":
+		var found bool
+		var err error
+		if id := req.FormValue("invitation"); id != "" {
+			if !self.allowed(resp, devRec, user, ROLE_OWNER) {
+				return
+			}
+			found, err = store.DeleteInvitation(devRec.ID, id)
+		} else {
+			userId := req.FormValue("user")
+			// Anyone can give up their own access.
+			if userId != user.ID && !self.allowed(resp, devRec, user, ROLE_OWNER) {
+				return
+			}
+			if found, err = store.RevokeAccess(devRec.ID, userId); found {
+				closeUser(devRec.ID, userId)
+			}
+		}
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if !found {
+			http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+			return
+		}
+		self.logger.Info(self.logCat, "Device access removed",
+			util.Fields{"deviceId": devRec.ID,
+				"userId":     user.ID,
+				"user":       req.FormValue("user"),
+				"invitation": req.FormValue("invitation")})
+		self.metrics.Increment("access.revoke")
+		if !roleAllows(user.Role, ROLE_OWNER) {
+			resp.Write([]byte("{}"))
+			return
+		}
+	default:
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	access, err := store.GetAccess(devRec.ID)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	invites, err := store.GetInvitations(devRec.ID)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	links := []inviteLink{}
+	for _, invite := range invites {
+		links = append(links, self.inviteLink(invite))
+	}
+	if access == nil {
+		access = []storage.DeviceAccess{}
+	}
+	output, _ := json.Marshal(replyType{"access": access,
+		"invitations": links})
+	resp.Write(output)
+}
+
+// Accept an invitation (POST /1/invitations/<token>) as the signed in
+// user.
+func (self *Handler) AcceptInvitation(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:AcceptInvitation"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	if req.Method != "POST" {
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := sessionStore.Get(req, SESSION_NAME)
+	if err != nil || !self.checkToken(session, req) {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	userId, email, err := self.getUser(resp, req)
+	if err != nil || userId == "" {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	path := strings.TrimRight(req.URL.Path, "/")
+	idsig := strings.SplitN(path[strings.LastIndex(path, "/")+1:], ".", 2)
+	if len(idsig) != 2 || len(idsig[0]) != SHARE_ID_LEN ||
+		!hmac.Equal([]byte(idsig[1]), []byte(self.tokenSig("invite", idsig[0]))) {
+		self.metrics.Increment("access.invalid")
+		http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+		return
+	}
+	store := self.store
+	invite, err := store.GetInvitation(idsig[0])
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	// Invitations are for the person they were sent to.
+	if invite == nil || !strings.EqualFold(invite.Email, email) {
+		http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+		return
+	}
+	devRec, err := store.GetDeviceInfo(invite.DeviceId)
+	if err != nil {
+		http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+		return
+	}
+	found, err := store.DeleteInvitation(invite.DeviceId, invite.ID)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	if !found {
+		http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+		return
+	}
+	// The device's owner already has every right.
+	if devRec.User != userId {
+		if err = store.GrantAccess(storage.DeviceAccess{
+			DeviceId:  invite.DeviceId,
+			UserId:    userId,
+			Role:      invite.Role,
+			GrantedBy: invite.InvitedBy,
+			Created:   time.Now().UTC().Unix()}); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	self.logger.Info(self.logCat, "Access invitation accepted",
+		util.Fields{"deviceId": invite.DeviceId,
+			"userId": userId,
+			"id":     invite.ID,
+			"role":   invite.Role})
+	self.metrics.Increment("access.accept")
+	output, _ := json.Marshal(replyType{"deviceid": invite.DeviceId,
+		"role": invite.Role})
+	resp.Write(output)
+}
@@ -0,0 +1,114 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+/* Account deletion.
+   DELETE /1/account/ removes the signed in user and everything held
+   for them: their devices with their positions, commands, status,
+   tracking, geofences and share links, their access to other people's
+   devices, the invitations they sent or were sent, their webhooks,
+   their notification preferences, and their audit history. Like an
+   erase, it needs a recent sign in (see reauth.go).
+
+   Tombstones are kept for db.tombstone_expry seconds. Each device is
+   pushed so it calls in, and its Cmd calls get a 410 from then on,
+   telling it to unregister; re-registering the device clears its
+   tombstone. Sessions signed in before the deletion are turned away,
+   whichever browser they're in.
+
+   The deletion is done in one transaction, so it either all happens or
+   none of it does. Nothing in the nonce table needs removing: OAuth
+   nonces are made at /signin/, before anyone is known, hold no user id,
+   and are used up by the callback (or lapse within five minutes). Hawk
+   nonces aren't stored at all.
+*/
+
+// Disconnect every page watching the device on this server.
+func closeDevice(devId string) {
+	muClient.RLock()
+	defer muClient.RUnlock()
+	for _, sock := range Clients[devId] {
+		sock.Socket.Close()
+	}
+}
+
+// Delete the signed in user's account.
+func (self *Handler) DeleteAccount(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:DeleteAccount"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	if req.Method != "DELETE" {
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := sessionStore.Get(req, SESSION_NAME)
+	if err != nil || !self.checkToken(session, req) {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	userId, _, err := self.getUser(resp, req)
+	if err != nil || userId == "" {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	if challenge := self.reauthChallenge(sessionAuthTime(session)); challenge != nil {
+		self.metrics.Increment("account.delete.reauth")
+		output, _ := json.Marshal(challenge)
+		http.Error(resp, string(output), http.StatusForbidden)
+		return
+	}
+	store := self.store
+	shared, err := store.GetSharedDevices(userId)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	devices, err := store.DeleteUser(userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not delete account",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	devIds := []string{}
+	for i := range devices {
+		devRec := &devices[i]
+		devIds = append(devIds, devRec.ID)
+		closeDevice(devRec.ID)
+		if devRec.Unreachable || devRec.PushUrl == "" {
+			continue
+		}
+		// The device collects its 410 when it calls in.
+		if err := self.pusher.Push(devRec, nil, nil); err != nil {
+			self.logger.Warn(self.logCat, "Could not push to deleted device",
+				util.Fields{"error": err.Error(),
+					"deviceId": devRec.ID})
+		}
+	}
+	for _, d := range shared {
+		closeUser(d.ID, userId)
+	}
+	for _, name := range []string{SESSION_LOGIN, SESSION_NAME} {
+		session, _ := sessionStore.Get(req, name)
+		session.Options.MaxAge = -1
+		session.Save(req, resp)
+	}
+	self.logger.Info(self.logCat, "Account deleted",
+		util.Fields{"userId": userId,
+			"devices": strconv.Itoa(len(devIds))})
+	self.metrics.Increment("account.delete")
+	output, _ := json.Marshal(replyType{"devices": devIds})
+	resp.Write(output)
+}
@@ -0,0 +1,161 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Audit log.
+   What is done to each device, by whom, and how it went is appended to
+   the audit log: commands queued (by a user, or by the scheduler when a
+   scheduled command comes due), registrations, device check ins that
+   reply to a command or collect one, devices being removed, sign ins
+   and outs, and webhooks being added or removed (see webhooks.go).
+   Each event has the user (empty for the device itself), the device
+   and its owner, the action, its arguments with passcodes masked, where
+   the request came from, and the result. Device replies are recorded
+   by command name only, so positions aren't copied into the log.
+
+   The device's owner can page through its history, newest first, with
+   GET /1/audit/<deviceid>?limit=50&before=<id>. The reply's "next" is
+   the before to use for the following page, 0 once there are no more.
+   Events are only removed with the account.
+
+   The source is the connecting address, or the first X-Forwarded-For
+   address if audit.trust_proxy is set (only set that behind a proxy
+   that always sets the header).
+*/
+
+const (
+	AUDIT_QUEUE    = "queue"
+	AUDIT_REGISTER = "register"
+	AUDIT_CMD      = "cmd"
+	AUDIT_DELETE   = "delete"
+	AUDIT_SIGNIN   = "signin"
+	AUDIT_SIGNOUT  = "signout"
+
+	AUDIT_WEBHOOK_ADD    = "webhook.add"
+	AUDIT_WEBHOOK_DELETE = "webhook.delete"
+
+	AUDIT_OK = "ok"
+	// Source of commands queued when their scheduled time comes.
+	AUDIT_SCHEDULER = "scheduler"
+)
+
+// Where the request came from.
+func (self *Handler) sourceAddr(req *http.Request) string {
+	if self.config.GetFlag("audit.trust_proxy") {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.SplitN(fwd, ",", 2)[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// The result to record for an error.
+func auditResult(err error) string {
+	if err == nil {
+		return AUDIT_OK
+	}
+	return strings.Trim(err.Error(), "\"")
+}
+
+// Append an event to the audit log. Commands in args ({"l": {...}})
+// have their passcodes masked. devRec is nil for account events. A
+// failure is logged, but doesn't stop whatever is being audited.
+func (self *Handler) audit(source, userId string, devRec *storage.Device, action string, args replyType, result string) {
+	event := storage.AuditEvent{Time: time.Now().UTC().Unix(),
+		UserId: userId,
+		Owner:  userId,
+		Action: action,
+		Source: source,
+		Result: result}
+	if devRec != nil {
+		event.DeviceId = devRec.ID
+		event.Owner = devRec.User
+	}
+	if len(args) > 0 {
+		js, _ := json.Marshal(maskCommands(args))
+		event.Args = string(js)
+	}
+	if err := self.store.AddAuditEvent(event); err != nil {
+		self.logger.Error(self.logCat, "Could not audit event",
+			util.Fields{"error": err.Error(),
+				"action":   action,
+				"deviceId": event.DeviceId,
+				"userId":   userId})
+	}
+}
+
+// Remove the device, recording why.
+func (self *Handler) deleteDevice(source, userId string, devRec *storage.Device, reason string) (err error) {
+	err = self.store.DeleteDevice(devRec.ID)
+	self.audit(source, userId, devRec, AUDIT_DELETE, replyType{"reason": reason},
+		auditResult(err))
+	return err
+}
+
+// Page through the device's audit history (owners only).
+func (self *Handler) Audit(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Audit"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	devRec, _, user := self.userDevice(resp, req)
+	if devRec == nil || !self.allowed(resp, devRec, user, ROLE_OWNER) {
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, before := 50, int64(0)
+	var err error
+	if val := req.FormValue("limit"); val != "" {
+		if limit, err = strconv.Atoi(val); err != nil || limit < 1 || limit > 200 {
+			output, _ := json.Marshal(replyType{"error": "Invalid limit",
+				"reason": "The limit must be 1 to 200"})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+	}
+	if val := req.FormValue("before"); val != "" {
+		if before, err = strconv.ParseInt(val, 10, 64); err != nil || before < 0 {
+			output, _ := json.Marshal(replyType{"error": "Invalid before",
+				"reason": "before must be an event id"})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+	}
+	// Ask for one more, to know if there's another page.
+	events, err := self.store.GetAuditEvents(devRec.ID, before, limit+1)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	var next int64
+	if len(events) > limit {
+		events = events[:limit]
+		next = events[limit-1].ID
+	}
+	if events == nil {
+		events = []storage.AuditEvent{}
+	}
+	output, _ := json.Marshal(replyType{"events": events, "next": next})
+	resp.Write(output)
+}
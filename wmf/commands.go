@@ -0,0 +1,351 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Device commands.
+   Every command the UI can send to a device is registered here with the
+   capability the device must list in "accepts", the arguments it takes,
+   and what to do with the device's reply. Arguments are sanitized
+   against the schema before the command is queued; anything not in the
+   schema is dropped. Commands registered with DeviceOnly are replies
+   devices may send, but that can't be queued.
+*/
+
+// Command argument types
+const (
+	ARG_STRING = iota // trimmed to MaxLen runes
+	ARG_INT           // clamped to Min..Max
+	ARG_BOOL
+	ARG_PASSCODE // checked against the device's passcode policy
+)
+
+type CommandArg struct {
+	Name      string
+	Type      int
+	Min       int64
+	Max       int64           // ARG_INT
+	MaxKey    string          // config key overriding Max
+	MaxLen    int             // ARG_STRING: length, in runes
+	MaxLenKey string          // config key overriding MaxLen
+	AsciiFlag string          // config flag restricting an ARG_STRING to ascii
+	Filter    func(rune) rune // applied to an ARG_STRING
+	Text      bool            // ARG_STRING typed by the user: markup is stripped
+}
+
+// Prepare a command for the device, sent by userId. May change the
+// arguments, or refuse the command by returning an error.
+type queueFunc func(handler *Handler, devRec *storage.Device, userId string, args replyType) (replyType, error)
+
+// Handle the device's reply to a command.
+type replyFunc func(handler *Handler, devRec *storage.Device, cmd string, args replyType) error
+
+type Command struct {
+	Name        string
+	Capability  string // the "accepts" entry needed (defaults to Name)
+	Args        []CommandArg
+	Destructive bool   // the command can't be undone
+	Default     bool   // assumed for devices that don't say what they accept
+	Always      bool   // every device accepts this
+	DeviceOnly  bool   // sent by devices, never queued
+	GraceKey    string // config key for how long to hold the command before sending it
+	Notice      string // owner notice sent when the command is scheduled
+	SentNotice  string // owner notice sent when the command is queued for the device
+	Reauth      bool   // the user must have signed in recently
+	ReauthArg   string // ...if this argument is given
+	Role        string // least role that may send it (ROLE_OPERATOR if not set)
+	OnQueue     queueFunc
+	OnReply     replyFunc
+}
+
+// Registered commands, by name.
+var commands = make(map[string]*Command)
+
+// Add a command. Commands are registered at init, before the handlers
+// run, so there's no locking.
+func RegisterCommand(cmd *Command) {
+	if cmd.Capability == "" {
+		cmd.Capability = cmd.Name
+	}
+	if cmd.Role == "" {
+		cmd.Role = ROLE_OPERATOR
+	}
+	commands[cmd.Name] = cmd
+}
+
+// Find the command. Devices and the UI have always been lax about
+// command names, so "Lock" is "l".
+func getCommand(name string) (cmd *Command, ok bool) {
+	name = strings.ToLower(name)
+	if cmd, ok = commands[name]; ok || name == "" {
+		return cmd, ok
+	}
+	cmd, ok = commands[name[:1]]
+	return cmd, ok
+}
+
+// The capabilities to record for a device, given the ones it sent.
+func acceptsFor(accepts string) string {
+	var names []string
+	for _, cmd := range commands {
+		if (cmd.Default && accepts == "") ||
+			(cmd.Always && !strings.Contains(accepts, cmd.Capability)) {
+			names = append(names, cmd.Capability)
+		}
+	}
+	sort.Strings(names)
+	return accepts + strings.Join(names, "")
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "l",
+		Default: true,
+		Args: []CommandArg{
+			// make sure that the lock code is one the device can set.
+			// otherwise we may lock users out of their phones.
+			{Name: "c", Type: ARG_PASSCODE},
+			{Name: "m", Type: ARG_STRING, MaxLen: 100, Text: true,
+				MaxLenKey: "cmd.m.max_len", AsciiFlag: "ascii_message_only"},
+		},
+		// Setting a new passcode could lock the owner out.
+		ReauthArg:  "c",
+		SentNotice: NOTICE_LOCK_ISSUED,
+	})
+	RegisterCommand(&Command{
+		Name:    "r",
+		Default: true,
+		Args: []CommandArg{
+			{Name: "d", Type: ARG_INT, Max: 10500, MaxKey: "cmd.r.max"},
+		},
+	})
+	RegisterCommand(&Command{
+		Name:    "t",
+		Default: true,
+		// Anyone who can see the device can locate it.
+		Role: ROLE_VIEWER,
+		Args: []CommandArg{
+			{Name: "d", Type: ARG_INT, Max: 10500, MaxKey: "cmd.t.max"},
+			{Name: "i", Type: ARG_INT, Min: 1, Max: 3600, MaxKey: "cmd.t.interval_max"},
+		},
+		OnQueue: trackQueue,
+		OnReply: trackReply,
+	})
+	RegisterCommand(&Command{
+		Name:        "e",
+		Default:     true,
+		Destructive: true,
+		Role:        ROLE_OWNER,
+		Reauth:      true,
+		GraceKey:    "cmd.e.grace",
+		Notice:      NOTICE_ERASE_SCHEDULED,
+		SentNotice:  NOTICE_ERASE_ISSUED,
+		OnQueue:     eraseQueue,
+		OnReply:     eraseReply,
+	})
+	// Every device can say hello, whatever it claims to accept.
+	RegisterCommand(&Command{
+		Name:       "h",
+		Default:    true,
+		Always:     true,
+		DeviceOnly: true,
+	})
+	RegisterCommand(&Command{
+		Name:       "q",
+		DeviceOnly: true,
+		OnReply:    quitReply,
+	})
+}
+
+// Tracking replies carry the device's position.
+func trackReply(self *Handler, devRec *storage.Device, cmd string, args replyType) error {
+	return self.updatePage(devRec.ID, cmd, args, true)
+}
+
+// User has quit, nuke what we know.
+func quitReply(self *Handler, devRec *storage.Device, cmd string, args replyType) error {
+	if self.config.GetFlag("cmd.q.allow") {
+		return self.deleteDevice("", "", devRec, "quit")
+	}
+	return nil
+}
+
+// The device is only removed once it confirms the erase, or can't be
+// reached to be told about it.
+func eraseQueue(self *Handler, devRec *storage.Device, userId string, args replyType) (replyType, error) {
+	if devRec.Unreachable {
+		// Nothing will ever collect the command.
+		self.metrics.Increment("device.erase.unreachable")
+		self.notify(devRec, NOTICE_ERASE_UNREACHABLE, nil)
+		return nil, ErrDeviceDeleted
+	}
+	if err := self.store.SetErasing(devRec.ID, time.Now().UTC().Unix()); err != nil {
+		return nil, err
+	}
+	return replyType{}, nil
+}
+
+func eraseReply(self *Handler, devRec *storage.Device, cmd string, args replyType) error {
+	if devRec.Erasing == 0 || !isTrue(args["ok"]) {
+		self.logger.Warn(self.logCat, "Unconfirmed erase reply",
+			util.Fields{"deviceId": devRec.ID,
+				"userId":  devRec.User,
+				"erasing": strconv.FormatInt(devRec.Erasing, 10)})
+		return self.updatePage(devRec.ID, cmd, args, false)
+	}
+	// Let the UI know before the device goes.
+	if err := self.updatePage(devRec.ID, cmd, args, false); err != nil {
+		return err
+	}
+	self.logger.Info(self.logCat, "Device erased",
+		util.Fields{"deviceId": devRec.ID,
+			"userId": devRec.User})
+	self.metrics.Increment("device.erased")
+	self.notify(devRec, NOTICE_ERASE_CONFIRMED, nil)
+	self.emit(devRec, EVENT_ERASE_COMPLETED, nil)
+	return self.deleteDevice("", "", devRec, "erased")
+}
+
+// Pass the device's reply to the command's handler. Replies without
+// one just update the UI.
+func (self *Handler) handleReply(devRec *storage.Device, cmd string, args replyType) error {
+	if command, ok := getCommand(cmd); ok && command.OnReply != nil {
+		return command.OnReply(self, devRec, cmd, args)
+	}
+	return self.updatePage(devRec.ID, cmd, args, false)
+}
+
+// Clean up the UI supplied arguments for the command. Anything can
+// arrive here, so don't trust the types. Returns an ArgError for
+// arguments that can't be fixed up.
+func (self *Handler) sanitizeArgs(command *Command, devRec *storage.Device, args replyType) (replyType, error) {
+	clean := make(replyType)
+	for _, arg := range command.Args {
+		v, ok := args[arg.Name]
+		if !ok {
+			continue
+		}
+		switch arg.Type {
+		case ARG_STRING:
+			vs, _ := v.(string)
+			if arg.Text {
+				vs = sanitizeText(vs)
+			}
+			if arg.AsciiFlag != "" && self.config.GetFlag(arg.AsciiFlag) {
+				vs = strings.Map(asciiOnly, vs)
+			}
+			if arg.Filter != nil {
+				vs = strings.Map(arg.Filter, vs)
+			}
+			vr := []rune(vs)
+			max := int(self.argLimit(arg.MaxLenKey, int64(arg.MaxLen)))
+			if max < 0 {
+				max = 0
+			}
+			clean[arg.Name] = string(vr[:minInt(max, len(vr))])
+		case ARG_INT:
+			clean[arg.Name] = self.rangeCheck(
+				strings.Map(digitsOnly, argString(v)),
+				arg.Min,
+				self.argLimit(arg.MaxKey, arg.Max))
+		case ARG_BOOL:
+			clean[arg.Name] = isTrue(v)
+		case ARG_PASSCODE:
+			var code string
+			switch v.(type) {
+			case string, float64:
+				code = argString(v)
+			}
+			if reason := checkPasscode(passcodePolicy(devRec), code); reason != "" {
+				return nil, &ArgError{Cmd: command.Name, Arg: arg.Name,
+					Reason: reason}
+			}
+			clean[arg.Name] = code
+		}
+	}
+	return clean, nil
+}
+
+// Numbers arrive as strings or floats.
+func argString(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return v.(string)
+	case float64:
+		return strconv.FormatFloat(v.(float64), 'f', 0, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Read an argument limit from the config, if it's configurable.
+func (self *Handler) argLimit(key string, def int64) int64 {
+	if key == "" {
+		return def
+	}
+	max, err := strconv.ParseInt(self.config.Get(key,
+		strconv.FormatInt(def, 10)), 10, 64)
+	if err != nil {
+		self.logger.Warn(self.logCat, "Invalid command limit",
+			util.Fields{"key": key})
+		return def
+	}
+	return max
+}
+
+// Hide the passcodes in the command's arguments, for showing them back
+// to people. Returns a copy; args is left alone.
+func maskArgs(name string, args replyType) replyType {
+	masked := make(replyType, len(args))
+	for k, v := range args {
+		masked[k] = v
+	}
+	if cmd, ok := getCommand(name); ok {
+		for _, arg := range cmd.Args {
+			if _, ok := masked[arg.Name]; ok && arg.Type == ARG_PASSCODE {
+				masked[arg.Name] = "****"
+			}
+		}
+	}
+	return masked
+}
+
+// The JSON command ({"l": {...}}) with its passcodes hidden, or "" if it
+// can't be read.
+func maskCommand(js string) string {
+	cmds := make(replyType)
+	if err := json.Unmarshal([]byte(js), &cmds); err != nil {
+		return ""
+	}
+	masked, _ := json.Marshal(maskCommands(cmds))
+	return string(masked)
+}
+
+// A copy of the commands ({"l": {...}, ...}) with their passcodes hidden.
+func maskCommands(cmds replyType) replyType {
+	masked := make(replyType, len(cmds))
+	for name, args := range cmds {
+		switch args := args.(type) {
+		case map[string]interface{}:
+			masked[name] = maskArgs(name, args)
+		case replyType:
+			masked[name] = maskArgs(name, args)
+		default:
+			masked[name] = args
+		}
+	}
+	return masked
+}
@@ -0,0 +1,105 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeArgs(t *testing.T) {
+	handler := newFuzzHandler(t, "cmd.r.max=60", "cmd.m.max_len=5",
+		"ascii_message_only=true")
+	alnum := &storage.Device{Passcode: &storage.PasscodePolicy{
+		MinLen: 4, MaxLen: 8, Charset: PASSCODE_ALNUM}}
+	for _, test := range []struct {
+		cmd  string
+		dev  *storage.Device
+		args replyType
+		want replyType
+	}{
+		{"l", nil, replyType{"c": "1234", "m": "Call me☃ please", "x": 1},
+			replyType{"c": "1234", "m": "Call "}},
+		{"lock", nil, replyType{"c": 1234.0, "m": 5}, replyType{"c": "1234", "m": ""}},
+		{"l", nil, replyType{"m": "<b>Hi</b>"}, replyType{"m": "Hi"}},
+		{"l", alnum, replyType{"c": "abc123"}, replyType{"c": "abc123"}},
+		{"r", nil, replyType{"d": "120"}, replyType{"d": int64(60)}},
+		{"t", nil, replyType{"d": 30.0}, replyType{"d": int64(30)}},
+		{"e", nil, replyType{"d": 30.0}, replyType{}},
+		// Passcodes that don't fit are refused, not fixed up.
+		{"l", nil, replyType{"c": 12345.0}, nil},
+		{"l", nil, replyType{"c": "1-2"}, nil},
+		{"l", nil, replyType{"c": true}, nil},
+		{"l", alnum, replyType{"c": "abc"}, nil},
+		{"o", alnum, replyType{"c": "abc 123"}, nil},
+	} {
+		command, ok := getCommand(test.cmd)
+		if !ok {
+			t.Fatalf("No command %q", test.cmd)
+		}
+		got, err := handler.sanitizeArgs(command, test.dev, test.args)
+		if test.want == nil {
+			if aerr, ok := err.(*ArgError); !ok || aerr.Arg != "c" {
+				t.Errorf("%s %v: expected ArgError, got %v %v", test.cmd,
+					test.args, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %v: got %v %v, want %v", test.cmd, test.args, got, err, test.want)
+		}
+	}
+	if _, ok := getCommand("x"); ok {
+		t.Error("Found an unregistered command")
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	for in, want := range map[string]string{
+		"Call me ☃ 電話して":                "Call me ☃ 電話して",
+		"<script>alert(1)</script>Hi":   "alert(1)Hi",
+		"&lt;img src=x onerror=y&gt;Hi": "Hi",
+		"<<b>script>x":                  "x",
+		"I <3 you":                      "I <3 you",
+		"  line\none\x00\u202etwo\t ":   "line\nonetwo",
+		"unclosed <a href='x'":          "unclosed",
+	} {
+		if got := sanitizeText(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParsePasscodePolicy(t *testing.T) {
+	for in, want := range map[string]*storage.PasscodePolicy{
+		`{"min":4,"max":16,"charset":"Alnum"}`: {MinLen: 4, MaxLen: 16, Charset: PASSCODE_ALNUM},
+		`{"max":6}`:                            {MinLen: 4, MaxLen: 6, Charset: PASSCODE_DIGITS},
+		`{"min":6}`:                            nil,
+		`{"charset":"emoji"}`:                  nil,
+		`{"min":1,"max":1000}`:                 nil,
+		`"digits"`:                             nil,
+	} {
+		var val interface{}
+		json.Unmarshal([]byte(in), &val)
+		if got := parsePasscodePolicy(val); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", in, got, want)
+		}
+	}
+}
+
+func TestAcceptsFor(t *testing.T) {
+	for accepts, want := range map[string]string{
+		"":    "ehlrt",
+		"lr":  "lrh",
+		"lhr": "lhr",
+	} {
+		if got := acceptsFor(accepts); got != want {
+			t.Errorf("%q: got %q, want %q", accepts, got, want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"errors"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* Asynchronous push delivery.
+   Handlers queue pushes and return immediately. A small pool of workers
+   sends them, retrying failures with exponential backoff. Pushes that
+   still fail after push.retries attempts are dead-lettered: logged,
+   counted, and handed back to the caller's failure function.
+   Endpoints the push service reports as gone are not retried.
+
+   At most push.max_waiting pushes wait for a retry at once (so an
+   outage can't pile up timers without limit); past that, failed pushes
+   are dead-lettered straight away. Pushes still waiting when the
+   dispatcher is closed are dead-lettered too.
+*/
+
+var (
+	ErrPushQueueFull = errors.New("Push queue full")
+	ErrUnreachable   = errors.New("Device has no push endpoint")
+	ErrPushBacklog   = errors.New("Too many pushes waiting to retry")
+	ErrPushClosed    = errors.New("Push dispatcher closed")
+)
+
+// Deliver a single push, returning any error.
+type pushSender func(devRec *storage.Device, payload []byte) error
+
+// Called when the push service says a device's endpoint is gone.
+type pushGoneFunc func(devRec *storage.Device)
+
+type pushJob struct {
+	device  storage.Device
+	payload []byte
+	attempt int
+	onFail  func(error)
+	queued  time.Time
+}
+
+type PushDispatcher struct {
+	config      *util.MzConfig
+	logger      *util.HekaLogger
+	metrics     *util.Metrics
+	logCat      string
+	send        pushSender
+	gone        pushGoneFunc
+	queue       chan *pushJob
+	retries     int
+	backoff     time.Duration // delay before the first retry
+	maxBackoff  time.Duration
+	perEndpoint int
+	mux         sync.Mutex
+	endpoints   map[string]int // in flight pushes, by endpoint host
+	maxWaiting  int
+	waiting     map[*pushJob]*time.Timer // pushes waiting to be retried
+	quit        chan struct{}
+	wg          sync.WaitGroup
+	closed      bool
+}
+
+func getDuration(config *util.MzConfig, key, def string) time.Duration {
+	d, err := time.ParseDuration(config.Get(key, def))
+	if err != nil {
+		d, _ = time.ParseDuration(def)
+	}
+	return d
+}
+
+func getInt(config *util.MzConfig, key string, def int64) int64 {
+	v, err := strconv.ParseInt(config.Get(key, ""), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Create and start the push dispatcher.
+func NewPushDispatcher(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics, send pushSender, gone pushGoneFunc) *PushDispatcher {
+	self := &PushDispatcher{
+		config:      config,
+		logger:      logger,
+		metrics:     metrics,
+		logCat:      "dispatch",
+		send:        send,
+		gone:        gone,
+		queue:       make(chan *pushJob, getInt(config, "push.queue_size", 1000)),
+		retries:     int(getInt(config, "push.retries", 5)),
+		backoff:     getDuration(config, "push.backoff", "1s"),
+		maxBackoff:  getDuration(config, "push.max_backoff", "5m"),
+		perEndpoint: int(getInt(config, "push.max_per_endpoint", 10)),
+		endpoints:   make(map[string]int),
+		maxWaiting:  int(getInt(config, "push.max_waiting", 1000)),
+		waiting:     make(map[*pushJob]*time.Timer),
+		quit:        make(chan struct{}),
+	}
+	for workers := getInt(config, "push.workers", 10); workers > 0; workers-- {
+		self.wg.Add(1)
+		go self.worker()
+	}
+	return self
+}
+
+// Queue a push for the device. onFail (which may be nil) is called if
+// the push could not be delivered.
+func (self *PushDispatcher) Push(devRec *storage.Device, payload []byte, onFail func(error)) error {
+	if devRec.PushUrl == "" {
+		self.metrics.Increment("push.unreachable")
+		return ErrUnreachable
+	}
+	job := &pushJob{
+		device:  *devRec,
+		payload: payload,
+		onFail:  onFail,
+		queued:  time.Now()}
+	if !self.enqueue(job) {
+		self.metrics.Increment("push.queue.full")
+		self.logger.Error(self.logCat, "Push queue full",
+			util.Fields{"deviceId": devRec.ID})
+		return ErrPushQueueFull
+	}
+	self.metrics.Increment("push.queued")
+	return nil
+}
+
+func (self *PushDispatcher) enqueue(job *pushJob) bool {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.closed {
+		return false
+	}
+	select {
+	case self.queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the workers. Pushes waiting to be retried are dead-lettered, and
+// queued pushes are abandoned after the timeout.
+func (self *PushDispatcher) Close(timeout time.Duration) {
+	self.mux.Lock()
+	if self.closed {
+		self.mux.Unlock()
+		return
+	}
+	self.closed = true
+	close(self.queue)
+	var stopped []*pushJob
+	for job, timer := range self.waiting {
+		// A timer that already fired dead-letters its own push.
+		if timer.Stop() {
+			stopped = append(stopped, job)
+		}
+	}
+	self.waiting = make(map[*pushJob]*time.Timer)
+	self.mux.Unlock()
+	for _, job := range stopped {
+		self.deadLetter(job, ErrPushClosed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		self.logger.Warn(self.logCat, "Abandoning queued pushes",
+			util.Fields{"queued": strconv.FormatInt(int64(len(self.queue)), 10)})
+	}
+	close(self.quit)
+}
+
+func (self *PushDispatcher) worker() {
+	defer self.wg.Done()
+	for job := range self.queue {
+		select {
+		case <-self.quit:
+			return
+		default:
+		}
+		self.process(job)
+	}
+}
+
+// Endpoints are limited by host, since that's usually what the
+// push service rate limits on.
+func endpointKey(pushUrl string) string {
+	if u, err := url.Parse(pushUrl); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return pushUrl
+}
+
+func (self *PushDispatcher) acquire(endpoint string) bool {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.perEndpoint > 0 && self.endpoints[endpoint] >= self.perEndpoint {
+		return false
+	}
+	self.endpoints[endpoint]++
+	return true
+}
+
+func (self *PushDispatcher) release(endpoint string) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.endpoints[endpoint]--; self.endpoints[endpoint] <= 0 {
+		delete(self.endpoints, endpoint)
+	}
+}
+
+func (self *PushDispatcher) process(job *pushJob) {
+	endpoint := endpointKey(job.device.PushUrl)
+	if !self.acquire(endpoint) {
+		// Endpoint is busy. Try again shortly, without using up
+		// an attempt.
+		self.metrics.Increment("push.endpoint.busy")
+		self.later(job, self.backoff/10)
+		return
+	}
+	job.attempt++
+	self.metrics.Increment("push.attempt")
+	start := time.Now()
+	err := self.send(&job.device, job.payload)
+	self.release(endpoint)
+	self.metrics.Timer("push.send", time.Now().Sub(start).Nanoseconds()/1e6)
+	if err == nil {
+		self.metrics.Increment("push.success")
+		self.metrics.Timer("push.delivery",
+			time.Now().Sub(job.queued).Nanoseconds()/1e6)
+		return
+	}
+	self.logger.Warn(self.logCat, "Push failed",
+		util.Fields{"error": err.Error(),
+			"deviceId": job.device.ID,
+			"attempt":  strconv.FormatInt(int64(job.attempt), 10)})
+	if pushGone(err) {
+		self.metrics.Increment("push.gone")
+		if self.gone != nil {
+			self.gone(&job.device)
+		}
+	}
+	if job.attempt > self.retries || !retryable(err) {
+		self.deadLetter(job, err)
+		return
+	}
+	self.metrics.Increment("push.retry")
+	delay := self.delay(job.attempt)
+	if perr, ok := err.(*PushError); ok && perr.RetryAfter > delay {
+		// The push service asked us to back off.
+		self.metrics.Increment("push.throttled")
+		delay = perr.RetryAfter
+	}
+	self.later(job, delay)
+}
+
+func (self *PushDispatcher) delay(attempt int) time.Duration {
+	return backoffDelay(self.backoff, self.maxBackoff, attempt)
+}
+
+// Exponential backoff, with jitter so retries don't arrive in bursts.
+func backoffDelay(backoff, maxBackoff time.Duration, attempt int) time.Duration {
+	d := backoff << uint(attempt-1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Requeue the job after the delay, unless too many are waiting already.
+func (self *PushDispatcher) later(job *pushJob, delay time.Duration) {
+	self.mux.Lock()
+	var err error
+	switch {
+	case self.closed:
+		err = ErrPushClosed
+	case self.maxWaiting > 0 && len(self.waiting) >= self.maxWaiting:
+		self.metrics.Increment("push.backlog")
+		err = ErrPushBacklog
+	default:
+		// The timer can't remove the job before it's added, since
+		// that needs the lock.
+		self.waiting[job] = time.AfterFunc(delay, func() {
+			self.mux.Lock()
+			delete(self.waiting, job)
+			self.mux.Unlock()
+			if !self.enqueue(job) {
+				self.deadLetter(job, ErrPushQueueFull)
+			}
+		})
+	}
+	self.mux.Unlock()
+	if err != nil {
+		self.deadLetter(job, err)
+	}
+}
+
+func (self *PushDispatcher) deadLetter(job *pushJob, err error) {
+	self.metrics.Increment("push.failed")
+	self.logger.Error(self.logCat, "Giving up on push",
+		util.Fields{"error": err.Error(),
+			"deviceId": job.device.ID,
+			"userId":   job.device.User,
+			"pushUrl":  job.device.PushUrl,
+			"attempts": strconv.FormatInt(int64(job.attempt), 10)})
+	if job.onFail != nil {
+		job.onFail(err)
+	}
+}
@@ -0,0 +1,174 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"sync"
+	"testing"
+	"time"
+)
+
+var errServer = &PushError{Status: 500, Class: PUSH_TRANSIENT}
+
+func newTestDispatcher(t *testing.T, send pushSender, overrides ...string) *PushDispatcher {
+	config := newTestConfig(t, append([]string{
+		"push.backoff=1ms", "push.max_backoff=5ms"}, overrides...)...)
+	logger := util.NewHekaLogger(config)
+	return NewPushDispatcher(config, logger,
+		util.NewMetrics("test", logger, config), send, nil)
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	var mux sync.Mutex
+	attempts := 0
+	done := make(chan bool, 1)
+	pusher := newTestDispatcher(t, func(*storage.Device, []byte) error {
+		mux.Lock()
+		defer mux.Unlock()
+		if attempts++; attempts < 3 {
+			return errServer
+		}
+		done <- true
+		return nil
+	})
+	defer pusher.Close(time.Second)
+
+	if err := pusher.Push(&storage.Device{ID: "dev1", PushUrl: "http://push/1"}, nil, func(err error) {
+		t.Errorf("Push dead-lettered: %s", err)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push not retried")
+	}
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	failed := make(chan error, 2)
+	var mux sync.Mutex
+	attempts := 0
+	pusher := newTestDispatcher(t, func(*storage.Device, []byte) error {
+		mux.Lock()
+		defer mux.Unlock()
+		attempts++
+		return errServer
+	}, "push.retries=2")
+	defer pusher.Close(time.Second)
+
+	pusher.Push(&storage.Device{ID: "dev1", PushUrl: "http://push/1"}, nil, func(err error) {
+		failed <- err
+	})
+	select {
+	case err := <-failed:
+		mux.Lock()
+		if err != errServer || attempts != 3 {
+			t.Errorf("Unexpected failure %v after %d attempts", err, attempts)
+		}
+		mux.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push never gave up")
+	}
+
+	// Some errors aren't worth retrying.
+	gone := &PushError{Status: 410, Class: PUSH_GONE}
+	permanent := newTestDispatcher(t, func(*storage.Device, []byte) error {
+		return gone
+	}, "push.backoff=1h")
+	defer permanent.Close(time.Second)
+	goneDevs := make(chan string, 1)
+	permanent.gone = func(devRec *storage.Device) {
+		goneDevs <- devRec.ID
+	}
+	permanent.Push(&storage.Device{ID: "dev2", PushUrl: "http://push/2"}, nil,
+		func(err error) {
+			failed <- err
+		})
+	select {
+	case err := <-failed:
+		if err != gone || <-goneDevs != "dev2" {
+			t.Errorf("Unexpected failure %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Permanent failure was retried")
+	}
+	if err := permanent.Push(&storage.Device{ID: "dev2"}, nil, nil); err != ErrUnreachable {
+		t.Errorf("Pushed to a device without an endpoint: %v", err)
+	}
+}
+
+func TestDispatcherLimits(t *testing.T) {
+	var mux sync.Mutex
+	running, most := 0, 0
+	var wg sync.WaitGroup
+	pusher := newTestDispatcher(t, func(*storage.Device, []byte) error {
+		mux.Lock()
+		if running++; running > most {
+			most = running
+		}
+		mux.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mux.Lock()
+		running--
+		mux.Unlock()
+		wg.Done()
+		return nil
+	}, "push.workers=4", "push.max_per_endpoint=1", "push.backoff=10ms")
+	defer pusher.Close(time.Second)
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		pusher.Push(&storage.Device{PushUrl: "https://push.example.com/1"}, nil, nil)
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("%d concurrent pushes to one endpoint", most)
+	}
+
+	// No workers, so the queue fills up.
+	full := newTestDispatcher(t, nil, "push.workers=0", "push.queue_size=1")
+	dev := &storage.Device{PushUrl: "http://push/1"}
+	if err := full.Push(dev, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := full.Push(dev, nil, nil); err != ErrPushQueueFull {
+		t.Errorf("Expected a full queue: %v", err)
+	}
+}
+
+func TestDispatcherBacklog(t *testing.T) {
+	failed := make(chan error, 2)
+	pusher := newTestDispatcher(t, func(*storage.Device, []byte) error {
+		return errServer
+	}, "push.backoff=1h", "push.max_backoff=1h", "push.max_waiting=1")
+	onFail := func(err error) {
+		failed <- err
+	}
+	pusher.Push(&storage.Device{ID: "dev1", PushUrl: "http://push/1"}, nil, onFail)
+	pusher.Push(&storage.Device{ID: "dev2", PushUrl: "http://push/2"}, nil, onFail)
+	// Only one push can wait for a retry.
+	select {
+	case err := <-failed:
+		if err != ErrPushBacklog {
+			t.Errorf("Unexpected failure %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retries not limited")
+	}
+	// The other is given up on at shutdown.
+	pusher.Close(time.Second)
+	select {
+	case err := <-failed:
+		if err != ErrPushClosed {
+			t.Errorf("Unexpected failure %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting retry dropped on close")
+	}
+}
@@ -0,0 +1,219 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"archive/zip"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/* Account export.
+   GET /1/export/ gives the signed in user everything the server holds
+   for them as a JSON download: their devices (names, when they were
+   registered and last heard from, status, lost mode), every retained
+   position, the commands waiting for each device or scheduled for
+   later, tracking sessions, geofences, share links, who else can use
+   the devices, the audit log (see audit.go), webhooks, and notification
+   preferences. ?format=zip gives the same as export.json inside a ZIP
+   archive. HAWK secrets, push endpoints and keys, OAuth access tokens,
+   webhook secrets and lock passcodes are never included. Devices other
+   people have shared with the user are listed, but their data belongs
+   to their owners.
+*/
+
+// One of the user's devices, as exported.
+type exportDevice struct {
+	ID           string
+	Name         string
+	Registered   int64 // UTC seconds
+	LastExchange int32 // UTC seconds
+	HasPasscode  bool
+	Accepts      string
+	Unreachable  bool
+	Lost         *storage.LostMode       `json:",omitempty"`
+	Erasing      int64                   `json:",omitempty"`
+	Passcode     *storage.PasscodePolicy `json:",omitempty"`
+	Status       *storage.DeviceStatus   `json:",omitempty"`
+	Best         *storage.Position       `json:",omitempty"`
+	Positions    []storage.Position
+	Pending      []storage.PendingCommand
+	Scheduled    []storage.ScheduledCommand
+	Tracking     *storage.TrackingSession `json:",omitempty"`
+	Geofences    []storage.Geofence
+	Shares       []storage.Share
+	Access       []storage.DeviceAccess
+	Invitations  []storage.Invitation
+}
+
+type exportData struct {
+	Exported int64 // UTC seconds
+	UserId   string
+	Email    string
+	Devices  []exportDevice
+	Shared   []storage.DeviceList // other people's devices the user can use
+	Audit    []storage.AuditEvent // what the user did, and what was done to their devices
+	Webhooks []storage.Webhook
+	Notify   storage.NotifyPrefs
+}
+
+// Gather what's held for the device, leaving out its secrets.
+func (self *Handler) exportDevice(devId string) (dev *exportDevice, err error) {
+	store := self.store
+	devRec, err := store.GetDeviceInfo(devId)
+	if err != nil {
+		return nil, err
+	}
+	dev = &exportDevice{ID: devRec.ID,
+		Name:         devRec.Name,
+		Registered:   devRec.Registered,
+		LastExchange: devRec.LastExchange,
+		HasPasscode:  devRec.HasPasscode,
+		Accepts:      devRec.Accepts,
+		Unreachable:  devRec.Unreachable,
+		Lost:         devRec.Lost,
+		Erasing:      devRec.Erasing,
+		Passcode:     devRec.Passcode,
+		Best:         devRec.Best}
+	if dev.Status, err = store.GetDeviceStatus(devId); err != nil {
+		return nil, err
+	}
+	if dev.Positions, err = store.GetPositionHistory(devId); err != nil {
+		return nil, err
+	}
+	if dev.Pending, err = store.GetPendingCommands(devId); err != nil {
+		return nil, err
+	}
+	for i := range dev.Pending {
+		dev.Pending[i].Cmd = maskCommand(dev.Pending[i].Cmd)
+	}
+	if dev.Scheduled, err = store.GetScheduled(devId); err != nil {
+		return nil, err
+	}
+	for i, sched := range dev.Scheduled {
+		args := make(replyType)
+		json.Unmarshal([]byte(sched.Args), &args)
+		masked, _ := json.Marshal(maskArgs(sched.Cmd, args))
+		dev.Scheduled[i].Args = string(masked)
+	}
+	if dev.Tracking, err = store.GetTracking(devId); err != nil {
+		return nil, err
+	}
+	if dev.Geofences, err = store.GetGeofences(devId); err != nil {
+		return nil, err
+	}
+	if dev.Shares, err = store.GetShares(devId); err != nil {
+		return nil, err
+	}
+	if dev.Access, err = store.GetAccess(devId); err != nil {
+		return nil, err
+	}
+	if dev.Invitations, err = store.GetInvitations(devId); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+// Download everything held for the signed in user (?format=json or zip).
+func (self *Handler) Export(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Export"
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	if req.Method != "GET" {
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	format := req.FormValue("format")
+	if format != "" && format != "json" && format != "zip" {
+		http.Error(resp, "\"Invalid Format\"", http.StatusBadRequest)
+		return
+	}
+	userId, email, err := self.getUser(resp, req)
+	if err != nil || userId == "" {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	store := self.store
+	now := time.Now().UTC()
+	data := exportData{Exported: now.Unix(),
+		UserId:  userId,
+		Email:   email,
+		Devices: []exportDevice{}}
+	// Every device, not just the ones the UI lists.
+	owned, err := store.GetOwnedDevices(userId)
+	if err == nil {
+		data.Shared, err = store.GetSharedDevices(userId)
+	}
+	if err == nil {
+		data.Audit, err = store.GetUserAuditEvents(userId)
+	}
+	if err == nil {
+		var hooks []storage.Webhook
+		hooks, err = store.GetWebhooks(userId)
+		data.Webhooks = []storage.Webhook{}
+		for _, hook := range hooks {
+			data.Webhooks = append(data.Webhooks, redactWebhook(hook))
+		}
+	}
+	if err == nil {
+		data.Notify, err = store.GetNotifyPrefs(userId)
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get devices for export",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	for _, devId := range owned {
+		dev, err := self.exportDevice(devId)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not export device",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		data.Devices = append(data.Devices, *dev)
+	}
+	output, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	self.logger.Info(self.logCat, "Account exported",
+		util.Fields{"userId": userId,
+			"format": format})
+	self.metrics.Increment("export")
+	name := "findmydevice-" + now.Format("20060102")
+	if format == "zip" {
+		resp.Header().Set("Content-Type", "application/zip")
+		resp.Header().Set("Content-Disposition",
+			"attachment; filename=\""+name+".zip\"")
+		archive := zip.NewWriter(resp)
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: "export.json",
+			Method: zip.Deflate, Modified: now})
+		if err == nil {
+			_, err = file.Write(output)
+		}
+		if err == nil {
+			err = archive.Close()
+		}
+		if err != nil {
+			self.logger.Warn(self.logCat, "Could not write export archive",
+				util.Fields{"error": err.Error(),
+					"userId": userId})
+		}
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Content-Disposition",
+		"attachment; filename=\""+name+".json\"")
+	resp.Write(output)
+}
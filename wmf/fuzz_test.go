@@ -0,0 +1,164 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Fuzz targets for the values that arrive from devices and the web UI.
+// The seeds below run as part of "go test"; to fuzz one, run e.g.
+//
+//	go test ./wmf -run XXX -fuzz FuzzParseAuthHeader
+//
+// Any crashers found are written to testdata/fuzz and are replayed by
+// later test runs.
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A handler backed by the memory store with no outside services.
+func newFuzzHandler(f testing.TB, overrides ...string) *Handler {
+	config := newTestConfig(f, overrides...)
+	logger := util.NewHekaLogger(config)
+	handler := NewHandler(config, logger, util.NewMetrics("test", logger, config))
+	if handler == nil {
+		f.Fatal("Could not create handler")
+	}
+	return handler
+}
+
+// Build an unverified assertion around the JSON claim
+func fakeAssertion(claim string) string {
+	return "header." + base64.RawURLEncoding.EncodeToString([]byte(claim)) +
+		".sig"
+}
+
+func FuzzParseAuthHeader(f *testing.F) {
+	f.Add(`Hawk id="0123", ts="1353832234", nonce="j4h3g2", ext="", mac="6R4rV5iE+NPoym+WwjeHzjAGXUtLNIxmo1vpMofpLAE="`)
+	f.Add(`hawk mac=`)
+	f.Add(`Hawk`)
+	f.Add(`Basic dXNlcjpwYXNz`)
+	f.Fuzz(func(t *testing.T, auth string) {
+		req, _ := http.NewRequest("POST", "http://localhost/1/cmd/0123", nil)
+		req.Header.Set("Authorization", auth)
+		hawk := Hawk{}
+		if err := hawk.ParseAuthHeader(req, nil); err == nil &&
+			!strings.EqualFold(auth[:4], "hawk") {
+			t.Errorf("Accepted non-Hawk header %q", auth)
+		}
+	})
+}
+
+func FuzzExtractFromAssertion(f *testing.F) {
+	handler := newFuzzHandler(f)
+	f.Add(fakeAssertion(`{"principal":{"email":"user@example.com"}}`))
+	f.Add(fakeAssertion(`{"principal":{"email":"user@example.com"},"fxa-verifiedEmail":"user@example.com"}`))
+	f.Add(fakeAssertion(`{"principal":"user@example.com"}`))
+	f.Add(fakeAssertion(`{"fxa-verifiedEmail":42}`))
+	f.Add("a.e30")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, assertion string) {
+		userid, email, err := handler.extractFromAssertion(assertion)
+		if err == nil && (userid == "" || email == "") {
+			t.Errorf("Empty credentials from %q", assertion)
+		}
+	})
+}
+
+func FuzzExtractAudience(f *testing.F) {
+	handler := newFuzzHandler(f)
+	f.Add("a.b.c." + base64.RawStdEncoding.EncodeToString([]byte(`{"audience":"https://example.com"}`)) + ".e")
+	f.Add("a.b.c." + base64.RawStdEncoding.EncodeToString([]byte(`{"aud":["x"]}`)) + ".e")
+	f.Add("a.b.c.d.e")
+	f.Fuzz(func(t *testing.T, assertion string) {
+		handler.extractAudience(assertion)
+	})
+}
+
+func FuzzGetDevFromUrl(f *testing.F) {
+	f.Add("/1/cmd/0123456789abcdef")
+	f.Add("/1/ws/sig/0123456789abcdef/")
+	f.Add("//////////")
+	f.Fuzz(func(t *testing.T, path string) {
+		u, err := url.Parse(path)
+		if err != nil {
+			return
+		}
+		devId := getDevFromUrl(u)
+		if len(devId) > 32 || strings.Map(deviceIdFilter, devId) != devId {
+			t.Errorf("Bad device id %q from %q", devId, path)
+		}
+	})
+}
+
+func FuzzCollapseAccepts(f *testing.F) {
+	f.Add([]byte(`["l","r","t","e","h"]`))
+	f.Add([]byte(`["Lock", "", 1, null, ["r"]]`))
+	f.Add([]byte(`"lrt"`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var val interface{}
+		if json.Unmarshal(data, &val) != nil {
+			return
+		}
+		for _, c := range collapseAccepts(val) {
+			if c < 'a' || c > 'z' {
+				t.Errorf("Unexpected accept %q from %s", c, data)
+			}
+		}
+	})
+}
+
+func FuzzSanitizeArgs(f *testing.F) {
+	handler := newFuzzHandler(f)
+	f.Add("l", []byte(`{"c":"1234","m":"Call me"}`))
+	f.Add("l", []byte(`{"c":1234,"m":5}`))
+	f.Add("r", []byte(`{"d":"30"}`))
+	f.Add("t", []byte(`{"d":[1,2]}`))
+	f.Fuzz(func(t *testing.T, c string, data []byte) {
+		args := make(replyType)
+		if json.Unmarshal(data, &args) != nil {
+			return
+		}
+		command, ok := getCommand(c)
+		if !ok {
+			return
+		}
+		args, err := handler.sanitizeArgs(command, nil, args)
+		if err != nil {
+			return
+		}
+		if code, ok := args["c"]; ok {
+			code, _ := code.(string)
+			if len(code) != 4 || strings.Map(digitsOnly, code) != code {
+				t.Errorf("Bad lock code %q from %s", code, data)
+			}
+		}
+		if m, ok := args["m"].(string); ok && markupTag.MatchString(m) {
+			t.Errorf("Markup %q left in message from %s", m, data)
+		}
+	})
+}
+
+// The whole registration path, with unverified assertions.
+func FuzzRegister(f *testing.F) {
+	handler := newFuzzHandler(f, "auth.disabled=true")
+	assert := fakeAssertion(`{"principal":{"email":"user@example.com"}}`)
+	f.Add([]byte(`{"assert":"` + assert + `","pushurl":"http://push/1","deviceid":"0123","has_passcode":"false","accepts":["l","r"]}`))
+	f.Add([]byte(`{"assert":"` + assert + `","pushurl":"http://push/1","has_passcode":true,"accepts":"lrt"}`))
+	f.Add([]byte(`{"assert":1,"pushurl":2,"deviceid":3,"accepts":[""]}`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, _ := http.NewRequest("POST", "http://localhost/1/register/",
+			bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		handler.Register(httptest.NewRecorder(), req)
+	})
+}
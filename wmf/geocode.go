@@ -0,0 +1,182 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* Reverse geocoding.
+   Locations are described as "near Portland, Oregon" using a local
+   GeoNames dump, so no position ever leaves the server. geocode.cities
+   is a GeoNames cities file (e.g. cities15000.txt: tab separated, with
+   the name, latitude, longitude, country code and admin1 code in
+   columns 2, 5, 6, 9 and 11). geocode.admin1 is the matching
+   admin1CodesASCII.txt, giving state and province names; without it
+   the country code is used. Places further than geocode.max_distance
+   km away aren't used. Without geocode.cities, locations aren't
+   described.
+*/
+
+var ErrNoPlaces = errors.New("No places in geocoder data")
+
+// A named place near a location.
+type Place struct {
+	Name     string
+	Admin    string  // state, province, etc. (or the country code)
+	Country  string  // ISO country code
+	Distance float64 // from the location, in km
+}
+
+// "Portland, Oregon"
+func (self *Place) String() string {
+	if self.Admin == "" {
+		return self.Name
+	}
+	return self.Name + ", " + self.Admin
+}
+
+type Geocoder interface {
+	// The place nearest to the location, or nil if there's none close.
+	Near(lat, lon float64) *Place
+}
+
+// Create the configured geocoder, or nil if there isn't one.
+func NewGeocoder(config *util.MzConfig) (Geocoder, error) {
+	cities := config.Get("geocode.cities", "")
+	if cities == "" {
+		return nil, nil
+	}
+	return NewOfflineGeocoder(cities, config.Get("geocode.admin1", ""),
+		float64(getInt(config, "geocode.max_distance", 50)))
+}
+
+// Places are indexed by the whole degree square they're in.
+type geoCell struct {
+	lat, lon int
+}
+
+// Reverse geocoder using GeoNames data loaded into memory.
+type OfflineGeocoder struct {
+	places  []Place
+	coords  [][2]float64 // latitude, longitude of each place
+	cells   map[geoCell][]int
+	maxDist float64
+}
+
+func NewOfflineGeocoder(cities, admin1 string, maxDist float64) (self *OfflineGeocoder, err error) {
+	self = &OfflineGeocoder{
+		cells:   make(map[geoCell][]int),
+		maxDist: maxDist,
+	}
+	admins := make(map[string]string)
+	if admin1 != "" {
+		// US.OR<tab>Oregon<tab>Oregon<tab>5744337
+		err = readTabFile(admin1, func(fields []string) {
+			if len(fields) >= 2 {
+				admins[fields[0]] = fields[1]
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = readTabFile(cities, func(fields []string) {
+		if len(fields) < 11 {
+			return
+		}
+		lat, err1 := strconv.ParseFloat(fields[4], 64)
+		lon, err2 := strconv.ParseFloat(fields[5], 64)
+		if err1 != nil || err2 != nil || math.Abs(lat) > 90 ||
+			math.Abs(lon) > 180 || fields[1] == "" {
+			return
+		}
+		place := Place{Name: fields[1], Country: fields[8]}
+		if place.Admin = admins[fields[8]+"."+fields[10]]; place.Admin == "" {
+			place.Admin = fields[8]
+		}
+		cell := geoCell{int(math.Floor(lat)), int(math.Floor(lon))}
+		if cell.lon == 180 {
+			cell.lon = -180
+		}
+		self.cells[cell] = append(self.cells[cell], len(self.places))
+		self.places = append(self.places, place)
+		self.coords = append(self.coords, [2]float64{lat, lon})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(self.places) == 0 {
+		return nil, ErrNoPlaces
+	}
+	return self, nil
+}
+
+// Call fn with the fields of each line of the tab separated file.
+func readTabFile(name string, fn func([]string)) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fn(strings.Split(line, "\t"))
+	}
+	return scanner.Err()
+}
+
+func (self *OfflineGeocoder) Near(lat, lon float64) *Place {
+	// Search the squares within maxDist of the location.
+	dlat := int(math.Ceil(self.maxDist / 111.2))
+	dlon := dlat
+	if c := math.Cos(math.Min(89, math.Abs(lat)+float64(dlat)) * math.Pi / 180); c > 0 {
+		dlon = int(math.Ceil(self.maxDist / (111.2 * c)))
+	}
+	if dlon > 180 {
+		dlon = 180
+	}
+	clat, clon := int(math.Floor(lat)), int(math.Floor(lon))
+	best, bestDist := -1, self.maxDist*1000
+	for y := clat - dlat; y <= clat+dlat; y++ {
+		for x := clon - dlon; x <= clon+dlon; x++ {
+			// wrap around the antimeridian
+			wx := ((x+180)%360+360)%360 - 180
+			for _, i := range self.cells[geoCell{y, wx}] {
+				d := haversine(lat, lon, self.coords[i][0], self.coords[i][1])
+				if d <= bestDist {
+					best, bestDist = i, d
+				}
+			}
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	place := self.places[best]
+	place.Distance = math.Floor(bestDist/100) / 10
+	return &place
+}
+
+// Describe where the position is, if there's a geocoder.
+func (self *Handler) placeNear(pos *storage.Position) *Place {
+	if self.geocoder == nil || pos == nil {
+		return nil
+	}
+	return self.geocoder.Near(pos.Latitude, pos.Longitude)
+}
@@ -0,0 +1,87 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A few places, in the GeoNames cities format.
+var testCities = []string{
+	"5746545\tPortland\tPortland\t\t45.52345\t-122.67621\tP\tPPLA2\tUS\t\tOR\t051\t\t\t632309",
+	"5747882\tBeaverton\tBeaverton\t\t45.48706\t-122.80371\tP\tPPL\tUS\t\tOR\t067\t\t\t97494",
+	"5814616\tVancouver\tVancouver\t\t45.63873\t-122.66149\tP\tPPL\tUS\t\tWA\t011\t\t\t183012",
+	"2198148\tLabasa\tLabasa\t\t-16.41667\t179.38333\tP\tPPL\tFJ\t\t02\t\t\t\t27949",
+	"4035413\tSomewhere\tSomewhere\t\t-16.9\t-179.95\tP\tPPL\tXX\t\t\t\t\t\t10",
+	"bad line",
+	"1\tNowhere\tNowhere\t\tnorth\t-122.5\tP\tPPL\tUS\t\tOR",
+	"# comment",
+}
+
+var testAdmin1 = []string{
+	"US.OR\tOregon\tOregon\t5744337",
+	"US.WA\tWashington\tWashington\t5815135",
+}
+
+// Write the test GeoNames files, returning their names.
+func writeGeonames(t *testing.T) (cities, admin1 string) {
+	dir, err := ioutil.TempDir("", "geonames")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	cities = filepath.Join(dir, "cities.txt")
+	admin1 = filepath.Join(dir, "admin1.txt")
+	ioutil.WriteFile(cities, []byte(strings.Join(testCities, "\n")+"\n"), 0644)
+	ioutil.WriteFile(admin1, []byte(strings.Join(testAdmin1, "\n")+"\n"), 0644)
+	return cities, admin1
+}
+
+func TestOfflineGeocoder(t *testing.T) {
+	cities, admin1 := writeGeonames(t)
+	defer os.RemoveAll(filepath.Dir(cities))
+
+	geocoder, err := NewOfflineGeocoder(cities, admin1, 50)
+	if err != nil {
+		t.Fatalf("Could not load places: %s", err)
+	}
+	if len(geocoder.places) != 5 {
+		t.Errorf("Malformed lines not skipped: %d places", len(geocoder.places))
+	}
+	for _, test := range []struct {
+		lat, lon float64
+		want     string
+	}{
+		{45.52, -122.68, "Portland, Oregon"},
+		{45.49, -122.79, "Beaverton, Oregon"},
+		{45.64, -122.66, "Vancouver, Washington"},
+		{45.0, -122.0, ""},               // ~80km from Portland
+		{-16.9, 179.95, "Somewhere, XX"}, // across the antimeridian
+		{-16.4, 179.4, "Labasa, FJ"},     // no admin1 name
+		{0, 0, ""},
+	} {
+		got := ""
+		if place := geocoder.Near(test.lat, test.lon); place != nil {
+			got = place.String()
+		}
+		if got != test.want {
+			t.Errorf("%v,%v: got %q, want %q", test.lat, test.lon, got, test.want)
+		}
+	}
+	if place := geocoder.Near(45.52, -122.68); place == nil ||
+		place.Country != "US" || place.Distance > 0.5 {
+		t.Errorf("Unexpected place %+v", place)
+	}
+
+	if _, err = NewOfflineGeocoder(admin1, "", 50); err != ErrNoPlaces {
+		t.Errorf("Expected ErrNoPlaces, got %v", err)
+	}
+	if _, err = NewOfflineGeocoder(cities+".missing", "", 50); err == nil {
+		t.Errorf("Missing file not reported")
+	}
+}
@@ -0,0 +1,284 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+)
+
+/* Geofences.
+   Owners can name areas, either a circle
+       {"name": "Home", "lat": 45.52, "lon": -122.68, "radius": 200}
+   or a polygon of [lat, lon] vertices
+       {"name": "School", "polygon": [[45.5, -122.7], [45.6, -122.7], ...]}
+   and are told when the device enters or leaves them. Each stored
+   position is checked against the device's geofences. A position only
+   counts as inside (or outside) if it is further inside (or outside)
+   than its accuracy, or geofence.margin meters if that's more, so a
+   device sitting near the edge doesn't flap in and out. The first
+   position after a geofence is added only sets where the device is.
+   Changes go to the UI with the position
+       {"Geofences": [{"ID": "12", "Name": "Home", "Event": "enter"}], ...}
+   and to the owner as geofence.enter and geofence.exit notices.
+   Geofences are managed with /1/geofences/<deviceid>: GET lists, POST
+   adds and DELETE ?id=<id> removes.
+*/
+
+const (
+	GEOFENCE_INSIDE   = "inside"
+	GEOFENCE_OUTSIDE  = "outside"
+	GEOFENCE_NAME_LEN = 64
+
+	// Mean earth radius, in meters.
+	EARTH_RADIUS = 6371000.0
+)
+
+// What the UI is told when the device crosses a geofence.
+type geofenceEvent struct {
+	ID    string
+	Name  string
+	Event string // "enter" or "exit"
+}
+
+// Distance between two points, in meters.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// How far the point is outside the geofence's edge, in meters. Negative
+// if it's inside.
+func geofenceDistance(fence *storage.Geofence, lat, lon float64) float64 {
+	if len(fence.Polygon) == 0 {
+		return haversine(lat, lon, fence.Latitude, fence.Longitude) - fence.Radius
+	}
+	// Geofences are small enough to treat as flat around the point.
+	rad := math.Pi / 180
+	scale := math.Cos(lat * rad)
+	project := func(v [2]float64) (x, y float64) {
+		dlon := math.Remainder(v[1]-lon, 360)
+		return dlon * rad * scale * EARTH_RADIUS, (v[0] - lat) * rad * EARTH_RADIUS
+	}
+	inside := false
+	nearest := math.Inf(1)
+	n := len(fence.Polygon)
+	for i := 0; i < n; i++ {
+		x1, y1 := project(fence.Polygon[i])
+		x2, y2 := project(fence.Polygon[(i+1)%n])
+		if (y1 > 0) != (y2 > 0) && x1+(0-y1)*(x2-x1)/(y2-y1) > 0 {
+			inside = !inside
+		}
+		// distance from the point (the origin) to the edge
+		dx, dy := x2-x1, y2-y1
+		t := 0.0
+		if l := dx*dx + dy*dy; l > 0 {
+			t = math.Max(0, math.Min(1, -(x1*dx+y1*dy)/l))
+		}
+		nearest = math.Min(nearest, math.Hypot(x1+t*dx, y1+t*dy))
+	}
+	if inside {
+		return -nearest
+	}
+	return nearest
+}
+
+// Where the position puts the device, or "" if it's too close to the
+// edge to tell.
+func geofenceState(fence *storage.Geofence, pos storage.Position, margin float64) string {
+	band := math.Max(pos.Accuracy, margin)
+	switch d := geofenceDistance(fence, pos.Latitude, pos.Longitude); {
+	case d <= -band:
+		return GEOFENCE_INSIDE
+	case d >= band:
+		return GEOFENCE_OUTSIDE
+	}
+	return ""
+}
+
+// Check a stored position against the device's geofences, telling the
+// owner about any crossed. Returns the crossings for the UI.
+func (self *Handler) checkGeofences(devId string, pos storage.Position) (events []geofenceEvent) {
+	fences, err := self.store.GetGeofences(devId)
+	if err != nil || len(fences) == 0 {
+		return nil
+	}
+	margin := float64(getInt(self.config, "geofence.margin", 20))
+	var devRec *storage.Device
+	for i := range fences {
+		fence := &fences[i]
+		state := geofenceState(fence, pos, margin)
+		if state == "" || state == fence.State {
+			continue
+		}
+		if err = self.store.SetGeofenceState(fence.ID, state); err != nil ||
+			fence.State == "" {
+			continue
+		}
+		event, notice := "exit", NOTICE_GEOFENCE_EXIT
+		if state == GEOFENCE_INSIDE {
+			event, notice = "enter", NOTICE_GEOFENCE_ENTER
+		}
+		self.logger.Info(self.logCat, "Device crossed geofence",
+			util.Fields{"deviceId": devId,
+				"geofence": fence.ID,
+				"event":    event})
+		self.metrics.Increment("geofence." + event)
+		events = append(events, geofenceEvent{ID: fence.ID, Name: fence.Name,
+			Event: event})
+		if devRec == nil {
+			if devRec, err = self.store.GetDeviceInfo(devId); err != nil {
+				devRec = nil
+				continue
+			}
+		}
+		self.notify(devRec, notice, replyType{"id": fence.ID,
+			"geofence": fence.Name})
+	}
+	return events
+}
+
+// Build a geofence from what the owner sent, or say what's wrong with it.
+func (self *Handler) newGeofence(devId string, args replyType) (fence *storage.Geofence, reason string) {
+	fence = &storage.Geofence{DeviceId: devId}
+	name, _ := args["name"].(string)
+	if r := []rune(sanitizeText(name)); len(r) > GEOFENCE_NAME_LEN {
+		fence.Name = string(r[:GEOFENCE_NAME_LEN])
+	} else {
+		fence.Name = string(r)
+	}
+	if fence.Name == "" {
+		return nil, "A name is required"
+	}
+	validPoint := func(lat, lon float64) bool {
+		return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+	}
+	if vertices, ok := args["polygon"].([]interface{}); ok {
+		maxPoints := int(getInt(self.config, "geofence.max_points", 64))
+		if len(vertices) < 3 || len(vertices) > maxPoints {
+			return nil, fmt.Sprintf("A polygon needs 3 to %d points", maxPoints)
+		}
+		for _, v := range vertices {
+			point, ok := v.([]interface{})
+			if !ok || len(point) != 2 {
+				return nil, "Polygon points are [latitude, longitude]"
+			}
+			lat, ok1 := point[0].(float64)
+			lon, ok2 := point[1].(float64)
+			if !ok1 || !ok2 || !validPoint(lat, lon) {
+				return nil, "Polygon points are [latitude, longitude]"
+			}
+			fence.Polygon = append(fence.Polygon, [2]float64{lat, lon})
+		}
+		return fence, ""
+	}
+	lat, ok1 := args["lat"].(float64)
+	lon, ok2 := args["lon"].(float64)
+	if !ok1 || !ok2 || !validPoint(lat, lon) {
+		return nil, "A valid lat and lon are required"
+	}
+	minRadius := float64(getInt(self.config, "geofence.min_radius", 50))
+	maxRadius := float64(getInt(self.config, "geofence.max_radius", 100000))
+	radius, _ := args["radius"].(float64)
+	if radius < minRadius || radius > maxRadius {
+		return nil, fmt.Sprintf("The radius must be %.0f to %.0f meters",
+			minRadius, maxRadius)
+	}
+	fence.Latitude, fence.Longitude, fence.Radius = lat, lon, radius
+	return fence, ""
+}
+
+// List (GET), add (POST) or remove (DELETE ?id=<id>) the device's
+// geofences.
+func (self *Handler) Geofences(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Geofences"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	devRec, _, user := self.userDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	store := self.store
+	if req.Method != "GET" && !self.allowed(resp, devRec, user, ROLE_OPERATOR) {
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "POST":
+		args := make(replyType)
+		if err := json.NewDecoder(io.LimitReader(req.Body,
+			64*1024)).Decode(&args); err != nil {
+			http.Error(resp, "\"Invalid Geofence\"", http.StatusBadRequest)
+			return
+		}
+		fence, reason := self.newGeofence(devRec.ID, args)
+		if fence == nil {
+			output, _ := json.Marshal(replyType{"error": "Invalid geofence",
+				"reason": reason})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+		fences, err := store.GetGeofences(devRec.ID)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if int64(len(fences)) >= getInt(self.config, "geofence.max", 20) {
+			output, _ := json.Marshal(replyType{"error": "Invalid geofence",
+				"reason": "Too many geofences for this device"})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+		if fence.ID, err = store.AddGeofence(*fence); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		self.logger.Info(self.logCat, "Geofence added",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": user.ID,
+				"id":     fence.ID})
+		self.metrics.Increment("geofence.add")
+	case "DELETE":
+		id := req.FormValue("id")
+		found, err := store.DeleteGeofence(devRec.ID, id)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if !found {
+			http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+			return
+		}
+		self.logger.Info(self.logCat, "Geofence removed",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": user.ID,
+				"id":     id})
+		self.metrics.Increment("geofence.delete")
+	default:
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	fences, err := store.GetGeofences(devRec.ID)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	if fences == nil {
+		fences = []storage.Geofence{}
+	}
+	output, _ := json.Marshal(replyType{"geofences": fences})
+	resp.Write(output)
+}
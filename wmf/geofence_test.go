@@ -0,0 +1,62 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"math"
+	"testing"
+)
+
+func TestGeofenceDistance(t *testing.T) {
+	circle := &storage.Geofence{Latitude: 45.52, Longitude: -122.68, Radius: 200}
+	// A square about 1.1km a side.
+	square := &storage.Geofence{Polygon: [][2]float64{
+		{45.50, -122.70}, {45.51, -122.70}, {45.51, -122.69}, {45.50, -122.69}}}
+	// One across the antimeridian.
+	dateline := &storage.Geofence{Polygon: [][2]float64{
+		{-17.0, 179.9}, {-16.9, 179.9}, {-16.9, -179.9}, {-17.0, -179.9}}}
+	for _, test := range []struct {
+		fence    *storage.Geofence
+		lat, lon float64
+		want     float64
+	}{
+		{circle, 45.52, -122.68, -200},
+		{circle, 45.521, -122.68, -89}, // 0.001 deg of latitude is ~111m
+		{circle, 45.523, -122.68, 134},
+		{square, 45.505, -122.695, -390}, // center, ~390m from the sides
+		{square, 45.5, -122.695, 0},
+		{square, 45.52, -122.695, 1112},
+		{dateline, -16.95, 180.0, -5560},
+		{dateline, -16.95, -179.0, 95700},
+	} {
+		got := geofenceDistance(test.fence, test.lat, test.lon)
+		if math.Abs(got-test.want) > math.Max(2, math.Abs(test.want)/100) {
+			t.Errorf("%v,%v: got %.0f, want %.0f", test.lat, test.lon, got, test.want)
+		}
+	}
+}
+
+func TestGeofenceState(t *testing.T) {
+	circle := &storage.Geofence{Latitude: 45.52, Longitude: -122.68, Radius: 200}
+	for _, test := range []struct {
+		lat, accuracy float64
+		want          string
+	}{
+		{45.52, 10, GEOFENCE_INSIDE},
+		{45.521, 10, GEOFENCE_INSIDE},
+		{45.521, 150, ""}, // could be outside
+		{45.5219, 10, ""}, // ~11m outside, within the margin
+		{45.523, 10, GEOFENCE_OUTSIDE},
+		{45.523, 500, ""},
+	} {
+		pos := storage.Position{Latitude: test.lat, Longitude: -122.68,
+			Accuracy: test.accuracy}
+		if got := geofenceState(circle, pos, 20); got != test.want {
+			t.Errorf("%v ±%v: got %q, want %q", test.lat, test.accuracy, got, test.want)
+		}
+	}
+}
@@ -42,8 +42,23 @@ type Handler struct {
 	logCat  string
 	accepts []string
 	hawk    *Hawk
-	store   *storage.Storage
+	store   storage.Store
+	webPush *WebPush
+	pushers *PushProviders
+	pusher  *PushDispatcher
 	maxCli  int64
+
+	scheduler *Scheduler
+	notifiers Notifiers
+	templates *MailTemplates
+	noticeMu  sync.Mutex
+	noticed   map[string]time.Time // throttled notices last sent, by event.deviceId
+	webhooks  *WebhookDispatcher
+	geocoder  Geocoder
+
+	sockMu  sync.Mutex
+	sockets map[*websocket.Conn]bool // open UI sockets, nil once closed
+	sockWg  sync.WaitGroup
 }
 
 const (
@@ -56,6 +71,7 @@ const (
 	SESSION_TOKEN     = "token"
 	SESSION_CSRFTOKEN = "csrftoken"
 	SESSION_DEVICEID  = "deviceid"
+	SESSION_AUTHTIME  = "authtime"
 )
 
 // Generic reply structure (useful for JSON responses)
@@ -170,9 +186,7 @@ func (self *Handler) extractFromAssertion(assertion string) (userid, email strin
 		return "", "", ErrInvalidAssertion
 	}
 	data := bits[1]
-	// pad to byte boundry
-	data = data + "===="[:len(data)%4]
-	decoded, err := base64.StdEncoding.DecodeString(data)
+	decoded, err := decodeSegment(data)
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not decode assertion",
 			util.Fields{"assertion frame": data,
@@ -191,14 +205,21 @@ func (self *Handler) extractFromAssertion(assertion string) (userid, email strin
 	// to need a value here, thus the insecure Id generation.
 	// Obviously:
 	// ******** DO NOT ENABLE auth.disabled FLAG IN PRODUCTION!! ******
-	if e, ok := asrt["fxa-verifiedEmail"]; ok {
-		email = e.(string)
+	principal, _ := asrt["principal"].(map[string]interface{})
+	principalEmail, _ := principal["email"].(string)
+	if e, ok := asrt["fxa-verifiedEmail"].(string); ok {
+		email = e
 		// userid is the local portion of the "email"
-		userid = strings.Split(asrt["principal"].(map[string]interface{})["email"].(string), "@")[0]
+		userid = strings.Split(principalEmail, "@")[0]
 	} else {
-		email = asrt["principal"].(map[string]interface{})["email"].(string)
+		email = principalEmail
 		userid = self.genHash(email)
 	}
+	if email == "" || userid == "" {
+		self.logger.Error(self.logCat, "Assertion missing email",
+			util.Fields{"assertion": assertion})
+		return "", "", ErrInvalidAssertion
+	}
 	self.logger.Debug(self.logCat, "Extracted credentials",
 		util.Fields{"userId": userid, "email": email})
 	return userid, email, nil
@@ -211,15 +232,15 @@ func (self *Handler) extractAudience(assertion string) (audience string) {
 	bits := strings.Split(assertion, ".")
 	// Classic? persona has 3 chunks, modified has 5.
 	if len(bits) == 5 {
-		if data, err := base64.StdEncoding.DecodeString(bits[3] + "===="[:len(bits[3])%4]); err == nil {
+		if data, err := decodeSegment(bits[3]); err == nil {
 			dj := make(replyType)
 			if err = json.Unmarshal(data, &dj); err == nil {
-				if v, ok := dj["audience"]; ok {
+				if v, ok := dj["audience"].(string); ok {
 					// fxa
-					return v.(string)
-				} else if v, ok := dj["aud"]; ok {
+					return v
+				} else if v, ok := dj["aud"].(string); ok {
 					// persona
-					return v.(string)
+					return v
 				}
 			}
 		}
@@ -449,7 +470,7 @@ func (self *Handler) verifyFxAAssertion(assertion string) (userid, email string,
 				return "", "", ErrOauth
 			}
 			//Convert code to access token.
-			accessToken, err := self.getAccessToken(code)
+			accessToken, _, err := self.getAccessToken(code)
 			fmt.Printf("### AccessToken: %s\n", accessToken)
 
 			if err != nil {
@@ -593,6 +614,16 @@ func (self *Handler) getUser(resp http.ResponseWriter, req *http.Request) (useri
 		}
 		// return the contents of the session.
 		if ret {
+			// Sessions from before the account was deleted are done.
+			deleted, err := self.store.GetTombstone(storage.TOMBSTONE_USER, userid)
+			if err != nil {
+				return "", "", err
+			}
+			if deleted > 0 && sessionAuthTime(session) <= deleted {
+				self.logger.Info(self.logCat, "Session for deleted user",
+					util.Fields{"userId": userid})
+				return "", "", ErrAuthorization
+			}
 			self.logger.Info(self.logCat, "::Got User::",
 				util.Fields{"source": "session",
 					"userId": userid,
@@ -666,7 +697,7 @@ func (self *Handler) getSessionInfo(resp http.ResponseWriter, req *http.Request,
 	return info, nil
 }
 
-func (self *Handler) stopTracking(devId string, store *storage.Storage) (err error) {
+func (self *Handler) stopTracking(devId string, store storage.Store) (err error) {
 	noTrack := storage.Unstructured{"t": replyType{"d": 0}}
 	jnt, err := json.Marshal(noTrack)
 	if err != nil {
@@ -676,43 +707,93 @@ func (self *Handler) stopTracking(devId string, store *storage.Storage) (err err
 	} else {
 		self.logger.Info(self.logCat, "Disabling tracking",
 			util.Fields{"deviceId": devId})
-		store.StoreCommand(devId, string(jnt), "t")
+		store.StoreCommand(devId, string(jnt), "t", "")
 		// send the push if possible.
 		if devRec, err := store.GetDeviceInfo(devId); err == nil {
 			self.logger.Debug(self.logCat, "Sending Push",
 				util.Fields{"deviceId": devId,
 					"cmd": "t:0"})
-			SendPush(devRec, self.config)
+			self.pusher.Push(devRec, nil, nil)
 		}
 	}
 	return err
 }
 
+// Send a push to the device now, using the device's push provider.
+// Called by the PushDispatcher.
+func (self *Handler) deliverPush(devRec *storage.Device, payload []byte) error {
+	return self.pushers.Send(devRec, payload)
+}
+
+// The push service no longer knows the device's endpoint (the app was
+// removed, or the subscription expired). Stop pushing to it; the user is
+// told the device needs to reopen the app, which will re-register it.
+func (self *Handler) pushGone(devRec *storage.Device) {
+	self.logger.Warn(self.logCat, "Push endpoint gone, device unreachable",
+		util.Fields{"deviceId": devRec.ID,
+			"userId":  devRec.User,
+			"pushUrl": devRec.PushUrl})
+	if err := self.store.SetDeviceUnreachable(devRec.ID,
+		devRec.PushUrl); err != nil {
+		self.logger.Error(self.logCat, "Could not mark device unreachable",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+	}
+	self.emit(devRec, EVENT_DEVICE_UNREACHABLE, nil)
+	// A device that can't be reached will never collect its erase.
+	if current, err := self.store.GetDeviceInfo(devRec.ID); err == nil &&
+		current.Erasing > 0 {
+		self.metrics.Increment("device.erase.unreachable")
+		self.notify(current, NOTICE_ERASE_UNREACHABLE, nil)
+		if err = self.deleteDevice("", "", current, "unreachable"); err != nil {
+			self.logger.Error(self.logCat, "Could not remove device",
+				util.Fields{"error": err.Error(),
+					"deviceId": devRec.ID})
+		}
+	}
+}
+
+// Remember where to send the user's notices.
+func (self *Handler) setUserEmail(userId, email string) {
+	if userId == "" || email == "" {
+		return
+	}
+	if err := self.store.SetUserEmail(userId, email); err != nil {
+		self.logger.Warn(self.logCat, "Could not record user email",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+	}
+}
+
 // log the device's position reply
 func (self *Handler) updatePage(devId, cmd string, args map[string]interface{}, logPosition bool) (err error) {
 	var location storage.Position
 	var hasPasscode bool
+	var best *storage.Position
+	var crossed []geofenceEvent
 
 	store := self.store
 
 	// Only record a location if there is one.
 	// Device reports OK:false on errors
-	if b, ok := args["ok"]; ok && b.(bool) == true {
+	if b, ok := args["ok"].(bool); ok && b == true {
 		for key, arg := range args {
 			if len(key) < 2 {
 				continue
 			}
+			// Non-numeric values are treated as 0
+			num, _ := arg.(float64)
 			switch k := strings.ToLower(key[:2]); k {
 			case "la":
-				location.Latitude = arg.(float64)
+				location.Latitude = num
 			case "lo":
-				location.Longitude = arg.(float64)
+				location.Longitude = num
 			case "al":
-				location.Altitude = arg.(float64)
+				location.Altitude = num
 			case "ac":
-				location.Accuracy = arg.(float64)
+				location.Accuracy = num
 			case "ti":
-				location.Time = int64(arg.(float64))
+				location.Time = int64(num)
 				if location.Time == 0 {
 					return nil
 				}
@@ -733,19 +814,36 @@ func (self *Handler) updatePage(devId, cmd string, args map[string]interface{},
 			if err = store.SetDeviceLocation(devId, location); err != nil {
 				return err
 			}
+			if userId, _, err := store.GetUserFromDevice(devId); err == nil {
+				self.emit(&storage.Device{ID: devId, User: userId},
+					EVENT_LOCATION_REPORTED, replyType{
+						"latitude":  location.Latitude,
+						"longitude": location.Longitude,
+						"altitude":  location.Altitude,
+						"accuracy":  location.Accuracy,
+						"time":      location.Time})
+			}
 			// because go sql locking.
 			store.GcDatabase(devId, "")
+			var moved bool
+			if best, moved = self.filterPosition(devId, location); moved {
+				crossed = self.checkGeofences(devId, *best)
+				self.lostLocation(devId, *best)
+			}
 		}
 	}
+	status, err := self.updateStatus(devId, args)
+	if err != nil {
+		return err
+	}
 	location.Cmd = storage.Unstructured{cmd: args}
 
 	// this defer also catches and logs panics from the i.Socket.Write()
 	defer func(logger *util.HekaLogger, logCat, devId string) {
 		if r := recover(); r != nil {
-			err := r.(error)
 			logger.Error(logCat,
 				"Panic in WS handler",
-				util.Fields{"error": err.Error(),
+				util.Fields{"error": fmt.Sprintf("%v", r),
 					"deviceId": devId})
 		}
 	}(self.logger, self.logCat, devId)
@@ -755,9 +853,35 @@ func (self *Handler) updatePage(devId, cmd string, args map[string]interface{},
 	muClient.RUnlock()
 
 	if ok {
-		js, _ := json.Marshal(location)
+		now := time.Now()
+		location.Stale = location.Time > 0 && self.staleFix(&location, now)
+		near := best
+		if best != nil {
+			best.Stale = self.staleFix(best, now)
+		} else if location.Time > 0 {
+			near = &location
+		}
+		place := self.placeNear(near)
+		js, _ := json.Marshal(pageUpdate{Position: location,
+			Best:       best,
+			Near:       place,
+			Status:     status,
+			LowBattery: self.lowBattery(status),
+			Geofences:  crossed})
+		// Share viewers only see where the device is.
+		var shared []byte
+		if location.Time > 0 {
+			shared, _ = json.Marshal(sharedUpdate{
+				Position: sharedPosition(&location),
+				Best:     sharedPosition(best),
+				Near:     place})
+		}
 		for _, i := range clients {
-			i.Socket.Write(js)
+			if i.Share == "" {
+				i.Socket.Write(js)
+			} else if shared != nil {
+				i.Socket.Write(shared)
+			}
 		}
 	} else {
 		self.logger.Warn(self.logCat,
@@ -775,8 +899,8 @@ func (self *Handler) logReply(devId, cmd string, args replyType) (err error) {
 		return ErrInvalidReply
 	} else {
 		if !isTrue(v) {
-			if e, ok := args["error"]; ok {
-				return errors.New(e.(string))
+			if e, ok := args["error"].(string); ok {
+				return errors.New(e)
 			}
 			return errors.New("Unknown error")
 		}
@@ -902,7 +1026,9 @@ func (self *Handler) checkSig(req *http.Request, userId, devId string) (ok bool)
 }
 
 // get the OAuth2 Access token
-func (self *Handler) getAccessToken(code string) (accessToken string, err error) {
+// Exchange an OAuth code for an access token. authTime is when the user
+// last entered their password, if FxA says (UTC seconds, else 0).
+func (self *Handler) getAccessToken(code string) (accessToken string, authTime int64, err error) {
 	token_url := self.config.Get("fxa.token", OAUTH_ENDPOINT+"/v1/token")
 	vals := make(map[string]string)
 	vals["client_id"] = self.config.Get("fxa.client_id", "invalid")
@@ -912,14 +1038,14 @@ func (self *Handler) getAccessToken(code string) (accessToken string, err error)
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not marshal vals to json",
 			util.Fields{"error": err.Error()})
-		return "", err
+		return "", 0, err
 	}
 	// fmt.Printf("### sending to %s\n %s\n", token_url, vd)
 	req, err := http.NewRequest("POST", token_url, bytes.NewBuffer(vd))
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not get oauth token",
 			util.Fields{"code": code, "error": err.Error()})
-		return "", ErrOauth
+		return "", 0, ErrOauth
 	}
 	req.Header.Add("Content-Type", "application/json")
 	cli := http.DefaultClient
@@ -927,22 +1053,29 @@ func (self *Handler) getAccessToken(code string) (accessToken string, err error)
 	if err != nil {
 		self.logger.Error(self.logCat, "Access Token Fetch failed",
 			util.Fields{"error": err.Error()})
-		return "", err
+		return "", 0, err
 	}
 	reply, raw, err := parseBody(res.Body)
 	if code, ok := reply["code"]; ok && code.(float64) > 299.0 {
 		self.logger.Error(self.logCat, "FxA Access token failure",
 			util.Fields{"code": strconv.FormatFloat(code.(float64), 'f', 1, 64),
 				"body": raw})
-		return "", ErrOauth
+		return "", 0, ErrOauth
 	}
 	token, ok := reply["access_token"]
 	if !ok {
 		self.logger.Error(self.logCat, "OAuth Access token missing from reply",
 			util.Fields{"code": code})
-		return "", ErrOauth
+		return "", 0, ErrOauth
 	}
-	return token.(string), nil
+	// OpenID calls it auth_time, FxA auth_at.
+	for _, claim := range []string{"auth_time", "auth_at"} {
+		if at, ok := reply[claim].(float64); ok {
+			authTime = int64(at)
+			break
+		}
+	}
+	return token.(string), authTime, nil
 }
 
 // Get the user's Data from the profile server using the OAuth2 access token
@@ -1004,12 +1137,11 @@ func (self *Handler) checkToken(session *sessions.Session, req *http.Request) (r
 	}
 
 	// get the URL args
-	if tokens, ok := req.Header["X-CSRFTOKEN"]; !ok {
+	// (header keys are canonicalized, so don't index the map directly)
+	if token = req.Header.Get("X-CSRFToken"); token == "" {
 		self.logger.Warn(self.logCat, "token fail",
 			util.Fields{"error": "No token in Request"})
 		return self.config.GetFlag("auth.allow_tokenless")
-	} else {
-		token = tokens[0]
 	}
 
 	// check to see if the "tok" field matches
@@ -1022,7 +1154,7 @@ func (self *Handler) checkToken(session *sessions.Session, req *http.Request) (r
 //Handler Public Functions
 
 func NewHandler(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) *Handler {
-	store, err := storage.Open(config, logger, metrics)
+	store, err := storage.OpenStore(config, logger, metrics)
 	if err != nil {
 		logger.Error("Handler", "Could not open storage",
 			util.Fields{"error": err.Error()})
@@ -1057,18 +1189,83 @@ func NewHandler(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Me
 		//MaxAge: 3600 * 24,
 	}
 	maxCli, _ := strconv.ParseInt(config.Get("ws.max_clients", "0"), 10, 64)
+	pushCli, err := NewPushClient(config, "push.tls.")
+	if err != nil {
+		logger.Error("Handler", "Could not create push client",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
+	webPush, err := NewWebPush(config, logger, pushCli)
+	if err != nil {
+		logger.Error("Handler", "Could not initialize Web Push",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
+	pushers, err := NewPushProviders(config, logger, pushCli, webPush)
+	if err != nil {
+		logger.Error("Handler", "Could not initialize push providers",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
+	templates, err := LoadMailTemplates(config)
+	if err != nil {
+		logger.Error("Handler", "Could not load email templates",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
+	notifiers, err := NewNotifiers(config, templates)
+	if err != nil {
+		logger.Error("Handler", "Could not initialize notifications",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
+	geocoder, err := NewGeocoder(config)
+	if err != nil {
+		logger.Error("Handler", "Could not load geocoder data",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
 
 	// Initialize the data store once. This creates tables and
 	// applies required changes.
 	store.Init()
+	webhooks, err := NewWebhookDispatcher(config, logger, metrics, store)
+	if err != nil {
+		logger.Error("Handler", "Could not initialize webhooks",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
 
-	return &Handler{config: config,
+	handler := &Handler{config: config,
 		logger:  logger,
 		logCat:  "handler",
 		metrics: metrics,
 		store:   store,
+		webPush: webPush,
+		pushers: pushers,
 		maxCli:  maxCli,
-	}
+
+		webhooks:  webhooks,
+		notifiers: notifiers,
+		templates: templates,
+		noticed:   make(map[string]time.Time),
+		geocoder:  geocoder,
+		sockets:   make(map[*websocket.Conn]bool),
+	}
+	handler.pusher = NewPushDispatcher(config, logger, metrics,
+		handler.deliverPush, handler.pushGone)
+	handler.scheduler = NewScheduler(handler)
+	return handler
+}
+
+// Stop the scheduler, stop sending pushes and webhook events, and close
+// the store.
+func (self *Handler) Close() {
+	self.closeSockets()
+	self.scheduler.Close()
+	self.pusher.Close(getDuration(self.config, "push.shutdown_wait", "5s"))
+	self.webhooks.Close(getDuration(self.config, "webhook.shutdown_wait", "5s"))
+	self.store.Close()
 }
 
 // Register a new device
@@ -1078,12 +1275,13 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 	var userid string
 	var email string
 	var user string
-	var pushUrl string
+	var pushUrl, pushKey, pushAuth, pushType string
 	var deviceid string
 	var devRec *storage.Device
 	var secret string
 	var accepts string
 	var hasPasscode bool
+	var passcode *storage.PasscodePolicy
 	var loggedIn bool
 	var err error
 	var raw string
@@ -1102,12 +1300,12 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 	} else {
 		loggedIn = false
 
-		if val, ok := buffer["deviceid"]; !ok || len(val.(string)) == 0 {
+		if val, ok := buffer["deviceid"].(string); !ok || len(val) == 0 {
 			deviceid, _ = util.GenUUID4()
 		} else {
 			// User provided a deviceid in the PATH, screen and see if we
 			// have any info about it.
-			deviceid = strings.Map(deviceIdFilter, val.(string))
+			deviceid = strings.Map(deviceIdFilter, val)
 			if len(deviceid) > 32 {
 				deviceid = deviceid[:32]
 			}
@@ -1119,13 +1317,18 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 			}
 		}
 		// If there's an assertion, validate it and pull user info.
-		if assertion, ok := buffer["assert"]; ok {
+		if assert, ok := buffer["assert"]; ok {
+			assertion, _ := assert.(string)
 			if self.config.GetFlag("auth.persona") {
-				userid, email, err = self.verifyPersonaAssertion(assertion.(string))
+				userid, email, err = self.verifyPersonaAssertion(assertion)
 			} else {
-				userid, email, err = self.verifyFxAAssertion(assertion.(string))
+				userid, email, err = self.verifyFxAAssertion(assertion)
 			}
 			if err != nil || userid == "" {
+				if devRec != nil {
+					self.audit(self.sourceAddr(req), "", devRec,
+						AUDIT_REGISTER, nil, "Unauthorized")
+				}
 				http.Error(resp, "Unauthorized", 401)
 				return
 			}
@@ -1165,26 +1368,51 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 		if !loggedIn {
 			self.logger.Error(self.logCat, "Device Not logged in",
 				util.Fields{"deviceId": deviceid})
+			if devRec != nil {
+				self.audit(self.sourceAddr(req), "", devRec,
+					AUDIT_REGISTER, nil, "Unauthorized")
+			}
 			http.Error(resp, "Unauthorized", 401)
 			return
 		}
-		// If there's a pushUrl specified, make sure it's not empty.
-		if val, ok := buffer["pushurl"]; !ok || val == nil || len(val.(string)) == 0 {
+		// Devices may send a Web Push subscription, a SimplePush url,
+		// or both (for older servers). The subscription is preferred.
+		if sub, ok := buffer["subscription"].(map[string]interface{}); ok {
+			if pushUrl, pushKey, pushAuth, err = parseSubscription(sub); err != nil {
+				self.logger.Error(self.logCat, "Invalid push subscription",
+					util.Fields{"deviceId": deviceid,
+						"subscription": fmt.Sprintf("%v", sub)})
+				http.Error(resp, "Bad Data", 400)
+				return
+			}
+		} else if val, ok := buffer["pushurl"].(string); ok {
+			pushUrl = val
+		}
+		if len(pushUrl) == 0 {
 			self.logger.Error(self.logCat, "Missing SimplePush url", nil)
 			http.Error(resp, "Bad Data", 400)
 			return
-		} else {
-			pushUrl = val.(string)
+		}
+		// Devices may name their push provider, otherwise it's
+		// picked from the push url. Either way, we need one.
+		if val, ok := buffer["pushtype"].(string); ok {
+			pushType = strings.ToLower(val)
+		}
+		if _, err = self.pushers.For(&storage.Device{PushUrl: pushUrl,
+			PushKey: pushKey, PushType: pushType}); err != nil {
+			self.logger.Error(self.logCat, "No push provider for device",
+				util.Fields{"deviceId": deviceid,
+					"pushUrl":  pushUrl,
+					"pushType": pushType})
+			http.Error(resp, "Bad Data", 400)
+			return
 		}
 		//ALWAYS generate a new secret on registration!
 		secret = GenNonce(16)
 		if val, ok := buffer["has_passcode"]; !ok {
 			hasPasscode = true
 		} else {
-			hasPasscode, err = strconv.ParseBool(val.(string))
-			if err != nil {
-				hasPasscode = false
-			}
+			hasPasscode = isTrue(val)
 		}
 		if self.config.GetFlag("ek.ignore_passcode_state") {
 			// This overrides the passcode state reported by the device.
@@ -1194,21 +1422,16 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 			hasPasscode = false
 		}
 		if val, ok := buffer["accepts"]; ok {
-			// collapse the array to a string
-			if l := len(val.([]interface{})); l > 0 {
-				acc := make([]byte, l)
-				for n, ke := range val.([]interface{}) {
-					acc[n] = ke.(string)[0]
-				}
-				accepts = strings.ToLower(string(acc))
+			accepts = collapseAccepts(val)
+		}
+		accepts = acceptsFor(accepts)
+		if val, ok := buffer["passcode"]; ok {
+			if passcode = parsePasscodePolicy(val); passcode == nil {
+				self.logger.Warn(self.logCat, "Ignoring invalid passcode policy",
+					util.Fields{"deviceId": deviceid,
+						"passcode": fmt.Sprintf("%v", val)})
 			}
 		}
-		if len(accepts) == 0 {
-			accepts = "elrth"
-		}
-		if !strings.Contains("h", accepts) {
-			accepts = accepts + "h"
-		}
 
 		// create the new device record
 		var devId string
@@ -1222,8 +1445,12 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 				Name:        user,
 				Secret:      secret,
 				PushUrl:     pushUrl,
+				PushKey:     pushKey,
+				PushAuth:    pushAuth,
+				PushType:    pushType,
 				HasPasscode: hasPasscode,
 				Accepts:     accepts,
+				Passcode:    passcode,
 			}); err != nil {
 			self.logger.Error(self.logCat, "Error Registering device", nil)
 			http.Error(resp, "Bad Request", 400)
@@ -1237,6 +1464,16 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 			}
 			self.devId = deviceid
 		}
+		self.setUserEmail(userid, email)
+		registered := &storage.Device{ID: deviceid, User: userid, Name: user}
+		self.audit(self.sourceAddr(req), userid, registered, AUDIT_REGISTER,
+			replyType{"accepts": accepts}, AUDIT_OK)
+		self.emit(registered, EVENT_DEVICE_REGISTERED,
+			replyType{"accepts": accepts})
+		// Re-registering a device isn't news to its owner.
+		if devRec == nil || devRec.User != userid {
+			self.notify(registered, NOTICE_DEVICE_ADDED, nil)
+		}
 	}
 	self.metrics.Increment("device.registration")
 	self.updatePage(self.devId, "register", buffer, false)
@@ -1279,6 +1516,13 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		switch err {
 		case storage.ErrUnknownDevice:
+			// Tell devices whose owner deleted their account to stop.
+			if deleted, _ := store.GetTombstone(storage.TOMBSTONE_DEVICE,
+				deviceId); deleted > 0 {
+				self.metrics.Increment("cmd.gone")
+				http.Error(resp, "\"Gone\"", http.StatusGone)
+				return
+			}
 			self.logger.Error(self.logCat,
 				"Unknown device requesting cmd",
 				util.Fields{
@@ -1307,10 +1551,14 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 	//validate the Hawk header
 	if self.config.GetFlag("hawk.disabled") == false {
 		if !self.verifyHawkHeader(req, body, devRec) {
+			self.audit(self.sourceAddr(req), "", devRec, AUDIT_CMD, nil,
+				"Unauthorized")
 			http.Error(resp, "Unauthorized", 401)
 			return
 		}
 	}
+	// The replies handled, by command name, for the audit log.
+	var replies []string
 	// Do the command.
 	self.logger.Info(self.logCat, "### Handling cmd response from device",
 		util.Fields{
@@ -1347,23 +1595,24 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 			switch args.(type) {
 			case bool:
 				margs = replyType{string(cmd): isTrue(args.(bool))}
-			default:
+			case map[string]interface{}:
 				margs = args.(map[string]interface{})
+			default:
+				self.logger.Warn(self.logCat, "Ignoring unparsable reply",
+					util.Fields{"cmd": string(cmd),
+						"deviceId": deviceId,
+						"args":     fmt.Sprintf("%v", args)})
+				continue
 			}
 			// handle the client response
 			err = store.Touch(deviceId)
-			switch cs {
-			case "t":
-				err = self.updatePage(deviceId, c, margs, true)
-			case "q":
-				// User has quit, nuke what we know.
-				if self.config.GetFlag("cmd.q.allow") {
-					err = store.DeleteDevice(deviceId)
-				}
-			default:
-				err = self.updatePage(deviceId, c, margs, false)
+			replies = append(replies, c)
+			// Only a reply to an inline command carries its id; other
+			// reports (e.g. tracking) mustn't drop a queued command.
+			if cmdId, ok := margs["id"].(string); ok && self.inlineCommands(devRec) {
+				store.DeletePending(deviceId, cmdId)
 			}
-			if err != nil {
+			if err = self.handleReply(devRec, c, margs); err != nil {
 				// Log the error
 				self.logger.Error(self.logCat, "Error handling command",
 					util.Fields{"error": err.Error(),
@@ -1371,6 +1620,8 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 						"deviceId": deviceId,
 						"userId":   devRec.User,
 						"args":     fmt.Sprintf("%v", args)})
+				self.audit(self.sourceAddr(req), "", devRec, AUDIT_CMD,
+					replyType{"reply": replies}, "Server Error")
 				http.Error(resp,
 					"\"Server Error\"",
 					http.StatusServiceUnavailable)
@@ -1390,6 +1641,21 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 				"userId":   devRec.User})
 		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
 	}
+	if cmd != "" {
+		self.emit(devRec, EVENT_COMMAND_DELIVERED, replyType{"cmd": ctype})
+	}
+	if len(replies) > 0 || cmd != "" {
+		args := replyType{}
+		if len(replies) > 0 {
+			args["reply"] = replies
+		}
+		sent := make(replyType)
+		if json.Unmarshal([]byte(cmd), &sent) == nil && len(sent) > 0 {
+			args["sent"] = maskCommands(sent)
+		}
+		self.audit(self.sourceAddr(req), "", devRec, AUDIT_CMD, args,
+			auditResult(err))
+	}
 	if output == nil || len(output) < 2 {
 		output = []byte("{}")
 	}
@@ -1398,17 +1664,6 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 		"", devRec.Secret)
 	resp.Header().Add("Authorization", authHeader)
 	self.metrics.Increment("cmd.send." + ctype)
-	if ctype == "e" {
-		self.logger.Debug(self.logCat,
-			"Deleting device",
-			util.Fields{"deviceId": devRec.ID})
-		if err = store.DeleteDevice(devRec.ID); err != nil {
-			self.logger.Warn(self.logCat, "Could not delete device",
-				util.Fields{"error": err.Error(),
-					"deviceId": devRec.ID,
-					"userId":   devRec.User})
-		}
-	}
 	if self.config.GetFlag("debug.show_output") {
 		self.logger.Debug(self.logCat,
 			">>>output",
@@ -1417,24 +1672,63 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 	resp.Write(output)
 }
 
-// Queue the command from the Web Front End for the device.
-func (self *Handler) Queue(devRec *storage.Device, cmd string, args, rep *replyType) (status int, err error) {
-	var v interface{}
-	var vs string
-	var ok bool
+// Queue the command from the Web Front End for the device, on behalf of
+// userId. source is where the request came from, for the audit log.
+func (self *Handler) Queue(devRec *storage.Device, userId, source, cmd string, args, rep *replyType) (status int, err error) {
+	return self.queue(devRec, userId, source, cmd, args, rep, false)
+}
+
+// Queue the command. Scheduled commands are fired when they're due, and
+// aren't delayed again (or checked against the user's role again).
+func (self *Handler) queue(devRec *storage.Device, userId, source, cmd string, args, rep *replyType, fired bool) (status int, err error) {
 	status = http.StatusOK
-	store := self.store
+	defer func() {
+		result := auditResult(err)
+		if err == ErrDeviceDeleted {
+			// The delete is audited on its own.
+			result = AUDIT_OK
+		} else if err == nil && (*rep)["error"] != nil && (*rep)["cmd"] == cmd {
+			result = "not accepted"
+		}
+		self.audit(source, userId, devRec, AUDIT_QUEUE,
+			replyType{cmd: *args}, result)
+	}()
 
 	self.logCat = "handler:Queue"
-	// sanitize values.
-	lcmd := strings.ToLower(cmd)
-	c := string(cmd[0])
+	if cmd == "" {
+		return http.StatusBadRequest, errors.New("\"Invalid Command\"")
+	}
 	self.logger.Debug(self.logCat, "Processing UI Command",
 		util.Fields{"cmd": cmd})
-	if !strings.Contains(devRec.Accepts, c) {
+	command, ok := getCommand(cmd)
+	if !ok || command.DeviceOnly {
+		self.logger.Warn(self.logCat, "Invalid Command",
+			util.Fields{"cmd": string(cmd),
+				"deviceId": devRec.ID,
+				"userId":   devRec.User,
+				"args":     fmt.Sprintf("%v", *args)})
+		return http.StatusBadRequest, errors.New("\"Invalid Command\"")
+	}
+	// Checked again when a scheduled command fires, in case the user
+	// has lost access since.
+	role, err := self.deviceRole(devRec, userId)
+	if err != nil {
+		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
+	}
+	if !roleAllows(role, command.Role) {
+		self.logger.Warn(self.logCat, "Role not allowed command",
+			util.Fields{"cmd": command.Name,
+				"deviceId": devRec.ID,
+				"userId":   userId,
+				"role":     role})
+		self.metrics.Increment("access.denied")
+		return http.StatusForbidden, errors.New("\"Forbidden\"")
+	}
+	c := command.Name
+	if !strings.Contains(devRec.Accepts, command.Capability) {
 		// skip unacceptable command
 		self.logger.Warn(self.logCat, "Agent does not accept command",
-			util.Fields{"unacceptable": c,
+			util.Fields{"unacceptable": command.Capability,
 				"acceptable": devRec.Accepts,
 				"deviceId":   devRec.ID,
 				"userId":     devRec.User})
@@ -1442,74 +1736,66 @@ func (self *Handler) Queue(devRec *storage.Device, cmd string, args, rep *replyT
 		(*rep)["cmd"] = cmd
 		return
 	}
-	rargs := *args
-	switch c {
-	case "l":
-		if v, ok = rargs["c"]; ok {
-			max, err := strconv.ParseInt(self.config.Get("cmd.c.max", "9999"),
-				10, 64)
-			if err != nil {
-				max = 9999
-			}
-			switch v.(type) {
-			case string:
-				vs = v.(string)
-			case int64:
-			case float64:
-				vs = strconv.FormatInt(int64(v.(int64)), 10)
-			}
-			// make sure that the lock code is a valid four digit string.
-			// otherwise we may lock users out of their phones.
-			rargs["c"] = fmt.Sprintf("%04d", self.rangeCheck(
-				strings.Map(digitsOnly, vs[:minInt(4, len(vs))]),
-				0, max))
-		}
-		if v, ok = rargs["m"]; ok {
-			vs = v.(string)
-			if self.config.GetFlag("ascii_message_only") {
-				vs = strings.Map(asciiOnly,
-					string(vs))
-			}
-			vr := []rune(vs)
-			trimmed := vr[:minInt(100,
-				len(vr))]
-			rargs["m"] = string(trimmed)
-		}
-	case "r", "t":
-		if v, ok = rargs["d"]; ok {
-			max, err := strconv.ParseInt(
-				self.config.Get("cmd."+c+".max",
-					"10500"), 10, 64)
-			if err != nil {
-				max = 10500
-			}
-			switch v.(type) {
-			case string:
-				vs = v.(string)
-			case float64:
-				vs = strconv.FormatFloat(v.(float64), 'f', 0, 64)
-			default:
-				vs = fmt.Sprintf("%s", v)
-			}
-			rargs["d"] = self.rangeCheck(
-				strings.Map(digitsOnly, vs),
-				0,
-				max)
+	when, err := scheduleTime(*args, time.Now(),
+		getDuration(self.config, "schedule.max_delay", "720h"))
+	if err != nil {
+		return http.StatusBadRequest, errors.New("\"Invalid Schedule\"")
+	}
+	// Give the user a chance to change their mind.
+	if command.GraceKey != "" && !fired {
+		grace := getDuration(self.config, command.GraceKey, "0")
+		if at := time.Now().Add(grace).UTC().Unix(); grace > 0 && at > when {
+			when = at
 		}
-	case "e":
-		rargs = replyType{}
-		// Delete the device
-		return http.StatusOK, ErrDeviceDeleted
-
-	default:
-		self.logger.Warn(self.logCat, "Invalid Command",
-			util.Fields{"cmd": string(cmd),
+	}
+	// sanitize values.
+	rargs, err := self.sanitizeArgs(command, devRec, *args)
+	if err != nil {
+		self.logger.Warn(self.logCat, "Invalid command argument",
+			util.Fields{"error": err.Error(),
 				"deviceId": devRec.ID,
-				"userId":   devRec.User,
-				"args":     fmt.Sprintf("%v", rargs)})
-		return http.StatusBadRequest, errors.New("\"Invalid Command\"")
+				"userId":   devRec.User})
+		return http.StatusBadRequest, err
+	}
+	if command.Destructive {
+		self.logger.Info(self.logCat, "Destructive command requested",
+			util.Fields{"cmd": c,
+				"deviceId": devRec.ID,
+				"userId":   devRec.User})
 	}
-	fixed, err := json.Marshal(storage.Unstructured{c: rargs})
+	if when > 0 {
+		return self.scheduleCommand(devRec, userId, command, rargs, when, rep)
+	}
+	if command.OnQueue != nil {
+		if rargs, err = command.OnQueue(self, devRec, userId, rargs); err != nil {
+			if err == ErrDeviceDeleted {
+				return http.StatusOK, err
+			}
+			self.logger.Error(self.logCat, "Error preparing command",
+				util.Fields{"error": err.Error(),
+					"cmd":      c,
+					"deviceId": devRec.ID,
+					"userId":   devRec.User})
+			return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
+		}
+	}
+	// The command is always stored: a push service only holds a push
+	// for push.ttl, so a device that's offline for longer would never
+	// see it. Web Push devices can also get the command in the push
+	// itself, which saves them a round trip; their reply echoes the
+	// command's id to drop the stored copy (see inlineCommands).
+	inline := self.inlineCommands(devRec)
+	sent, cmdId := rargs, ""
+	if inline {
+		ib := make([]byte, 8)
+		rand.Read(ib)
+		cmdId = hex.EncodeToString(ib)
+		sent = replyType{"id": cmdId}
+		for k, v := range rargs {
+			sent[k] = v
+		}
+	}
+	fixed, err := json.Marshal(storage.Unstructured{c: sent})
 	if err != nil {
 		// Log the error
 		self.logger.Error(self.logCat, "Error handling command",
@@ -1521,56 +1807,115 @@ func (self *Handler) Queue(devRec *storage.Device, cmd string, args, rep *replyT
 		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
 	}
 
-	err = store.StoreCommand(devRec.ID, string(fixed), lcmd)
-	if err != nil {
-		// Log the error
+	if err = self.queueCommand(devRec, string(fixed), c, cmdId, !inline); err != nil {
+		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
+	}
+	self.metrics.Increment("cmd.store." + c)
+	if inline {
+		rec := *devRec
+		if err = self.pusher.Push(&rec, fixed, func(err error) {
+			// Wake it to fetch the command instead, unless it's gone.
+			if !pushGone(err) {
+				self.pusher.Push(&rec, nil, nil)
+			}
+		}); err != nil {
+			// The device still gets the command when it next checks in.
+			self.logger.Warn(self.logCat, "Could not queue inline command",
+				util.Fields{"error": err.Error(),
+					"cmd":      c,
+					"deviceId": devRec.ID})
+			err = nil
+		} else {
+			self.metrics.Increment("cmd.inline." + c)
+		}
+	}
+	self.queued(devRec, userId, command, rargs)
+	return
+}
+
+// Are commands for the device sent in its pushes? If so, a device's
+// reply carrying the command's id acknowledges it, and drops the
+// stored copy.
+func (self *Handler) inlineCommands(devRec *storage.Device) bool {
+	return self.config.GetFlag("push.inline_commands") && self.pushers.CanCarry(devRec)
+}
+
+// Tell the owner's webhooks, and the owner if it's a command they want
+// to hear about, that the command is on its way to the device.
+func (self *Handler) queued(devRec *storage.Device, userId string, command *Command, args replyType) {
+	self.emit(devRec, EVENT_COMMAND_QUEUED,
+		replyType{"cmd": command.Name, "args": maskArgs(command.Name, args)})
+	if command.SentNotice == "" {
+		return
+	}
+	data := replyType{}
+	// Say who asked, if it wasn't the owner. (Scheduled commands are
+	// queued as the owner when they come due.)
+	if userId != devRec.User {
+		if email, err := self.store.GetUserEmail(userId); err == nil && email != "" {
+			data["by"] = email
+		}
+	}
+	self.notify(devRec, command.SentNotice, data)
+}
+
+// Store the command for the device's next check in, and (optionally)
+// wake it. The command will wait for the device even if the push fails.
+func (self *Handler) queueCommand(devRec *storage.Device, cmd, ctype, cmdId string, wake bool) (err error) {
+	if err = self.store.StoreCommand(devRec.ID, cmd, ctype, cmdId); err != nil {
 		self.logger.Error(self.logCat, "Error storing command",
 			util.Fields{"error": err.Error(),
-				"cmd":      string(cmd),
+				"cmd":      cmd,
 				"deviceId": devRec.ID,
-				"userId":   devRec.User,
-				"args":     fmt.Sprintf("%v", args)})
-		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
+				"userId":   devRec.User})
+		return err
+	}
+	if !wake {
+		return nil
 	}
 	// trigger the push
-	self.metrics.Increment("cmd.store." + c)
 	self.metrics.Increment("push.send")
 	self.logger.Debug(self.logCat,
 		"Sending Push",
 		util.Fields{"deviceId": devRec.ID,
 			"userId": devRec.User,
-			"cmd":    c})
-	err = SendPush(devRec, self.config)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not send Push",
+			"cmd":    ctype})
+	if err := self.pusher.Push(devRec, nil, nil); err != nil {
+		self.logger.Warn(self.logCat, "Could not queue Push",
 			util.Fields{"error": err.Error(),
 				"pushUrl":  devRec.PushUrl,
 				"deviceId": devRec.ID,
 				"userId":   devRec.User})
-		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
 	}
-	return
+	return nil
 }
 
-// Accept a command to queue from the REST interface
-func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
-	/* Queue commands for the device.
-	 */
-	var err error
-	var lbody int
-	store := self.store
-	rep := make(replyType)
-
+// Return the VAPID public key that devices should use as the
+// applicationServerKey when subscribing.
+func (self *Handler) PushKey(resp http.ResponseWriter, req *http.Request) {
+	key := self.webPush.PublicKey()
+	if key == "" {
+		http.Error(resp, "Not Found", http.StatusNotFound)
+		return
+	}
+	output, _ := json.Marshal(replyType{"publicKey": key})
 	resp.Header().Set("Content-Type", "application/json")
-	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
-	self.logCat = "handler:Queue"
+	resp.Write(output)
+}
 
-	session, err := sessionStore.Get(req, SESSION_NAME)
+// Get the signed in user's device from the request URL. Checks the
+// session and CSRF token, and that the user has some role for the
+// device; callers check the role is enough. On failure, the error
+// response is written and nil returned.
+func (self *Handler) userDevice(resp http.ResponseWriter, req *http.Request) (devRec *storage.Device, session *sessions.Session, user deviceUser) {
+	var err error
+
+	session, err = sessionStore.Get(req, SESSION_NAME)
 	if err != nil {
 		self.logger.Error(self.logCat, "Unauthorized access to Cmd",
 			util.Fields{"error": err.Error()})
 		http.Error(resp, "Unauthorized", 401)
-		return
+		return nil, nil, user
 	}
 	if !self.checkToken(session, req) {
 		var stoken string
@@ -1583,14 +1928,14 @@ func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
 			util.Fields{"url": req.URL.String(),
 				"expecting": stoken})
 		http.Error(resp, "Unauthorized", 401)
-		return
+		return nil, nil, user
 	}
 
 	deviceId := getDevFromUrl(req.URL)
 	if deviceId == "" {
 		self.logger.Error(self.logCat, "Invalid call (No device id)", nil)
 		http.Error(resp, "Unauthorized", 401)
-		return
+		return nil, nil, user
 	}
 	userId, _, err := self.getUser(resp, req)
 	if userId == "" || err != nil {
@@ -1599,10 +1944,10 @@ func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
 		session.Options.MaxAge = -1
 		session.Save(req, resp)
 		http.Error(resp, "Unauthorized", 401)
-		return
+		return nil, nil, user
 	}
 
-	devRec, err := store.GetDeviceInfo(deviceId)
+	devRec, err = self.store.GetDeviceInfo(deviceId)
 	// fmt.Printf("### devices: %+v\n", devRec)
 	if err != nil || devRec == nil {
 		fields := util.Fields{"deviceId": deviceId}
@@ -1617,9 +1962,14 @@ func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
 		session.Options.MaxAge = -1
 		session.Save(req, resp)
 		http.Error(resp, "Unauthorized", 401)
-		return
+		return nil, nil, user
+	}
+	user.ID = userId
+	if user.Role, err = self.deviceRole(devRec, userId); err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return nil, nil, user
 	}
-	if devRec.User != userId {
+	if user.Role == "" {
 		self.logger.Error(self.logCat, "Unauthorized device",
 			util.Fields{"devrec": devRec.User,
 				"userId": userId})
@@ -1627,33 +1977,28 @@ func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
 		session.Options.MaxAge = -1
 		session.Save(req, resp)
 		http.Error(resp, "Unauthorized", 401)
-		return
+		return nil, nil, user
 	}
+	return devRec, session, user
+}
+
+// Accept a command to queue from the REST interface
+func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
+	/* Queue commands for the device.
+	 */
+	var err error
+	var lbody int
+	rep := make(replyType)
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+	self.logCat = "handler:Queue"
+
+	devRec, session, user := self.userDevice(resp, req)
 	if devRec == nil {
-		self.logger.Error(self.logCat,
-			"Queue:User requested unknown device",
-			util.Fields{
-				"deviceId": deviceId,
-				"userId":   userId})
-		self.clearSession(session)
-		session.Options.MaxAge = -1
-		session.Save(req, resp)
-		http.Error(resp, "Unauthorized", 401)
-		return
-	}
-	if err != nil {
-		switch err {
-		default:
-			self.logger.Error(self.logCat,
-				"Cmd:Unhandled Error",
-				util.Fields{
-					"error":    err.Error(),
-					"deviceId": deviceId,
-					"userId":   userId})
-			http.Error(resp, "Unauthorized", 401)
-		}
 		return
 	}
+	source := self.sourceAddr(req)
 
 	//decode the body
 	var body = make([]byte, req.ContentLength)
@@ -1683,14 +2028,29 @@ func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
 		}
 
 		for cmd, args := range reply {
-			rargs := replyType(args.(map[string]interface{}))
-			status, err := self.Queue(devRec, cmd, &rargs, &rep)
+			margs, ok := args.(map[string]interface{})
+			if !ok {
+				self.logger.Warn(self.logCat, "Invalid command arguments",
+					util.Fields{"cmd": cmd,
+						"args": fmt.Sprintf("%v", args)})
+				http.Error(resp, "\"Invalid Command\"", http.StatusBadRequest)
+				return
+			}
+			rargs := replyType(margs)
+			if challenge := self.checkReauth(cmd, rargs,
+				sessionAuthTime(session)); challenge != nil {
+				output, _ := json.Marshal(challenge)
+				http.Error(resp, string(output), http.StatusForbidden)
+				return
+			}
+			status, err := self.Queue(devRec, user.ID, source, cmd, &rargs, &rep)
 			switch err {
 			case nil:
 				break
 			case ErrDeviceDeleted:
 				// remove the deviceId
-				if err = store.DeleteDevice(devRec.ID); err != nil {
+				if err = self.deleteDevice(source, user.ID, devRec,
+					"unreachable"); err != nil {
 					self.logger.Warn(self.logCat,
 						"Could not remove device",
 						util.Fields{"deviceId": devRec.ID,
@@ -1724,9 +2084,13 @@ func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
 func (self *Handler) UserDevices(resp http.ResponseWriter, req *http.Request) {
 	self.logCat = "handler:userDevices"
 	type devList struct {
-		ID   string
-		Name string
-		URL  string
+		ID          string
+		Name        string
+		URL         string
+		Unreachable bool // device must reopen the app to re-register
+		Lost        bool // device is in lost mode
+		Tracking    bool   // device has an active tracking session
+		Role        string // the user's role for the device
 	}
 
 	var data struct {
@@ -1756,6 +2120,19 @@ func (self *Handler) UserDevices(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "Server Error", 500)
 		return
 	}
+	for i := range deviceList {
+		deviceList[i].Role = ROLE_OWNER
+	}
+	// and those other people have shared with them
+	shared, err := store.GetSharedDevices(data.UserId)
+	if err != nil {
+		self.logger.Error(self.logCat,
+			"Could not get shared devices for user",
+			util.Fields{"error": err.Error()})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	deviceList = append(deviceList, shared...)
 
 	var reply []devList
 	verRoot := strings.SplitN(self.config.Get("VERSION", "0"), ".", 2)[0]
@@ -1765,8 +2142,12 @@ func (self *Handler) UserDevices(resp http.ResponseWriter, req *http.Request) {
 			continue
 		}
 		reply = append(reply, devList{
-			ID:   d.ID,
-			Name: d.Name,
+			ID:          d.ID,
+			Name:        d.Name,
+			Unreachable: d.Unreachable,
+			Lost:        d.Lost,
+			Tracking:    d.Tracking,
+			Role:        d.Role,
 			URL: fmt.Sprintf("%s://%s/%s/ws/%s/%s",
 				self.config.Get("ws.proto",
 					self.config.Get("ws_proto", "wss")),
@@ -1815,6 +2196,8 @@ func (self *Handler) Index(resp http.ResponseWriter, req *http.Request) {
 			util.Fields{"error": err.Error()})
 	}
 	// fmt.Printf("### Index:: session %+v\n", session)
+	signedIn := session.Values[SESSION_USERID] != nil ||
+		session.Values[SESSION_EMAIL] != nil
 	sessionInfo, err := self.getSessionInfo(resp, req, session)
 	initData, err := self.initData(resp, req, sessionInfo)
 	if err != nil {
@@ -1833,10 +2216,17 @@ func (self *Handler) Index(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "Server error", 500)
 	}
 	if sessionInfo != nil {
+		self.setUserEmail(sessionInfo.UserId, sessionInfo.Email)
 		session.Values[SESSION_USERID] = sessionInfo.UserId
 		session.Values[SESSION_EMAIL] = sessionInfo.Email
 		session.Values[SESSION_DEVICEID] = sessionInfo.DeviceId
 		session.Values[SESSION_CSRFTOKEN] = initData.Token
+		if !signedIn {
+			// The user just signed in with an assertion.
+			session.Values[SESSION_AUTHTIME] = time.Now().UTC().Unix()
+			self.audit(self.sourceAddr(req), sessionInfo.UserId, nil,
+				AUDIT_SIGNIN, nil, AUDIT_OK)
+		}
 		if err = session.Save(req, resp); err != nil {
 			self.logger.Error(self.logCat,
 				"Could not save session",
@@ -1937,11 +2327,35 @@ func (self *Handler) State(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, err.Error(), 401)
 		return
 	}
+	if sessionInfo == nil {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
 	devInfo, err := store.GetDeviceInfo(sessionInfo.DeviceId)
 	if err != nil {
 		http.Error(resp, err.Error(), 500)
 		return
 	}
+	role, err := self.deviceRole(devInfo, sessionInfo.UserId)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	if role == "" {
+		self.logger.Error(self.logCat, "Unauthorized device",
+			util.Fields{"deviceId": devInfo.ID,
+				"userId": sessionInfo.UserId})
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	if devInfo.User != sessionInfo.UserId {
+		// Only the device's owner sees how to reach it.
+		devInfo.Secret = ""
+		devInfo.PushUrl = ""
+		devInfo.PushKey = ""
+		devInfo.PushAuth = ""
+		devInfo.AccessToken = ""
+	}
 	// add the user session cookie
 	if sessionInfo != nil {
 		session.Values[SESSION_USERID] = sessionInfo.UserId
@@ -1953,8 +2367,41 @@ func (self *Handler) State(resp http.ResponseWriter, req *http.Request) {
 	if self.config.GetFlag("ek.ignore_passcode_state") {
 		devInfo.HasPasscode = false
 	}
+	if devInfo.Best != nil {
+		devInfo.Best.Stale = self.staleFix(devInfo.Best, time.Now())
+	}
+	status, err := store.GetDeviceStatus(devInfo.ID)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	scheduled, err := store.GetScheduled(devInfo.ID)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	tracking, err := store.GetTracking(devInfo.ID)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	geofences, err := store.GetGeofences(devInfo.ID)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
 	// display the device info...
-	output, err := json.Marshal(devInfo)
+	output, err := json.Marshal(struct {
+		*storage.Device
+		Status     *storage.DeviceStatus
+		LowBattery bool
+		Scheduled  []storage.ScheduledCommand `json:",omitempty"`
+		Tracking   *storage.TrackingSession   `json:",omitempty"`
+		Geofences  []storage.Geofence         `json:",omitempty"`
+		Near       *Place                     `json:",omitempty"`
+		Role       string                     // the signed in user's role
+	}{devInfo, status, self.lowBattery(status), scheduled, tracking,
+		geofences, self.placeNear(devInfo.Best), role})
 	if err == nil {
 		if self.config.GetFlag("debug.show_output") {
 			self.logger.Debug(self.logCat,
@@ -2035,6 +2482,8 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 	session, _ := sessionStore.Get(req, SESSION_NAME)
 	loginSession, _ := sessionStore.Get(req, SESSION_LOGIN)
 
+	// Set if the user was asked to sign in again.
+	_, reauth := loginSession.Values["max_age"].(int64)
 	if ni, ok := loginSession.Values["nonce"]; !ok {
 		// No nonce, no service
 		self.logger.Error(self.logCat, "Missing nonce", nil)
@@ -2056,7 +2505,10 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 	loginSession.Save(req, resp)
 
 	// fmt.Printf("### oauth session: %+v, err: %s\n", session, err)
-	if _, ok := session.Values[SESSION_TOKEN]; !ok {
+	signedIn := false
+	// A code means the user has just signed in (possibly again, to
+	// confirm a command), so always exchange it.
+	if _, ok := session.Values[SESSION_TOKEN]; !ok || req.FormValue("code") != "" {
 		// get the "state", and "code"
 		state := req.FormValue("state")
 		code := req.FormValue("code")
@@ -2079,7 +2531,7 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 
 		// fetch the token:
 		// fmt.Printf("### Getting access token\n")
-		token, err := self.getAccessToken(code)
+		token, authTime, err := self.getAccessToken(code)
 		if err != nil {
 			self.logger.Error(self.logCat, "Could not get access token",
 				util.Fields{"error": err.Error()})
@@ -2088,7 +2540,26 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 		}
 		// fmt.Printf("### store user token %s\n", token)
 		delete(session.Values, SESSION_EMAIL)
+		delete(session.Values, SESSION_AUTHTIME)
 		session.Values[SESSION_TOKEN] = token
+		// A silent sign in doesn't mean the user entered their
+		// password, so only a step-up login, as of when FxA says the
+		// password was entered, counts as a recent sign in.
+		if reauth {
+			now := time.Now().UTC().Unix()
+			if authTime > now {
+				authTime = now
+			}
+			if authTime > 0 && time.Since(time.Unix(authTime, 0)) <=
+				getDuration(self.config, "auth.reauth_age", "10m") {
+				session.Values[SESSION_AUTHTIME] = authTime
+			} else {
+				self.logger.Warn(self.logCat, "Stale step-up sign in",
+					util.Fields{"auth_time": strconv.FormatInt(authTime, 10)})
+				self.metrics.Increment("page.signin.reauth.stale")
+			}
+		}
+		signedIn = true
 	}
 	// fmt.Printf("### Getting user email from access token\n")
 	val, err := self.getUserData(session.Values[SESSION_TOKEN].(string), "email")
@@ -2108,6 +2579,10 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 	session.Values[SESSION_USERID] = val
+	if signedIn {
+		self.audit(self.sourceAddr(req), val, nil, AUDIT_SIGNIN, nil,
+			AUDIT_OK)
+	}
 	fmt.Printf("### Saving session %+v\n", session)
 	// awesome. So saving the session apparently doesn't mean it's
 	// readable by subsequent session get calls.
@@ -2117,8 +2592,46 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 	return
 }
 
+// Note an open UI socket. Returns false if the handler is closed.
+func (self *Handler) addSocket(ws *websocket.Conn) bool {
+	self.sockMu.Lock()
+	defer self.sockMu.Unlock()
+	if self.sockets == nil {
+		return false
+	}
+	self.sockets[ws] = true
+	self.sockWg.Add(1)
+	return true
+}
+
+func (self *Handler) removeSocket(ws *websocket.Conn) {
+	self.sockMu.Lock()
+	if self.sockets != nil {
+		delete(self.sockets, ws)
+	}
+	self.sockMu.Unlock()
+	self.sockWg.Done()
+}
+
+// Close the UI sockets, and wait for their handlers to finish.
+func (self *Handler) closeSockets() {
+	self.sockMu.Lock()
+	sockets := self.sockets
+	self.sockets = nil
+	self.sockMu.Unlock()
+	for ws := range sockets {
+		ws.Close()
+	}
+	self.sockWg.Wait()
+}
+
 // Handle Websocket processing.
 func (self *Handler) WSSocketHandler(ws *websocket.Conn) {
+	if !self.addSocket(ws) {
+		ws.Close()
+		return
+	}
+	defer self.removeSocket(ws)
 	self.logCat = "handler:Socket"
 	store := self.store
 	session, _ := sessionStore.Get(ws.Request(), SESSION_NAME)
@@ -2143,24 +2656,35 @@ func (self *Handler) WSSocketHandler(ws *websocket.Conn) {
 		socketError(ws, "Invalid Device")
 		return
 	}
+	// The user may have lost access since they listed their devices.
+	if role, err := self.deviceRole(devRec, userid.(string)); err != nil || role == "" {
+		self.logger.Error(self.logCat, "Unauthorized access.",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": userid.(string)})
+		socketError(ws, "Unauthorized")
+		return
+	}
 
 	sock := &WWS{
-		Socket:  ws,
-		Handler: self,
-		Device:  devRec,
-		Logger:  self.logger,
-		Born:    time.Now(),
-		Quit:    false}
+		Socket:   ws,
+		Handler:  self,
+		Device:   devRec,
+		Logger:   self.logger,
+		Born:     time.Now(),
+		UserId:   userid.(string),
+		AuthTime: sessionAuthTime(session),
+		Source:   self.sourceAddr(ws.Request()),
+		Quit:     false}
 
 	defer func(logger *util.HekaLogger) {
 		if r := recover(); r != nil {
 			debug.PrintStack()
 			if logger != nil {
 				logger.Error(self.logCat, "Uknown Error",
-					util.Fields{"error": r.(error).Error()})
+					util.Fields{"error": fmt.Sprintf("%v", r)})
 			} else {
 				socketError(ws, "Unknown Error")
-				log.Printf("Socket Unknown Error: %s\n", r.(error).Error())
+				log.Printf("Socket Unknown Error: %v\n", r)
 			}
 		}
 	}(sock.Logger)
@@ -2184,6 +2708,7 @@ func (self *Handler) WSSocketHandler(ws *websocket.Conn) {
 		socketError(ws, "Too Many Connections")
 		return
 	}
+	self.trackingWatched(self.devId, store)
 	defer func(self *Handler, sock *WWS, instance string) {
 		self.metrics.Decrement("page.socket")
 		self.metrics.Timer("page.socket", int64(time.Since(sock.Born).Seconds()))
@@ -2195,7 +2720,7 @@ func (self *Handler) WSSocketHandler(ws *websocket.Conn) {
 					"deviceId": self.devId})
 		} else {
 			if stopTrack {
-				self.stopTracking(self.devId, store)
+				self.trackingUnwatched(self.devId, store)
 			}
 		}
 	}(self, sock, instance)
@@ -2251,13 +2776,29 @@ func (self *Handler) Signin(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	loginUrl := buffer.String()
+	// Step-up sign ins ask for the user to have logged in recently.
+	// The callback only counts the sign in as recent if this was set.
+	delete(session.Values, "max_age")
+	if maxAge, err := strconv.ParseInt(req.FormValue("max_age"), 10, 64); err == nil && maxAge >= 0 {
+		session.Values["max_age"] = maxAge
+		loginUrl += fmt.Sprintf("&max_age=%d", maxAge)
+		self.metrics.Increment("page.signin.reauth")
+	}
+
 	session.Save(req, resp)
-	http.Redirect(resp, req, buffer.String(), http.StatusFound)
+	http.Redirect(resp, req, loginUrl, http.StatusFound)
 	self.metrics.Increment("page.signin.attempt")
 	return
 }
 
 func (self *Handler) Signout(resp http.ResponseWriter, req *http.Request) {
+	if session, err := sessionStore.Get(req, SESSION_NAME); err == nil {
+		if userId, ok := session.Values[SESSION_USERID].(string); ok && userId != "" {
+			self.audit(self.sourceAddr(req), userId, nil, AUDIT_SIGNOUT,
+				nil, AUDIT_OK)
+		}
+	}
 	for _, name := range []string{SESSION_LOGIN, SESSION_NAME} {
 		session, _ := sessionStore.Get(req, name)
 		session.Options.MaxAge = -1
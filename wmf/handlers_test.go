@@ -0,0 +1,2257 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Base configuration for the handler tests. Uses the in-memory store,
+// so no database is required.
+const testConfig = `
+db.type=memory
+db.max_devices_for_user=10
+session.secret=TestSessionSecretTestSessionSecr
+auth.allow_insecure_cookie=true
+document_root=../static/app
+ws.proto=ws
+logger.filter=0
+VERSION=1.3
+`
+
+// A running handler, with stand-ins for the push and FxA servers.
+type testServer struct {
+	t        *testing.T
+	config   *util.MzConfig
+	handler  *Handler
+	server   *httptest.Server
+	push     *httptest.Server
+	verifier *httptest.Server
+	pushes   chan string
+}
+
+// Write the config (plus any "key=value" overrides) and read it back.
+func newTestConfig(t testing.TB, overrides ...string) *util.MzConfig {
+	file, err := ioutil.TempFile("", "fmd_test_config")
+	if err != nil {
+		t.Fatalf("Could not create config: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(testConfig + strings.Join(overrides, "\n") + "\n")
+	file.Close()
+	config, err := util.ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatalf("Could not read config: %s", err)
+	}
+	return config
+}
+
+// FxA verifier stand-in. Assertions of the form "valid.<uid>" are
+// accepted for <uid>@example.com, anything else is refused.
+func fakeVerifier(resp http.ResponseWriter, req *http.Request) {
+	args := make(map[string]string)
+	json.NewDecoder(req.Body).Decode(&args)
+	var reply replyType
+	if uid := strings.TrimPrefix(args["assertion"], "valid."); uid != args["assertion"] {
+		email := uid + "@example.com"
+		reply = replyType{"status": "okay",
+			"idpClaims": replyType{
+				"principal":         replyType{"email": email},
+				"fxa-verifiedEmail": email}}
+	} else {
+		reply = replyType{"status": "failure", "reason": "invalid assertion"}
+	}
+	json.NewEncoder(resp).Encode(reply)
+}
+
+func newTestServer(t *testing.T, overrides ...string) *testServer {
+	self := &testServer{t: t, pushes: make(chan string, 100)}
+
+	// Push endpoint stand-in. Records the device woken up.
+	self.push = httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if req.Method != "PUT" {
+				http.Error(resp, "Bad method", 405)
+				return
+			}
+			self.pushes <- strings.TrimPrefix(req.URL.Path, "/")
+		}))
+	self.verifier = httptest.NewServer(http.HandlerFunc(fakeVerifier))
+
+	self.config = newTestConfig(t, append([]string{
+		"fxa.verifier=" + self.verifier.URL}, overrides...)...)
+	logger := util.NewHekaLogger(self.config)
+	metrics := util.NewMetrics("test", logger, self.config)
+	if self.handler = NewHandler(self.config, logger, metrics); self.handler == nil {
+		t.Fatal("Could not create handler")
+	}
+	mux := http.NewServeMux()
+	self.handler.HandleRoutes(mux, "1")
+	self.server = httptest.NewServer(mux)
+	self.config.Override("ws.hostname",
+		strings.TrimPrefix(self.server.URL, "http://"))
+	return self
+}
+
+func (self *testServer) Close() {
+	// Stop the handler's sockets and workers too, so none outlive the
+	// test.
+	self.server.Close()
+	self.handler.Close()
+	self.push.Close()
+	self.verifier.Close()
+}
+
+func (self *testServer) url(path string) string {
+	return self.server.URL + path
+}
+
+func (self *testServer) pushUrl(devId string) string {
+	return self.push.URL + "/" + devId
+}
+
+// Wait for a push to the device.
+func (self *testServer) expectPush(devId string) {
+	select {
+	case got := <-self.pushes:
+		if got != devId {
+			self.t.Fatalf("Push sent to %s, expected %s", got, devId)
+		}
+	case <-time.After(5 * time.Second):
+		self.t.Fatalf("No push sent for %s", devId)
+	}
+}
+
+func (self *testServer) post(path string, body interface{}, header http.Header, cookies []*http.Cookie) (resp *http.Response, reply []byte) {
+	js, err := json.Marshal(body)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", self.url(path), bytes.NewReader(js))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		self.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply, _ = ioutil.ReadAll(resp.Body)
+	return resp, reply
+}
+
+// Register a device, returning its HAWK client.
+func (self *testServer) register(devId, assertion string) (hawk *HawkClient, status int) {
+	resp, body := self.post("/1/register/", replyType{
+		"assert":       assertion,
+		"pushurl":      self.pushUrl(devId),
+		"deviceid":     devId,
+		"has_passcode": "false",
+		"accepts":      []string{"l", "r", "t", "e"}}, nil, nil)
+	if resp.StatusCode != 200 {
+		return nil, resp.StatusCode
+	}
+	cred := make(map[string]string)
+	if err := json.Unmarshal(body, &cred); err != nil {
+		self.t.Fatalf("Bad registration reply %s: %s", body, err)
+	}
+	if cred["deviceid"] != devId || cred["secret"] == "" {
+		self.t.Fatalf("Unexpected registration reply %s", body)
+	}
+	return NewHawkClient(devId, cred["secret"], nil), resp.StatusCode
+}
+
+// Send a device reply to Cmd, returning the next command.
+func (self *testServer) cmd(hawk *HawkClient, reply interface{}) (command replyType, status int) {
+	var body []byte
+	if reply != nil {
+		body, _ = json.Marshal(reply)
+	}
+	raw, status, err := hawk.Do("POST", self.url("/1/cmd/"+hawk.Id), body)
+	if err != nil {
+		self.t.Fatalf("Cmd failed: %s", err)
+	}
+	if status != 200 {
+		return nil, status
+	}
+	command = make(replyType)
+	if err = json.Unmarshal(raw, &command); err != nil {
+		self.t.Fatalf("Bad Cmd reply %s: %s", raw, err)
+	}
+	return command, status
+}
+
+// A signed in web UI user.
+type testUser struct {
+	uid     string
+	cookies []*http.Cookie
+	token   string
+}
+
+var tokenMeta = regexp.MustCompile(`<meta name="token" content="([^"]+)">`)
+
+// Sign in through the index page, as the UI does.
+func (self *testServer) signin(uid string) *testUser {
+	resp, err := http.Get(self.url("/?assertion=valid." + uid))
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		self.t.Fatalf("Signin failed %d: %s", resp.StatusCode, page)
+	}
+	token := tokenMeta.FindSubmatch(page)
+	if token == nil || len(resp.Cookies()) == 0 {
+		self.t.Fatalf("Signin did not set a session")
+	}
+	return &testUser{uid: uid, cookies: resp.Cookies(), token: string(token[1])}
+}
+
+// Queue a command from the web UI.
+func (self *testServer) queue(user *testUser, devId string, cmd replyType) int {
+	header := http.Header{}
+	var cookies []*http.Cookie
+	if user != nil {
+		header.Set("X-CSRFTOKEN", user.token)
+		cookies = user.cookies
+	}
+	resp, _ := self.post("/1/queue/"+devId, cmd, header, cookies)
+	return resp.StatusCode
+}
+
+// List (GET) or cancel (DELETE) the device's scheduled commands.
+func (self *testServer) scheduled(user *testUser, method, path string) (status int, list []storage.ScheduledCommand) {
+	req, _ := http.NewRequest(method, self.url("/1/scheduled/"+path), nil)
+	req.Header.Set("X-CSRFToken", user.token)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply struct{ Scheduled []storage.ScheduledCommand }
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply.Scheduled
+}
+
+// Show (GET) or stop (DELETE) the device's tracking session.
+func (self *testServer) tracking(user *testUser, method, devId string) (status int, session *storage.TrackingSession) {
+	req, _ := http.NewRequest(method, self.url("/1/tracking/"+devId), nil)
+	req.Header.Set("X-CSRFToken", user.token)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply struct{ Tracking *storage.TrackingSession }
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply.Tracking
+}
+
+// Open the UI websocket for the device, using the URL from UserDevices.
+func (self *testServer) socket(user *testUser, devId string) *websocket.Conn {
+	req, _ := http.NewRequest("GET", self.url("/1/devices/"), nil)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var devices struct {
+		Devices []struct {
+			ID  string
+			URL string
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		self.t.Fatalf("Bad device list: %s", err)
+	}
+	var wsUrl string
+	for _, dev := range devices.Devices {
+		if dev.ID == devId {
+			wsUrl = dev.URL
+		}
+	}
+	if wsUrl == "" {
+		self.t.Fatalf("Device %s not listed for %s", devId, user.uid)
+	}
+	wsConfig, _ := websocket.NewConfig(wsUrl, self.server.URL)
+	for _, cookie := range user.cookies {
+		wsConfig.Header.Add("Cookie", cookie.String())
+	}
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		self.t.Fatalf("Could not open socket: %s", err)
+	}
+	// wait for the handler to start tracking the client.
+	for i := 0; i < 100; i++ {
+		muClient.RLock()
+		_, ok := Clients[devId]
+		muClient.RUnlock()
+		if ok {
+			return ws
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	self.t.Fatalf("Socket client was not added")
+	return nil
+}
+
+// Read socket updates until one for cmd arrives.
+func readUpdate(t *testing.T, ws *websocket.Conn, cmd string) (update map[string]interface{}) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatalf("No %s update on socket: %s", cmd, err)
+		}
+		update = make(map[string]interface{})
+		if err := json.Unmarshal([]byte(msg), &update); err != nil {
+			t.Fatalf("Bad socket update %s: %s", msg, err)
+		}
+		if c, ok := update["Cmd"].(map[string]interface{}); ok {
+			if _, ok := c[cmd]; ok {
+				return update
+			}
+		}
+	}
+}
+
+func newDevId() string {
+	id, _ := util.GenUUID4()
+	return id
+}
+
+func TestEndToEnd(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, status := srv.register(devId, "valid.alice")
+	if status != 200 {
+		t.Fatalf("Register failed: %d", status)
+	}
+	// Initial position report; nothing pending.
+	command, status := srv.cmd(dev, replyType{"t": replyType{"ok": true,
+		"la": 45.5, "lo": -122.6, "ti": time.Now().Unix(), "ha": false}})
+	if status != 200 || len(command) != 0 {
+		t.Fatalf("Unexpected Cmd reply %d %v", status, command)
+	}
+
+	user := srv.signin("alice")
+	ws := srv.socket(user, devId)
+	defer ws.Close()
+
+	// Ring
+	if status = srv.queue(user, devId, replyType{"r": replyType{"d": 10}}); status != 200 {
+		t.Fatalf("Queue failed: %d", status)
+	}
+	srv.expectPush(devId)
+	command, _ = srv.cmd(dev, nil)
+	if args, ok := command["r"].(map[string]interface{}); !ok || args["d"] != 10.0 {
+		t.Fatalf("Expected ring command, got %v", command)
+	}
+	srv.cmd(dev, replyType{"r": replyType{"ok": true}})
+	readUpdate(t, ws, "r")
+
+	// Track, and see the position arrive on the socket.
+	if status = srv.queue(user, devId, replyType{"t": replyType{"d": 60}}); status != 200 {
+		t.Fatalf("Queue failed: %d", status)
+	}
+	srv.expectPush(devId)
+	command, _ = srv.cmd(dev, nil)
+	if _, ok := command["t"]; !ok {
+		t.Fatalf("Expected track command, got %v", command)
+	}
+	command, _ = srv.cmd(dev, replyType{"t": replyType{"ok": true,
+		"la": 45.52, "lo": -122.68, "ac": 12.0, "ti": time.Now().Unix()}})
+	if len(command) != 0 {
+		t.Fatalf("Unexpected command %v", command)
+	}
+	update := readUpdate(t, ws, "t")
+	if update["Latitude"] != 45.52 || update["Longitude"] != -122.68 {
+		t.Fatalf("Unexpected location update %v", update)
+	}
+	if positions, _ := srv.handler.store.GetPositions(devId); len(positions) != 1 {
+		t.Fatalf("Position not stored: %v", positions)
+	}
+
+	// Each message gets one reply, even a bad one.
+	for _, test := range []struct{ msg, reply string }{
+		{`{"r":{"d":5}}`, "true"},
+		{`{"r":5}`, "false"},
+	} {
+		websocket.Message.Send(ws, test.msg)
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply string
+		if err := websocket.Message.Receive(ws, &reply); err != nil ||
+			reply != test.reply {
+			t.Errorf("%s: expected %s, got %q %v", test.msg, test.reply, reply, err)
+		}
+	}
+	ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var extra string
+	if err := websocket.Message.Receive(ws, &extra); err == nil {
+		t.Errorf("Unexpected reply %q", extra)
+	}
+}
+
+func TestDeviceStatus(t *testing.T) {
+	srv := newTestServer(t, "status.low_battery=5")
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.mona")
+	user := srv.signin("mona")
+	ws := srv.socket(user, devId)
+	defer ws.Close()
+
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 1.0, "lo": 2.0,
+		"ti": time.Now().Unix(), "battery": 4.0, "charging": false,
+		"network": "WiFi", "carrier": "Example\x00Mobile",
+		"app_version": "2.1"}})
+	update := readUpdate(t, ws, "t")
+	status, _ := update["Status"].(map[string]interface{})
+	if status["Battery"] != 4.0 || status["Network"] != "wifi" ||
+		status["Carrier"] != "ExampleMobile" || update["LowBattery"] != true {
+		t.Fatalf("Unexpected status update %v", update)
+	}
+
+	// Later reports only change what they include.
+	srv.cmd(dev, replyType{"r": replyType{"ok": true, "charging": true}})
+	update = readUpdate(t, ws, "r")
+	status, _ = update["Status"].(map[string]interface{})
+	if status["Battery"] != 4.0 || status["Charging"] != true ||
+		status["AppVersion"] != "2.1" || update["LowBattery"] != nil {
+		t.Errorf("Unexpected status update %v", update)
+	}
+	// Replies without status don't send one.
+	srv.cmd(dev, replyType{"l": replyType{"ok": true}})
+	if update = readUpdate(t, ws, "l"); update["Status"] != nil {
+		t.Errorf("Unexpected status %v", update)
+	}
+	stored, _ := srv.handler.store.GetDeviceStatus(devId)
+	if stored == nil || stored.Battery != 4 || !stored.Charging || stored.Time == 0 {
+		t.Errorf("Status not stored: %+v", stored)
+	}
+}
+
+func TestRegisterAuth(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	if _, status := srv.register(newDevId(), "invalid"); status != 401 {
+		t.Errorf("Bad assertion: expected 401, got %d", status)
+	}
+	if _, status := srv.register(newDevId(), ""); status != 401 {
+		t.Errorf("Empty assertion: expected 401, got %d", status)
+	}
+	// no assertion, no HAWK
+	resp, _ := srv.post("/1/register/", replyType{"deviceid": newDevId(),
+		"pushurl": srv.pushUrl("x")}, nil, nil)
+	if resp.StatusCode != 401 {
+		t.Errorf("No credentials: expected 401, got %d", resp.StatusCode)
+	}
+	resp, _ = srv.post("/1/register/", replyType{"assert": "valid.bob"},
+		nil, nil)
+	if resp.StatusCode != 400 {
+		t.Errorf("No pushurl: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestReRegister(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.carol")
+	rereg := func(secret string) int {
+		body, _ := json.Marshal(replyType{"deviceid": devId,
+			"pushurl": srv.pushUrl(devId)})
+		req, _ := http.NewRequest("POST", srv.url("/1/register/"),
+			bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		(&HawkClient{Id: devId, Secret: secret}).Sign(req, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := rereg("wrong"); status != 401 {
+		t.Errorf("Bad HAWK re-registration: expected 401, got %d", status)
+	}
+	if status := rereg(dev.Secret); status != 200 {
+		t.Errorf("HAWK re-registration: expected 200, got %d", status)
+	}
+	// The secret is replaced on every registration.
+	if _, status := srv.cmd(dev, nil); status != 401 {
+		t.Errorf("Old secret: expected 401, got %d", status)
+	}
+}
+
+func TestCmdHawk(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.dave")
+	if _, status := srv.cmd(dev, nil); status != 200 {
+		t.Fatalf("Valid HAWK: expected 200, got %d", status)
+	}
+	if _, status := srv.cmd(&HawkClient{Id: devId, Secret: "wrong",
+		Client: http.DefaultClient}, nil); status != 401 {
+		t.Errorf("Wrong secret: expected 401, got %d", status)
+	}
+	if _, status := srv.cmd(&HawkClient{Id: "0123456789abcdef",
+		Secret: dev.Secret, Client: http.DefaultClient}, nil); status != 401 {
+		t.Errorf("Unknown device: expected 401, got %d", status)
+	}
+
+	send := func(sign, body []byte, header bool) int {
+		req, _ := http.NewRequest("POST", srv.url("/1/cmd/"+devId),
+			bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if header {
+			dev.Sign(req, sign)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send(nil, nil, false); status != 401 {
+		t.Errorf("No HAWK header: expected 401, got %d", status)
+	}
+	if status := send([]byte(`{"r":{"ok":true}}`),
+		[]byte(`{"e":{"ok":true}}`), true); status != 401 {
+		t.Errorf("Tampered body: expected 401, got %d", status)
+	}
+}
+
+func TestQueueAuth(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	srv.register(devId, "valid.erin")
+	otherId := newDevId()
+	srv.register(otherId, "valid.frank")
+	user := srv.signin("erin")
+	ring := replyType{"r": replyType{"d": 5}}
+
+	if status := srv.queue(nil, devId, ring); status != 401 {
+		t.Errorf("No session: expected 401, got %d", status)
+	}
+	if status := srv.queue(&testUser{cookies: user.cookies, token: "bogus"},
+		devId, ring); status != 401 {
+		t.Errorf("Bad CSRF token: expected 401, got %d", status)
+	}
+	if status := srv.queue(user, otherId, ring); status != 401 {
+		t.Errorf("Other user's device: expected 401, got %d", status)
+	}
+	select {
+	case dev := <-srv.pushes:
+		t.Errorf("Unexpected push to %s", dev)
+	default:
+	}
+}
+
+func TestQueueErase(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.gina")
+	user := srv.signin("gina")
+	if status := srv.queue(user, devId, replyType{"e": replyType{}}); status != 200 {
+		t.Fatalf("Erase failed: %d", status)
+	}
+	srv.expectPush(devId)
+	// The device is kept until it confirms the erase.
+	if command, _ := srv.cmd(dev, nil); !reflect.DeepEqual(command,
+		replyType{"e": map[string]interface{}{}}) {
+		t.Fatalf("Unexpected command %v", command)
+	}
+	if devRec, _ := srv.handler.store.GetDeviceInfo(devId); devRec == nil ||
+		devRec.Erasing == 0 {
+		t.Fatalf("Erase not recorded: %+v", devRec)
+	}
+	if _, status := srv.cmd(dev, replyType{"e": replyType{"ok": false}}); status != 200 {
+		t.Fatalf("Failed erase reply: %d", status)
+	}
+	if _, status := srv.cmd(dev, replyType{"e": replyType{"ok": true}}); status != 200 {
+		t.Fatalf("Erase reply: %d", status)
+	}
+	if _, status := srv.cmd(dev, nil); status != 401 {
+		t.Errorf("Erased device: expected 401, got %d", status)
+	}
+}
+
+func TestEraseGrace(t *testing.T) {
+	notices := make(chan *WebhookEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			if req.Header.Get("X-FMD-Signature") != hmacSignature([]byte("s3cret"), body) {
+				t.Errorf("Bad notice signature")
+			}
+			notice := new(WebhookEvent)
+			json.Unmarshal(body, notice)
+			notices <- notice
+		}))
+	defer hook.Close()
+	srv := newTestServer(t, "cmd.e.grace=1h", "schedule.interval=10ms",
+		"webhook.url="+hook.URL, "webhook.secret=s3cret",
+		"webhook.events="+strings.Join(noticeEvents, ","))
+	defer srv.Close()
+	expectNotice := func(event, devId string) {
+		select {
+		case notice := <-notices:
+			if notice.Event != event || notice.DeviceId != devId {
+				t.Errorf("Unexpected notice %+v", notice)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s notice", event)
+		}
+	}
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.kate")
+	expectNotice(NOTICE_DEVICE_ADDED, devId)
+	user := srv.signin("kate")
+	resp, body := srv.post("/1/queue/"+devId, replyType{"e": replyType{}},
+		http.Header{"X-Csrftoken": {user.token}}, user.cookies)
+	var reply struct{ Scheduled []storage.ScheduledCommand }
+	if resp.StatusCode != 200 || json.Unmarshal(body, &reply) != nil ||
+		len(reply.Scheduled) != 1 ||
+		reply.Scheduled[0].Time < time.Now().Add(59*time.Minute).Unix() {
+		t.Fatalf("Erase not held %d: %s", resp.StatusCode, body)
+	}
+	expectNotice(NOTICE_ERASE_SCHEDULED, devId)
+	devRec, _ := srv.handler.store.GetDeviceInfo(devId)
+	if email, _ := srv.handler.store.GetUserEmail(devRec.User); email != "kate@example.com" {
+		t.Errorf("User email not recorded: %q", email)
+	}
+	if command, _ := srv.cmd(dev, nil); len(command) != 0 {
+		t.Fatalf("Erase sent during grace period: %v", command)
+	}
+	if status, list := srv.scheduled(user, "DELETE",
+		devId+"?id="+reply.Scheduled[0].ID); status != 200 || len(list) != 0 {
+		t.Fatalf("Erase not cancelled %d: %+v", status, list)
+	}
+
+	// A device that can't be reached is removed when the erase is due.
+	srv.handler.store.SetDeviceUnreachable(devId, devRec.PushUrl)
+	srv.handler.store.ScheduleCommand(storage.ScheduledCommand{
+		DeviceId: devId, Cmd: "e", Args: "{}", Time: time.Now().Unix() - 1})
+	expectNotice(NOTICE_ERASE_UNREACHABLE, devId)
+	for i := 0; i < 50; i++ {
+		if _, err := srv.handler.store.GetDeviceInfo(devId); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Unreachable device not removed")
+}
+
+func TestSocketEraseUnreachable(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	srv.register(devId, "valid.lars")
+	devRec, _ := srv.handler.store.GetDeviceInfo(devId)
+	srv.handler.store.SetDeviceUnreachable(devId, devRec.PushUrl)
+	user := srv.signin("lars")
+	ws := srv.socket(user, devId)
+	defer ws.Close()
+
+	// Nothing will collect the erase, so the device is removed.
+	websocket.Message.Send(ws, `{"e":{}}`)
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply string
+	if err := websocket.Message.Receive(ws, &reply); err != nil || reply != "true" {
+		t.Fatalf("Unexpected erase reply %q %v", reply, err)
+	}
+	if _, err := srv.handler.store.GetDeviceInfo(devId); err == nil {
+		t.Errorf("Unreachable device not removed")
+	}
+}
+
+func TestLostMode(t *testing.T) {
+	srv := newTestServer(t, "cmd.o.interval=60")
+	defer srv.Close()
+
+	devId := newDevId()
+	resp, body := srv.post("/1/register/", replyType{
+		"assert":   "valid.lena",
+		"pushurl":  srv.pushUrl(devId),
+		"deviceid": devId,
+		"accepts":  []string{"l", "t", "o"}}, nil, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Register failed %d: %s", resp.StatusCode, body)
+	}
+	cred := make(map[string]string)
+	json.Unmarshal(body, &cred)
+	dev := NewHawkClient(devId, cred["secret"], nil)
+	user := srv.signin("lena")
+
+	if status := srv.queue(user, devId, replyType{"o": replyType{
+		"c": "1234",
+		"m": "Please return me",
+		"p": "+1 (555) 123-4567<script>",
+		"e": "lena@example.com"}}); status != 200 {
+		t.Fatalf("Lost mode failed: %d", status)
+	}
+	srv.expectPush(devId)
+	command, _ := srv.cmd(dev, nil)
+	want := replyType{"o": map[string]interface{}{"c": "1234",
+		"m": "Please return me", "p": "+1 (555) 123-4567",
+		"e": "lena@example.com", "i": 60.0}}
+	if !reflect.DeepEqual(command, want) {
+		t.Errorf("Unexpected lost mode command %v", command)
+	}
+	devRec, _ := srv.handler.store.GetDeviceInfo(devId)
+	if devRec.Lost == nil || devRec.Lost.Phone != "+1 (555) 123-4567" ||
+		devRec.Lost.Since == 0 {
+		t.Fatalf("Lost mode not recorded: %+v", devRec.Lost)
+	}
+	// The device replying doesn't end lost mode.
+	srv.cmd(dev, replyType{"o": replyType{"ok": true, "la": 1.0,
+		"lo": 2.0, "ti": 1400000000}})
+	if devRec, _ = srv.handler.store.GetDeviceInfo(devId); devRec.Lost == nil {
+		t.Errorf("Lost mode cleared by the device")
+	}
+
+	if status := srv.queue(user, devId, replyType{"o": replyType{"off": true}}); status != 200 {
+		t.Fatalf("Clearing lost mode failed: %d", status)
+	}
+	srv.expectPush(devId)
+	if command, _ = srv.cmd(dev, nil); !reflect.DeepEqual(command,
+		replyType{"o": map[string]interface{}{"off": true}}) {
+		t.Errorf("Unexpected command %v", command)
+	}
+	if devRec, _ = srv.handler.store.GetDeviceInfo(devId); devRec.Lost != nil {
+		t.Errorf("Lost mode not cleared: %+v", devRec.Lost)
+	}
+
+	// Devices need to know about lost mode.
+	otherId := newDevId()
+	srv.register(otherId, "valid.lena")
+	resp, body = srv.post("/1/queue/"+otherId, replyType{"o": replyType{}},
+		http.Header{"X-Csrftoken": {user.token}}, user.cookies)
+	if reply := make(replyType); json.Unmarshal(body, &reply) != nil ||
+		reply["error"] != 422.0 {
+		t.Errorf("Lost mode sent to an unsupported device: %s", body)
+	}
+}
+
+func TestPasscodePolicy(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	resp, body := srv.post("/1/register/", replyType{
+		"assert":   "valid.maya",
+		"pushurl":  srv.pushUrl(devId),
+		"deviceid": devId,
+		"accepts":  []string{"l", "r"},
+		"passcode": replyType{"min": 4, "max": 8, "charset": "alnum"}}, nil, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Register failed %d: %s", resp.StatusCode, body)
+	}
+	user := srv.signin("maya")
+	header := http.Header{"X-Csrftoken": {user.token}}
+
+	if status := srv.queue(user, devId, replyType{"l": replyType{
+		"c": "abc123"}}); status != 200 {
+		t.Errorf("Lock with an allowed passcode failed: %d", status)
+	}
+	srv.expectPush(devId)
+	resp, body = srv.post("/1/queue/"+devId, replyType{"l": replyType{"c": "ab"}},
+		header, user.cookies)
+	reply := make(replyType)
+	if resp.StatusCode != 400 || json.Unmarshal(body, &reply) != nil ||
+		reply["arg"] != "c" || reply["reason"] != "The passcode must be 4 to 8 letters or digits" {
+		t.Errorf("Short passcode not refused %d: %s", resp.StatusCode, body)
+	}
+
+	// Devices that don't give a policy get four digits.
+	otherId := newDevId()
+	srv.register(otherId, "valid.maya")
+	if status := srv.queue(user, otherId, replyType{"l": replyType{
+		"c": "12345"}}); status != 400 {
+		t.Errorf("Five digit passcode accepted: %d", status)
+	}
+	if status := srv.queue(user, otherId, replyType{"l": replyType{
+		"c": "0042"}}); status != 200 {
+		t.Errorf("Four digit passcode refused: %d", status)
+	}
+	srv.expectPush(otherId)
+}
+
+func TestTrackingSessions(t *testing.T) {
+	srv := newTestServer(t, "track.idle=2s", "schedule.interval=50ms")
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.nina")
+	user := srv.signin("nina")
+	ws := srv.socket(user, devId)
+
+	if status := srv.queue(user, devId, replyType{"t": replyType{
+		"d": 60, "i": 30}}); status != 200 {
+		t.Fatalf("Track failed: %d", status)
+	}
+	srv.expectPush(devId)
+	if command, _ := srv.cmd(dev, nil); !reflect.DeepEqual(command,
+		replyType{"t": map[string]interface{}{"d": 60.0, "i": 30.0}}) {
+		t.Errorf("Unexpected track command %v", command)
+	}
+	devRec, _ := srv.handler.store.GetDeviceInfo(devId)
+	status, session := srv.tracking(user, "GET", devId)
+	if status != 200 || session == nil || session.StartedBy != devRec.User ||
+		session.Interval != 30 || session.Expires-session.Started != 60 ||
+		session.Unwatched != 0 {
+		t.Fatalf("Unexpected tracking session %d %+v", status, session)
+	}
+
+	// Closing the page only starts the idle timer...
+	ws.Close()
+	unwatched := func() int64 {
+		for i := 0; i < 100; i++ {
+			if session, _ = srv.handler.store.GetTracking(devId); session != nil &&
+				session.Unwatched > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return session.Unwatched
+	}
+	if unwatched() == 0 {
+		t.Fatalf("Tracking not marked unwatched")
+	}
+	// ...which coming back cancels.
+	ws = srv.socket(user, devId)
+	if session, _ = srv.handler.store.GetTracking(devId); session == nil ||
+		session.Unwatched != 0 {
+		t.Fatalf("Tracking not watched again: %+v", session)
+	}
+
+	if status, _ = srv.tracking(user, "DELETE", devId); status != 200 {
+		t.Fatalf("Stopping tracking failed: %d", status)
+	}
+	srv.expectPush(devId)
+	stop := replyType{"t": map[string]interface{}{"d": 0.0}}
+	if command, _ := srv.cmd(dev, nil); !reflect.DeepEqual(command, stop) {
+		t.Errorf("Unexpected command %v", command)
+	}
+	if status, _ = srv.tracking(user, "DELETE", devId); status != 404 {
+		t.Errorf("Stopped a session twice: %d", status)
+	}
+
+	// Nobody watching: the device is stopped after track.idle.
+	srv.queue(user, devId, replyType{"t": replyType{"d": 60}})
+	srv.expectPush(devId)
+	srv.cmd(dev, nil)
+	ws.Close()
+	srv.expectPush(devId)
+	if command, _ := srv.cmd(dev, nil); !reflect.DeepEqual(command, stop) {
+		t.Errorf("Unexpected command %v", command)
+	}
+	if status, session = srv.tracking(user, "GET", devId); status != 200 ||
+		session != nil {
+		t.Errorf("Idle session not ended %d %+v", status, session)
+	}
+}
+
+func TestGeofences(t *testing.T) {
+	notices := make(chan *WebhookEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			notice := new(WebhookEvent)
+			json.NewDecoder(req.Body).Decode(notice)
+			notices <- notice
+		}))
+	defer hook.Close()
+	srv := newTestServer(t, "webhook.url="+hook.URL,
+		"webhook.events="+strings.Join(noticeEvents, ","))
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.omar")
+	select {
+	case notice := <-notices:
+		if notice.Event != NOTICE_DEVICE_ADDED {
+			t.Errorf("Unexpected notice %+v", notice)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No device added notice")
+	}
+	user := srv.signin("omar")
+	header := http.Header{"X-Csrftoken": {user.token}}
+	ws := srv.socket(user, devId)
+	defer ws.Close()
+
+	for _, bad := range []replyType{
+		{"lat": 45.52, "lon": -122.68, "radius": 200},
+		{"name": "Home", "lat": 95.0, "lon": -122.68, "radius": 200},
+		{"name": "Home", "lat": 45.52, "lon": -122.68, "radius": 1},
+		{"name": "Park", "polygon": []interface{}{[]float64{45.5, -122.7}}},
+	} {
+		if resp, body := srv.post("/1/geofences/"+devId, bad, header,
+			user.cookies); resp.StatusCode != 400 {
+			t.Errorf("Invalid geofence %v accepted: %s", bad, body)
+		}
+	}
+	resp, body := srv.post("/1/geofences/"+devId, replyType{"name": "<b>Home</b>",
+		"lat": 45.52, "lon": -122.68, "radius": 200}, header, user.cookies)
+	var reply struct{ Geofences []storage.Geofence }
+	if resp.StatusCode != 200 || json.Unmarshal(body, &reply) != nil ||
+		len(reply.Geofences) != 1 || reply.Geofences[0].Name != "Home" {
+		t.Fatalf("Could not add geofence %d: %s", resp.StatusCode, body)
+	}
+	fenceId := reply.Geofences[0].ID
+
+	// Fixes a couple of minutes apart, so none are impossible jumps.
+	fixTime := time.Now().Unix()
+	report := func(lat float64) map[string]interface{} {
+		fixTime += 120
+		srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": lat,
+			"lo": -122.68, "ac": 10.0, "ti": fixTime}})
+		return readUpdate(t, ws, "t")
+	}
+	// The first fix only says where the device is.
+	if update := report(45.53); update["Geofences"] != nil {
+		t.Errorf("Unexpected geofence event %v", update["Geofences"])
+	}
+	if update := report(45.52); !reflect.DeepEqual(update["Geofences"],
+		[]interface{}{map[string]interface{}{"ID": fenceId, "Name": "Home",
+			"Event": "enter"}}) {
+		t.Errorf("No enter event: %v", update["Geofences"])
+	}
+	select {
+	case notice := <-notices:
+		if notice.Event != NOTICE_GEOFENCE_ENTER || notice.Data["geofence"] != "Home" {
+			t.Errorf("Unexpected notice %+v", notice)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No geofence notice")
+	}
+	// Too close to the edge to say it left.
+	if update := report(45.5219); update["Geofences"] != nil {
+		t.Errorf("Geofence flapped: %v", update["Geofences"])
+	}
+	if update := report(45.525); update["Geofences"] == nil {
+		t.Errorf("No exit event")
+	}
+	<-notices
+
+	req, _ := http.NewRequest("DELETE",
+		srv.url("/1/geofences/"+devId+"?id="+fenceId), nil)
+	req.Header.Set("X-CSRFToken", user.token)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Could not remove geofence: %v", err)
+	}
+	if fences, _ := srv.handler.store.GetGeofences(devId); len(fences) != 0 {
+		t.Errorf("Geofence not removed: %+v", fences)
+	}
+}
+
+func TestBestPosition(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.pia")
+	user := srv.signin("pia")
+	ws := srv.socket(user, devId)
+	defer ws.Close()
+
+	now := time.Now().Unix()
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 45.52,
+		"lo": -122.68, "ac": 8.0, "ti": now}})
+	readUpdate(t, ws, "t")
+	// A rough network fix a few seconds later doesn't replace it...
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 45.53,
+		"lo": -122.69, "ac": 1500.0, "ti": now + 5}})
+	update := readUpdate(t, ws, "t")
+	best, _ := update["Best"].(map[string]interface{})
+	if update["Latitude"] != 45.53 || best == nil || best["Latitude"] != 45.52 {
+		t.Errorf("Unexpected best position %v", update)
+	}
+	// ...nor does an impossible jump.
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 48.85,
+		"lo": 2.35, "ac": 5.0, "ti": now + 600}})
+	update = readUpdate(t, ws, "t")
+	if best, _ = update["Best"].(map[string]interface{}); best == nil ||
+		best["Latitude"] != 45.52 {
+		t.Errorf("Jump taken as best position %v", update)
+	}
+	devRec, _ := srv.handler.store.GetDeviceInfo(devId)
+	if devRec.Best == nil || devRec.Best.Latitude != 45.52 ||
+		devRec.Best.Accuracy != 8 {
+		t.Errorf("Best position not stored %+v", devRec.Best)
+	}
+	// An old fix is flagged.
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 45.52,
+		"lo": -122.68, "ac": 8.0, "ti": now - 3600}})
+	if update = readUpdate(t, ws, "t"); update["Stale"] != true {
+		t.Errorf("Old fix not flagged %v", update)
+	}
+}
+
+func TestNearPlace(t *testing.T) {
+	cities, admin1 := writeGeonames(t)
+	defer os.RemoveAll(filepath.Dir(cities))
+	srv := newTestServer(t, "geocode.cities="+cities, "geocode.admin1="+admin1)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.quinn")
+	user := srv.signin("quinn")
+	ws := srv.socket(user, devId)
+	defer ws.Close()
+
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 45.52,
+		"lo": -122.68, "ac": 8.0, "ti": time.Now().Unix()}})
+	update := readUpdate(t, ws, "t")
+	near, _ := update["Near"].(map[string]interface{})
+	if near == nil || near["Name"] != "Portland" || near["Admin"] != "Oregon" {
+		t.Errorf("Unexpected place %v", update["Near"])
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.rosa")
+	user := srv.signin("rosa")
+	header := http.Header{"X-Csrftoken": {user.token}}
+
+	if resp, body := srv.post("/1/shares/"+devId, replyType{"duration": 86401},
+		header, user.cookies); resp.StatusCode != 400 {
+		t.Errorf("Overlong share accepted: %s", body)
+	}
+	if resp, _ := srv.post("/1/shares/"+devId, replyType{}, nil,
+		nil); resp.StatusCode != 401 {
+		t.Errorf("Share created without signing in: %d", resp.StatusCode)
+	}
+	resp, body := srv.post("/1/shares/"+devId, replyType{"duration": 600},
+		header, user.cookies)
+	var link shareLink
+	if resp.StatusCode != 200 || json.Unmarshal(body, &link) != nil ||
+		link.Token == "" || link.URL != "/share/"+link.Token {
+		t.Fatalf("Could not share %d: %s", resp.StatusCode, body)
+	}
+	shared := func(token string) int {
+		resp, err := http.Get(srv.url("/1/shared/" + token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := shared(link.Token); status != 200 {
+		t.Errorf("Share link not accepted: %d", status)
+	}
+	if status := shared(link.ID + "." + strings.Repeat("0", 64)); status != 404 {
+		t.Errorf("Forged share link accepted: %d", status)
+	}
+	expired := storage.Share{ID: strings.Repeat("1", SHARE_ID_LEN),
+		DeviceId: devId, Expires: time.Now().Unix() - 1}
+	srv.handler.store.AddShare(expired)
+	if status := shared(srv.handler.shareLink(expired).Token); status != 404 {
+		t.Errorf("Expired share link accepted: %d", status)
+	}
+
+	wsConfig, _ := websocket.NewConfig(strings.Replace(srv.server.URL,
+		"http:", "ws:", 1)+"/1/shared/ws/"+link.Token, srv.server.URL)
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		t.Fatalf("Could not open share socket: %s", err)
+	}
+	defer ws.Close()
+	for i := 0; i < 100 && !hasViewers(devId); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 45.52,
+		"lo": -122.68, "ac": 8.0, "ti": time.Now().Unix()}})
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var update map[string]interface{}
+	if err = websocket.JSON.Receive(ws, &update); err != nil {
+		t.Fatalf("No update on share socket: %s", err)
+	}
+	if update["Latitude"] != 45.52 || update["Cmd"] != nil || update["Status"] != nil {
+		t.Errorf("Unexpected shared update %v", update)
+	}
+	// Share viewers can't send commands.
+	websocket.Message.Send(ws, `{"r": {"d": 30}}`)
+	var reply string
+	if err = websocket.Message.Receive(ws, &reply); err != nil || reply != "false" {
+		t.Errorf("Command from share viewer not refused: %q %v", reply, err)
+	}
+	if cmd, _, _ := srv.handler.store.GetPending(devId); cmd != "" {
+		t.Errorf("Command from share viewer queued: %s", cmd)
+	}
+
+	req, _ := http.NewRequest("DELETE",
+		srv.url("/1/shares/"+devId+"?id="+link.ID), nil)
+	req.Header.Set("X-CSRFToken", user.token)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Could not revoke share: %v", err)
+	}
+	if status := shared(link.Token); status != 404 {
+		t.Errorf("Revoked share link accepted: %d", status)
+	}
+	if err = websocket.Message.Receive(ws, &reply); err == nil {
+		t.Errorf("Share socket still open after revoking: %q", reply)
+	}
+}
+
+func TestDeviceRoles(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	srv.register(devId, "valid.opal")
+	owner := srv.signin("opal")
+	ownerHeader := http.Header{"X-Csrftoken": {owner.token}}
+	viewer := srv.signin("sam")
+	viewerHeader := http.Header{"X-Csrftoken": {viewer.token}}
+	ring := replyType{"r": replyType{"d": 5}}
+	locate := replyType{"t": replyType{"d": 0}}
+
+	invite := func(email, role string) inviteLink {
+		resp, body := srv.post("/1/access/"+devId, replyType{"email": email,
+			"role": role}, ownerHeader, owner.cookies)
+		var link inviteLink
+		if resp.StatusCode != 200 || json.Unmarshal(body, &link) != nil ||
+			link.Token == "" {
+			t.Fatalf("Could not invite %s: %d %s", email, resp.StatusCode, body)
+		}
+		return link
+	}
+	if status := srv.queue(viewer, devId, locate); status != 401 {
+		t.Errorf("Queued without access: %d", status)
+	}
+	if resp, _ := srv.post("/1/access/"+devId, replyType{"email": "sam@example.com",
+		"role": "admin"}, ownerHeader, owner.cookies); resp.StatusCode != 400 {
+		t.Errorf("Unknown role accepted: %d", resp.StatusCode)
+	}
+	// Invitations are for the address they were sent to.
+	link := invite("Sam@Example.com", ROLE_VIEWER)
+	other := srv.signin("tom")
+	if resp, _ := srv.post("/1/invitations/"+link.Token, nil,
+		http.Header{"X-Csrftoken": {other.token}}, other.cookies); resp.StatusCode != 404 {
+		t.Errorf("Invitation accepted by someone else: %d", resp.StatusCode)
+	}
+	if resp, _ := srv.post("/1/invitations/"+link.ID+"."+strings.Repeat("0", 64),
+		nil, viewerHeader, viewer.cookies); resp.StatusCode != 404 {
+		t.Errorf("Forged invitation accepted: %d", resp.StatusCode)
+	}
+	if resp, body := srv.post("/1/invitations/"+link.Token, nil, viewerHeader,
+		viewer.cookies); resp.StatusCode != 200 {
+		t.Fatalf("Could not accept invitation %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := srv.post("/1/invitations/"+link.Token, nil, viewerHeader,
+		viewer.cookies); resp.StatusCode != 404 {
+		t.Errorf("Invitation accepted twice: %d", resp.StatusCode)
+	}
+
+	// Viewers can locate the device, and nothing more.
+	if status := srv.queue(viewer, devId, locate); status != 200 {
+		t.Errorf("Viewer could not locate: %d", status)
+	}
+	srv.expectPush(devId)
+	if status := srv.queue(viewer, devId, ring); status != 403 {
+		t.Errorf("Viewer rang device: %d", status)
+	}
+	if status := srv.queue(viewer, devId, replyType{"e": replyType{}}); status != 403 {
+		t.Errorf("Viewer erased device: %d", status)
+	}
+	if resp, _ := srv.post("/1/shares/"+devId, replyType{}, viewerHeader,
+		viewer.cookies); resp.StatusCode != 403 {
+		t.Errorf("Viewer shared location: %d", resp.StatusCode)
+	}
+	ws := srv.socket(viewer, devId)
+	defer ws.Close()
+	websocket.Message.Send(ws, `{"r": {"d": 30}}`)
+	var reply string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.Message.Receive(ws, &reply); err != nil || reply != "false" {
+		t.Errorf("Ring from viewer's socket not refused: %q %v", reply, err)
+	}
+
+	// The device list says what each user may do.
+	req, _ := http.NewRequest("GET", srv.url("/1/devices/"), nil)
+	for _, cookie := range viewer.cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices struct {
+		Devices []struct{ ID, Role string }
+	}
+	json.NewDecoder(resp.Body).Decode(&devices)
+	resp.Body.Close()
+	if len(devices.Devices) != 1 || devices.Devices[0].ID != devId ||
+		devices.Devices[0].Role != ROLE_VIEWER {
+		t.Errorf("Unexpected shared device list %+v", devices)
+	}
+
+	// Accepting a new invitation changes the role.
+	link = invite("sam@example.com", ROLE_OPERATOR)
+	srv.post("/1/invitations/"+link.Token, nil, viewerHeader, viewer.cookies)
+	if status := srv.queue(viewer, devId, ring); status != 200 {
+		t.Errorf("Operator could not ring: %d", status)
+	}
+	srv.expectPush(devId)
+	if status := srv.queue(viewer, devId, replyType{"e": replyType{}}); status != 403 {
+		t.Errorf("Operator erased device: %d", status)
+	}
+
+	access, _ := srv.handler.store.GetAccess(devId)
+	if len(access) != 1 || access[0].Role != ROLE_OPERATOR {
+		t.Fatalf("Unexpected access list %+v", access)
+	}
+	req, _ = http.NewRequest("DELETE", srv.url("/1/access/"+devId+"?user="+
+		access[0].UserId), nil)
+	req.Header.Set("X-CSRFToken", owner.token)
+	for _, cookie := range owner.cookies {
+		req.AddCookie(cookie)
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Could not revoke access: %v %v", resp, err)
+	}
+	if status := srv.queue(viewer, devId, locate); status != 401 {
+		t.Errorf("Queued after access revoked: %d", status)
+	}
+	// Drain any updates sent before the socket was closed.
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				t.Errorf("Socket still open after revoking access")
+			}
+			break
+		}
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	// The UI only lists one device, but the export has them all.
+	srv := newTestServer(t, "db.max_devices_for_user=1")
+	defer srv.Close()
+
+	olderId := newDevId()
+	srv.register(olderId, "valid.vera")
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.vera")
+	srv.cmd(dev, replyType{"t": replyType{"ok": true, "la": 45.52,
+		"lo": -122.68, "ac": 8.0, "ti": time.Now().Unix()}})
+	user := srv.signin("vera")
+	if status := srv.queue(user, devId, replyType{"l": replyType{
+		"c": "4242", "m": "call me"}}); status != 200 {
+		t.Fatalf("Lock failed: %d", status)
+	}
+	srv.expectPush(devId)
+
+	export := func(query string, cookies []*http.Cookie) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", srv.url("/1/export/"+query), nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+	if resp, _ := export("", nil); resp.StatusCode != 401 {
+		t.Errorf("Exported without signing in: %d", resp.StatusCode)
+	}
+	resp, body := export("", user.cookies)
+	var data exportData
+	if resp.StatusCode != 200 || json.Unmarshal(body, &data) != nil {
+		t.Fatalf("Export failed %d: %s", resp.StatusCode, body)
+	}
+	if len(data.Devices) != 2 || data.Devices[1].ID != olderId ||
+		data.Email != "vera@example.com" {
+		t.Fatalf("Unexpected export %s", body)
+	}
+	exported := data.Devices[0]
+	if exported.ID != devId || exported.Registered == 0 ||
+		len(exported.Positions) != 1 || exported.Positions[0].Latitude != 45.52 ||
+		len(exported.Pending) != 1 {
+		t.Errorf("Device not exported %+v", exported)
+	}
+	for _, secret := range []string{dev.Secret, srv.pushUrl(devId), "4242"} {
+		if bytes.Contains(body, []byte(secret)) {
+			t.Errorf("Export includes secret %q", secret)
+		}
+	}
+	if !strings.Contains(exported.Pending[0].Cmd, "call me") {
+		t.Errorf("Pending command not exported: %s", exported.Pending[0].Cmd)
+	}
+	// Exporting leaves the command for the device.
+	if command, _ := srv.cmd(dev, nil); command["l"] == nil {
+		t.Errorf("Pending command taken by export: %v", command)
+	}
+
+	resp, body = export("?format=zip", user.cookies)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("Zip export failed %d: %s", resp.StatusCode, body)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != "export.json" {
+		t.Fatalf("Bad export archive: %v", err)
+	}
+	file, _ := archive.File[0].Open()
+	defer file.Close()
+	data = exportData{}
+	if err = json.NewDecoder(file).Decode(&data); err != nil ||
+		len(data.Devices) != 2 || data.Devices[0].ID != devId {
+		t.Errorf("Unexpected archived export %+v %v", data, err)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	srv := newTestServer(t, "auth.reauth_age=1h")
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.una")
+	user := srv.signin("una")
+	// Una can also see Walt's device.
+	waltId := newDevId()
+	srv.register(waltId, "valid.walt")
+	walt := srv.signin("walt")
+	resp, body := srv.post("/1/access/"+waltId, replyType{"email": "una@example.com",
+		"role": ROLE_VIEWER}, http.Header{"X-Csrftoken": {walt.token}}, walt.cookies)
+	var link inviteLink
+	json.Unmarshal(body, &link)
+	if resp, _ = srv.post("/1/invitations/"+link.Token, nil,
+		http.Header{"X-Csrftoken": {user.token}}, user.cookies); resp.StatusCode != 200 {
+		t.Fatalf("Could not accept invitation: %d", resp.StatusCode)
+	}
+
+	deleteAccount := func(user *testUser) (*http.Response, []byte) {
+		req, _ := http.NewRequest("DELETE", srv.url("/1/account/"), nil)
+		req.Header.Set("X-CSRFToken", user.token)
+		for _, cookie := range user.cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+	// A long lived session isn't enough.
+	req, _ := http.NewRequest("GET", srv.url("/"), nil)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	session, _ := sessionStore.Get(req, SESSION_NAME)
+	session.Values[SESSION_AUTHTIME] = time.Now().Add(-2 * time.Hour).Unix()
+	rec := httptest.NewRecorder()
+	session.Save(req, rec)
+	stale := &testUser{uid: user.uid, token: user.token,
+		cookies: (&http.Response{Header: rec.Header()}).Cookies()}
+	if resp, body := deleteAccount(stale); resp.StatusCode != 403 ||
+		!strings.Contains(string(body), "reauth") {
+		t.Fatalf("Stale session deleted account %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := deleteAccount(&testUser{cookies: user.cookies,
+		token: "bogus"}); resp.StatusCode != 401 {
+		t.Fatalf("Account deleted without CSRF token: %d", resp.StatusCode)
+	}
+
+	resp, body = deleteAccount(user)
+	var reply struct{ Devices []string }
+	if resp.StatusCode != 200 || json.Unmarshal(body, &reply) != nil ||
+		!reflect.DeepEqual(reply.Devices, []string{devId}) {
+		t.Fatalf("Could not delete account %d: %s", resp.StatusCode, body)
+	}
+	srv.expectPush(devId)
+	if _, status := srv.cmd(dev, nil); status != 410 {
+		t.Errorf("Deleted device: expected 410, got %d", status)
+	}
+	if _, err := srv.handler.store.GetDeviceInfo(devId); err != storage.ErrUnknownDevice {
+		t.Errorf("Device not deleted: %v", err)
+	}
+	if access, _ := srv.handler.store.GetAccess(waltId); len(access) != 0 {
+		t.Errorf("Access to other devices kept %+v", access)
+	}
+	// Other sessions are signed out too.
+	req, _ = http.NewRequest("GET", srv.url("/1/devices/"), nil)
+	for _, cookie := range stale.cookies {
+		req.AddCookie(cookie)
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 401 {
+		t.Errorf("Deleted user's session still works: %v %v", resp, err)
+	}
+	if devRec, _ := srv.handler.store.GetDeviceInfo(waltId); devRec == nil {
+		t.Errorf("Other user's device deleted")
+	}
+
+	// The device can be set up again.
+	dev, status := srv.register(devId, "valid.una")
+	if status != 200 {
+		t.Fatalf("Could not register again: %d", status)
+	}
+	if _, status = srv.cmd(dev, nil); status != 200 {
+		t.Errorf("Registered again: expected 200, got %d", status)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.ada")
+	owner := srv.signin("ada")
+	if status := srv.queue(owner, devId, replyType{"l": replyType{
+		"c": "4242", "m": "call me"}}); status != 200 {
+		t.Fatalf("Lock failed: %d", status)
+	}
+	srv.expectPush(devId)
+	if command, _ := srv.cmd(dev, nil); command["l"] == nil {
+		t.Fatalf("Lock not collected: %v", command)
+	}
+
+	audit := func(user *testUser, query string) (int, []storage.AuditEvent, int64) {
+		req, _ := http.NewRequest("GET", srv.url("/1/audit/"+devId+query), nil)
+		req.Header.Set("X-CSRFToken", user.token)
+		for _, cookie := range user.cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if bytes.Contains(body, []byte("4242")) {
+			t.Errorf("Audit log shows the passcode: %s", body)
+		}
+		var reply struct {
+			Events []storage.AuditEvent
+			Next   int64
+		}
+		json.Unmarshal(body, &reply)
+		return resp.StatusCode, reply.Events, reply.Next
+	}
+	status, events, next := audit(owner, "")
+	if status != 200 || len(events) != 3 || next != 0 {
+		t.Fatalf("Unexpected audit log %d: %+v", status, events)
+	}
+	// Newest first.
+	for i, action := range []string{AUDIT_CMD, AUDIT_QUEUE, AUDIT_REGISTER} {
+		if events[i].Action != action || events[i].Result != AUDIT_OK ||
+			events[i].Owner != events[2].UserId {
+			t.Errorf("Unexpected event %d: %+v", i, events[i])
+		}
+	}
+	if queued := events[1]; queued.UserId != events[2].UserId ||
+		!strings.Contains(queued.Args, "****") || queued.Source == "" {
+		t.Errorf("Queue not audited: %+v", queued)
+	}
+	if !strings.Contains(events[0].Args, "****") || events[0].UserId != "" {
+		t.Errorf("Collected command not audited: %+v", events[0])
+	}
+
+	// Paging.
+	status, page, next := audit(owner, "?limit=2")
+	if status != 200 || len(page) != 2 || next != page[1].ID {
+		t.Fatalf("Unexpected first page %d: %+v, %d", status, page, next)
+	}
+	status, page, next = audit(owner, "?limit=2&before="+strconv.FormatInt(next, 10))
+	if status != 200 || len(page) != 1 || page[0].ID != events[2].ID || next != 0 {
+		t.Errorf("Unexpected second page %d: %+v, %d", status, page, next)
+	}
+	if status, _, _ = audit(owner, "?limit=0"); status != 400 {
+		t.Errorf("Accepted a limit of 0: %d", status)
+	}
+
+	// Only the owner sees the log.
+	viewer := srv.signin("ben")
+	resp, body := srv.post("/1/access/"+devId, replyType{"email": "ben@example.com",
+		"role": ROLE_OPERATOR}, http.Header{"X-Csrftoken": {owner.token}}, owner.cookies)
+	var link inviteLink
+	if resp.StatusCode != 200 || json.Unmarshal(body, &link) != nil {
+		t.Fatalf("Could not invite: %d %s", resp.StatusCode, body)
+	}
+	if resp, _ = srv.post("/1/invitations/"+link.Token, nil,
+		http.Header{"X-Csrftoken": {viewer.token}}, viewer.cookies); resp.StatusCode != 200 {
+		t.Fatalf("Could not accept invitation: %d", resp.StatusCode)
+	}
+	if status, _, _ = audit(viewer, ""); status != 403 {
+		t.Errorf("Operator read the audit log: %d", status)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+		event  WebhookEvent
+	}
+	events := make(chan received, 10)
+	failed := false
+	hook := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			var rec received
+			rec.header = req.Header
+			rec.body, _ = ioutil.ReadAll(req.Body)
+			json.Unmarshal(rec.body, &rec.event)
+			events <- rec
+			// Fail the first delivery, to have it retried.
+			if !failed {
+				failed = true
+				http.Error(resp, "Busy", http.StatusServiceUnavailable)
+			}
+		}))
+	defer hook.Close()
+	srv := newTestServer(t, "webhook.allow_http=true", "webhook.allow_private=true",
+		"webhook.backoff=10ms", "webhook.max_backoff=20ms", "webhook.workers=1")
+	defer srv.Close()
+	expectEvent := func(event string) received {
+		select {
+		case rec := <-events:
+			if rec.event.Event != event || rec.header.Get("X-FMD-Event") != event {
+				t.Fatalf("Unexpected event %s", rec.body)
+			}
+			return rec
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s event", event)
+		}
+		return received{}
+	}
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.iris")
+	user := srv.signin("iris")
+	header := http.Header{"X-Csrftoken": {user.token}}
+	webhooks := func(user *testUser, method, path string) (int, []byte) {
+		req, _ := http.NewRequest(method, srv.url("/1/webhooks/"+path), nil)
+		req.Header.Set("X-CSRFToken", user.token)
+		for _, cookie := range user.cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	for _, bad := range []replyType{{"url": "ftp://example.com/"},
+		{"url": "not a url"},
+		{"url": hook.URL, "events": []string{"device.stolen"}}} {
+		if resp, body := srv.post("/1/webhooks/", bad, header,
+			user.cookies); resp.StatusCode != 400 {
+			t.Errorf("Invalid webhook %v added %d: %s", bad, resp.StatusCode, body)
+		}
+	}
+	resp, body := srv.post("/1/webhooks/", replyType{"url": hook.URL,
+		"events": []string{EVENT_COMMAND_QUEUED, EVENT_COMMAND_DELIVERED}},
+		header, user.cookies)
+	var added storage.Webhook
+	if resp.StatusCode != 200 || json.Unmarshal(body, &added) != nil ||
+		added.ID == "" || added.Secret == "" {
+		t.Fatalf("Could not add webhook %d: %s", resp.StatusCode, body)
+	}
+	status, body := webhooks(user, "GET", "")
+	var list struct{ Webhooks []storage.Webhook }
+	if status != 200 || json.Unmarshal(body, &list) != nil ||
+		len(list.Webhooks) != 1 || list.Webhooks[0].ID != added.ID ||
+		bytes.Contains(body, []byte(added.Secret)) {
+		t.Fatalf("Unexpected webhook list %d: %s", status, body)
+	}
+
+	if status := srv.queue(user, devId, replyType{"l": replyType{
+		"c": "4242", "m": "call me"}}); status != 200 {
+		t.Fatalf("Lock failed: %d", status)
+	}
+	srv.expectPush(devId)
+	first := expectEvent(EVENT_COMMAND_QUEUED)
+	retry := expectEvent(EVENT_COMMAND_QUEUED)
+	if !bytes.Equal(first.body, retry.body) ||
+		retry.header.Get("X-FMD-Delivery") != retry.event.ID {
+		t.Errorf("Retry differs: %s, %s", first.body, retry.body)
+	}
+	if retry.header.Get("X-FMD-Signature") !=
+		hmacSignature([]byte(added.Secret), retry.body) {
+		t.Errorf("Bad event signature")
+	}
+	if retry.event.DeviceId != devId || retry.event.Data["cmd"] != "l" ||
+		bytes.Contains(retry.body, []byte("4242")) {
+		t.Errorf("Unexpected event %s", retry.body)
+	}
+	srv.cmd(dev, nil)
+	expectEvent(EVENT_COMMAND_DELIVERED)
+
+	// Every attempt is logged.
+	var logged struct {
+		Webhook    storage.Webhook
+		Deliveries []storage.WebhookDelivery
+	}
+	for i := 0; i < 50 && len(logged.Deliveries) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, body = webhooks(user, "GET", added.ID)
+		if status != 200 || json.Unmarshal(body, &logged) != nil {
+			t.Fatalf("Could not get deliveries %d: %s", status, body)
+		}
+	}
+	if d := logged.Deliveries; len(d) != 3 || d[2].Status != 503 ||
+		d[2].Attempt != 1 || d[1].Status != 200 || d[1].Attempt != 2 ||
+		d[1].Delivery != d[2].Delivery || d[0].Event != EVENT_COMMAND_DELIVERED {
+		t.Errorf("Unexpected deliveries %+v", logged.Deliveries)
+	}
+
+	// Webhooks are private to their user.
+	other := srv.signin("jon")
+	if status, _ = webhooks(other, "GET", added.ID); status != 404 {
+		t.Errorf("Other user saw the webhook: %d", status)
+	}
+	if status, _ = webhooks(other, "DELETE", added.ID); status != 404 {
+		t.Errorf("Other user removed the webhook: %d", status)
+	}
+	if status, body = webhooks(user, "DELETE", added.ID); status != 200 ||
+		json.Unmarshal(body, &list) != nil || len(list.Webhooks) != 0 {
+		t.Errorf("Could not remove webhook %d: %s", status, body)
+	}
+	srv.queue(user, devId, replyType{"r": replyType{"d": 5}})
+	srv.expectPush(devId)
+	select {
+	case rec := <-events:
+		t.Errorf("Event sent to removed webhook: %s", rec.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	hits := make(chan string, 10)
+	target := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			hits <- req.URL.Path
+			if req.URL.Path == "/redirect" {
+				http.Redirect(resp, req, "/internal", http.StatusFound)
+			}
+		}))
+	defer target.Close()
+	srv := newTestServer(t, "webhook.allow_http=true", "webhook.retries=0",
+		"webhook.url="+target.URL+"/redirect", "webhook.events="+EVENT_COMMAND_QUEUED)
+	defer srv.Close()
+
+	devId := newDevId()
+	srv.register(devId, "valid.kim")
+	user := srv.signin("kim")
+	if resp, body := srv.post("/1/webhooks/", replyType{"url": target.URL},
+		http.Header{"X-Csrftoken": {user.token}}, user.cookies); resp.StatusCode != 400 ||
+		!strings.Contains(string(body), "public address") {
+		t.Errorf("Loopback webhook added %d: %s", resp.StatusCode, body)
+	}
+	// A name can still resolve to somewhere private.
+	hookUrl := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	srv.handler.store.AddWebhook(storage.Webhook{ID: "hook1", UserId: "kim",
+		URL: hookUrl + "/private"})
+	srv.queue(user, devId, replyType{"r": replyType{"d": 5}})
+
+	deliveries := func(id string) (list []storage.WebhookDelivery) {
+		for i := 0; i < 50 && len(list) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			list, _ = srv.handler.store.GetWebhookDeliveries(id, 50)
+		}
+		return list
+	}
+	if d := deliveries("hook1"); len(d) != 1 || d[0].Status != 0 ||
+		d[0].Error != ErrWebhookAddress.Error() {
+		t.Errorf("Unexpected deliveries %+v", d)
+	}
+	// The deployment's webhook can be local, but redirects aren't
+	// followed.
+	if d := deliveries(WEBHOOK_DEPLOYMENT); len(d) != 1 || d[0].Status != 302 {
+		t.Errorf("Unexpected deployment deliveries %+v", d)
+	}
+	if path := <-hits; path != "/redirect" {
+		t.Errorf("Unexpected request for %s", path)
+	}
+	select {
+	case path := <-hits:
+		t.Errorf("Unexpected request for %s", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if msg := deliveryError(&net.OpError{Op: "dial", Net: "tcp",
+		Err: errors.New("connection refused")}); msg != "Could not connect" {
+		t.Errorf("Dial error logged as %q", msg)
+	}
+}
+
+func TestScheduledCommands(t *testing.T) {
+	srv := newTestServer(t, "schedule.interval=10ms", "schedule.max_delay=48h")
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.ivan")
+	user := srv.signin("ivan")
+	scheduled := func(method, query string) (int, []storage.ScheduledCommand) {
+		return srv.scheduled(user, method, devId+query)
+	}
+
+	if status := srv.queue(user, devId, replyType{"e": replyType{
+		"delay": "24h"}}); status != 200 {
+		t.Fatalf("Scheduling erase failed: %d", status)
+	}
+	if status := srv.queue(user, devId, replyType{"r": replyType{
+		"d": 30, "at": time.Now().Add(time.Hour).Unix()}}); status != 200 {
+		t.Fatalf("Scheduling ring failed: %d", status)
+	}
+	for _, bad := range []replyType{{"delay": "soon"}, {"delay": "72h"},
+		{"at": true}} {
+		if status := srv.queue(user, devId, replyType{"r": bad}); status != 400 {
+			t.Errorf("Schedule %v accepted: %d", bad, status)
+		}
+	}
+	// Nothing is sent until the commands are due.
+	if command, _ := srv.cmd(dev, nil); len(command) != 0 {
+		t.Fatalf("Scheduled command sent early: %v", command)
+	}
+	if devRec, _ := srv.handler.store.GetDeviceInfo(devId); devRec == nil {
+		t.Fatalf("Device erased early")
+	}
+	status, list := scheduled("GET", "")
+	if status != 200 || len(list) != 2 || list[0].Cmd != "r" ||
+		list[0].Args != `{"d":30}` || list[1].Cmd != "e" {
+		t.Fatalf("Unexpected scheduled commands %d: %+v", status, list)
+	}
+	if status, list = scheduled("DELETE", "?id="+list[1].ID); status != 200 ||
+		len(list) != 1 || list[0].Cmd != "r" {
+		t.Fatalf("Cancel failed %d: %+v", status, list)
+	}
+	if status, _ = scheduled("DELETE", "?id=nope"); status != 404 {
+		t.Errorf("Cancelled an unknown command: %d", status)
+	}
+
+	// Due commands are queued and the device woken.
+	srv.handler.store.CancelScheduled(devId, list[0].ID)
+	srv.handler.store.ScheduleCommand(storage.ScheduledCommand{
+		DeviceId: devId, Cmd: "r", Args: `{"d":15}`,
+		Time: time.Now().Unix() - 1})
+	srv.expectPush(devId)
+	if command, _ := srv.cmd(dev, nil); !reflect.DeepEqual(command,
+		replyType{"r": map[string]interface{}{"d": 15.0}}) {
+		t.Errorf("Unexpected command %v", command)
+	}
+	if _, list = scheduled("GET", ""); len(list) != 0 {
+		t.Errorf("Fired command still scheduled: %+v", list)
+	}
+
+	// Other users can't see them.
+	srv.register(newDevId(), "valid.judy")
+	user = srv.signin("judy")
+	if status, _ = scheduled("GET", ""); status != 401 {
+		t.Errorf("Scheduled commands shown to another user: %d", status)
+	}
+}
+
+// A store that can't save commands while fail is set.
+type failingStore struct {
+	storage.Store
+	fail bool
+}
+
+func (self *failingStore) StoreCommand(devId, command, cType, cmdId string) error {
+	if self.fail {
+		return errors.New("Store unavailable")
+	}
+	return self.Store.StoreCommand(devId, command, cType, cmdId)
+}
+
+func TestScheduledRetry(t *testing.T) {
+	// Fired by hand, below.
+	srv := newTestServer(t, "schedule.interval=0", "schedule.max_attempts=2")
+	defer srv.Close()
+	store := &failingStore{Store: srv.handler.store, fail: true}
+	srv.handler.store = store
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.ines")
+	sched := storage.ScheduledCommand{ID: "7", DeviceId: devId, Cmd: "r",
+		Args: `{"d":5}`, Time: time.Now().Unix(), Created: time.Now().Unix()}
+	take := func() []storage.ScheduledCommand {
+		due, _ := store.TakeDueCommands(time.Now().Add(2*time.Hour).Unix(), 10)
+		return due
+	}
+
+	// A command that can't be queued is put back for later.
+	srv.handler.scheduler.queue(sched)
+	due := take()
+	if len(due) != 1 || due[0].ID != "7" || due[0].Attempts != 1 ||
+		due[0].Time <= sched.Time {
+		t.Fatalf("Command not put back %+v", due)
+	}
+	// Until it's been tried schedule.max_attempts times.
+	srv.handler.scheduler.queue(due[0])
+	if due = take(); len(due) != 0 {
+		t.Errorf("Command retried too often %+v", due)
+	}
+	store.fail = false
+	srv.handler.scheduler.queue(sched)
+	srv.expectPush(devId)
+	if command, _ := srv.cmd(dev, nil); command["r"] == nil {
+		t.Errorf("Scheduled command not queued: %v", command)
+	}
+	if due = take(); len(due) != 0 {
+		t.Errorf("Queued command put back %+v", due)
+	}
+}
+
+func TestScheduledRole(t *testing.T) {
+	// Fired by hand, below.
+	srv := newTestServer(t, "schedule.interval=0")
+	defer srv.Close()
+
+	devId := newDevId()
+	dev, _ := srv.register(devId, "valid.olga")
+	user := srv.signin("olga")
+	devRec, _ := srv.handler.store.GetDeviceInfo(devId)
+	if status := srv.queue(user, devId, replyType{"r": replyType{
+		"d": 30, "delay": "1h"}}); status != 200 {
+		t.Fatalf("Scheduling ring failed: %d", status)
+	}
+	if _, list := srv.scheduled(user, "GET", devId); len(list) != 1 ||
+		list[0].By != devRec.User {
+		t.Fatalf("Scheduling user not recorded %+v", list)
+	}
+
+	// A user who has lost access can't ring the device any more.
+	sched := storage.ScheduledCommand{ID: "7", DeviceId: devId, Cmd: "r",
+		Args: `{"d":5}`, Time: time.Now().Unix(), Created: time.Now().Unix(),
+		By: "revoked"}
+	srv.handler.scheduler.queue(sched)
+	if command, _ := srv.cmd(dev, nil); len(command) != 0 {
+		t.Errorf("Command queued without access: %v", command)
+	}
+	due, _ := srv.handler.store.TakeDueCommands(time.Now().Add(2*time.Hour).Unix(), 10)
+	if len(due) != 1 || due[0].By != devRec.User {
+		t.Errorf("Refused command put back %+v", due)
+	}
+	sched.By = devRec.User
+	srv.handler.scheduler.queue(sched)
+	srv.expectPush(devId)
+	if command, _ := srv.cmd(dev, nil); command["r"] == nil {
+		t.Errorf("Scheduled command not queued: %v", command)
+	}
+}
+
+func TestReauth(t *testing.T) {
+	srv := newTestServer(t, "auth.reauth_age=1h")
+	defer srv.Close()
+
+	devId := newDevId()
+	srv.register(devId, "valid.lisa")
+	user := srv.signin("lisa")
+	if status := srv.queue(user, devId, replyType{"l": replyType{
+		"c": "1234"}}); status != 200 {
+		t.Fatalf("Lock after sign in failed: %d", status)
+	}
+
+	// Age the session's sign in.
+	req, _ := http.NewRequest("GET", srv.url("/"), nil)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	session, _ := sessionStore.Get(req, SESSION_NAME)
+	session.Values[SESSION_AUTHTIME] = time.Now().Add(-2 * time.Hour).Unix()
+	rec := httptest.NewRecorder()
+	session.Save(req, rec)
+	stale := &testUser{uid: user.uid, token: user.token,
+		cookies: (&http.Response{Header: rec.Header()}).Cookies()}
+
+	for _, ok := range []replyType{
+		{"r": replyType{"d": 5}},
+		{"l": replyType{"m": "Call me"}},
+		{"o": replyType{"off": true}},
+	} {
+		if status := srv.queue(stale, devId, ok); status != 200 {
+			t.Errorf("%v refused: %d", ok, status)
+		}
+	}
+	for _, cmd := range []replyType{
+		{"e": replyType{}},
+		{"l": replyType{"c": "4321"}},
+		{"o": replyType{"c": "4321", "m": "Lost"}},
+	} {
+		resp, body := srv.post("/1/queue/"+devId, cmd,
+			http.Header{"X-Csrftoken": {stale.token}}, stale.cookies)
+		reply := make(replyType)
+		if resp.StatusCode != 403 || json.Unmarshal(body, &reply) != nil ||
+			reply["reauth"] != "/signin/?max_age=3600" {
+			t.Errorf("%v not challenged %d: %s", cmd, resp.StatusCode, body)
+		}
+	}
+	if devRec, _ := srv.handler.store.GetDeviceInfo(devId); devRec.Erasing != 0 {
+		t.Errorf("Erase accepted without sign in")
+	}
+
+	// Same for the websocket.
+	ws := srv.socket(stale, devId)
+	defer ws.Close()
+	websocket.Message.Send(ws, `{"e":{}}`)
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err != nil ||
+		!strings.Contains(msg, `"reauth":"/signin/?max_age=3600"`) {
+		t.Errorf("Socket erase not challenged: %s %v", msg, err)
+	}
+
+	// The challenge asks FxA for a fresh login.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(srv.url("/signin/?max_age=3600"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if loc := resp.Header.Get("Location"); !strings.HasSuffix(loc, "&max_age=3600") {
+		t.Errorf("Login url without max_age: %s", loc)
+	}
+
+	// Only a step-up login counts, as of when FxA says the password
+	// was entered.
+	var authAt int64
+	fxa := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/v1/token" {
+				json.NewEncoder(resp).Encode(replyType{
+					"access_token": "token", "auth_at": authAt})
+				return
+			}
+			json.NewEncoder(resp).Encode(replyType{
+				"uid": "lisa", "email": "lisa@example.com"})
+		}))
+	defer fxa.Close()
+	srv.config.Override("fxa.token", fxa.URL+"/v1/token")
+	srv.config.Override("fxa.content.endpoint", fxa.URL)
+	// Session cookies are for session.domain.
+	local := strings.Replace(srv.url(""), "127.0.0.1", "localhost", 1)
+	login := func(signin string) int64 {
+		jar, _ := cookiejar.New(nil)
+		client.Jar = jar
+		resp, err := client.Get(local + signin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		loc, _ := url.Parse(resp.Header.Get("Location"))
+		if resp, err = client.Get(local + "/oauth/?code=code&state=" +
+			loc.Query().Get("state")); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		req, _ := http.NewRequest("GET", local+"/", nil)
+		for _, cookie := range jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
+		session, _ := sessionStore.Get(req, SESSION_NAME)
+		if session.Values[SESSION_USERID] != "lisa" {
+			t.Fatalf("Not signed in: %v", session.Values)
+		}
+		return sessionAuthTime(session)
+	}
+	authAt = time.Now().Add(-time.Minute).Unix()
+	if at := login("/signin/"); at != 0 {
+		t.Errorf("Silent sign in recorded as recent: %d", at)
+	}
+	if at := login("/signin/?max_age=3600"); at != authAt {
+		t.Errorf("Step-up sign in at %d, expected %d", at, authAt)
+	}
+	authAt = time.Now().Add(-2 * time.Hour).Unix()
+	if at := login("/signin/?max_age=3600"); at != 0 {
+		t.Errorf("Stale step-up sign in accepted: %d", at)
+	}
+}
+
+func TestQueuePushFailure(t *testing.T) {
+	srv := newTestServer(t, "push.retries=0")
+	defer srv.Close()
+	broken := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			http.Error(resp, "Nope", 500)
+		}))
+	defer broken.Close()
+
+	devId := newDevId()
+	resp, body := srv.post("/1/register/", replyType{
+		"assert":   "valid.hank",
+		"pushurl":  broken.URL + "/" + devId,
+		"deviceid": devId,
+		"accepts":  []string{"r"}}, nil, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Register failed %d: %s", resp.StatusCode, body)
+	}
+	cred := make(map[string]string)
+	json.Unmarshal(body, &cred)
+	dev := NewHawkClient(devId, cred["secret"], nil)
+
+	// The command is stored, so the user shouldn't see the push failure.
+	user := srv.signin("hank")
+	if status := srv.queue(user, devId, replyType{"r": replyType{"d": 10}}); status != 200 {
+		t.Fatalf("Queue failed: %d", status)
+	}
+	if command, _ := srv.cmd(dev, nil); command["r"] == nil {
+		t.Errorf("Command not queued: %v", command)
+	}
+}
+
+func TestPushGone(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	gone := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			http.Error(resp, "Gone", http.StatusGone)
+		}))
+	defer gone.Close()
+
+	devId := newDevId()
+	reg := replyType{
+		"assert":   "valid.ivan",
+		"pushurl":  gone.URL + "/" + devId,
+		"deviceid": devId,
+		"accepts":  []string{"r"}}
+	if resp, body := srv.post("/1/register/", reg, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Register failed %d: %s", resp.StatusCode, body)
+	}
+	user := srv.signin("ivan")
+	if status := srv.queue(user, devId, replyType{"r": replyType{"d": 10}}); status != 200 {
+		t.Fatalf("Queue failed: %d", status)
+	}
+	var devRec *storage.Device
+	for i := 0; i < 100; i++ {
+		if devRec, _ = srv.handler.store.GetDeviceInfo(devId); devRec.Unreachable {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !devRec.Unreachable || devRec.PushUrl != "" {
+		t.Fatalf("Device not marked unreachable: %+v", devRec)
+	}
+
+	// The UI is told.
+	req, _ := http.NewRequest("GET", srv.url("/1/devices/"), nil)
+	for _, cookie := range user.cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Devices []struct {
+			ID          string
+			Unreachable bool
+		}
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Devices) != 1 || !list.Devices[0].Unreachable {
+		t.Errorf("Unexpected device list %+v", list)
+	}
+
+	// Reopening the app re-registers the device.
+	reg["pushurl"] = srv.pushUrl(devId)
+	srv.post("/1/register/", reg, nil, nil)
+	if devRec, _ = srv.handler.store.GetDeviceInfo(devId); devRec.Unreachable {
+		t.Errorf("Re-registered device still unreachable")
+	}
+}
+
+func TestSocketSignature(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	devId := newDevId()
+	srv.register(devId, "valid.hank")
+	user := srv.signin("hank")
+	wsConfig, _ := websocket.NewConfig(
+		"ws"+strings.TrimPrefix(srv.url("/1/ws/badsig/"+devId), "http"),
+		srv.server.URL)
+	for _, cookie := range user.cookies {
+		wsConfig.Header.Add("Cookie", cookie.String())
+	}
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		t.Fatalf("Could not open socket: %s", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg string
+	if err = websocket.Message.Receive(ws, &msg); err == nil {
+		t.Errorf("Expected socket to be closed, got %s", msg)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.Close()
+	srv := newTestServer(t, "notify.smtp.host="+sink.Addr(),
+		"notify.smtp.from=fmd@example.com")
+	defer srv.Close()
+
+	devId := newDevId()
+	resp, body := srv.post("/1/register/", replyType{
+		"assert":   "valid.nina",
+		"pushurl":  srv.pushUrl(devId),
+		"deviceid": devId,
+		"accepts":  []string{"l", "t", "o"}}, nil, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Register failed %d: %s", resp.StatusCode, body)
+	}
+	cred := make(map[string]string)
+	json.Unmarshal(body, &cred)
+	dev := NewHawkClient(devId, cred["secret"], nil)
+	if msg := sink.expect(t, "nina@example.com"); msg.Lang != "en" ||
+		msg.Subject != "nina was added to your account" {
+		t.Errorf("Unexpected mail %+v", msg)
+	}
+	user := srv.signin("nina")
+	header := http.Header{"X-Csrftoken": {user.token}}
+
+	for _, bad := range []replyType{{"locale": "xx"},
+		{"muted": []string{"device.stolen"}}} {
+		if resp, body := srv.post("/1/preferences/", bad, header,
+			user.cookies); resp.StatusCode != 400 {
+			t.Errorf("Invalid preferences %v saved: %s", bad, body)
+		}
+	}
+	var prefs struct {
+		Locale  string
+		Email   bool
+		Muted   []string
+		Locales []string
+	}
+	resp, body = srv.post("/1/preferences/", replyType{"locale": "fr"},
+		header, user.cookies)
+	if resp.StatusCode != 200 || json.Unmarshal(body, &prefs) != nil ||
+		prefs.Locale != "fr" || !prefs.Email || len(prefs.Muted) != 0 ||
+		!reflect.DeepEqual(prefs.Locales, []string{"de", "en", "fr"}) {
+		t.Fatalf("Preferences not saved %d: %s", resp.StatusCode, body)
+	}
+
+	// Locking the device tells the owner, without the passcode.
+	if status := srv.queue(user, devId, replyType{"l": replyType{
+		"c": "1234", "m": "Call me"}}); status != 200 {
+		t.Fatalf("Lock failed: %d", status)
+	}
+	srv.expectPush(devId)
+	if msg := sink.expect(t, "nina@example.com"); msg.Lang != "fr" ||
+		msg.Subject != "nina va être verrouillé" ||
+		strings.Contains(msg.Body, "1234") {
+		t.Errorf("Unexpected mail %+v", msg)
+	}
+	srv.post("/1/preferences/", replyType{"muted": []string{NOTICE_LOCK_ISSUED}},
+		header, user.cookies)
+	srv.queue(user, devId, replyType{"l": replyType{"m": "Call me"}})
+	srv.expectPush(devId)
+	sink.expectNone(t)
+
+	// Lost devices send their position, but not every time.
+	if status := srv.queue(user, devId, replyType{"o": replyType{
+		"m": "Please return me"}}); status != 200 {
+		t.Fatalf("Lost mode failed: %d", status)
+	}
+	srv.expectPush(devId)
+	sink.expectNone(t)
+	fixTime := time.Now().Unix()
+	srv.cmd(dev, replyType{"o": replyType{"ok": true, "la": 45.52,
+		"lo": -122.68, "ac": 10.0, "ti": fixTime}})
+	if msg := sink.expect(t, "nina@example.com"); msg.Subject != "nina a signalé sa position" ||
+		!strings.Contains(msg.Body, "45.52000, -122.68000") {
+		t.Errorf("Unexpected mail %+v", msg)
+	}
+	srv.cmd(dev, replyType{"o": replyType{"ok": true, "la": 45.53,
+		"lo": -122.68, "ac": 10.0, "ti": fixTime + 60}})
+	sink.expectNone(t)
+	// Fixes that aren't taken as the best location aren't sent.
+	srv.handler.noticeMu.Lock()
+	srv.handler.noticed = make(map[string]time.Time)
+	srv.handler.noticeMu.Unlock()
+	srv.cmd(dev, replyType{"o": replyType{"ok": true, "la": 48.85,
+		"lo": 2.35, "ac": 10.0, "ti": fixTime + 120}})
+	sink.expectNone(t)
+	srv.cmd(dev, replyType{"o": replyType{"ok": true, "la": 45.531,
+		"lo": -122.68, "ac": 10.0, "ti": fixTime + 180}})
+	if msg := sink.expect(t, "nina@example.com"); !strings.Contains(msg.Body,
+		"45.53100, -122.68000") {
+		t.Errorf("Unexpected mail %+v", msg)
+	}
+
+	// Turning email off stops the rest.
+	resp, body = srv.post("/1/preferences/", replyType{"email": false},
+		header, user.cookies)
+	if json.Unmarshal(body, &prefs) != nil || prefs.Email || prefs.Locale != "fr" ||
+		!reflect.DeepEqual(prefs.Muted, []string{NOTICE_LOCK_ISSUED}) {
+		t.Errorf("Preferences not updated: %s", body)
+	}
+	srv.register(newDevId(), "valid.nina")
+	sink.expectNone(t)
+}
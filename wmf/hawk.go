@@ -195,11 +195,34 @@ func (self *Hawk) GenerateSignature(req *http.Request, extra, body, secret strin
 // Initialize self from the AuthHeader
 func (self *Hawk) ParseAuthHeader(req *http.Request, logger *util.HekaLogger) (err error) {
 
-	auth := req.Header.Get("Authorization")
+	if err = self.parseHeader(req.Header.Get("Authorization")); err != nil {
+		return err
+	}
+	self.Path = getFullPath(req)
+	self.Method = strings.ToUpper(req.Method)
+	self.Host, self.Port = self.getHostPort(req)
+	if self.config.GetFlag("hawk.show_hash") {
+		self.logger.Debug("hawk", "Parsed Header",
+			util.Fields{"Time": self.Time,
+				"Nonce":  self.Nonce,
+				"Method": self.Method,
+				"Path":   self.Path,
+				"Host":   self.Host,
+				"Port":   self.Port,
+				"Extra":  self.Extra,
+				"Hash":   self.Hash,
+				"Sig":    self.Signature})
+	}
+	return err
+}
+
+// Read the Hawk values out of an Authorization header string.
+func (self *Hawk) parseHeader(auth string) (err error) {
 	if auth == "" {
 		return ErrNoAuth
 	}
-	if strings.ToLower(auth[:4]) != "hawk" {
+	// "Hawk" plus a separator
+	if len(auth) < 5 || !strings.EqualFold(auth[:4], "hawk") {
 		return ErrNotHawkAuth
 	}
 	elements := strings.Split(auth[5:], ", ")
@@ -224,22 +247,7 @@ func (self *Hawk) ParseAuthHeader(req *http.Request, logger *util.HekaLogger) (e
 			self.Signature = val
 		}
 	}
-	self.Path = getFullPath(req)
-	self.Method = strings.ToUpper(req.Method)
-	self.Host, self.Port = self.getHostPort(req)
-	if self.config.GetFlag("hawk.show_hash") {
-		self.logger.Debug("hawk", "Parsed Header",
-			util.Fields{"Time": self.Time,
-				"Nonce":  self.Nonce,
-				"Method": self.Method,
-				"Path":   self.Path,
-				"Host":   self.Host,
-				"Port":   self.Port,
-				"Extra":  self.Extra,
-				"Hash":   self.Hash,
-				"Sig":    self.Signature})
-	}
-	return err
+	return nil
 }
 
 // Compare a signature value against the generated Signature.
@@ -0,0 +1,100 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Device side HAWK. Signs the requests a device sends to the server and
+// checks the Authorization header the server returns with each reply.
+type HawkClient struct {
+	Id     string // device id
+	Secret string // HAWK secret returned by Register
+	// Port to sign with. Leave empty to use the port in the URL, set it
+	// when the server is configured with hawk.port (e.g. behind a proxy).
+	Port   string
+	Client *http.Client
+}
+
+func NewHawkClient(id, secret string, client *http.Client) *HawkClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HawkClient{Id: id, Secret: secret, Client: client}
+}
+
+// Start a new HAWK for the request, honoring any port override.
+func (self *HawkClient) newHawk(req *http.Request) *Hawk {
+	hawk := &Hawk{}
+	if self.Port != "" {
+		hawk.Host = strings.Split(req.Host, ":")[0]
+		hawk.Port = self.Port
+	}
+	return hawk
+}
+
+// Add the HAWK Authorization header for body to the request.
+func (self *HawkClient) Sign(req *http.Request, body []byte) (err error) {
+	hawk := self.newHawk(req)
+	if err = hawk.GenerateSignature(req, "", string(body), self.Secret); err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", hawk.AsHeader(req, self.Id,
+		string(body), "", self.Secret))
+	return nil
+}
+
+// Verify the server's HAWK Authorization header against the reply body.
+// The reply is signed using the original request's method, path and
+// content type, so resp.Request must be the request that was sent.
+func (self *HawkClient) Verify(resp *http.Response, body []byte) (err error) {
+	rhawk := Hawk{}
+	if err = rhawk.parseHeader(resp.Header.Get("Authorization")); err != nil {
+		return err
+	}
+	lhawk := self.newHawk(resp.Request)
+	lhawk.Nonce = rhawk.Nonce
+	lhawk.Time = rhawk.Time
+	lhawk.Method = strings.ToUpper(resp.Request.Method)
+	if err = lhawk.GenerateSignature(resp.Request, rhawk.Extra,
+		string(body), self.Secret); err != nil {
+		return err
+	}
+	if !lhawk.Compare(rhawk.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Send a signed JSON request and return the reply body.
+// Successful replies must carry a valid server signature; error replies
+// (which the server does not sign) are returned as is along with the
+// status code for the caller to handle.
+func (self *HawkClient) Do(method, url string, body []byte) (reply []byte, status int, err error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err = self.Sign(req, body); err != nil {
+		return nil, 0, err
+	}
+	resp, err := self.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if reply, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		err = self.Verify(resp, reply)
+	}
+	return reply, resp.StatusCode, err
+}
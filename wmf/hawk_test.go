@@ -0,0 +1,84 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const hawkSecret = "NK4v4Wfkk+XPj48lmyWEzw=="
+
+// Server side check, as verifyHawkHeader does it.
+func checkRequest(req *http.Request, body []byte, secret string) error {
+	rhawk := Hawk{}
+	if err := rhawk.ParseAuthHeader(req, nil); err != nil {
+		return err
+	}
+	lhawk := Hawk{Nonce: rhawk.Nonce, Time: rhawk.Time, Method: rhawk.Method}
+	lhawk.GenerateSignature(req, rhawk.Extra, string(body), secret)
+	if !lhawk.Compare(rhawk.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func TestHawkSignRequest(t *testing.T) {
+	body := []byte(`{"t":{"ok":true}}`)
+	req, _ := http.NewRequest("POST", "http://localhost:8080/1/cmd/0123", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	client := NewHawkClient("0123", hawkSecret, nil)
+	if err := client.Sign(req, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRequest(req, body, hawkSecret); err != nil {
+		t.Errorf("Signed request did not verify: %s", err)
+	}
+	if err := checkRequest(req, []byte(`{}`), hawkSecret); err != ErrInvalidSignature {
+		t.Errorf("Altered body verified: %v", err)
+	}
+	if err := checkRequest(req, body, "wrong"); err != ErrInvalidSignature {
+		t.Errorf("Wrong secret verified: %v", err)
+	}
+	// Proxied servers sign with a fixed port.
+	client.Port = "443"
+	client.Sign(req, body)
+	if err := checkRequest(req, body, hawkSecret); err != ErrInvalidSignature {
+		t.Errorf("Port override ignored: %v", err)
+	}
+}
+
+func TestHawkVerifyReply(t *testing.T) {
+	reply := `{"r":{"d":10}}`
+	var secret = hawkSecret
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			hawk := Hawk{}
+			resp.Header().Add("Authorization",
+				hawk.AsHeader(req, "0123", reply, "", secret))
+			resp.Write([]byte(reply))
+		}))
+	defer srv.Close()
+
+	client := NewHawkClient("0123", hawkSecret, nil)
+	body, status, err := client.Do("POST", srv.URL+"/1/cmd/0123", nil)
+	if err != nil || status != 200 || string(body) != reply {
+		t.Fatalf("Unexpected reply %d %s: %v", status, body, err)
+	}
+	secret = "wrong"
+	if _, _, err = client.Do("POST", srv.URL+"/1/cmd/0123", nil); err != ErrInvalidSignature {
+		t.Errorf("Bad reply signature accepted: %v", err)
+	}
+
+	// Replies without a signature are refused.
+	resp := &http.Response{Header: http.Header{}, Request: &http.Request{}}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	if err = client.Verify(resp, nil); err != ErrNoAuth {
+		t.Errorf("Unsigned reply accepted: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"time"
+)
+
+/* Lost mode ("o").
+   Locks the device (with c, if given), shows the finder message (m) and
+   the owner's contact phone (p) and email (e), and has the device report
+   its position every cmd.o.interval seconds. The device stays lost, as
+   far as the UI is concerned, until the owner sends {"o": {"off": true}}.
+
+   The device is sent:
+       {"o": {"c": "1234", "m": "...", "p": "...", "e": "...", "i": 300}}
+   or, to leave lost mode:
+       {"o": {"off": true}}
+
+   While the device is lost, the owner is sent its best location (see
+   position.go) when that changes, at most once every
+   notify.lost_interval (default 1h).
+*/
+
+func init() {
+	RegisterCommand(&Command{
+		Name: "o",
+		Args: []CommandArg{
+			{Name: "c", Type: ARG_PASSCODE},
+			{Name: "m", Type: ARG_STRING, MaxLen: 100, Text: true,
+				MaxLenKey: "cmd.m.max_len", AsciiFlag: "ascii_message_only"},
+			{Name: "p", Type: ARG_STRING, MaxLen: 32, Filter: phoneFilter},
+			{Name: "e", Type: ARG_STRING, MaxLen: 254, Filter: emailFilter},
+			{Name: "off", Type: ARG_BOOL},
+		},
+		ReauthArg: "c",
+		OnQueue:   lostQueue,
+		// Lost devices report where they are.
+		OnReply: trackReply,
+	})
+}
+
+// Record the lost mode state, and add the tracking interval.
+func lostQueue(self *Handler, devRec *storage.Device, userId string, args replyType) (replyType, error) {
+	if off, _ := args["off"].(bool); off {
+		self.logger.Info(self.logCat, "Leaving lost mode",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": userId})
+		if err := self.store.SetLostMode(devRec.ID, nil); err != nil {
+			return nil, err
+		}
+		self.metrics.Increment("device.lost.off")
+		return replyType{"off": true}, nil
+	}
+	delete(args, "off")
+	lost := &storage.LostMode{Since: time.Now().UTC().Unix()}
+	lost.Message, _ = args["m"].(string)
+	lost.Phone, _ = args["p"].(string)
+	lost.Email, _ = args["e"].(string)
+	self.logger.Info(self.logCat, "Entering lost mode",
+		util.Fields{"deviceId": devRec.ID,
+			"userId": userId})
+	if err := self.store.SetLostMode(devRec.ID, lost); err != nil {
+		return nil, err
+	}
+	self.metrics.Increment("device.lost.on")
+	args["i"] = self.argLimit("cmd.o.interval", 300)
+	return args, nil
+}
+
+// Tell the owner where their lost device is, unless they were told
+// recently. location is the new best location, so rejected fixes
+// aren't passed on.
+func (self *Handler) lostLocation(devId string, location storage.Position) {
+	devRec, err := self.store.GetDeviceInfo(devId)
+	if err != nil || devRec == nil || devRec.Lost == nil {
+		return
+	}
+	key := NOTICE_LOST_LOCATION + "." + devId
+	now := time.Now()
+	self.noticeMu.Lock()
+	if last, ok := self.noticed[key]; ok &&
+		now.Sub(last) < getDuration(self.config, "notify.lost_interval", "1h") {
+		self.noticeMu.Unlock()
+		return
+	}
+	self.noticed[key] = now
+	self.noticeMu.Unlock()
+	self.notify(devRec, NOTICE_LOST_LOCATION, replyType{
+		"latitude":  location.Latitude,
+		"longitude": location.Longitude,
+		"accuracy":  location.Accuracy,
+		"time":      location.Time})
+}
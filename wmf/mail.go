@@ -0,0 +1,328 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/* Notice emails.
+   Each notice event has a text/template per locale. The first line of
+   the rendered template is the subject, the rest (after a blank line)
+   is the body, followed by the locale's "footer" template. Templates
+   are given:
+       .Name       the device name
+       .When       when it happened (or, for scheduled events, is due)
+       .Near       where the device was last seen, if known
+       .Place      the geofence name, for geofence events
+       .By         who asked, if it wasn't the owner
+       .Latitude, .Longitude, .Accuracy  the reported position
+   English, French and German are built in. Set notify.templates to a
+   directory of <locale>/<event>.txt files to replace them or to add
+   locales. Owners who haven't picked a locale get
+   notify.default_locale ("en").
+
+   Mail is handed to a MailSender, normally SMTPSender.
+*/
+
+const MAIL_TIME_FORMAT = "2006-01-02 15:04 UTC"
+
+// The footer template added to every email.
+const MAIL_FOOTER = "footer"
+
+var mailTemplates = map[string]map[string]string{
+	"en": {
+		NOTICE_ERASE_SCHEDULED: "{{.Name}} will be erased\n\n" +
+			"An erase of {{.Name}} was requested, and will be sent to the device at {{.When}}.\n" +
+			"If you didn't ask for this, sign in to Find My Device and cancel it.\n",
+		NOTICE_ERASE_CONFIRMED: "{{.Name}} has been erased\n\n" +
+			"{{.Name}} confirmed that it was erased at {{.When}}, and has been removed from your account.\n",
+		NOTICE_ERASE_UNREACHABLE: "{{.Name}} could not be erased\n\n" +
+			"{{.Name}} could no longer be reached at {{.When}}, so it could not be told to erase itself.\n" +
+			"It has been removed from your account.\n",
+		NOTICE_GEOFENCE_ENTER: "{{.Name}} arrived at {{.Place}}\n\n" +
+			"{{.Name}} arrived at {{.Place}} at {{.When}}.\n",
+		NOTICE_GEOFENCE_EXIT: "{{.Name}} left {{.Place}}\n\n" +
+			"{{.Name}} left {{.Place}} at {{.When}}.\n",
+		NOTICE_LOCK_ISSUED: "{{.Name}} is being locked\n\n" +
+			"{{if .By}}{{.By}} asked{{else}}You asked{{end}} for {{.Name}} to be locked at {{.When}}.\n" +
+			"If this wasn't expected, sign in to Find My Device and check your account.\n",
+		NOTICE_ERASE_ISSUED: "{{.Name}} is being erased\n\n" +
+			"{{.Name}} was told to erase itself at {{.When}}{{if .By}}, at the request of {{.By}}{{end}}.\n" +
+			"If this wasn't expected, sign in to Find My Device and check your account.\n",
+		NOTICE_LOST_LOCATION: "{{.Name}} reported its location\n\n" +
+			"Your lost device {{.Name}} was at {{printf \"%.5f, %.5f\" .Latitude .Longitude}} " +
+			"(within {{printf \"%.0f\" .Accuracy}} m) at {{.When}}.\n",
+		NOTICE_DEVICE_ADDED: "{{.Name}} was added to your account\n\n" +
+			"{{.Name}} was registered with your Find My Device account at {{.When}}.\n" +
+			"If you didn't do this, sign in to Find My Device and remove it.\n",
+		MAIL_FOOTER: "{{if .Near}}It was last seen near {{.Near}}.\n{{end}}" +
+			"\nYou can choose which emails you get in Find My Device's settings.\n",
+	},
+	"fr": {
+		NOTICE_ERASE_SCHEDULED: "{{.Name}} va être effacé\n\n" +
+			"L'effacement de {{.Name}} a été demandé et sera envoyé à l'appareil le {{.When}}.\n" +
+			"Si vous n'êtes pas à l'origine de cette demande, connectez-vous à Localiser mon appareil pour l'annuler.\n",
+		NOTICE_ERASE_CONFIRMED: "{{.Name}} a été effacé\n\n" +
+			"{{.Name}} a confirmé son effacement le {{.When}} et a été retiré de votre compte.\n",
+		NOTICE_ERASE_UNREACHABLE: "{{.Name}} n'a pas pu être effacé\n\n" +
+			"{{.Name}} n'était plus joignable le {{.When}} et n'a donc pas pu recevoir l'ordre d'effacement.\n" +
+			"Il a été retiré de votre compte.\n",
+		NOTICE_GEOFENCE_ENTER: "{{.Name}} est arrivé à {{.Place}}\n\n" +
+			"{{.Name}} est arrivé à {{.Place}} le {{.When}}.\n",
+		NOTICE_GEOFENCE_EXIT: "{{.Name}} a quitté {{.Place}}\n\n" +
+			"{{.Name}} a quitté {{.Place}} le {{.When}}.\n",
+		NOTICE_LOCK_ISSUED: "{{.Name}} va être verrouillé\n\n" +
+			"{{if .By}}{{.By}} a demandé{{else}}Vous avez demandé{{end}} le verrouillage de {{.Name}} le {{.When}}.\n" +
+			"Si ce n'était pas prévu, connectez-vous à Localiser mon appareil pour vérifier votre compte.\n",
+		NOTICE_ERASE_ISSUED: "{{.Name}} va être effacé\n\n" +
+			"L'ordre d'effacement a été envoyé à {{.Name}} le {{.When}}{{if .By}}, à la demande de {{.By}}{{end}}.\n" +
+			"Si ce n'était pas prévu, connectez-vous à Localiser mon appareil pour vérifier votre compte.\n",
+		NOTICE_LOST_LOCATION: "{{.Name}} a signalé sa position\n\n" +
+			"Votre appareil perdu {{.Name}} se trouvait à {{printf \"%.5f, %.5f\" .Latitude .Longitude}} " +
+			"(à {{printf \"%.0f\" .Accuracy}} m près) le {{.When}}.\n",
+		NOTICE_DEVICE_ADDED: "{{.Name}} a été ajouté à votre compte\n\n" +
+			"{{.Name}} a été enregistré sur votre compte Localiser mon appareil le {{.When}}.\n" +
+			"Si vous n'êtes pas à l'origine de cet ajout, connectez-vous pour le retirer.\n",
+		MAIL_FOOTER: "{{if .Near}}Il a été vu pour la dernière fois près de {{.Near}}.\n{{end}}" +
+			"\nVous pouvez choisir les e-mails que vous recevez dans les paramètres de Localiser mon appareil.\n",
+	},
+	"de": {
+		NOTICE_ERASE_SCHEDULED: "{{.Name}} wird gelöscht\n\n" +
+			"Das Löschen von {{.Name}} wurde angefordert und wird am {{.When}} an das Gerät gesendet.\n" +
+			"Falls Sie das nicht angefordert haben, melden Sie sich bei Mein Gerät finden an und brechen Sie es ab.\n",
+		NOTICE_ERASE_CONFIRMED: "{{.Name}} wurde gelöscht\n\n" +
+			"{{.Name}} hat am {{.When}} bestätigt, dass es gelöscht wurde, und wurde aus Ihrem Konto entfernt.\n",
+		NOTICE_ERASE_UNREACHABLE: "{{.Name}} konnte nicht gelöscht werden\n\n" +
+			"{{.Name}} war am {{.When}} nicht mehr erreichbar und konnte daher nicht gelöscht werden.\n" +
+			"Es wurde aus Ihrem Konto entfernt.\n",
+		NOTICE_GEOFENCE_ENTER: "{{.Name}} ist bei {{.Place}} angekommen\n\n" +
+			"{{.Name}} ist am {{.When}} bei {{.Place}} angekommen.\n",
+		NOTICE_GEOFENCE_EXIT: "{{.Name}} hat {{.Place}} verlassen\n\n" +
+			"{{.Name}} hat {{.Place}} am {{.When}} verlassen.\n",
+		NOTICE_LOCK_ISSUED: "{{.Name}} wird gesperrt\n\n" +
+			"{{if .By}}{{.By}} hat{{else}}Sie haben{{end}} am {{.When}} das Sperren von {{.Name}} angefordert.\n" +
+			"Falls das unerwartet ist, melden Sie sich bei Mein Gerät finden an und prüfen Sie Ihr Konto.\n",
+		NOTICE_ERASE_ISSUED: "{{.Name}} wird gelöscht\n\n" +
+			"{{.Name}} wurde am {{.When}}{{if .By}} auf Wunsch von {{.By}}{{end}} angewiesen, sich zu löschen.\n" +
+			"Falls das unerwartet ist, melden Sie sich bei Mein Gerät finden an und prüfen Sie Ihr Konto.\n",
+		NOTICE_LOST_LOCATION: "{{.Name}} hat seinen Standort gemeldet\n\n" +
+			"Ihr verlorenes Gerät {{.Name}} war am {{.When}} bei {{printf \"%.5f, %.5f\" .Latitude .Longitude}} " +
+			"(auf {{printf \"%.0f\" .Accuracy}} m genau).\n",
+		NOTICE_DEVICE_ADDED: "{{.Name}} wurde Ihrem Konto hinzugefügt\n\n" +
+			"{{.Name}} wurde am {{.When}} bei Ihrem Konto für Mein Gerät finden registriert.\n" +
+			"Falls Sie das nicht waren, melden Sie sich an und entfernen Sie es.\n",
+		MAIL_FOOTER: "{{if .Near}}Es wurde zuletzt in der Nähe von {{.Near}} gesehen.\n{{end}}" +
+			"\nIn den Einstellungen von Mein Gerät finden können Sie wählen, welche E-Mails Sie erhalten.\n",
+	},
+}
+
+// What a notice template is given.
+type mailData struct {
+	Name      string
+	When      string
+	Near      string
+	Place     string
+	By        string
+	Latitude  float64
+	Longitude float64
+	Accuracy  float64
+}
+
+// Notice email templates, by locale.
+type MailTemplates struct {
+	defLocale string
+	locales   map[string]*template.Template
+}
+
+// Parse the built in templates, and any in notify.templates.
+func LoadMailTemplates(config *util.MzConfig) (self *MailTemplates, err error) {
+	self = &MailTemplates{
+		defLocale: strings.ToLower(config.Get("notify.default_locale", "en")),
+		locales:   make(map[string]*template.Template),
+	}
+	for locale, texts := range mailTemplates {
+		for event, text := range texts {
+			if err = self.add(locale, event, text); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if dir := config.Get("notify.templates", ""); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("notify.templates %q is not a directory", dir)
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*", "*.txt"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			text, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			locale := filepath.Base(filepath.Dir(file))
+			event := strings.TrimSuffix(filepath.Base(file), ".txt")
+			if err = self.add(strings.ToLower(locale), event, string(text)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, ok := self.locales[self.defLocale]; !ok {
+		return nil, fmt.Errorf("No templates for notify.default_locale %q",
+			self.defLocale)
+	}
+	return self, nil
+}
+
+func (self *MailTemplates) add(locale, event, text string) (err error) {
+	tmpl, ok := self.locales[locale]
+	if !ok {
+		tmpl = template.New(locale)
+		self.locales[locale] = tmpl
+	}
+	if _, err = tmpl.New(event).Parse(text); err != nil {
+		return fmt.Errorf("Invalid %s template for %s: %s", locale, event, err)
+	}
+	return nil
+}
+
+// The locales there are templates for.
+func (self *MailTemplates) Locales() (locales []string) {
+	for locale := range self.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// The closest locale there are templates for: the locale itself, its
+// language ("fr" for "fr-CA"), or the default.
+func (self *MailTemplates) Locale(want string) string {
+	want = strings.ToLower(strings.Replace(want, "_", "-", -1))
+	if _, ok := self.locales[want]; ok {
+		return want
+	}
+	lang := strings.SplitN(want, "-", 2)[0]
+	if _, ok := self.locales[lang]; ok {
+		return lang
+	}
+	return self.defLocale
+}
+
+// Find the event's template, falling back to the default locale, then
+// to English.
+func (self *MailTemplates) lookup(locale, event string) (tmpl *template.Template, lang string) {
+	for _, lang = range []string{locale, self.defLocale, "en"} {
+		if set, ok := self.locales[lang]; ok {
+			if tmpl = set.Lookup(event); tmpl != nil {
+				return tmpl, lang
+			}
+		}
+	}
+	return nil, ""
+}
+
+// Render the email for the event. ok is false if there's no template
+// for it.
+func (self *MailTemplates) Render(locale, event string, data *mailData) (subject, body, lang string, ok bool, err error) {
+	tmpl, lang := self.lookup(self.Locale(locale), event)
+	if tmpl == nil {
+		return "", "", "", false, nil
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", "", "", false, err
+	}
+	if footer := self.locales[lang].Lookup(MAIL_FOOTER); footer != nil {
+		if err = footer.Execute(&buf, data); err != nil {
+			return "", "", "", false, err
+		}
+	}
+	parts := strings.SplitN(buf.String(), "\n", 2)
+	subject = strings.TrimSpace(parts[0])
+	if len(parts) > 1 {
+		body = strings.TrimLeft(parts[1], "\r\n")
+	}
+	return subject, body, lang, true, nil
+}
+
+// Sends finished messages.
+type MailSender interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// Sends mail through an SMTP server.
+type SMTPSender struct {
+	addr string
+	auth smtp.Auth
+}
+
+func NewSMTPSender(config *util.MzConfig) (self *SMTPSender, err error) {
+	self = &SMTPSender{addr: config.Get("notify.smtp.host", "")}
+	host, _, err := net.SplitHostPort(self.addr)
+	if err != nil {
+		host = self.addr
+		self.addr = net.JoinHostPort(host, "25")
+	}
+	if user := config.Get("notify.smtp.user", ""); user != "" {
+		self.auth = smtp.PlainAuth("", user,
+			config.Get("notify.smtp.password", ""), host)
+	}
+	return self, nil
+}
+
+func (self *SMTPSender) Send(from string, to []string, msg []byte) error {
+	return smtp.SendMail(self.addr, self.auth, from, to, msg)
+}
+
+// Build a plain text message. The body is sent quoted-printable (which
+// also turns its line breaks into CRLFs), so any line length or
+// character set is fine.
+func mailMessage(from, to, subject, body, lang string, now time.Time) ([]byte, error) {
+	var msg bytes.Buffer
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "<> ")
+	}
+	msgId, _ := util.GenUUID4()
+	headers := [][2]string{
+		{"From", from},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + msgId + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=UTF-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+		{"Content-Language", lang},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
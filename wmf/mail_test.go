@@ -0,0 +1,234 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A message received by the SMTP sink.
+type sinkMail struct {
+	From    string
+	To      []string
+	Subject string
+	Lang    string
+	Body    string
+}
+
+// An SMTP server that accepts everything, for notify.smtp.host.
+type smtpSink struct {
+	listener net.Listener
+	mail     chan *sinkMail
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not start SMTP sink: %s", err)
+	}
+	self := &smtpSink{listener: listener, mail: make(chan *sinkMail, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go self.serve(t, conn)
+		}
+	}()
+	return self
+}
+
+func (self *smtpSink) Addr() string {
+	return self.listener.Addr().String()
+}
+
+func (self *smtpSink) Close() {
+	self.listener.Close()
+}
+
+func (self *smtpSink) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	msg := new(sinkMail)
+	reply("220 localhost SMTP sink")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg.From = strings.Trim(line[10:], "<> \r\n")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.To = append(msg.To, strings.Trim(line[8:], "<> \r\n"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 Go ahead")
+			data, _ := ioutil.ReadAll(textproto.NewReader(reader).DotReader())
+			parsed, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("Unreadable mail: %s", err)
+				return
+			}
+			msg.Subject, _ = new(mime.WordDecoder).DecodeHeader(
+				parsed.Header.Get("Subject"))
+			msg.Lang = parsed.Header.Get("Content-Language")
+			body, _ := ioutil.ReadAll(quotedprintable.NewReader(parsed.Body))
+			msg.Body = string(body)
+			reply("250 OK")
+			self.mail <- msg
+			msg = new(sinkMail)
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			// EHLO, HELO, RSET, NOOP
+			reply("250 OK")
+		}
+	}
+}
+
+// Wait for the next message.
+func (self *smtpSink) expect(t *testing.T, to string) *sinkMail {
+	select {
+	case msg := <-self.mail:
+		if len(msg.To) != 1 || msg.To[0] != to {
+			t.Errorf("Mail to %v, expected %s", msg.To, to)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No mail for %s", to)
+	}
+	return nil
+}
+
+// Make sure nothing else was sent.
+func (self *smtpSink) expectNone(t *testing.T) {
+	select {
+	case msg := <-self.mail:
+		t.Errorf("Unexpected mail %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMailTemplates(t *testing.T) {
+	templates, err := LoadMailTemplates(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &mailData{Name: "Phone", When: "2026-10-18 12:00 UTC",
+		Near: "Lyon", By: "sam@example.com"}
+	for _, test := range []struct {
+		locale, lang, subject, body string
+	}{
+		{"", "en", "Phone is being locked", "sam@example.com asked"},
+		{"fr-CA", "fr", "Phone va être verrouillé", "près de Lyon"},
+		{"de_AT", "de", "Phone wird gesperrt", "hat am 2026-10-18"},
+		{"xx", "en", "Phone is being locked", "last seen near Lyon"},
+	} {
+		subject, body, lang, ok, err := templates.Render(test.locale,
+			NOTICE_LOCK_ISSUED, data)
+		if !ok || err != nil || lang != test.lang || subject != test.subject ||
+			!strings.Contains(body, test.body) {
+			t.Errorf("%q: %q %q %q %v %v", test.locale, subject, body, lang, ok, err)
+		}
+	}
+	// Every event has a template in every built in locale.
+	for locale := range mailTemplates {
+		for _, event := range noticeEvents {
+			if _, lang := templates.lookup(locale, event); lang != locale {
+				t.Errorf("No %s template for %s", locale, event)
+			}
+		}
+	}
+	if _, _, _, ok, _ := templates.Render("en", "unknown.event", data); ok {
+		t.Errorf("Rendered an unknown event")
+	}
+
+	// Templates can be replaced, or added for other locales.
+	dir, err := ioutil.TempDir("", "fmd_templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "nl"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nl", NOTICE_LOCK_ISSUED+".txt"),
+		[]byte("{{.Name}} wordt vergrendeld\n\nDoor {{.By}}.\n"), 0644)
+	templates, err = LoadMailTemplates(newTestConfig(t,
+		"notify.templates="+dir, "notify.default_locale=fr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locales := templates.Locales(); strings.Join(locales, ",") != "de,en,fr,nl" {
+		t.Errorf("Unexpected locales %v", locales)
+	}
+	if subject, body, _, _, _ := templates.Render("nl", NOTICE_LOCK_ISSUED,
+		data); subject != "Phone wordt vergrendeld" ||
+		body != "Door sam@example.com.\n" {
+		t.Errorf("Template not added: %q %q", subject, body)
+	}
+	// Events without a template in the locale use the default's.
+	if _, _, lang, _, _ := templates.Render("nl", NOTICE_ERASE_ISSUED,
+		data); lang != "fr" {
+		t.Errorf("Expected the default locale, got %q", lang)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "nl", NOTICE_LOCK_ISSUED+".txt"),
+		[]byte("{{.Name"), 0644)
+	if _, err = LoadMailTemplates(newTestConfig(t,
+		"notify.templates="+dir)); err == nil {
+		t.Errorf("Invalid template loaded")
+	}
+	if _, err = LoadMailTemplates(newTestConfig(t,
+		"notify.default_locale=xx")); err == nil {
+		t.Errorf("Unknown default locale accepted")
+	}
+}
+
+func TestMailNotifier(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.Close()
+	config := newTestConfig(t, "notify.smtp.host="+sink.Addr(),
+		"notify.smtp.from=fmd@example.com")
+	templates, _ := LoadMailTemplates(config)
+	notifier, err := NewMailNotifier(config, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notice := &Notice{Event: NOTICE_GEOFENCE_ENTER,
+		Name:   "Phone\r\nBcc: someone@example.com",
+		Time:   1792324800,
+		Data:   replyType{"geofence": "Home"},
+		Locale: "de"}
+	if err = notifier.Notify(notice, "ana@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	msg := sink.expect(t, "ana@example.com")
+	if msg.From != "fmd@example.com" || msg.Lang != "de" ||
+		msg.Subject != "PhoneBcc: someone@example.com ist bei Home angekommen" ||
+		!strings.Contains(msg.Body, "am 2026-10-18 12:00 UTC bei Home") {
+		t.Errorf("Unexpected mail %+v", msg)
+	}
+	// Nothing is sent without an address.
+	notifier.Notify(notice, "")
+	sink.expectNone(t)
+}
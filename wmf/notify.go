@@ -0,0 +1,200 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"strings"
+	"time"
+)
+
+/* Owner notifications.
+   Owners are told about important things happening to their devices
+   (e.g. an erase being scheduled) by email, and notices are also sent
+   as webhook events (see webhooks.go), with the device's name and where
+   it was last seen added to the event's data:
+       {"id": "...", "event": "erase.scheduled", "userid": "...",
+        "deviceid": "...", "time": 1400000000,
+        "data": {"name": "...", "near": "...", ...}}
+   Email goes to the address the owner signed in with, through the SMTP
+   server at notify.smtp.host, in the owner's language (see mail.go for
+   the templates). If there's a geocoder, notices say where the device
+   was last seen ("near": "Portland, Oregon").
+
+   Owners are told when a device is added to their account, when a lock
+   or erase is sent to one of their devices, and (at most once every
+   notify.lost_interval per device) when a lost device reports where it
+   is, as well as about scheduled and confirmed erases and geofences.
+   Owners can turn email off, mute events, or pick a language at
+   /1/preferences/ (preferences.go); webhooks pick their own events.
+*/
+
+// Notice events
+const (
+	NOTICE_ERASE_SCHEDULED   = "erase.scheduled"
+	NOTICE_ERASE_CONFIRMED   = "erase.confirmed"
+	NOTICE_ERASE_UNREACHABLE = "erase.unreachable"
+	NOTICE_GEOFENCE_ENTER    = "geofence.enter"
+	NOTICE_GEOFENCE_EXIT     = "geofence.exit"
+	NOTICE_LOCK_ISSUED       = "lock.issued"
+	NOTICE_ERASE_ISSUED      = "erase.issued"
+	NOTICE_LOST_LOCATION     = "lost.location"
+	NOTICE_DEVICE_ADDED      = "device.added"
+)
+
+// Every notice event, for checking the events owners mute.
+var noticeEvents = []string{
+	NOTICE_DEVICE_ADDED,
+	NOTICE_LOCK_ISSUED,
+	NOTICE_ERASE_SCHEDULED,
+	NOTICE_ERASE_ISSUED,
+	NOTICE_ERASE_CONFIRMED,
+	NOTICE_ERASE_UNREACHABLE,
+	NOTICE_LOST_LOCATION,
+	NOTICE_GEOFENCE_ENTER,
+	NOTICE_GEOFENCE_EXIT,
+}
+
+type Notice struct {
+	Event    string
+	UserId   string
+	DeviceId string
+	Name     string
+	Time     int64
+	Near     string // where the device was last seen
+	Data     replyType
+	Locale   string // the owner's
+}
+
+type Notifier interface {
+	// email is the owner's address, if known.
+	Notify(notice *Notice, email string) error
+}
+
+type Notifiers []Notifier
+
+// Create the configured notifiers. There may be none.
+func NewNotifiers(config *util.MzConfig, templates *MailTemplates) (notifiers Notifiers, err error) {
+	if config.Get("notify.smtp.host", "") != "" {
+		mail, err := NewMailNotifier(config, templates)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, mail)
+	}
+	return notifiers, nil
+}
+
+// Tell the device's owner about the event, in the way they prefer, and
+// the webhooks that want it. Notices are sent in the background;
+// failures are only logged.
+func (self *Handler) notify(devRec *storage.Device, event string, data replyType) {
+	notice := &Notice{
+		Event:    event,
+		UserId:   devRec.User,
+		DeviceId: devRec.ID,
+		Name:     devRec.Name,
+		Time:     time.Now().UTC().Unix(),
+		Data:     data,
+	}
+	if place := self.placeNear(devRec.Best); place != nil {
+		notice.Near = place.String()
+	}
+	hookData := replyType{"name": notice.Name}
+	if notice.Near != "" {
+		hookData["near"] = notice.Near
+	}
+	for key, val := range data {
+		hookData[key] = val
+	}
+	self.emit(devRec, event, hookData)
+	if len(self.notifiers) == 0 {
+		return
+	}
+	email, err := self.store.GetUserEmail(devRec.User)
+	if err != nil {
+		email = ""
+	}
+	// Preferences only apply to email.
+	prefs, err := self.store.GetNotifyPrefs(devRec.User)
+	if err != nil || !prefs.Email || hasString(prefs.Muted, event) {
+		email = ""
+	}
+	notice.Locale = prefs.Locale
+	go func() {
+		for _, notifier := range self.notifiers {
+			if err := notifier.Notify(notice, email); err != nil {
+				self.logger.Warn("notify", "Could not send notice",
+					util.Fields{"error": err.Error(),
+						"event":    event,
+						"deviceId": devRec.ID,
+						"userId":   devRec.User})
+				self.metrics.Increment("notify.error")
+				continue
+			}
+			self.metrics.Increment("notify.sent")
+		}
+	}()
+}
+
+type MailNotifier struct {
+	from      string
+	sender    MailSender
+	templates *MailTemplates
+}
+
+func NewMailNotifier(config *util.MzConfig, templates *MailTemplates) (self *MailNotifier, err error) {
+	self = &MailNotifier{
+		from:      config.Get("notify.smtp.from", "noreply@localhost"),
+		templates: templates,
+	}
+	if self.sender, err = NewSMTPSender(config); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *MailNotifier) Notify(notice *Notice, email string) error {
+	if email == "" {
+		return nil
+	}
+	// Device names come from the device; don't let them add headers.
+	headerSafe := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1
+			}
+			return r
+		}, s)
+	}
+	data := &mailData{Name: headerSafe(notice.Name),
+		Near: notice.Near}
+	when := time.Unix(notice.Time, 0).UTC()
+	if at, ok := notice.Data["at"].(int64); ok {
+		when = time.Unix(at, 0).UTC()
+	}
+	data.When = when.Format(MAIL_TIME_FORMAT)
+	if place, ok := notice.Data["geofence"].(string); ok {
+		data.Place = headerSafe(place)
+	}
+	if by, ok := notice.Data["by"].(string); ok {
+		data.By = headerSafe(by)
+	}
+	data.Latitude, _ = notice.Data["latitude"].(float64)
+	data.Longitude, _ = notice.Data["longitude"].(float64)
+	data.Accuracy, _ = notice.Data["accuracy"].(float64)
+	subject, body, lang, ok, err := self.templates.Render(notice.Locale,
+		notice.Event, data)
+	if !ok || err != nil {
+		return err
+	}
+	msg, err := mailMessage(self.from, email, subject, body, lang, time.Now())
+	if err != nil {
+		return err
+	}
+	return self.sender.Send(self.from, []string{email}, msg)
+}
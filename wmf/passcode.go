@@ -0,0 +1,133 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/* Passcode policy.
+   Devices may say which passcodes they can set when they register:
+       "passcode": {"min": 4, "max": 16, "charset": "alnum"}
+   charset is "digits" (the default), "alnum" (ASCII letters and digits)
+   or "any" (any printable characters). Devices that don't say take
+   exactly four digits. A passcode ("c") that doesn't fit the policy is
+   refused with 400 and
+       {"error": "Invalid argument", "cmd": "l", "arg": "c",
+        "reason": "The passcode must be 4 digits"}
+   rather than being cut or padded into one the user didn't ask for.
+*/
+
+const (
+	PASSCODE_DIGITS  = "digits"
+	PASSCODE_ALNUM   = "alnum"
+	PASSCODE_ANY     = "any"
+	PASSCODE_MAX_LEN = 64
+)
+
+var defaultPasscodePolicy = storage.PasscodePolicy{
+	MinLen:  4,
+	MaxLen:  4,
+	Charset: PASSCODE_DIGITS,
+}
+
+// A command argument the user needs to fix.
+type ArgError struct {
+	Cmd    string
+	Arg    string
+	Reason string
+}
+
+func (self *ArgError) Error() string {
+	reply, _ := json.Marshal(replyType{
+		"error":  "Invalid argument",
+		"cmd":    self.Cmd,
+		"arg":    self.Arg,
+		"reason": self.Reason,
+	})
+	return string(reply)
+}
+
+// Read the passcode policy the device sent. Returns nil if it's not
+// usable.
+func parsePasscodePolicy(val interface{}) *storage.PasscodePolicy {
+	args, ok := val.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	policy := defaultPasscodePolicy
+	if min, ok := args["min"].(float64); ok {
+		policy.MinLen = int(min)
+	}
+	if max, ok := args["max"].(float64); ok {
+		policy.MaxLen = int(max)
+	}
+	if charset, ok := args["charset"].(string); ok {
+		policy.Charset = strings.ToLower(charset)
+	}
+	switch policy.Charset {
+	case PASSCODE_DIGITS, PASSCODE_ALNUM, PASSCODE_ANY:
+	default:
+		return nil
+	}
+	if policy.MinLen < 1 || policy.MaxLen < policy.MinLen ||
+		policy.MaxLen > PASSCODE_MAX_LEN {
+		return nil
+	}
+	return &policy
+}
+
+// The passcodes the device can set.
+func passcodePolicy(devRec *storage.Device) storage.PasscodePolicy {
+	if devRec == nil || devRec.Passcode == nil {
+		return defaultPasscodePolicy
+	}
+	return *devRec.Passcode
+}
+
+// Say why the passcode doesn't fit the policy, or "" if it does.
+func checkPasscode(policy storage.PasscodePolicy, code string) string {
+	var what string
+	var valid func(rune) bool
+
+	switch policy.Charset {
+	case PASSCODE_ALNUM:
+		what = "letters or digits"
+		valid = func(r rune) bool {
+			return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+		}
+	case PASSCODE_ANY:
+		what = "characters"
+		valid = func(r rune) bool {
+			return unicode.IsPrint(r) && r != utf8.RuneError
+		}
+	default:
+		what = "digits"
+		valid = func(r rune) bool {
+			return r >= '0' && r <= '9'
+		}
+	}
+	length := fmt.Sprintf("%d to %d", policy.MinLen, policy.MaxLen)
+	if policy.MinLen == policy.MaxLen {
+		length = fmt.Sprintf("%d", policy.MinLen)
+	}
+	reason := fmt.Sprintf("The passcode must be %s %s", length, what)
+	n := utf8.RuneCountInString(code)
+	if n < policy.MinLen || n > policy.MaxLen {
+		return reason
+	}
+	for _, r := range code {
+		if !valid(r) {
+			return reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"math"
+	"time"
+)
+
+/* Position filtering.
+   Devices report whatever fix they have, and a quick network fix can be
+   far worse than the GPS fix before it. Every report is stored and shown
+   as the device's last position, but the best known location (Best, in
+   the device state and UI updates) only moves to a fix that is:
+     - valid, and not older than the best one,
+     - not an impossible jump: getting there from the best fix mustn't
+       take more than position.max_speed meters a second, allowing for
+       the accuracy of both fixes,
+     - as accurate as the best one, if within position.window of it.
+   Fixes that don't report an accuracy are taken to be accurate to
+   position.unknown_accuracy meters. Fixes older than position.stale are
+   flagged Stale. A stale best location is replaced by the next valid
+   fix, so one bad fix can't keep the device pinned in place.
+*/
+
+// Why a fix wasn't taken as the best location.
+const (
+	FIX_INVALID  = "invalid"
+	FIX_OLDER    = "older"
+	FIX_SPEED    = "speed"
+	FIX_ACCURACY = "accuracy"
+)
+
+// Devices report fix times in seconds or milliseconds.
+func fixSeconds(t int64) int64 {
+	if t > 1e11 {
+		return t / 1000
+	}
+	return t
+}
+
+// Is the fix too old to show as current?
+func (self *Handler) staleFix(pos *storage.Position, now time.Time) bool {
+	stale := getDuration(self.config, "position.stale", "10m")
+	return stale > 0 && now.Unix()-fixSeconds(pos.Time) > int64(stale.Seconds())
+}
+
+// Should the fix replace the best location? If not, say why.
+func (self *Handler) betterFix(best *storage.Position, fix *storage.Position, now time.Time) (reason string) {
+	if fix.Time <= 0 || fix.Accuracy < 0 ||
+		math.Abs(fix.Latitude) > 90 || math.Abs(fix.Longitude) > 180 ||
+		(fix.Latitude == 0 && fix.Longitude == 0) {
+		return FIX_INVALID
+	}
+	if best == nil || self.staleFix(best, now) {
+		return ""
+	}
+	dt := fixSeconds(fix.Time) - fixSeconds(best.Time)
+	if dt < 0 {
+		return FIX_OLDER
+	}
+	accuracy := func(pos *storage.Position) float64 {
+		if pos.Accuracy > 0 {
+			return pos.Accuracy
+		}
+		return float64(getInt(self.config, "position.unknown_accuracy", 1000))
+	}
+	fixAccuracy, bestAccuracy := accuracy(fix), accuracy(best)
+	moved := haversine(best.Latitude, best.Longitude, fix.Latitude,
+		fix.Longitude) - fixAccuracy - bestAccuracy
+	maxSpeed := float64(getInt(self.config, "position.max_speed", 100))
+	if moved > 0 && (dt == 0 || moved/float64(dt) > maxSpeed) {
+		return FIX_SPEED
+	}
+	window := getDuration(self.config, "position.window", "60s")
+	if dt < int64(window.Seconds()) && fixAccuracy > bestAccuracy {
+		return FIX_ACCURACY
+	}
+	return ""
+}
+
+// Take the reported fix as the device's best location, if it is better.
+// Returns the best location, and whether it changed.
+func (self *Handler) filterPosition(devId string, fix storage.Position) (best *storage.Position, changed bool) {
+	devRec, err := self.store.GetDeviceInfo(devId)
+	if err != nil {
+		return nil, false
+	}
+	if reason := self.betterFix(devRec.Best, &fix, time.Now()); reason != "" {
+		self.logger.Debug(self.logCat, "Position not taken as best",
+			util.Fields{"deviceId": devId,
+				"reason": reason})
+		self.metrics.Increment("position.rejected." + reason)
+		return devRec.Best, false
+	}
+	if err = self.store.SetBestPosition(devId, fix); err != nil {
+		return devRec.Best, false
+	}
+	fix.Cmd = nil
+	return &fix, true
+}
@@ -0,0 +1,55 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"testing"
+	"time"
+)
+
+func TestBetterFix(t *testing.T) {
+	handler := newFuzzHandler(t)
+	now := time.Now()
+	t0 := now.Unix() - 300
+	// A good GPS fix in Portland.
+	gps := &storage.Position{Latitude: 45.52, Longitude: -122.68,
+		Accuracy: 10, Time: t0}
+	fix := func(lat, accuracy float64, dt int64) *storage.Position {
+		return &storage.Position{Latitude: lat, Longitude: -122.68,
+			Accuracy: accuracy, Time: t0 + dt}
+	}
+	for _, test := range []struct {
+		best *storage.Position
+		fix  *storage.Position
+		want string
+	}{
+		{nil, gps, ""},
+		{gps, fix(45.521, 10, 20), ""},
+		{gps, &storage.Position{Time: t0 + 20}, FIX_INVALID},
+		{gps, fix(95, 10, 20), FIX_INVALID},
+		{gps, fix(45.521, 10, -20), FIX_OLDER},
+		// ~55km in a minute
+		{gps, fix(46.02, 10, 60), FIX_SPEED},
+		// unless the fixes could be that far off
+		{gps, fix(45.53, 800, 5), FIX_ACCURACY},
+		// a worse fix 100m away, inside and after the window
+		{gps, fix(45.521, 500, 30), FIX_ACCURACY},
+		{gps, fix(45.521, 500, 90), ""},
+		// no accuracy is taken as poor accuracy
+		{gps, fix(45.521, 0, 30), FIX_ACCURACY},
+		// a stale best fix is replaced by anything valid
+		{fix(45.52, 10, -3600), fix(46.02, 2000, 0), ""},
+		// times in milliseconds
+		{&storage.Position{Latitude: 45.52, Longitude: -122.68,
+			Accuracy: 10, Time: t0 * 1000}, fix(46.02, 10, 60), FIX_SPEED},
+	} {
+		if got := handler.betterFix(test.best, test.fix, now); got != test.want {
+			t.Errorf("%+v after %+v: got %q, want %q", test.fix, test.best,
+				got, test.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+/* Notification preferences.
+   GET /1/preferences/ returns the signed in user's preferences:
+       {"locale": "fr", "email": true, "muted": ["lost.location"],
+        "locales": ["de", "en", "fr"], "events": [...]}
+   where locales and events are the choices there are. POST the fields
+   to change (e.g. {"email": false}); the reply is the same as for GET.
+   An empty locale uses the server's default. Preferences only apply to
+   email; webhooks get the notices they ask for.
+*/
+
+func (self *Handler) writePrefs(resp http.ResponseWriter, prefs storage.NotifyPrefs) {
+	if prefs.Muted == nil {
+		prefs.Muted = []string{}
+	}
+	output, _ := json.Marshal(replyType{"locale": prefs.Locale,
+		"email":   prefs.Email,
+		"muted":   prefs.Muted,
+		"locales": self.templates.Locales(),
+		"events":  noticeEvents})
+	resp.Write(output)
+}
+
+// Show (GET) or change (POST) the signed in user's notification
+// preferences.
+func (self *Handler) Preferences(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Preferences"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	session, err := sessionStore.Get(req, SESSION_NAME)
+	if err != nil || !self.checkToken(session, req) {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	userId, _, err := self.getUser(resp, req)
+	if err != nil || userId == "" {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	prefs, err := self.store.GetNotifyPrefs(userId)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		self.writePrefs(resp, prefs)
+	case "POST":
+		var args struct {
+			Locale *string
+			Email  *bool
+			Muted  *[]string
+		}
+		if err := json.NewDecoder(io.LimitReader(req.Body,
+			4096)).Decode(&args); err != nil {
+			http.Error(resp, "\"Invalid Preferences\"", http.StatusBadRequest)
+			return
+		}
+		reason := ""
+		if args.Locale != nil {
+			prefs.Locale = *args.Locale
+			if prefs.Locale != "" && !hasString(self.templates.Locales(), prefs.Locale) {
+				reason = "Unknown locale " + prefs.Locale
+			}
+		}
+		if args.Email != nil {
+			prefs.Email = *args.Email
+		}
+		if args.Muted != nil {
+			prefs.Muted = *args.Muted
+			for _, event := range prefs.Muted {
+				if !hasString(noticeEvents, event) {
+					reason = "Unknown event " + event
+				}
+			}
+		}
+		if reason != "" {
+			output, _ := json.Marshal(replyType{"error": "Invalid preferences",
+				"reason": reason})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+		if err = self.store.SetNotifyPrefs(userId, prefs); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		self.logger.Info(self.logCat, "Notification preferences changed",
+			util.Fields{"userId": userId})
+		self.metrics.Increment("preferences.set")
+		self.writePrefs(resp, prefs)
+	default:
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+	}
+}
@@ -7,43 +7,267 @@ package wmf
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"github.com/mozilla-services/FindMyDevice/util"
 	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func SendPush(devRec *storage.Device, config *util.MzConfig) error {
-	// wow, so very tempted to make sure this matches the known push server.
-	bbody := []byte{}
-	body := bytes.NewReader(bbody)
-	/* If your server is not trustfully signed, the following will fail.
-	   If partners are unable/unwilling to trustfully sign servers,
-	   it is possible to skip validation by using
-	    &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-	   however that is not advised as a general policy for damn good reasons.
-
-	*/
+var ErrUnknownPushType = errors.New("Unknown push type")
+
+// A way of waking devices.
+type PushProvider interface {
+	// Send a push to the device. payload may be nil.
+	Send(devRec *storage.Device, payload []byte) error
+	// Can the push carry a payload (e.g. an inline command) to the device?
+	CanCarry(devRec *storage.Device) bool
+}
+
+/* Devices may name their push provider when they register ("pushtype").
+   Otherwise devices with Web Push keys use "webpush", and the rest are
+   picked by the scheme of their push url. http(s) urls are SimplePush,
+   and webhook providers claim their own schemes (push.webhook.*.schemes)
+*/
+
+// Push providers, by name and by push url scheme.
+type PushProviders struct {
+	byName   map[string]PushProvider
+	byScheme map[string]PushProvider
+}
+
+// How a push service refused a push.
+const (
+	PUSH_TRANSIENT = iota // server trouble, try again later
+	PUSH_THROTTLED        // try again after RetryAfter
+	PUSH_GONE             // the endpoint no longer exists
+	PUSH_REJECTED         // bad request, trying again won't help
+)
+
+type PushError struct {
+	Status     int
+	Class      int
+	RetryAfter time.Duration
+}
+
+func (self *PushError) Error() string {
+	return fmt.Sprintf("Push Server Error: %d", self.Status)
+}
+
+// Check the push service response. Returns nil for success, otherwise
+// a *PushError.
+func checkPushResponse(resp *http.Response) error {
+	perr := &PushError{Status: resp.StatusCode}
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusNotFound, code == http.StatusGone:
+		perr.Class = PUSH_GONE
+	case code == http.StatusTooManyRequests:
+		perr.Class = PUSH_THROTTLED
+	case code >= 500:
+		perr.Class = PUSH_TRANSIENT
+	default:
+		perr.Class = PUSH_REJECTED
+	}
+	if perr.Class == PUSH_THROTTLED || perr.Class == PUSH_TRANSIENT {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"),
+			time.Now()); ok {
+			perr.Class = PUSH_THROTTLED
+			perr.RetryAfter = after
+		}
+	}
+	return perr
+}
+
+// Retry-After is either a number of seconds or an HTTP date.
+func parseRetryAfter(val string, now time.Time) (after time.Duration, ok bool) {
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(val); err == nil {
+		if after = when.Sub(now); after < 0 {
+			after = 0
+		}
+		return after, true
+	}
+	return 0, false
+}
+
+// Is this push failure worth trying again?
+func retryable(err error) bool {
+	switch err {
+	case ErrPayloadTooLarge, ErrInvalidSubscription, ErrPushQueueFull,
+		ErrUnreachable, ErrUnknownPushType:
+		return false
+	}
+	if perr, ok := err.(*PushError); ok {
+		return perr.Class == PUSH_TRANSIENT || perr.Class == PUSH_THROTTLED
+	}
+	// Network trouble.
+	return true
+}
+
+// Did the push service say the endpoint is gone?
+func pushGone(err error) bool {
+	perr, ok := err.(*PushError)
+	return ok && perr.Class == PUSH_GONE
+}
+
+// TLS settings for talking to push services. Partners with servers
+// signed by a private CA can add it with <prefix>ca_file, and partners
+// requiring mutual TLS can be given a client certificate with
+// <prefix>cert_file and <prefix>key_file.
+func pushTLSConfig(config *util.MzConfig, prefix string) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{}
+	if caFile := config.Get(prefix+"ca_file", ""); caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		certs, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(certs) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile := config.Get(prefix+"cert_file", ""); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile,
+			config.Get(prefix+"key_file", certFile))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Create an HTTP client for push requests. TLS options are read from
+// the config keys starting with prefix (e.g. "push.tls.")
+func NewPushClient(config *util.MzConfig, prefix string) (client *http.Client, err error) {
+	timeout := getDuration(config, "push.timeout", "10s")
+	tlsConfig, err := pushTLSConfig(config, prefix)
+	if err != nil {
+		return nil, err
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-		//NameToCertificate: config["partnerCertPool"],
-		//InsecureSkipVerify: true,
+		TLSClientConfig:       tlsConfig,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConnsPerHost:   int(getInt(config, "push.max_per_endpoint", 10)),
+	}
+	return &http.Client{Transport: tr, Timeout: timeout}, nil
+}
+
+// Split a comma separated config value.
+func configList(config *util.MzConfig, key string) (list []string) {
+	for _, item := range strings.Split(config.Get(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Create the push providers: simplepush, webpush, and any webhook
+// providers listed in push.webhooks.
+func NewPushProviders(config *util.MzConfig, logger *util.HekaLogger, client *http.Client, webPush *WebPush) (self *PushProviders, err error) {
+	simplePush := &SimplePush{client: client}
+	self = &PushProviders{
+		byName: map[string]PushProvider{
+			"simplepush": simplePush,
+			"webpush":    webPush,
 		},
+		byScheme: map[string]PushProvider{
+			"http":  simplePush,
+			"https": simplePush,
+		},
+	}
+	for _, name := range configList(config, "push.webhooks") {
+		hook, err := NewWebhookPush(config, logger, name)
+		if err != nil {
+			return nil, fmt.Errorf("push.webhook.%s: %s", name, err)
+		}
+		self.byName[name] = hook
+		for _, scheme := range configList(config, "push.webhook."+name+".schemes") {
+			self.byScheme[strings.ToLower(scheme)] = hook
+		}
+	}
+	return self, nil
+}
+
+// Find the provider for the device.
+func (self *PushProviders) For(devRec *storage.Device) (provider PushProvider, err error) {
+	if devRec.PushType != "" {
+		if provider, ok := self.byName[devRec.PushType]; ok {
+			return provider, nil
+		}
+		return nil, ErrUnknownPushType
+	}
+	if devRec.PushKey != "" {
+		return self.byName["webpush"], nil
 	}
+	if u, err := url.Parse(devRec.PushUrl); err == nil {
+		if provider, ok := self.byScheme[strings.ToLower(u.Scheme)]; ok {
+			return provider, nil
+		}
+	}
+	return nil, ErrUnknownPushType
+}
 
-	req, err := http.NewRequest("PUT", devRec.PushUrl, body)
+// Send the push with the device's provider.
+func (self *PushProviders) Send(devRec *storage.Device, payload []byte) error {
+	provider, err := self.For(devRec)
 	if err != nil {
 		return err
 	}
-	cli := http.Client{Transport: tr}
-	resp, err := cli.Do(req)
-	// Close the body, otherwise Memory leak!
-	defer resp.Body.Close()
+	return provider.Send(devRec, payload)
+}
+
+// Can the device's provider carry a payload?
+func (self *PushProviders) CanCarry(devRec *storage.Device) bool {
+	provider, err := self.For(devRec)
+	return err == nil && provider.CanCarry(devRec)
+}
+
+// SimplePush: an empty PUT to the device's push url.
+type SimplePush struct {
+	client *http.Client
+}
+
+func (self *SimplePush) Send(devRec *storage.Device, payload []byte) error {
+	// wow, so very tempted to make sure this matches the known push server.
+	req, err := http.NewRequest("PUT", devRec.PushUrl, bytes.NewReader(nil))
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		return errors.New("Push Server Error")
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
 	}
-	return nil
+	// Close the body, otherwise Memory leak!
+	defer resp.Body.Close()
+	return checkPushResponse(resp)
+}
+
+func (self *SimplePush) CanCarry(devRec *storage.Device) bool {
+	return false
 }
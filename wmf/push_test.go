@@ -0,0 +1,219 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckPushResponse(t *testing.T) {
+	later := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	for _, test := range []struct {
+		status     int
+		retryAfter string
+		class      int
+		after      time.Duration
+	}{
+		{http.StatusNotFound, "", PUSH_GONE, 0},
+		{http.StatusGone, "", PUSH_GONE, 0},
+		{http.StatusTooManyRequests, "30", PUSH_THROTTLED, 30 * time.Second},
+		{http.StatusTooManyRequests, "", PUSH_THROTTLED, 0},
+		{http.StatusServiceUnavailable, "", PUSH_TRANSIENT, 0},
+		{http.StatusServiceUnavailable, later, PUSH_THROTTLED, time.Hour},
+		{http.StatusBadRequest, "30", PUSH_REJECTED, 0},
+		{http.StatusRequestEntityTooLarge, "", PUSH_REJECTED, 0},
+	} {
+		resp := &http.Response{StatusCode: test.status, Header: http.Header{}}
+		resp.Header.Set("Retry-After", test.retryAfter)
+		perr, ok := checkPushResponse(resp).(*PushError)
+		if !ok || perr.Class != test.class {
+			t.Errorf("%d: unexpected class %+v", test.status, perr)
+			continue
+		}
+		// Allow for the clock moving on.
+		if diff := test.after - perr.RetryAfter; diff < 0 || diff > time.Minute {
+			t.Errorf("%d: unexpected Retry-After %s", test.status, perr.RetryAfter)
+		}
+		if retryable(perr) != (test.class == PUSH_TRANSIENT || test.class == PUSH_THROTTLED) {
+			t.Errorf("%d: wrong retry decision", test.status)
+		}
+	}
+	if err := checkPushResponse(&http.Response{StatusCode: http.StatusCreated}); err != nil {
+		t.Errorf("Success reported as %s", err)
+	}
+}
+
+func TestPushProviders(t *testing.T) {
+	config := newTestConfig(t, "push.webhooks=carrier",
+		"push.webhook.carrier.url=https://wake.example.com/",
+		"push.webhook.carrier.schemes=sms, tel")
+	pushers, err := NewPushProviders(config, nil, nil, &WebPush{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		dev      storage.Device
+		provider string
+	}{
+		{storage.Device{PushUrl: "https://push.example.com/1"}, "simplepush"},
+		{storage.Device{PushUrl: "https://push.example.com/1", PushKey: "k"}, "webpush"},
+		{storage.Device{PushUrl: "SMS:+15551234567"}, "carrier"},
+		{storage.Device{PushUrl: "https://push.example.com/1", PushType: "carrier"}, "carrier"},
+		{storage.Device{PushUrl: "udp:10.0.0.1"}, ""},
+		{storage.Device{PushUrl: "https://push.example.com/1", PushType: "bogus"}, ""},
+	} {
+		provider, err := pushers.For(&test.dev)
+		if test.provider == "" {
+			if err != ErrUnknownPushType {
+				t.Errorf("%+v: expected no provider, got %v", test.dev, provider)
+			}
+			continue
+		}
+		if err != nil || provider != pushers.byName[test.provider] {
+			t.Errorf("%+v: expected %s, got %v %v", test.dev, test.provider, provider, err)
+		}
+	}
+
+	if _, err = NewPushProviders(newTestConfig(t, "push.webhooks=broken"),
+		nil, nil, &WebPush{}); err == nil {
+		t.Error("Webhook without a url accepted")
+	}
+}
+
+// Write a PEM file to a temp file, returning the name.
+func writePEM(t *testing.T, blocks ...*pem.Block) string {
+	file, err := ioutil.TempFile("", "fmd_pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		pem.Encode(file, block)
+	}
+	file.Close()
+	return file.Name()
+}
+
+// Create a self-signed client certificate.
+func newClientCert(t *testing.T) (cert *x509.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fmd test client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, writePEM(t, &pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		writePEM(t, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestWebhookPush(t *testing.T) {
+	type wake struct {
+		body      []byte
+		signature string
+	}
+	wakes := make(chan wake, 10)
+	gateway := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			wakes <- wake{body, req.Header.Get("X-FMD-Signature")}
+			resp.WriteHeader(http.StatusAccepted)
+		}))
+	clientCert, certFile, keyFile := newClientCert(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	clients := x509.NewCertPool()
+	clients.AddCert(clientCert)
+	gateway.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: clients}
+	gateway.StartTLS()
+	defer gateway.Close()
+	caFile := writePEM(t, &pem.Block{Type: "CERTIFICATE",
+		Bytes: gateway.Certificate().Raw})
+	defer os.Remove(caFile)
+
+	srv := newTestServer(t, "push.webhooks=carrier",
+		"push.webhook.carrier.url="+gateway.URL,
+		"push.webhook.carrier.secret=sekrit",
+		"push.webhook.carrier.schemes=sms",
+		"push.webhook.carrier.tls.ca_file="+caFile,
+		"push.webhook.carrier.tls.cert_file="+certFile,
+		"push.webhook.carrier.tls.key_file="+keyFile)
+	defer srv.Close()
+
+	devId := newDevId()
+	if resp, body := srv.post("/1/register/", replyType{
+		"assert":   "valid.alice",
+		"pushurl":  "sms:+15551234567",
+		"deviceid": devId,
+		"accepts":  []string{"l", "r", "t", "e"}}, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Register failed %d: %s", resp.StatusCode, body)
+	}
+	user := srv.signin("alice")
+	if status := srv.queue(user, devId, replyType{"r": replyType{"d": 10}}); status != 200 {
+		t.Fatalf("Queue failed: %d", status)
+	}
+	select {
+	case got := <-wakes:
+		mac := hmac.New(sha256.New, []byte("sekrit"))
+		mac.Write(got.body)
+		if got.signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Bad signature %q", got.signature)
+		}
+		args := make(replyType)
+		json.Unmarshal(got.body, &args)
+		if args["deviceid"] != devId || args["pushurl"] != "sms:+15551234567" {
+			t.Errorf("Unexpected wake %s", got.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No wake sent")
+	}
+
+	// Devices need a provider we know.
+	for _, args := range []replyType{
+		{"pushurl": "udp:10.0.0.1"},
+		{"pushurl": srv.pushUrl(devId), "pushtype": "bogus"},
+	} {
+		args["assert"] = "valid.alice"
+		args["deviceid"] = devId
+		if resp, _ := srv.post("/1/register/", args, nil, nil); resp.StatusCode != 400 {
+			t.Errorf("Registered %v: %d", args, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/gorilla/sessions"
+
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/* Step-up authentication.
+   Commands that can't be undone, or that set a new passcode, need the
+   user to have signed in within auth.reauth_age. A long lived session
+   cookie isn't enough. Otherwise the command is refused (403 for REST,
+   instead of "true" on the websocket) with
+       {"error": 403, "cmd": "e", "reauth": "/signin/?max_age=300"}
+   The UI sends the user to the reauth url, which has FxA ask for their
+   password again, and resends the command once they're back. Only that
+   step-up login sets the sign in time, taken from FxA's auth_time (when
+   the password was entered), and only if it's within auth.reauth_age;
+   a silent sign in clears it. Deleting the account and adding a webhook
+   are held to the same rule.
+*/
+
+// When the session last signed in (UTC seconds), 0 if unknown.
+func sessionAuthTime(session *sessions.Session) int64 {
+	if session == nil {
+		return 0
+	}
+	authTime, _ := session.Values[SESSION_AUTHTIME].(int64)
+	return authTime
+}
+
+// Return a challenge if the user needs to sign in again before the
+// command is accepted.
+func (self *Handler) checkReauth(cmd string, args replyType, authTime int64) (challenge replyType) {
+	command, ok := getCommand(cmd)
+	if !ok {
+		// Queue will refuse it.
+		return nil
+	}
+	if _, given := args[command.ReauthArg]; !command.Reauth &&
+		(command.ReauthArg == "" || !given) {
+		return nil
+	}
+	if challenge = self.reauthChallenge(authTime); challenge != nil {
+		self.metrics.Increment("cmd.reauth." + command.Name)
+		challenge["cmd"] = cmd
+	}
+	return challenge
+}
+
+// Return a challenge if the user hasn't signed in recently enough.
+func (self *Handler) reauthChallenge(authTime int64) (challenge replyType) {
+	maxAge := getDuration(self.config, "auth.reauth_age", "10m")
+	if maxAge <= 0 || self.config.Get("auth.force_user", "") != "" {
+		return nil
+	}
+	if authTime > 0 && time.Since(time.Unix(authTime, 0)) <= maxAge {
+		return nil
+	}
+	return replyType{
+		"error":  http.StatusForbidden,
+		"reauth": fmt.Sprintf("/signin/?max_age=%d", int64(maxAge.Seconds())),
+	}
+}
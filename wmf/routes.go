@@ -0,0 +1,100 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"code.google.com/p/go.net/websocket"
+
+	"fmt"
+	"net/http"
+)
+
+// Attach the REST, WebUI and websocket handlers to mux.
+// verRoot is the API version prefix (e.g. "1" for "/1/register/")
+func (self *Handler) HandleRoutes(mux *http.ServeMux, verRoot string) {
+	// REST calls
+	mux.HandleFunc(fmt.Sprintf("/%s/register/", verRoot),
+		self.Register)
+	mux.HandleFunc(fmt.Sprintf("/%s/cmd/", verRoot),
+		self.Cmd)
+	mux.HandleFunc(fmt.Sprintf("/%s/pushkey/", verRoot),
+		self.PushKey)
+	// Web UI calls
+	mux.HandleFunc(fmt.Sprintf("/%s/queue/", verRoot),
+		self.RestQueue)
+	mux.HandleFunc(fmt.Sprintf("/%s/scheduled/", verRoot),
+		self.Scheduled)
+	mux.HandleFunc(fmt.Sprintf("/%s/tracking/", verRoot),
+		self.Tracking)
+	mux.HandleFunc(fmt.Sprintf("/%s/geofences/", verRoot),
+		self.Geofences)
+	mux.HandleFunc(fmt.Sprintf("/%s/shares/", verRoot),
+		self.Shares)
+	mux.HandleFunc(fmt.Sprintf("/%s/access/", verRoot),
+		self.Access)
+	mux.HandleFunc(fmt.Sprintf("/%s/invitations/", verRoot),
+		self.AcceptInvitation)
+	mux.HandleFunc(fmt.Sprintf("/%s/export/", verRoot),
+		self.Export)
+	mux.HandleFunc(fmt.Sprintf("/%s/account/", verRoot),
+		self.DeleteAccount)
+	mux.HandleFunc(fmt.Sprintf("/%s/audit/", verRoot),
+		self.Audit)
+	mux.HandleFunc(fmt.Sprintf("/%s/webhooks/", verRoot),
+		self.Webhooks)
+	mux.HandleFunc(fmt.Sprintf("/%s/preferences/", verRoot),
+		self.Preferences)
+	mux.HandleFunc(fmt.Sprintf("/%s/state/", verRoot),
+		self.State)
+	// Static files (served by nginx in production)
+	if self.config.GetFlag("use_insecure_static") {
+		mux.HandleFunc("/bower_components/",
+			self.Static)
+		mux.HandleFunc("/images/",
+			self.Static)
+		mux.HandleFunc("/scripts/",
+			self.Static)
+		mux.HandleFunc("/styles/",
+			self.Static)
+	}
+	// Metrics
+	mux.HandleFunc("/metrics/",
+		self.Metrics)
+	// Operations call
+	mux.HandleFunc("/status/",
+		self.Status)
+	//Signin
+	// set state nonce & check if valid at signin
+	mux.HandleFunc("/signin/",
+		self.Signin)
+	//Signout
+	mux.HandleFunc("/signout/",
+		self.Signout)
+	// Config option because there are other teams involved.
+	auth := self.config.Get("fxa.redir_uri", "/oauth/")
+	mux.HandleFunc(auth, self.OAuthCallback)
+
+	mux.Handle(fmt.Sprintf("/%s/ws/", verRoot),
+		websocket.Handler(self.WSSocketHandler))
+	// Read-only location sharing; no sign in needed
+	mux.HandleFunc(fmt.Sprintf("/%s/shared/", verRoot),
+		self.Shared)
+	mux.Handle(fmt.Sprintf("/%s/shared/ws/", verRoot),
+		websocket.Handler(self.WSShareHandler))
+	mux.HandleFunc("/share/",
+		self.SharePage)
+	// Handle root calls as webUI
+	// Get a list of registered devices for the currently logged in user
+	mux.HandleFunc(fmt.Sprintf("/%s/devices/", verRoot),
+		self.UserDevices)
+	// Get an object describing the data for a user's device
+	// e.g. http://host/0/data/0123deviceid
+	mux.HandleFunc(fmt.Sprintf("/%s/data/", verRoot),
+		self.InitDataJson)
+	mux.HandleFunc(fmt.Sprintf("/%s/validate/", verRoot),
+		self.Validate)
+	mux.HandleFunc("/",
+		self.Index)
+}
@@ -0,0 +1,320 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* Scheduled commands.
+   Commands sent with "at" (UTC seconds, or an RFC 3339 time) or "delay"
+   (seconds, or a duration such as "24h") are stored, and queued for the
+   device when they're due. e.g.
+       {"r": {"d": 30, "at": "2014-06-01T07:00:00Z"}}
+       {"e": {"delay": "24h"}}
+   The Scheduler looks for due commands every schedule.interval. The
+   owner can list and cancel them with /1/scheduled/<deviceid>
+   A command that can't be queued (e.g. the store is down) is put back
+   and tried again later, backing off from schedule.interval, up to
+   schedule.max_attempts times in all.
+*/
+
+var (
+	ErrInvalidSchedule = errors.New("Invalid command schedule")
+	ErrScheduleTooLate = errors.New("Command scheduled too far ahead")
+)
+
+// Get the time the command should be queued from its arguments.
+// Returns 0 if it should be queued now.
+func scheduleTime(args replyType, now time.Time, maxDelay time.Duration) (when int64, err error) {
+	var at time.Time
+
+	if v, ok := args["at"]; ok {
+		switch v.(type) {
+		case float64:
+			at = time.Unix(int64(v.(float64)), 0)
+		case string:
+			if at, err = time.Parse(time.RFC3339, v.(string)); err != nil {
+				return 0, ErrInvalidSchedule
+			}
+		default:
+			return 0, ErrInvalidSchedule
+		}
+	} else if v, ok := args["delay"]; ok {
+		var delay time.Duration
+		switch v.(type) {
+		case float64:
+			delay = time.Duration(v.(float64)) * time.Second
+		case string:
+			if delay, err = time.ParseDuration(v.(string)); err != nil {
+				return 0, ErrInvalidSchedule
+			}
+		default:
+			return 0, ErrInvalidSchedule
+		}
+		at = now.Add(delay)
+	} else {
+		return 0, nil
+	}
+	if !at.After(now) {
+		return 0, nil
+	}
+	if at.Sub(now) > maxDelay {
+		return 0, ErrScheduleTooLate
+	}
+	return at.UTC().Unix(), nil
+}
+
+// Store the (sanitized) command to queue later.
+func (self *Handler) scheduleCommand(devRec *storage.Device, userId string, command *Command, args replyType, when int64, rep *replyType) (status int, err error) {
+	c := command.Name
+	jargs, err := json.Marshal(args)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("\"Invalid Command\"")
+	}
+	sched := storage.ScheduledCommand{
+		DeviceId: devRec.ID,
+		Cmd:      c,
+		Args:     string(jargs),
+		Time:     when,
+		By:       userId,
+	}
+	if sched.ID, err = self.store.ScheduleCommand(sched); err != nil {
+		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
+	}
+	self.logger.Info(self.logCat, "Command scheduled",
+		util.Fields{"cmd": c,
+			"deviceId": devRec.ID,
+			"userId":   userId,
+			"id":       sched.ID,
+			"time":     strconv.FormatInt(when, 10)})
+	self.metrics.Increment("cmd.scheduled." + c)
+	if command.Notice != "" {
+		self.notify(devRec, command.Notice, replyType{"id": sched.ID,
+			"at": when})
+	}
+	scheduled, _ := (*rep)["scheduled"].([]storage.ScheduledCommand)
+	(*rep)["scheduled"] = append(scheduled, sched)
+	return http.StatusOK, nil
+}
+
+// List (GET) or cancel (DELETE ?id=<id>) the device's scheduled
+// commands.
+func (self *Handler) Scheduled(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Scheduled"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	devRec, _, user := self.userDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "DELETE":
+		if !self.allowed(resp, devRec, user, ROLE_OPERATOR) {
+			return
+		}
+		id := req.FormValue("id")
+		found, err := self.store.CancelScheduled(devRec.ID, id)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if !found {
+			http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+			return
+		}
+		self.logger.Info(self.logCat, "Scheduled command cancelled",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": user.ID,
+				"id":     id})
+		self.metrics.Increment("cmd.scheduled.cancel")
+	default:
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	scheduled, err := self.store.GetScheduled(devRec.ID)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	if scheduled == nil {
+		scheduled = []storage.ScheduledCommand{}
+	}
+	output, _ := json.Marshal(replyType{"scheduled": scheduled})
+	resp.Write(output)
+}
+
+// Queues scheduled commands when they're due.
+type Scheduler struct {
+	handler  *Handler
+	logger   *util.HekaLogger
+	metrics  *util.Metrics
+	logCat   string
+	interval time.Duration
+	batch    int
+	attempts int
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// Create and start the scheduler. A schedule.interval of 0 disables it
+// (e.g. to leave scheduling to another server).
+func NewScheduler(handler *Handler) *Scheduler {
+	self := &Scheduler{
+		handler:  handler,
+		logger:   handler.logger,
+		metrics:  handler.metrics,
+		logCat:   "scheduler",
+		interval: getDuration(handler.config, "schedule.interval", "10s"),
+		batch:    int(getInt(handler.config, "schedule.batch", 100)),
+		attempts: int(getInt(handler.config, "schedule.max_attempts", 5)),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if self.interval <= 0 || self.batch <= 0 {
+		close(self.done)
+		return self
+	}
+	go self.run()
+	return self
+}
+
+// Stop the scheduler.
+func (self *Scheduler) Close() {
+	select {
+	case <-self.quit:
+	default:
+		close(self.quit)
+	}
+	<-self.done
+}
+
+func (self *Scheduler) run() {
+	defer close(self.done)
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.quit:
+			return
+		case <-ticker.C:
+			// Keep going while there's a backlog.
+			for self.fire() == self.batch {
+			}
+			self.sweepTracking()
+		}
+	}
+}
+
+// Queue the commands that are due, returning how many there were.
+func (self *Scheduler) fire() int {
+	defer func() {
+		if r := recover(); r != nil {
+			self.logger.Error(self.logCat, "Panic firing scheduled commands",
+				util.Fields{"error": fmt.Sprintf("%v", r)})
+		}
+	}()
+	store := self.handler.store
+	due, err := store.TakeDueCommands(time.Now().UTC().Unix(), self.batch)
+	if err != nil {
+		return 0
+	}
+	for _, sched := range due {
+		self.queue(sched)
+	}
+	return len(due)
+}
+
+// Queue the scheduled command, as if the user had just sent it.
+func (self *Scheduler) queue(sched storage.ScheduledCommand) {
+	store := self.handler.store
+	fields := util.Fields{"deviceId": sched.DeviceId,
+		"cmd": sched.Cmd,
+		"id":  sched.ID}
+	devRec, err := store.GetDeviceInfo(sched.DeviceId)
+	if err == storage.ErrUnknownDevice {
+		self.logger.Warn(self.logCat, "Dropping command for unknown device",
+			fields)
+		return
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+		self.retry(sched, fields)
+		return
+	}
+	args := make(replyType)
+	if err = json.Unmarshal([]byte(sched.Args), &args); err != nil {
+		fields["error"] = err.Error()
+		self.logger.Error(self.logCat, "Unreadable scheduled command", fields)
+		return
+	}
+	rep := make(replyType)
+	self.metrics.Increment("cmd.scheduled.fired")
+	// Commands scheduled before the scheduling user was recorded run as
+	// the device owner.
+	userId := sched.By
+	if userId == "" {
+		userId = devRec.User
+	}
+	fields["userId"] = userId
+	status, err := self.handler.queue(devRec, userId, AUDIT_SCHEDULER, sched.Cmd, &args, &rep, true)
+	switch err {
+	case nil:
+		if rep["error"] != nil {
+			self.logger.Warn(self.logCat, "Device no longer accepts command",
+				fields)
+		}
+	case ErrDeviceDeleted:
+		if err = self.handler.deleteDevice(AUDIT_SCHEDULER, devRec.User, devRec,
+			"unreachable"); err != nil {
+			fields["error"] = err.Error()
+			self.logger.Warn(self.logCat, "Could not remove device", fields)
+		}
+	default:
+		fields["error"] = err.Error()
+		if status != http.StatusServiceUnavailable {
+			// e.g. the user no longer has access to the device.
+			self.metrics.Increment("cmd.scheduled.denied")
+			self.logger.Warn(self.logCat, "Dropping scheduled command",
+				fields)
+			return
+		}
+		self.retry(sched, fields)
+	}
+}
+
+// Put the command back to try again later, unless it's been tried too
+// often already.
+func (self *Scheduler) retry(sched storage.ScheduledCommand, fields util.Fields) {
+	sched.Attempts++
+	fields["attempt"] = strconv.FormatInt(int64(sched.Attempts), 10)
+	if sched.Attempts >= self.attempts {
+		self.metrics.Increment("cmd.scheduled.failed")
+		self.logger.Error(self.logCat, "Giving up on scheduled command",
+			fields)
+		return
+	}
+	self.logger.Warn(self.logCat, "Could not queue scheduled command",
+		fields)
+	self.metrics.Increment("cmd.scheduled.retry")
+	sched.Time = time.Now().Add(backoffDelay(self.interval, time.Hour,
+		sched.Attempts)).UTC().Unix()
+	if err := self.handler.store.RescheduleCommand(sched); err != nil {
+		self.metrics.Increment("cmd.scheduled.failed")
+		fields["error"] = err.Error()
+		self.logger.Error(self.logCat, "Could not put back scheduled command",
+			fields)
+	}
+}
@@ -0,0 +1,317 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Location sharing.
+   Owners can share a lost device's location (with a friend, or the
+   police) without sharing their account. POST {"duration": 3600} to
+   /1/shares/<deviceid> creates a link, good for duration seconds
+   (share.duration if not given, at most share.max_duration):
+       {"ID": "...", "Expires": 1400003600, "Token": "<id>.<sig>",
+        "URL": "https://.../share/<id>.<sig>"}
+   The token is the share's id signed with share.secret (session.secret
+   if not set), so forged links are turned away before the store is
+   asked. GET lists the device's links and DELETE ?id=<id> revokes one.
+
+   Anyone with the link gets a read-only view: /1/shared/<token> gives
+   the device name and where it is, and the websocket
+   /1/shared/ws/<token> gets the position updates the owner's page does
+   (without command replies or device status). Nothing sent on that
+   socket is acted on. Viewers are disconnected once the link expires or
+   is revoked; other servers notice a revocation within share.check.
+*/
+
+const SHARE_ID_LEN = 32
+
+// What the owner is told about a share link.
+type shareLink struct {
+	storage.Share
+	Token string
+	URL   string
+}
+
+// What a share viewer is sent when the device reports its position.
+type sharedUpdate struct {
+	*storage.Position
+	Best *storage.Position `json:",omitempty"`
+	Near *Place            `json:",omitempty"`
+}
+
+// Strip a position down to what a share viewer may see.
+func sharedPosition(pos *storage.Position) *storage.Position {
+	if pos == nil {
+		return nil
+	}
+	return &storage.Position{Latitude: pos.Latitude,
+		Longitude: pos.Longitude,
+		Altitude:  pos.Altitude,
+		Accuracy:  pos.Accuracy,
+		Time:      pos.Time,
+		Stale:     pos.Stale}
+}
+
+// Sign the id of a share link or invitation (kind).
+func (self *Handler) tokenSig(kind, id string) string {
+	secret := self.config.Get("share.secret", "")
+	if secret == "" {
+		secret = self.config.Get("session.secret", "")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, kind+"."+id)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *Handler) shareLink(share storage.Share) shareLink {
+	token := share.ID + "." + self.tokenSig("share", share.ID)
+	return shareLink{Share: share,
+		Token: token,
+		URL:   self.config.Get("share.url", "") + "/share/" + token}
+}
+
+// Get the share for the token at the end of the URL. Returns nil if the
+// token is forged, or the share has expired or been revoked.
+func (self *Handler) shareFromUrl(req *http.Request) (share *storage.Share, err error) {
+	path := strings.TrimRight(req.URL.Path, "/")
+	token := path[strings.LastIndex(path, "/")+1:]
+	idsig := strings.SplitN(token, ".", 2)
+	if len(idsig) != 2 || len(idsig[0]) != SHARE_ID_LEN ||
+		!hmac.Equal([]byte(idsig[1]), []byte(self.tokenSig("share", idsig[0]))) {
+		self.metrics.Increment("share.invalid")
+		return nil, nil
+	}
+	return self.store.GetShare(idsig[0])
+}
+
+// Disconnect anyone watching through the share link on this server.
+func closeShare(devId, shareId string) {
+	muClient.RLock()
+	defer muClient.RUnlock()
+	for _, sock := range Clients[devId] {
+		if sock.Share == shareId {
+			sock.Socket.Close()
+		}
+	}
+}
+
+// List (GET), create (POST) or revoke (DELETE ?id=<id>) the device's
+// share links.
+func (self *Handler) Shares(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Shares"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	devRec, _, user := self.userDevice(resp, req)
+	if devRec == nil || !self.allowed(resp, devRec, user, ROLE_OWNER) {
+		return
+	}
+	store := self.store
+	switch req.Method {
+	case "GET":
+	case "POST":
+		args := make(replyType)
+		if err := json.NewDecoder(io.LimitReader(req.Body,
+			1024)).Decode(&args); err != nil && err != io.EOF {
+			http.Error(resp, "\"Invalid Share\"", http.StatusBadRequest)
+			return
+		}
+		duration := int64(getDuration(self.config, "share.duration", "1h").Seconds())
+		if d, ok := args["duration"].(float64); ok {
+			duration = int64(d)
+		}
+		maxDuration := getDuration(self.config, "share.max_duration", "24h")
+		if duration <= 0 || duration > int64(maxDuration.Seconds()) {
+			output, _ := json.Marshal(replyType{"error": "Invalid share",
+				"reason": "The duration must be 1 second to " +
+					maxDuration.String()})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+		shares, err := store.GetShares(devRec.ID)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if int64(len(shares)) >= getInt(self.config, "share.max", 10) {
+			output, _ := json.Marshal(replyType{"error": "Invalid share",
+				"reason": "Too many share links for this device"})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+		ib := make([]byte, SHARE_ID_LEN/2)
+		if _, err = rand.Read(ib); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		now := time.Now().UTC().Unix()
+		share := storage.Share{ID: hex.EncodeToString(ib),
+			DeviceId:  devRec.ID,
+			CreatedBy: user.ID,
+			Created:   now,
+			Expires:   now + duration}
+		if err = store.AddShare(share); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		self.logger.Info(self.logCat, "Location shared",
+			util.Fields{"deviceId": devRec.ID,
+				"userId":   user.ID,
+				"id":       share.ID,
+				"duration": strconv.FormatInt(duration, 10)})
+		self.metrics.Increment("share.add")
+		output, _ := json.Marshal(self.shareLink(share))
+		resp.Write(output)
+		return
+	case "DELETE":
+		id := req.FormValue("id")
+		found, err := store.DeleteShare(devRec.ID, id)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if !found {
+			http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+			return
+		}
+		self.logger.Info(self.logCat, "Share revoked",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": user.ID,
+				"id":     id})
+		self.metrics.Increment("share.delete")
+		closeShare(devRec.ID, id)
+	default:
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	shares, err := store.GetShares(devRec.ID)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	links := []shareLink{}
+	for _, share := range shares {
+		links = append(links, self.shareLink(share))
+	}
+	output, _ := json.Marshal(replyType{"shares": links})
+	resp.Write(output)
+}
+
+// Show a share viewer the device's name and where it is.
+func (self *Handler) Shared(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Shared"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	if req.Method != "GET" {
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	share, err := self.shareFromUrl(req)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	if share == nil {
+		http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+		return
+	}
+	devRec, err := self.store.GetDeviceInfo(share.DeviceId)
+	if err != nil {
+		http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	reply := struct {
+		Name     string
+		Expires  int64
+		Position *storage.Position `json:",omitempty"`
+		Best     *storage.Position `json:",omitempty"`
+		Near     *Place            `json:",omitempty"`
+	}{Name: devRec.Name, Expires: share.Expires}
+	if positions, err := self.store.GetPositions(devRec.ID); err == nil &&
+		len(positions) > 0 {
+		reply.Position = sharedPosition(&positions[0])
+		reply.Position.Stale = self.staleFix(reply.Position, now)
+	}
+	if reply.Best = sharedPosition(devRec.Best); reply.Best != nil {
+		reply.Best.Stale = self.staleFix(reply.Best, now)
+		reply.Near = self.placeNear(reply.Best)
+	} else {
+		reply.Near = self.placeNear(reply.Position)
+	}
+	self.metrics.Increment("share.view")
+	output, _ := json.Marshal(reply)
+	resp.Write(output)
+}
+
+// The read-only share view page.
+func (self *Handler) SharePage(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:SharePage"
+	docRoot := self.config.Get("document_root", "./static/app")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+	resp.Header().Set("Referrer-Policy", "no-referrer")
+	http.ServeFile(resp, req, docRoot+"/share.html")
+}
+
+// Websocket for share viewers. Position updates go out; nothing coming
+// in is acted on.
+func (self *Handler) WSShareHandler(ws *websocket.Conn) {
+	self.logCat = "handler:ShareSocket"
+	share, err := self.shareFromUrl(ws.Request())
+	if err != nil || share == nil {
+		socketError(ws, "Invalid Share")
+		return
+	}
+	devRec, err := self.store.GetDeviceInfo(share.DeviceId)
+	if err != nil {
+		socketError(ws, "Invalid Share")
+		return
+	}
+	ib := make([]byte, 4)
+	rand.Read(ib)
+	instance := hex.EncodeToString(ib)
+	sock := &WWS{
+		Socket:  ws,
+		Handler: self,
+		Device:  devRec,
+		Logger:  self.logger,
+		Born:    time.Now(),
+		Share:   share.ID,
+		Expires: time.Unix(share.Expires, 0),
+		Quit:    false}
+	if err := addClient(devRec.ID, instance, sock, self.maxCli); err != nil {
+		self.logger.Warn(self.logCat, "Could not add share viewer",
+			util.Fields{"deviceId": devRec.ID,
+				"id":    share.ID,
+				"error": err.Error()})
+		socketError(ws, "Too Many Connections")
+		return
+	}
+	self.trackingWatched(devRec.ID, self.store)
+	self.metrics.Increment("share.socket")
+	defer func() {
+		self.metrics.Decrement("share.socket")
+		if stopTrack, err := rmClient(devRec.ID, instance); err == nil && stopTrack {
+			self.trackingUnwatched(devRec.ID, self.store)
+		}
+	}()
+	sock.Run()
+}
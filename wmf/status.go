@@ -0,0 +1,111 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Device status.
+   Devices may add any of the following to a command reply (or to their
+   registration):
+       "battery": 0-100, "charging": true, "network": "wifi",
+       "carrier": "...", "app_version": "...", "os_version": "..."
+   Reported values replace the stored ones, anything not reported is
+   kept. The status goes to the UI with the position, and is flagged as
+   LowBattery when the device isn't charging and its battery is at or
+   below status.low_battery percent.
+*/
+
+// Longest status string kept.
+const STATUS_MAX_LEN = 64
+
+// What the UI is sent when the device replies.
+type pageUpdate struct {
+	storage.Position
+	Best       *storage.Position     `json:",omitempty"` // best known location
+	Near       *Place                `json:",omitempty"` // place near it
+	Status     *storage.DeviceStatus `json:",omitempty"`
+	LowBattery bool                  `json:",omitempty"`
+	Geofences  []geofenceEvent       `json:",omitempty"`
+}
+
+// Clean up a reported status string.
+func statusString(v interface{}) string {
+	s, _ := v.(string)
+	r := []rune(strings.TrimSpace(strings.Map(asciiOnly, s)))
+	return string(r[:minInt(STATUS_MAX_LEN, len(r))])
+}
+
+// Merge any status in the device's reply into its stored status.
+// Returns nil if the reply didn't include any.
+func (self *Handler) updateStatus(devId string, args map[string]interface{}) (status *storage.DeviceStatus, err error) {
+	var reported bool
+
+	if status, err = self.store.GetDeviceStatus(devId); err != nil {
+		return nil, err
+	}
+	if status == nil {
+		status = &storage.DeviceStatus{Battery: -1}
+	}
+	for key, arg := range args {
+		switch strings.ToLower(key) {
+		case "battery":
+			switch arg.(type) {
+			case float64:
+				status.Battery = int(arg.(float64))
+			case string:
+				status.Battery = int(self.rangeCheck(
+					strings.Map(digitsOnly, arg.(string)), 0, 100))
+			default:
+				continue
+			}
+			if status.Battery < 0 {
+				status.Battery = 0
+			} else if status.Battery > 100 {
+				status.Battery = 100
+			}
+		case "charging":
+			status.Charging = isTrue(arg)
+		case "network":
+			status.Network = strings.ToLower(statusString(arg))
+		case "carrier":
+			status.Carrier = statusString(arg)
+		case "app_version":
+			status.AppVersion = statusString(arg)
+		case "os_version":
+			status.OSVersion = statusString(arg)
+		default:
+			continue
+		}
+		reported = true
+	}
+	if !reported {
+		return nil, nil
+	}
+	status.Time = time.Now().UTC().Unix()
+	if err = self.store.SetDeviceStatus(devId, *status); err != nil {
+		return nil, err
+	}
+	self.metrics.Increment("device.status")
+	return status, nil
+}
+
+// Should the user be told to find the device while it still can be?
+func (self *Handler) lowBattery(status *storage.DeviceStatus) bool {
+	if status == nil || status.Battery < 0 || status.Charging {
+		return false
+	}
+	limit, err := strconv.ParseInt(self.config.Get("status.low_battery", "10"),
+		10, 64)
+	if err != nil {
+		limit = 10
+	}
+	return int64(status.Battery) <= limit
+}
@@ -0,0 +1,1222 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* In memory storage.
+   Mirrors the behavior of the postgres tables closely enough to run the
+   handlers without a database. Nothing survives a restart, so this is
+   for tests and local development only (db.type = memory).
+*/
+
+type memDevice struct {
+	Device
+	lastExchange time.Time
+}
+
+type memMapping struct {
+	userId string
+	name   string
+	date   time.Time
+}
+
+type memCommand struct {
+	id    int64
+	devId string
+	time  time.Time
+	cmd   string
+	ctype string
+	cmdId string
+}
+
+type memPosition struct {
+	time time.Time
+	Position
+}
+
+type memNonce struct {
+	val  string
+	time time.Time
+}
+
+type Memory struct {
+	sync.Mutex
+	config    *util.MzConfig
+	logger    *util.HekaLogger
+	metrics   *util.Metrics
+	logCat    string
+	defExpry  int64
+	lastId    int64
+	devices   map[string]*memDevice      // deviceInfo
+	owners    map[string]*memMapping     // userToDeviceMap, by deviceId
+	pending   []*memCommand              // pendingCommands
+	scheduled []*ScheduledCommand        // scheduledCommands
+	positions map[string][]*memPosition  // position, by deviceId
+	statuses  map[string]DeviceStatus    // deviceStatus, by deviceId
+	tracking  map[string]TrackingSession // trackingSessions, by deviceId
+	geofences []*Geofence                // geofences
+	shares    map[string]Share           // shares, by id
+	access    []*DeviceAccess            // deviceAccess
+	invites   map[string]Invitation      // invitations, by id
+	emails    map[string]string          // userInfo, by userId
+	prefs     map[string]NotifyPrefs     // notifyPrefs, by userId
+	nonces    map[string]*memNonce       // nonce, by key
+	tombs     map[string]time.Time       // tombstones, by kind.id
+	audit     []AuditEvent               // auditLog
+	webhooks  []Webhook                  // webhooks
+	delivered []WebhookDelivery          // webhookDeliveries
+	meta      map[string]string
+}
+
+// Create a new, empty memory store.
+func OpenMemory(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store *Memory, err error) {
+	defExpry, err := strconv.ParseInt(config.Get("db.default_expry", "432000"), 0, 64)
+	if err != nil {
+		defExpry = 432000
+	}
+	return &Memory{
+		config:    config,
+		logger:    logger,
+		metrics:   metrics,
+		logCat:    "storage:memory",
+		defExpry:  defExpry,
+		devices:   make(map[string]*memDevice),
+		owners:    make(map[string]*memMapping),
+		positions: make(map[string][]*memPosition),
+		statuses:  make(map[string]DeviceStatus),
+		tracking:  make(map[string]TrackingSession),
+		shares:    make(map[string]Share),
+		invites:   make(map[string]Invitation),
+		emails:    make(map[string]string),
+		prefs:     make(map[string]NotifyPrefs),
+		nonces:    make(map[string]*memNonce),
+		tombs:     make(map[string]time.Time),
+		meta:      make(map[string]string),
+	}, nil
+}
+
+func (self *Memory) Init() (err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.meta["db.ver"] = DB_VERSION
+	return nil
+}
+
+func (self *Memory) Close() {
+}
+
+// Register a new device to a given userID.
+func (self *Memory) RegisterDevice(userid string, dev Device) (devId string, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if dev.ID == "" {
+		dev.ID, _ = util.GenUUID4()
+	}
+	now := time.Now().UTC()
+	if dev.Passcode != nil {
+		policy := *dev.Passcode
+		dev.Passcode = &policy
+	}
+	if owner, ok := self.owners[dev.ID]; ok && owner.userId == userid {
+		rec := self.devices[dev.ID]
+		rec.HasPasscode = dev.HasPasscode
+		rec.LoggedIn = dev.LoggedIn
+		rec.Secret = dev.Secret
+		rec.Accepts = dev.Accepts
+		rec.PushUrl = dev.PushUrl
+		rec.PushKey = dev.PushKey
+		rec.PushAuth = dev.PushAuth
+		rec.PushType = dev.PushType
+		rec.Passcode = dev.Passcode
+		rec.Unreachable = false
+		rec.lastExchange = now
+		return dev.ID, nil
+	}
+	// deviceId is unique.
+	if _, ok := self.devices[dev.ID]; ok {
+		self.logger.Error(self.logCat, "Could not create device",
+			util.Fields{"error": "device already registered",
+				"deviceId": dev.ID})
+		return "", ErrDatabase
+	}
+	self.devices[dev.ID] = &memDevice{
+		Device: Device{
+			ID:          dev.ID,
+			HasPasscode: dev.HasPasscode,
+			LoggedIn:    dev.LoggedIn,
+			Secret:      dev.Secret,
+			Accepts:     dev.Accepts,
+			PushUrl:     dev.PushUrl,
+			PushKey:     dev.PushKey,
+			PushAuth:    dev.PushAuth,
+			PushType:    dev.PushType,
+			Passcode:    dev.Passcode,
+		},
+		lastExchange: now,
+	}
+	self.owners[dev.ID] = &memMapping{userId: userid, name: dev.Name,
+		date: now}
+	delete(self.tombs, TOMBSTONE_DEVICE+"."+dev.ID)
+	return dev.ID, nil
+}
+
+// Return known info about a device.
+func (self *Memory) GetDeviceInfo(devId string) (devInfo *Device, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	rec, ok := self.devices[devId]
+	owner, mapped := self.owners[devId]
+	if !ok || !mapped {
+		return nil, ErrUnknownDevice
+	}
+	reply := rec.Device
+	reply.User = owner.userId
+	reply.Name = owner.name
+	reply.LoggedIn = rec.PushUrl != ""
+	reply.LastExchange = int32(rec.lastExchange.Unix())
+	reply.Registered = owner.date.Unix()
+	if rec.Lost != nil {
+		lost := *rec.Lost
+		reply.Lost = &lost
+	}
+	if rec.Passcode != nil {
+		policy := *rec.Passcode
+		reply.Passcode = &policy
+	}
+	if rec.Best != nil {
+		best := *rec.Best
+		reply.Best = &best
+	}
+	return &reply, nil
+}
+
+func (self *Memory) GetPositions(devId string) (positions []Position, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	// as with postgres, only the oldest retained position is returned.
+	if recs := self.positions[devId]; len(recs) > 0 {
+		pos := recs[0].Position
+		pos.Time = recs[0].time.Unix()
+		positions = append(positions, pos)
+	}
+	return positions, nil
+}
+
+func (self *Memory) GetPositionHistory(devId string) (positions []Position, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rec := range self.positions[devId] {
+		pos := rec.Position
+		pos.Time = rec.time.Unix()
+		positions = append(positions, pos)
+	}
+	return positions, nil
+}
+
+func (self *Memory) GetPendingCommands(devId string) (pending []PendingCommand, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rec := range self.pending {
+		if rec.devId == devId {
+			pending = append(pending, PendingCommand{Cmd: rec.cmd,
+				Type: rec.ctype, Time: rec.time.Unix()})
+		}
+	}
+	return pending, nil
+}
+
+// Get pending commands.
+func (self *Memory) GetPending(devId string) (cmd, ctype string, err error) {
+	self.Lock()
+	for i, rec := range self.pending {
+		if rec.devId != devId {
+			continue
+		}
+		cmd, ctype = rec.cmd, rec.ctype
+		lifespan := int64(time.Now().UTC().Sub(rec.time).Seconds())
+		self.metrics.Timer("cmd.pending", lifespan)
+		self.pending = append(self.pending[:i], self.pending[i+1:]...)
+		break
+	}
+	self.Unlock()
+	self.Touch(devId)
+	return cmd, ctype, nil
+}
+
+func (self *Memory) GetUserFromDevice(deviceId string) (userId, name string, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if owner, ok := self.owners[deviceId]; ok {
+		return owner.userId, owner.name, nil
+	}
+	return "", "", ErrUnknownDevice
+}
+
+// Get all known devices for this user.
+func (self *Memory) GetDevicesForUser(userId, oldUserId string) (devices []DeviceList, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	limit, err := strconv.ParseInt(self.config.Get("db.max_devices_for_user", "1"), 0, 64)
+	if err != nil {
+		limit = 1
+	}
+	// Update from the old sha hash to the new FxA UID if need be.
+	if len(oldUserId) > 0 && userId != oldUserId {
+		hits := 0
+		for _, owner := range self.owners {
+			if owner.userId == oldUserId {
+				owner.userId = userId
+				hits++
+			}
+		}
+		self.metrics.IncrementBy("db.UserID.Updated", hits)
+	}
+	var found []*memMapping
+	ids := make(map[*memMapping]string)
+	for devId, owner := range self.owners {
+		if owner.userId == userId {
+			found = append(found, owner)
+			ids[owner] = devId
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].date.After(found[j].date)
+	})
+	for _, owner := range found {
+		if int64(len(devices)) >= limit {
+			break
+		}
+		devices = append(devices, self.listDevice(ids[owner], owner))
+	}
+	return devices, nil
+}
+
+// Every device the user owns, newest first.
+func (self *Memory) GetOwnedDevices(userId string) (devIds []string, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	var found []*memMapping
+	ids := make(map[*memMapping]string)
+	for devId, owner := range self.owners {
+		if owner.userId == userId {
+			found = append(found, owner)
+			ids[owner] = devId
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].date.After(found[j].date)
+	})
+	for _, owner := range found {
+		devIds = append(devIds, ids[owner])
+	}
+	return devIds, nil
+}
+
+// How the device shows up in device lists. Call with the lock held.
+func (self *Memory) listDevice(devId string, owner *memMapping) DeviceList {
+	name := owner.name
+	if name == "" {
+		name = devId
+	}
+	var unreachable, lost bool
+	if rec, ok := self.devices[devId]; ok {
+		unreachable = rec.Unreachable
+		lost = rec.Lost != nil
+	}
+	session, tracking := self.tracking[devId]
+	tracking = tracking && session.Expires > time.Now().Unix()
+	return DeviceList{ID: devId, Name: name,
+		Unreachable: unreachable, Lost: lost, Tracking: tracking}
+}
+
+// Store a command into the list of pending commands for a device.
+func (self *Memory) StoreCommand(devId, command, cType, cmdId string) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now().UTC()
+	for _, rec := range self.pending {
+		if rec.devId == devId && rec.ctype == cType {
+			rec.time = now
+			rec.cmd = command
+			rec.cmdId = cmdId
+			return nil
+		}
+	}
+	self.lastId++
+	self.pending = append(self.pending, &memCommand{
+		id:    self.lastId,
+		devId: devId,
+		time:  now,
+		cmd:   command,
+		ctype: cType,
+		cmdId: cmdId})
+	return nil
+}
+
+// Drop the device's pending command with the id, if it's still there.
+func (self *Memory) DeletePending(devId, cmdId string) (err error) {
+	if cmdId == "" {
+		return nil
+	}
+	self.Lock()
+	defer self.Unlock()
+	pending := self.pending[:0]
+	for _, rec := range self.pending {
+		if rec.devId != devId || rec.cmdId != cmdId {
+			pending = append(pending, rec)
+		}
+	}
+	self.pending = pending
+	return nil
+}
+
+// update a device record, if present.
+func (self *Memory) updateDevice(devId string, fn func(*memDevice)) {
+	self.Lock()
+	defer self.Unlock()
+	if rec, ok := self.devices[devId]; ok {
+		fn(rec)
+		rec.lastExchange = time.Now().UTC()
+	}
+}
+
+func (self *Memory) SetAccessToken(devId, token string) (err error) {
+	self.updateDevice(devId, func(rec *memDevice) {
+		rec.AccessToken = token
+	})
+	return nil
+}
+
+// Shorthand function to set the lock state for a device.
+func (self *Memory) SetDeviceLock(devId string, state bool) (err error) {
+	self.updateDevice(devId, func(rec *memDevice) {
+		rec.HasPasscode = state
+	})
+	return nil
+}
+
+// Forget the device's push endpoint (if it's still pushUrl).
+func (self *Memory) SetDeviceUnreachable(devId, pushUrl string) (err error) {
+	self.updateDevice(devId, func(rec *memDevice) {
+		if rec.PushUrl == pushUrl {
+			rec.PushUrl = ""
+			rec.PushKey = ""
+			rec.PushAuth = ""
+			rec.Unreachable = true
+		}
+	})
+	return nil
+}
+
+// Record the device's lost mode, or clear it (lost is nil).
+func (self *Memory) SetLostMode(devId string, lost *LostMode) (err error) {
+	if lost != nil {
+		copied := *lost
+		lost = &copied
+	}
+	self.updateDevice(devId, func(rec *memDevice) {
+		rec.Lost = lost
+	})
+	return nil
+}
+
+// Record the device's best known location.
+func (self *Memory) SetBestPosition(devId string, position Position) (err error) {
+	position.Cmd = nil
+	position.Stale = false
+	self.updateDevice(devId, func(rec *memDevice) {
+		rec.Best = &position
+	})
+	return nil
+}
+
+// Record when the device was sent an erase, or clear it (when is 0).
+func (self *Memory) SetErasing(devId string, when int64) (err error) {
+	self.updateDevice(devId, func(rec *memDevice) {
+		rec.Erasing = when
+	})
+	return nil
+}
+
+// Record the user's email address, for notifications.
+func (self *Memory) SetUserEmail(userId, email string) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.emails[userId] = email
+	return nil
+}
+
+// Get the user's email address. Returns "" if it isn't known.
+func (self *Memory) GetUserEmail(userId string) (email string, err error) {
+	self.Lock()
+	defer self.Unlock()
+	return self.emails[userId], nil
+}
+
+// The user's notification preferences, DefaultNotifyPrefs if they
+// haven't set any.
+func (self *Memory) GetNotifyPrefs(userId string) (prefs NotifyPrefs, err error) {
+	self.Lock()
+	defer self.Unlock()
+	prefs, ok := self.prefs[userId]
+	if !ok {
+		return DefaultNotifyPrefs, nil
+	}
+	prefs.Muted = append([]string(nil), prefs.Muted...)
+	return prefs, nil
+}
+
+// Replace the user's notification preferences.
+func (self *Memory) SetNotifyPrefs(userId string, prefs NotifyPrefs) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	prefs.Muted = append([]string(nil), prefs.Muted...)
+	self.prefs[userId] = prefs
+	return nil
+}
+
+// Replace the device's status record.
+func (self *Memory) SetDeviceStatus(devId string, status DeviceStatus) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.statuses[devId] = status
+	return nil
+}
+
+// Get the device's last status (nil if there isn't one).
+func (self *Memory) GetDeviceStatus(devId string) (status *DeviceStatus, err error) {
+	self.Lock()
+	defer self.Unlock()
+	if rec, ok := self.statuses[devId]; ok {
+		return &rec, nil
+	}
+	return nil, nil
+}
+
+// Store a command to queue later.
+func (self *Memory) ScheduleCommand(sched ScheduledCommand) (id string, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.lastId++
+	sched.ID = strconv.FormatInt(self.lastId, 10)
+	sched.Created = time.Now().UTC().Unix()
+	self.scheduled = append(self.scheduled, &sched)
+	sort.SliceStable(self.scheduled, func(i, j int) bool {
+		return self.scheduled[i].Time < self.scheduled[j].Time
+	})
+	return sched.ID, nil
+}
+
+// Get the commands scheduled for the device, soonest first.
+func (self *Memory) GetScheduled(devId string) (scheduled []ScheduledCommand, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rec := range self.scheduled {
+		if rec.DeviceId == devId {
+			scheduled = append(scheduled, *rec)
+		}
+	}
+	return scheduled, nil
+}
+
+// Cancel a scheduled command.
+func (self *Memory) CancelScheduled(devId, id string) (found bool, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for i, rec := range self.scheduled {
+		if rec.DeviceId == devId && rec.ID == id {
+			self.scheduled = append(self.scheduled[:i], self.scheduled[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Remove and return up to limit commands due by now.
+func (self *Memory) TakeDueCommands(now int64, limit int) (due []ScheduledCommand, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	i := 0
+	for ; i < len(self.scheduled) && len(due) < limit; i++ {
+		if self.scheduled[i].Time > now {
+			break
+		}
+		due = append(due, *self.scheduled[i])
+	}
+	self.scheduled = self.scheduled[i:]
+	return due, nil
+}
+
+// Put a command taken by TakeDueCommands back, keeping its id.
+func (self *Memory) RescheduleCommand(sched ScheduledCommand) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.scheduled = append(self.scheduled, &sched)
+	sort.SliceStable(self.scheduled, func(i, j int) bool {
+		return self.scheduled[i].Time < self.scheduled[j].Time
+	})
+	return nil
+}
+
+// Start tracking the device, replacing any earlier session.
+func (self *Memory) StartTracking(session TrackingSession) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.tracking[session.DeviceId] = session
+	return nil
+}
+
+// Get the device's tracking session. Returns nil if the device isn't
+// being tracked.
+func (self *Memory) GetTracking(devId string) (session *TrackingSession, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	rec, ok := self.tracking[devId]
+	if !ok || rec.Expires <= time.Now().Unix() {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+// Record when the last viewer left (0 when one comes back).
+func (self *Memory) SetTrackingUnwatched(devId string, since int64) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if rec, ok := self.tracking[devId]; ok {
+		rec.Unwatched = since
+		self.tracking[devId] = rec
+	}
+	return nil
+}
+
+// End the device's tracking session.
+func (self *Memory) StopTracking(devId string) (found bool, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	_, found = self.tracking[devId]
+	delete(self.tracking, devId)
+	return found, nil
+}
+
+// Remove and return up to limit sessions that have expired by now, or
+// that nobody has watched since idleSince.
+func (self *Memory) TakeIdleTracking(now, idleSince int64, limit int) (idle []TrackingSession, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for devId, rec := range self.tracking {
+		if len(idle) >= limit {
+			break
+		}
+		if rec.Expires <= now || (rec.Unwatched > 0 && rec.Unwatched <= idleSince) {
+			idle = append(idle, rec)
+			delete(self.tracking, devId)
+		}
+	}
+	return idle, nil
+}
+
+// Add a geofence for the device.
+func (self *Memory) AddGeofence(fence Geofence) (id string, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.lastId++
+	fence.ID = strconv.FormatInt(self.lastId, 10)
+	fence.Created = time.Now().UTC().Unix()
+	fence.Polygon = append([][2]float64(nil), fence.Polygon...)
+	self.geofences = append(self.geofences, &fence)
+	return fence.ID, nil
+}
+
+// Get the device's geofences, oldest first.
+func (self *Memory) GetGeofences(devId string) (fences []Geofence, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rec := range self.geofences {
+		if rec.DeviceId == devId {
+			fence := *rec
+			fence.Polygon = append([][2]float64(nil), rec.Polygon...)
+			fences = append(fences, fence)
+		}
+	}
+	return fences, nil
+}
+
+// Remove one of the device's geofences.
+func (self *Memory) DeleteGeofence(devId, id string) (found bool, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for i, rec := range self.geofences {
+		if rec.DeviceId == devId && rec.ID == id {
+			self.geofences = append(self.geofences[:i], self.geofences[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Record whether the device was last seen inside the geofence.
+func (self *Memory) SetGeofenceState(id, state string) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rec := range self.geofences {
+		if rec.ID == id {
+			rec.State = state
+		}
+	}
+	return nil
+}
+
+// Add a share link for the device, clearing out its expired ones.
+func (self *Memory) AddShare(share Share) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now().Unix()
+	for id, rec := range self.shares {
+		if rec.DeviceId == share.DeviceId && rec.Expires <= now {
+			delete(self.shares, id)
+		}
+	}
+	self.shares[share.ID] = share
+	return nil
+}
+
+// Get a share link. Returns nil if it has expired or been revoked.
+func (self *Memory) GetShare(id string) (share *Share, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	rec, ok := self.shares[id]
+	if !ok || rec.Expires <= time.Now().Unix() {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+// Get the device's current share links, oldest first.
+func (self *Memory) GetShares(devId string) (shares []Share, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now().Unix()
+	for _, rec := range self.shares {
+		if rec.DeviceId == devId && rec.Expires > now {
+			shares = append(shares, rec)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Created != shares[j].Created {
+			return shares[i].Created < shares[j].Created
+		}
+		return shares[i].ID < shares[j].ID
+	})
+	return shares, nil
+}
+
+// Revoke one of the device's share links.
+func (self *Memory) DeleteShare(devId, id string) (found bool, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	rec, ok := self.shares[id]
+	if !ok || rec.DeviceId != devId || rec.Expires <= time.Now().Unix() {
+		return false, nil
+	}
+	delete(self.shares, id)
+	return true, nil
+}
+
+// Invite someone to access the device, clearing out its expired
+// invitations.
+func (self *Memory) AddInvitation(invite Invitation) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now().Unix()
+	for id, rec := range self.invites {
+		if rec.DeviceId == invite.DeviceId && rec.Expires <= now {
+			delete(self.invites, id)
+		}
+	}
+	self.invites[invite.ID] = invite
+	return nil
+}
+
+// Get an invitation. Returns nil if it has expired, or was accepted or
+// withdrawn.
+func (self *Memory) GetInvitation(id string) (invite *Invitation, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	rec, ok := self.invites[id]
+	if !ok || rec.Expires <= time.Now().Unix() {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+// Get the device's open invitations, oldest first.
+func (self *Memory) GetInvitations(devId string) (invites []Invitation, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now().Unix()
+	for _, rec := range self.invites {
+		if rec.DeviceId == devId && rec.Expires > now {
+			invites = append(invites, rec)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		if invites[i].Created != invites[j].Created {
+			return invites[i].Created < invites[j].Created
+		}
+		return invites[i].ID < invites[j].ID
+	})
+	return invites, nil
+}
+
+// Remove an invitation, once accepted or withdrawn.
+func (self *Memory) DeleteInvitation(devId, id string) (found bool, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	rec, ok := self.invites[id]
+	if !ok || rec.DeviceId != devId || rec.Expires <= time.Now().Unix() {
+		return false, nil
+	}
+	delete(self.invites, id)
+	return true, nil
+}
+
+// Give the user access to the device, replacing any role they had.
+func (self *Memory) GrantAccess(access DeviceAccess) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rec := range self.access {
+		if rec.DeviceId == access.DeviceId && rec.UserId == access.UserId {
+			*rec = access
+			return nil
+		}
+	}
+	self.access = append(self.access, &access)
+	return nil
+}
+
+// Get who else can access the device, oldest first.
+func (self *Memory) GetAccess(devId string) (access []DeviceAccess, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rec := range self.access {
+		if rec.DeviceId == devId {
+			access = append(access, *rec)
+		}
+	}
+	sort.SliceStable(access, func(i, j int) bool {
+		return access[i].Created < access[j].Created
+	})
+	return access, nil
+}
+
+// Take away the user's access to the device.
+func (self *Memory) RevokeAccess(devId, userId string) (found bool, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for i, rec := range self.access {
+		if rec.DeviceId == devId && rec.UserId == userId {
+			self.access = append(self.access[:i], self.access[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get the devices other users have given the user access to, newest
+// first.
+func (self *Memory) GetSharedDevices(userId string) (devices []DeviceList, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for i := len(self.access) - 1; i >= 0; i-- {
+		rec := self.access[i]
+		owner, ok := self.owners[rec.DeviceId]
+		if rec.UserId != userId || !ok {
+			continue
+		}
+		dev := self.listDevice(rec.DeviceId, owner)
+		dev.Role = rec.Role
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// Add the location information to the known set for a device.
+func (self *Memory) SetDeviceLocation(devId string, position Position) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	// Only keep the latest positon
+	position.Cmd = nil
+	self.positions[devId] = []*memPosition{&memPosition{
+		time:     time.Now().UTC(),
+		Position: position}}
+	return nil
+}
+
+// Remove expired position information.
+func (self *Memory) GcDatabase(devId, userId string) (err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	expry := time.Now().UTC().Add(-time.Duration(self.defExpry) * time.Second)
+	for id, recs := range self.positions {
+		var keep []*memPosition
+		for _, rec := range recs {
+			if !rec.time.Before(expry) {
+				keep = append(keep, rec)
+			}
+		}
+		self.positions[id] = keep
+	}
+	tombExpry, err := strconv.ParseInt(self.config.Get("db.tombstone_expry",
+		"2592000"), 0, 64)
+	if err != nil {
+		tombExpry = 2592000
+	}
+	expry = time.Now().UTC().Add(-time.Duration(tombExpry) * time.Second)
+	for key, deleted := range self.tombs {
+		if deleted.Before(expry) {
+			delete(self.tombs, key)
+		}
+	}
+	logExpry, err := strconv.ParseInt(self.config.Get("db.webhook_log_expry",
+		"604800"), 0, 64)
+	if err != nil {
+		logExpry = 604800
+	}
+	cutoff := time.Now().UTC().Unix() - logExpry
+	var delivered []WebhookDelivery
+	for _, rec := range self.delivered {
+		if rec.Time >= cutoff {
+			delivered = append(delivered, rec)
+		}
+	}
+	self.delivered = delivered
+	return nil
+}
+
+// remove all tracking information for devId.
+func (self *Memory) PurgePosition(devId string) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.positions, devId)
+	return nil
+}
+
+func (self *Memory) Touch(devId string) (err error) {
+	self.updateDevice(devId, func(*memDevice) {})
+	return nil
+}
+
+func (self *Memory) DeleteDevice(devId string) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.deleteDevice(devId)
+	return nil
+}
+
+func (self *Memory) deleteDevice(devId string) {
+	var pending []*memCommand
+	for _, rec := range self.pending {
+		if rec.devId != devId {
+			pending = append(pending, rec)
+		}
+	}
+	self.pending = pending
+	var scheduled []*ScheduledCommand
+	for _, rec := range self.scheduled {
+		if rec.DeviceId != devId {
+			scheduled = append(scheduled, rec)
+		}
+	}
+	self.scheduled = scheduled
+	var geofences []*Geofence
+	for _, rec := range self.geofences {
+		if rec.DeviceId != devId {
+			geofences = append(geofences, rec)
+		}
+	}
+	self.geofences = geofences
+	for id, rec := range self.shares {
+		if rec.DeviceId == devId {
+			delete(self.shares, id)
+		}
+	}
+	var access []*DeviceAccess
+	for _, rec := range self.access {
+		if rec.DeviceId != devId {
+			access = append(access, rec)
+		}
+	}
+	self.access = access
+	for id, rec := range self.invites {
+		if rec.DeviceId == devId {
+			delete(self.invites, id)
+		}
+	}
+	delete(self.positions, devId)
+	delete(self.statuses, devId)
+	delete(self.tracking, devId)
+	delete(self.owners, devId)
+	delete(self.devices, devId)
+}
+
+func (self *Memory) DeleteUser(userId string) (devices []Device, err error) {
+	var devIds []string
+	self.Lock()
+	for devId, owner := range self.owners {
+		if owner.userId == userId {
+			devIds = append(devIds, devId)
+		}
+	}
+	self.Unlock()
+	for _, devId := range devIds {
+		if devRec, err := self.GetDeviceInfo(devId); err == nil {
+			devices = append(devices, *devRec)
+		}
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	now := time.Now().UTC()
+	self.tombs[TOMBSTONE_USER+"."+userId] = now
+	for _, devId := range devIds {
+		self.tombs[TOMBSTONE_DEVICE+"."+devId] = now
+		self.deleteDevice(devId)
+	}
+	var access []*DeviceAccess
+	for _, rec := range self.access {
+		if rec.UserId != userId {
+			access = append(access, rec)
+		}
+	}
+	self.access = access
+	email := self.emails[userId]
+	for id, rec := range self.invites {
+		if rec.InvitedBy == userId ||
+			(email != "" && strings.EqualFold(rec.Email, email)) {
+			delete(self.invites, id)
+		}
+	}
+	for id, rec := range self.shares {
+		if rec.CreatedBy == userId {
+			delete(self.shares, id)
+		}
+	}
+	var audit []AuditEvent
+	for _, rec := range self.audit {
+		if rec.UserId != userId && rec.Owner != userId {
+			audit = append(audit, rec)
+		}
+	}
+	self.audit = audit
+	var hooks []Webhook
+	for _, rec := range self.webhooks {
+		if rec.UserId == userId {
+			self.deleteDeliveries(rec.ID)
+		} else {
+			hooks = append(hooks, rec)
+		}
+	}
+	self.webhooks = hooks
+	delete(self.prefs, userId)
+	delete(self.emails, userId)
+	return devices, nil
+}
+
+func (self *Memory) AddAuditEvent(event AuditEvent) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.lastId++
+	event.ID = self.lastId
+	self.audit = append(self.audit, event)
+	return nil
+}
+
+func (self *Memory) GetAuditEvents(devId string, before int64, limit int) (events []AuditEvent, err error) {
+	self.Lock()
+	defer self.Unlock()
+	for i := len(self.audit) - 1; i >= 0; i-- {
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+		rec := self.audit[i]
+		if rec.DeviceId == devId && (before == 0 || rec.ID < before) {
+			events = append(events, rec)
+		}
+	}
+	return events, nil
+}
+
+func (self *Memory) GetUserAuditEvents(userId string) (events []AuditEvent, err error) {
+	self.Lock()
+	defer self.Unlock()
+	for _, rec := range self.audit {
+		if rec.UserId == userId || rec.Owner == userId {
+			events = append(events, rec)
+		}
+	}
+	return events, nil
+}
+
+func (self *Memory) AddWebhook(hook Webhook) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	hook.Events = append([]string(nil), hook.Events...)
+	self.webhooks = append(self.webhooks, hook)
+	return nil
+}
+
+// Get the user's webhooks, oldest first.
+func (self *Memory) GetWebhooks(userId string) (hooks []Webhook, err error) {
+	self.Lock()
+	defer self.Unlock()
+	for _, rec := range self.webhooks {
+		if rec.UserId == userId {
+			rec.Events = append([]string(nil), rec.Events...)
+			hooks = append(hooks, rec)
+		}
+	}
+	return hooks, nil
+}
+
+func (self *Memory) DeleteWebhook(userId, id string) (found bool, err error) {
+	self.Lock()
+	defer self.Unlock()
+	for i, rec := range self.webhooks {
+		if rec.UserId == userId && rec.ID == id {
+			self.webhooks = append(self.webhooks[:i], self.webhooks[i+1:]...)
+			self.deleteDeliveries(id)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Drop the webhook's delivery log. The lock must be held.
+func (self *Memory) deleteDeliveries(webhookId string) {
+	var delivered []WebhookDelivery
+	for _, rec := range self.delivered {
+		if rec.WebhookId != webhookId {
+			delivered = append(delivered, rec)
+		}
+	}
+	self.delivered = delivered
+}
+
+func (self *Memory) AddWebhookDelivery(delivery WebhookDelivery) (err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.lastId++
+	delivery.ID = self.lastId
+	self.delivered = append(self.delivered, delivery)
+	return nil
+}
+
+// The webhook's most recent delivery attempts, newest first.
+func (self *Memory) GetWebhookDeliveries(webhookId string, limit int) (deliveries []WebhookDelivery, err error) {
+	self.Lock()
+	defer self.Unlock()
+	for i := len(self.delivered) - 1; i >= 0; i-- {
+		if limit > 0 && len(deliveries) >= limit {
+			break
+		}
+		if rec := self.delivered[i]; rec.WebhookId == webhookId {
+			deliveries = append(deliveries, rec)
+		}
+	}
+	return deliveries, nil
+}
+
+func (self *Memory) GetTombstone(kind, id string) (deleted int64, err error) {
+	self.Lock()
+	defer self.Unlock()
+	if when, ok := self.tombs[kind+"."+id]; ok {
+		return when.Unix(), nil
+	}
+	return 0, nil
+}
+
+// Generate a nonce for OAuth checks
+func (self *Memory) GetNonce() (string, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	key, _ := util.GenUUID4()
+	val, _ := util.GenUUID4()
+	self.nonces[key] = &memNonce{val: val, time: time.Now().UTC()}
+	return key + "." + genSig(key, val), nil
+}
+
+// Does the user's nonce match?
+func (self *Memory) CheckNonce(nonce string) (bool, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	// gc nonces before checking.
+	expry := time.Now().UTC().Add(-5 * time.Minute)
+	for key, rec := range self.nonces {
+		if rec.time.Before(expry) {
+			delete(self.nonces, key)
+		}
+	}
+	keysig := strings.SplitN(nonce, ".", 2)
+	if len(keysig) != 2 {
+		self.logger.Warn(self.logCat,
+			"Invalid nonce",
+			util.Fields{"nonce": nonce})
+		return false, nil
+	}
+	rec, ok := self.nonces[keysig[0]]
+	if !ok {
+		return false, nil
+	}
+	delete(self.nonces, keysig[0])
+	return genSig(keysig[0], rec.val) == keysig[1], nil
+}
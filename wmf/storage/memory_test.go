@@ -0,0 +1,564 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// The Store tests, run against each implementation (see
+// postgres_test.go).
+var storeTests = []struct {
+	name string
+	test func(*testing.T, Store)
+}{
+	{"Devices", testDevices},
+	{"Commands", testCommands},
+	{"Scheduled", testScheduled},
+	{"Tracking", testTracking},
+	{"Geofences", testGeofences},
+	{"Positions", testPositions},
+	{"Nonce", testNonce},
+	{"Shares", testShares},
+	{"Access", testAccess},
+	{"DeleteUser", testDeleteUser},
+	{"Audit", testAudit},
+	{"Webhooks", testWebhooks},
+	{"NotifyPrefs", testNotifyPrefs},
+}
+
+func testConfig(t *testing.T, settings string) *util.MzConfig {
+	file, err := ioutil.TempFile("", "fmd_storage_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("db.max_devices_for_user=5\nlogger.filter=0\n" + settings)
+	file.Close()
+	config, err := util.ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func testStore(t *testing.T) Store {
+	config := testConfig(t, "db.type=memory\n")
+	logger := util.NewHekaLogger(config)
+	store, err := OpenStore(config, logger, util.NewMetrics("test", logger, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Init()
+	return store
+}
+
+func TestMemory(t *testing.T) {
+	for _, st := range storeTests {
+		t.Run(st.name, func(t *testing.T) {
+			st.test(t, testStore(t))
+		})
+	}
+}
+
+func testDevices(t *testing.T, store Store) {
+
+	devId, err := store.RegisterDevice("user1", Device{ID: "dev1",
+		Name: "phone", Secret: "s1", PushUrl: "http://push/1", Accepts: "elrth",
+		Passcode: &PasscodePolicy{MinLen: 4, MaxLen: 8, Charset: "alnum"}})
+	if err != nil || devId != "dev1" {
+		t.Fatalf("Register failed: %s %v", devId, err)
+	}
+	// Re-registration by the owner updates the record.
+	if _, err = store.RegisterDevice("user1", Device{ID: "dev1",
+		Secret: "s2", PushUrl: "http://push/2", Accepts: "rh"}); err != nil {
+		t.Fatal(err)
+	}
+	// But nobody else can claim it.
+	if _, err = store.RegisterDevice("user2", Device{ID: "dev1"}); err == nil {
+		t.Error("Device registered to a second user")
+	}
+	dev, err := store.GetDeviceInfo("dev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.User != "user1" || dev.Name != "phone" || dev.Secret != "s2" ||
+		dev.PushUrl != "http://push/2" || !dev.LoggedIn || dev.Passcode != nil {
+		t.Errorf("Unexpected device record %+v", dev)
+	}
+	// Only the endpoint the push service reported is cleared.
+	store.SetDeviceUnreachable("dev1", "http://push/1")
+	if dev, _ = store.GetDeviceInfo("dev1"); dev.Unreachable {
+		t.Error("Current push url cleared")
+	}
+	store.SetDeviceUnreachable("dev1", "http://push/2")
+	if dev, _ = store.GetDeviceInfo("dev1"); !dev.Unreachable ||
+		dev.PushUrl != "" || dev.LoggedIn {
+		t.Errorf("Device not unreachable %+v", dev)
+	}
+	lost := &LostMode{Message: "Call me", Since: 1}
+	store.SetLostMode("dev1", lost)
+	lost.Message = "changed"
+	if dev, _ = store.GetDeviceInfo("dev1"); dev.Lost == nil ||
+		dev.Lost.Message != "Call me" {
+		t.Errorf("Lost mode not stored %+v", dev.Lost)
+	}
+	if status, _ := store.GetDeviceStatus("dev1"); status != nil {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	store.SetDeviceStatus("dev1", DeviceStatus{Battery: 50, Network: "wifi"})
+	if status, _ := store.GetDeviceStatus("dev1"); status == nil ||
+		status.Battery != 50 || status.Network != "wifi" {
+		t.Errorf("Status not stored %+v", status)
+	}
+	store.SetBestPosition("dev1", Position{Latitude: 1, Longitude: 2,
+		Cmd: map[string]interface{}{"t": nil}})
+	if dev, _ = store.GetDeviceInfo("dev1"); dev.Best == nil ||
+		dev.Best.Longitude != 2 || dev.Best.Cmd != nil {
+		t.Errorf("Best position not stored %+v", dev.Best)
+	}
+	store.SetErasing("dev1", 100)
+	if dev, _ = store.GetDeviceInfo("dev1"); dev.Erasing != 100 {
+		t.Errorf("Erase time not stored %+v", dev)
+	}
+	store.SetUserEmail("user1", "user1@example.com")
+	if email, _ := store.GetUserEmail("user1"); email != "user1@example.com" {
+		t.Errorf("Unexpected email %q", email)
+	}
+	store.SetLostMode("dev1", nil)
+	if dev, _ = store.GetDeviceInfo("dev1"); dev.Lost != nil {
+		t.Errorf("Lost mode not cleared %+v", dev.Lost)
+	}
+	if _, err = store.GetDeviceInfo("nope"); err != ErrUnknownDevice {
+		t.Errorf("Expected ErrUnknownDevice, got %v", err)
+	}
+	store.RegisterDevice("olduser", Device{ID: "dev2"})
+	devices, _ := store.GetDevicesForUser("user1", "olduser")
+	if len(devices) != 2 {
+		t.Errorf("Expected migrated device list, got %+v", devices)
+	}
+	if owned, _ := store.GetOwnedDevices("user1"); len(owned) != 2 {
+		t.Errorf("Unexpected owned devices %v", owned)
+	}
+	if err = store.DeleteDevice("dev1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GetDeviceInfo("dev1"); err != ErrUnknownDevice {
+		t.Errorf("Deleted device still present: %v", err)
+	}
+}
+
+func testCommands(t *testing.T, store Store) {
+
+	store.RegisterDevice("user1", Device{ID: "dev1"})
+	store.StoreCommand("dev1", `{"r":{"d":5}}`, "r", "")
+	// Same type replaces the earlier command.
+	store.StoreCommand("dev1", `{"r":{"d":10}}`, "r", "")
+	store.StoreCommand("dev1", `{"t":{"d":30}}`, "t", "")
+
+	if pending, _ := store.GetPendingCommands("dev1"); len(pending) != 2 ||
+		pending[0].Cmd != `{"r":{"d":10}}` || pending[1].Type != "t" {
+		t.Errorf("Unexpected pending commands %+v", pending)
+	}
+	for _, expect := range []string{`{"r":{"d":10}}`, `{"t":{"d":30}}`, ""} {
+		if cmd, _, _ := store.GetPending("dev1"); cmd != expect {
+			t.Errorf("Expected %q, got %q", expect, cmd)
+		}
+	}
+
+	// Commands sent inline are dropped by id.
+	store.StoreCommand("dev1", `{"r":{"d":5,"id":"a"}}`, "r", "a")
+	store.StoreCommand("dev1", `{"l":{"c":"1234"}}`, "l", "")
+	store.DeletePending("dev1", "")
+	store.DeletePending("dev1", "b")
+	if pending, _ := store.GetPendingCommands("dev1"); len(pending) != 2 {
+		t.Errorf("Unacknowledged commands dropped %+v", pending)
+	}
+	store.DeletePending("dev1", "a")
+	if pending, _ := store.GetPendingCommands("dev1"); len(pending) != 1 ||
+		pending[0].Type != "l" {
+		t.Errorf("Acknowledged command kept %+v", pending)
+	}
+}
+
+func testScheduled(t *testing.T, store Store) {
+
+	store.RegisterDevice("user1", Device{ID: "dev1"})
+	store.ScheduleCommand(ScheduledCommand{DeviceId: "dev1", Cmd: "e", Time: 300})
+	ringId, _ := store.ScheduleCommand(ScheduledCommand{DeviceId: "dev1",
+		Cmd: "r", Time: 100})
+	store.ScheduleCommand(ScheduledCommand{DeviceId: "dev1", Cmd: "l", Time: 200,
+		By: "user1"})
+	if found, _ := store.CancelScheduled("dev2", ringId); found {
+		t.Error("Cancelled another device's command")
+	}
+	if found, _ := store.CancelScheduled("dev1", ringId); !found {
+		t.Error("Command not cancelled")
+	}
+	due, _ := store.TakeDueCommands(250, 10)
+	if len(due) != 1 || due[0].Cmd != "l" || due[0].By != "user1" {
+		t.Errorf("Unexpected due commands %+v", due)
+	}
+	// Taken commands aren't handed out twice.
+	if due, _ = store.TakeDueCommands(250, 10); len(due) != 0 {
+		t.Errorf("Commands taken twice %+v", due)
+	}
+	// Commands that couldn't be queued can be put back.
+	retry := ScheduledCommand{ID: "42", DeviceId: "dev1", Cmd: "r", Args: "{}",
+		Time: 280, Created: 100, Attempts: 1}
+	if err := store.RescheduleCommand(retry); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = store.TakeDueCommands(290, 10); len(due) != 1 ||
+		due[0].ID != "42" || due[0].Attempts != 1 {
+		t.Errorf("Command not put back %+v", due)
+	}
+	store.DeleteDevice("dev1")
+	if scheduled, _ := store.GetScheduled("dev1"); len(scheduled) != 0 {
+		t.Errorf("Scheduled commands not deleted %+v", scheduled)
+	}
+}
+
+func testTracking(t *testing.T, store Store) {
+	store.RegisterDevice("user1", Device{ID: "dev1"})
+	store.RegisterDevice("user1", Device{ID: "dev2"})
+	now := time.Now().Unix()
+
+	store.StartTracking(TrackingSession{DeviceId: "dev1", StartedBy: "user1",
+		Started: now, Expires: now + 60})
+	store.StartTracking(TrackingSession{DeviceId: "dev2", Started: now - 60,
+		Expires: now - 1})
+	if session, _ := store.GetTracking("dev1"); session == nil ||
+		session.StartedBy != "user1" {
+		t.Errorf("Session not stored %+v", session)
+	}
+	if session, _ := store.GetTracking("dev2"); session != nil {
+		t.Errorf("Expired session returned %+v", session)
+	}
+	devices, _ := store.GetDevicesForUser("user1", "")
+	for _, dev := range devices {
+		if dev.Tracking != (dev.ID == "dev1") {
+			t.Errorf("Unexpected tracking state %+v", dev)
+		}
+	}
+	store.AddGeofence(Geofence{DeviceId: "dev2", Name: "Home", Radius: 100})
+	store.SetTrackingUnwatched("dev1", now-10)
+	idle, _ := store.TakeIdleTracking(now, now-20, 10)
+	if len(idle) != 1 || idle[0].DeviceId != "dev2" {
+		t.Errorf("Expected the expired session, got %+v", idle)
+	}
+	if fences, _ := store.GetGeofences("dev2"); len(fences) != 1 {
+		t.Errorf("Ending tracking removed geofences %+v", fences)
+	}
+	idle, _ = store.TakeIdleTracking(now, now-5, 10)
+	if len(idle) != 1 || idle[0].DeviceId != "dev1" || idle[0].Unwatched != now-10 {
+		t.Errorf("Expected the unwatched session, got %+v", idle)
+	}
+	if found, _ := store.StopTracking("dev1"); found {
+		t.Error("Taken session still present")
+	}
+}
+
+func testGeofences(t *testing.T, store Store) {
+	store.RegisterDevice("user1", Device{ID: "dev1"})
+
+	square := [][2]float64{{1, 1}, {1, 2}, {2, 2}, {2, 1}}
+	id, err := store.AddGeofence(Geofence{DeviceId: "dev1", Name: "Park",
+		Polygon: square})
+	if err != nil || id == "" {
+		t.Fatalf("Could not add geofence: %s %v", id, err)
+	}
+	square[0][0] = 5
+	store.SetGeofenceState(id, "inside")
+	fences, _ := store.GetGeofences("dev1")
+	if len(fences) != 1 || fences[0].Polygon[0][0] != 1 ||
+		fences[0].State != "inside" || fences[0].Created == 0 {
+		t.Errorf("Unexpected geofences %+v", fences)
+	}
+	if found, _ := store.DeleteGeofence("dev2", id); found {
+		t.Error("Removed another device's geofence")
+	}
+	store.DeleteDevice("dev1")
+	if fences, _ = store.GetGeofences("dev1"); len(fences) != 0 {
+		t.Errorf("Geofences left for deleted device %+v", fences)
+	}
+}
+
+func testPositions(t *testing.T, store Store) {
+
+	store.SetDeviceLocation("dev1", Position{Latitude: 1, Longitude: 2})
+	store.SetDeviceLocation("dev1", Position{Latitude: 3, Longitude: 4})
+	positions, _ := store.GetPositions("dev1")
+	if len(positions) != 1 || positions[0].Latitude != 3 {
+		t.Errorf("Expected only the latest position, got %+v", positions)
+	}
+	if history, _ := store.GetPositionHistory("dev1"); len(history) != 1 ||
+		history[0].Latitude != 3 || history[0].Time == 0 {
+		t.Errorf("Unexpected position history %+v", history)
+	}
+	store.PurgePosition("dev1")
+	if positions, _ = store.GetPositions("dev1"); len(positions) != 0 {
+		t.Errorf("Positions not purged: %+v", positions)
+	}
+}
+
+func testNonce(t *testing.T, store Store) {
+
+	nonce, err := store.GetNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.CheckNonce(nonce + "x"); ok {
+		t.Error("Bad nonce signature accepted")
+	}
+	nonce, _ = store.GetNonce()
+	if ok, _ := store.CheckNonce(nonce); !ok {
+		t.Error("Valid nonce refused")
+	}
+	if ok, _ := store.CheckNonce(nonce); ok {
+		t.Error("Nonce accepted twice")
+	}
+}
+
+func testShares(t *testing.T, store Store) {
+	store.RegisterDevice("user1", Device{ID: "dev1"})
+	now := time.Now().Unix()
+
+	store.AddShare(Share{ID: "old", DeviceId: "dev1", Created: now - 60,
+		Expires: now - 1})
+	store.AddShare(Share{ID: "s1", DeviceId: "dev1", CreatedBy: "user1",
+		Created: now, Expires: now + 60})
+	if share, _ := store.GetShare("s1"); share == nil || share.CreatedBy != "user1" {
+		t.Errorf("Share not stored %+v", share)
+	}
+	if share, _ := store.GetShare("old"); share != nil {
+		t.Errorf("Expired share returned %+v", share)
+	}
+	if shares, _ := store.GetShares("dev1"); len(shares) != 1 || shares[0].ID != "s1" {
+		t.Errorf("Unexpected shares %+v", shares)
+	}
+	if found, _ := store.DeleteShare("dev2", "s1"); found {
+		t.Error("Share revoked through another device")
+	}
+	if found, _ := store.DeleteShare("dev1", "s1"); !found {
+		t.Error("Share not revoked")
+	}
+	store.AddShare(Share{ID: "s2", DeviceId: "dev1", Expires: now + 60})
+	store.DeleteDevice("dev1")
+	if share, _ := store.GetShare("s2"); share != nil {
+		t.Errorf("Share outlived its device %+v", share)
+	}
+}
+
+func testAccess(t *testing.T, store Store) {
+	store.RegisterDevice("user1", Device{ID: "dev1", Name: "phone"})
+	now := time.Now().Unix()
+
+	store.AddInvitation(Invitation{ID: "old", DeviceId: "dev1",
+		Role: "viewer", Expires: now - 1})
+	store.AddInvitation(Invitation{ID: "i1", DeviceId: "dev1",
+		Role: "viewer", Email: "sam@example.com", Expires: now + 60})
+	if invite, _ := store.GetInvitation("old"); invite != nil {
+		t.Errorf("Expired invitation returned %+v", invite)
+	}
+	if invites, _ := store.GetInvitations("dev1"); len(invites) != 1 ||
+		invites[0].Email != "sam@example.com" {
+		t.Errorf("Unexpected invitations %+v", invites)
+	}
+	if found, _ := store.DeleteInvitation("dev2", "i1"); found {
+		t.Error("Invitation withdrawn through another device")
+	}
+	if found, _ := store.DeleteInvitation("dev1", "i1"); !found {
+		t.Error("Invitation not withdrawn")
+	}
+
+	store.GrantAccess(DeviceAccess{DeviceId: "dev1", UserId: "user2",
+		Role: "viewer", GrantedBy: "user1", Created: now})
+	// Granting again changes the role.
+	store.GrantAccess(DeviceAccess{DeviceId: "dev1", UserId: "user2",
+		Role: "operator", GrantedBy: "user1", Created: now})
+	if access, _ := store.GetAccess("dev1"); len(access) != 1 ||
+		access[0].Role != "operator" {
+		t.Errorf("Unexpected access %+v", access)
+	}
+	if devices, _ := store.GetSharedDevices("user2"); len(devices) != 1 ||
+		devices[0].ID != "dev1" || devices[0].Role != "operator" {
+		t.Errorf("Unexpected shared devices %+v", devices)
+	}
+	if found, _ := store.RevokeAccess("dev1", "user2"); !found {
+		t.Error("Access not revoked")
+	}
+	if devices, _ := store.GetSharedDevices("user2"); len(devices) != 0 {
+		t.Errorf("Revoked device still shared %+v", devices)
+	}
+	store.GrantAccess(DeviceAccess{DeviceId: "dev1", UserId: "user2",
+		Role: "viewer"})
+	store.AddInvitation(Invitation{ID: "i2", DeviceId: "dev1", Expires: now + 60})
+	store.DeleteDevice("dev1")
+	if access, _ := store.GetAccess("dev1"); len(access) != 0 {
+		t.Errorf("Access outlived its device %+v", access)
+	}
+	if invite, _ := store.GetInvitation("i2"); invite != nil {
+		t.Errorf("Invitation outlived its device %+v", invite)
+	}
+}
+
+func testDeleteUser(t *testing.T, store Store) {
+	store.RegisterDevice("user1", Device{ID: "dev1", PushUrl: "https://push/1"})
+	store.RegisterDevice("user2", Device{ID: "dev2"})
+	store.SetUserEmail("user1", "una@example.com")
+	store.StoreCommand("dev1", `{"r":{"d":5}}`, "r", "")
+	store.GrantAccess(DeviceAccess{DeviceId: "dev2", UserId: "user1",
+		Role: "viewer"})
+	store.AddInvitation(Invitation{ID: "i1", DeviceId: "dev2",
+		Email: "UNA@example.com", Expires: time.Now().Unix() + 60})
+
+	devices, err := store.DeleteUser("user1")
+	if err != nil || len(devices) != 1 || devices[0].ID != "dev1" ||
+		devices[0].PushUrl != "https://push/1" {
+		t.Fatalf("Unexpected deleted devices %+v %v", devices, err)
+	}
+	if _, err = store.GetDeviceInfo("dev1"); err != ErrUnknownDevice {
+		t.Errorf("Device not deleted: %v", err)
+	}
+	if cmd, _, _ := store.GetPending("dev1"); cmd != "" {
+		t.Errorf("Pending command kept: %s", cmd)
+	}
+	if access, _ := store.GetAccess("dev2"); len(access) != 0 {
+		t.Errorf("Access kept %+v", access)
+	}
+	if invite, _ := store.GetInvitation("i1"); invite != nil {
+		t.Errorf("Invitation to the user kept %+v", invite)
+	}
+	if email, _ := store.GetUserEmail("user1"); email != "" {
+		t.Errorf("Email kept %s", email)
+	}
+	if _, err = store.GetDeviceInfo("dev2"); err != nil {
+		t.Errorf("Other user's device deleted: %v", err)
+	}
+	for _, tomb := range [][2]string{{TOMBSTONE_USER, "user1"},
+		{TOMBSTONE_DEVICE, "dev1"}} {
+		if deleted, _ := store.GetTombstone(tomb[0], tomb[1]); deleted == 0 {
+			t.Errorf("No tombstone for %s %s", tomb[0], tomb[1])
+		}
+	}
+	if deleted, _ := store.GetTombstone(TOMBSTONE_DEVICE, "dev2"); deleted != 0 {
+		t.Errorf("Tombstone for a device that wasn't deleted")
+	}
+	// Registering the device again clears its tombstone.
+	store.RegisterDevice("user3", Device{ID: "dev1"})
+	if deleted, _ := store.GetTombstone(TOMBSTONE_DEVICE, "dev1"); deleted != 0 {
+		t.Errorf("Tombstone kept after registering again")
+	}
+}
+
+func testAudit(t *testing.T, store Store) {
+	store.RegisterDevice("user1", Device{ID: "dev1"})
+	for i, action := range []string{"register", "queue", "cmd"} {
+		if err := store.AddAuditEvent(AuditEvent{Time: int64(i),
+			UserId: "user1", DeviceId: "dev1", Owner: "user1",
+			Action: action, Result: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Someone else's action on the device is kept with it.
+	store.AddAuditEvent(AuditEvent{UserId: "user2", DeviceId: "dev1",
+		Owner: "user1", Action: "queue", Result: "Forbidden"})
+	store.AddAuditEvent(AuditEvent{UserId: "user2", Owner: "user2",
+		Action: "signin", Result: "ok"})
+
+	events, err := store.GetAuditEvents("dev1", 0, 2)
+	if err != nil || len(events) != 2 || events[0].UserId != "user2" ||
+		events[1].Action != "cmd" || events[0].ID <= events[1].ID {
+		t.Fatalf("Unexpected audit events %+v %v", events, err)
+	}
+	if older, _ := store.GetAuditEvents("dev1", events[1].ID, 0); len(older) != 2 ||
+		older[0].Action != "queue" || older[1].Action != "register" {
+		t.Errorf("Unexpected older events %+v", older)
+	}
+	// Deleting the device leaves its history.
+	store.DeleteDevice("dev1")
+	if events, _ = store.GetAuditEvents("dev1", 0, 0); len(events) != 4 {
+		t.Errorf("Audit events lost with the device %+v", events)
+	}
+	if events, _ = store.GetUserAuditEvents("user2"); len(events) != 2 {
+		t.Errorf("Unexpected events for user2 %+v", events)
+	}
+	store.DeleteUser("user1")
+	if events, _ = store.GetUserAuditEvents("user1"); len(events) != 0 {
+		t.Errorf("Audit events kept with the account %+v", events)
+	}
+	if events, _ = store.GetUserAuditEvents("user2"); len(events) != 1 ||
+		events[0].Action != "signin" {
+		t.Errorf("Other user's events removed %+v", events)
+	}
+}
+
+func testWebhooks(t *testing.T, store Store) {
+	store.AddWebhook(Webhook{ID: "h1", UserId: "user1", URL: "https://a",
+		Events: []string{"command.queued"}})
+	store.AddWebhook(Webhook{ID: "h2", UserId: "user2", URL: "https://b"})
+	for i, status := range []int{503, 200} {
+		store.AddWebhookDelivery(WebhookDelivery{WebhookId: "h1",
+			Delivery: "d1", Event: "command.queued", Time: time.Now().Unix(),
+			Attempt: i + 1, Status: status})
+	}
+	store.AddWebhookDelivery(WebhookDelivery{WebhookId: "h2", Delivery: "d2",
+		Time: time.Now().Unix(), Attempt: 1, Status: 200})
+
+	hooks, err := store.GetWebhooks("user1")
+	if err != nil || len(hooks) != 1 || hooks[0].ID != "h1" ||
+		len(hooks[0].Events) != 1 {
+		t.Fatalf("Unexpected webhooks %+v %v", hooks, err)
+	}
+	deliveries, _ := store.GetWebhookDeliveries("h1", 0)
+	if len(deliveries) != 2 || deliveries[0].Status != 200 ||
+		deliveries[1].Attempt != 1 {
+		t.Errorf("Unexpected deliveries %+v", deliveries)
+	}
+	if deliveries, _ = store.GetWebhookDeliveries("h1", 1); len(deliveries) != 1 {
+		t.Errorf("Deliveries not limited %+v", deliveries)
+	}
+	if found, _ := store.DeleteWebhook("user2", "h1"); found {
+		t.Errorf("Deleted another user's webhook")
+	}
+	if found, _ := store.DeleteWebhook("user1", "h1"); !found {
+		t.Errorf("Webhook not deleted")
+	}
+	if deliveries, _ = store.GetWebhookDeliveries("h1", 0); len(deliveries) != 0 {
+		t.Errorf("Delivery log kept %+v", deliveries)
+	}
+	store.DeleteUser("user2")
+	if hooks, _ = store.GetWebhooks("user2"); len(hooks) != 0 {
+		t.Errorf("Webhooks kept with the account %+v", hooks)
+	}
+	if deliveries, _ = store.GetWebhookDeliveries("h2", 0); len(deliveries) != 0 {
+		t.Errorf("Delivery log kept with the account %+v", deliveries)
+	}
+}
+
+func testNotifyPrefs(t *testing.T, store Store) {
+	if prefs, err := store.GetNotifyPrefs("user1"); err != nil || !prefs.Email ||
+		prefs.Locale != "" || len(prefs.Muted) != 0 {
+		t.Errorf("Unexpected default preferences %+v %v", prefs, err)
+	}
+	muted := []string{"lost.location"}
+	store.SetNotifyPrefs("user1", NotifyPrefs{Locale: "fr", Muted: muted})
+	muted[0] = "changed"
+	if prefs, _ := store.GetNotifyPrefs("user1"); prefs.Email ||
+		prefs.Locale != "fr" || len(prefs.Muted) != 1 ||
+		prefs.Muted[0] != "lost.location" {
+		t.Errorf("Unexpected preferences %+v", prefs)
+	}
+	store.DeleteUser("user1")
+	if prefs, _ := store.GetNotifyPrefs("user1"); !prefs.Email || prefs.Locale != "" {
+		t.Errorf("Preferences kept with the account %+v", prefs)
+	}
+}
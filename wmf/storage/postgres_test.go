@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+
+	"os"
+	"strings"
+	"testing"
+)
+
+// Runs the Store tests against Postgres when FMD_TEST_DSN is set to a
+// scratch database set up with sql/create_db.sql, e.g.
+//
+//	FMD_TEST_DSN="dbname=fmd_test sslmode=disable timezone=UTC"
+//
+// Every table is emptied before each test.
+func pgStore(t *testing.T) *Storage {
+	dsn := os.Getenv("FMD_TEST_DSN")
+	if dsn == "" {
+		t.Skip("FMD_TEST_DSN not set")
+	}
+	config := testConfig(t, "db.type=postgres\ndb.dsn="+dsn+"\n")
+	logger := util.NewHekaLogger(config)
+	store, err := Open(config, logger, util.NewMetrics("test", logger, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := store.db.Query("select table_name from information_schema.tables where table_schema = 'public' and table_type = 'BASE TABLE' and table_name != 'meta';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if _, err = store.db.Exec("truncate " + strings.Join(tables, ", ") + ";"); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestPostgres(t *testing.T) {
+	for _, st := range storeTests {
+		t.Run(st.name, func(t *testing.T) {
+			store := pgStore(t)
+			defer store.Close()
+			st.test(t, store)
+		})
+	}
+}
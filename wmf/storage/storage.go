@@ -10,6 +10,7 @@ import (
 	"crypto/md5"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
@@ -23,9 +24,88 @@ var ErrDatabase = errors.New("Database Error")
 var ErrUnknownDevice = errors.New("Unknown device")
 
 const (
-	DB_VERSION = "20140707"
+	DB_VERSION = "20261106"
 )
 
+// What a tombstone marks as deleted.
+const (
+	TOMBSTONE_USER   = "user"
+	TOMBSTONE_DEVICE = "device"
+)
+
+// Storage backend interface. Storage (postgres) is the production
+// backend, Memory is used for tests and local development.
+type Store interface {
+	Init() error
+	Close()
+	RegisterDevice(userid string, dev Device) (devId string, err error)
+	GetDeviceInfo(devId string) (devInfo *Device, err error)
+	GetPositions(devId string) (positions []Position, err error)
+	GetPending(devId string) (cmd, ctype string, err error)
+	GetPendingCommands(devId string) (pending []PendingCommand, err error)
+	GetPositionHistory(devId string) (positions []Position, err error)
+	GetUserFromDevice(deviceId string) (userId, name string, err error)
+	GetDevicesForUser(userId, oldUserId string) (devices []DeviceList, err error)
+	GetOwnedDevices(userId string) (devIds []string, err error)
+	StoreCommand(devId, command, cType, cmdId string) (err error)
+	DeletePending(devId, cmdId string) (err error)
+	SetAccessToken(devId, token string) (err error)
+	SetDeviceLock(devId string, state bool) (err error)
+	SetDeviceLocation(devId string, position Position) (err error)
+	SetDeviceUnreachable(devId, pushUrl string) (err error)
+	SetLostMode(devId string, lost *LostMode) (err error)
+	SetBestPosition(devId string, position Position) (err error)
+	SetErasing(devId string, when int64) (err error)
+	SetDeviceStatus(devId string, status DeviceStatus) (err error)
+	GetDeviceStatus(devId string) (status *DeviceStatus, err error)
+	ScheduleCommand(sched ScheduledCommand) (id string, err error)
+	GetScheduled(devId string) (scheduled []ScheduledCommand, err error)
+	CancelScheduled(devId, id string) (found bool, err error)
+	TakeDueCommands(now int64, limit int) (due []ScheduledCommand, err error)
+	RescheduleCommand(sched ScheduledCommand) (err error)
+	StartTracking(session TrackingSession) (err error)
+	GetTracking(devId string) (session *TrackingSession, err error)
+	SetTrackingUnwatched(devId string, since int64) (err error)
+	StopTracking(devId string) (found bool, err error)
+	TakeIdleTracking(now, idleSince int64, limit int) (idle []TrackingSession, err error)
+	AddGeofence(fence Geofence) (id string, err error)
+	GetGeofences(devId string) (fences []Geofence, err error)
+	DeleteGeofence(devId, id string) (found bool, err error)
+	SetGeofenceState(id, state string) (err error)
+	AddShare(share Share) (err error)
+	GetShare(id string) (share *Share, err error)
+	GetShares(devId string) (shares []Share, err error)
+	DeleteShare(devId, id string) (found bool, err error)
+	AddInvitation(invite Invitation) (err error)
+	GetInvitation(id string) (invite *Invitation, err error)
+	GetInvitations(devId string) (invites []Invitation, err error)
+	DeleteInvitation(devId, id string) (found bool, err error)
+	GrantAccess(access DeviceAccess) (err error)
+	GetAccess(devId string) (access []DeviceAccess, err error)
+	RevokeAccess(devId, userId string) (found bool, err error)
+	GetSharedDevices(userId string) (devices []DeviceList, err error)
+	SetUserEmail(userId, email string) (err error)
+	GetUserEmail(userId string) (email string, err error)
+	GetNotifyPrefs(userId string) (prefs NotifyPrefs, err error)
+	SetNotifyPrefs(userId string, prefs NotifyPrefs) (err error)
+	GcDatabase(devId, userId string) (err error)
+	PurgePosition(devId string) (err error)
+	Touch(devId string) (err error)
+	DeleteDevice(devId string) (err error)
+	DeleteUser(userId string) (devices []Device, err error)
+	AddAuditEvent(event AuditEvent) (err error)
+	GetAuditEvents(devId string, before int64, limit int) (events []AuditEvent, err error)
+	GetUserAuditEvents(userId string) (events []AuditEvent, err error)
+	AddWebhook(hook Webhook) (err error)
+	GetWebhooks(userId string) (hooks []Webhook, err error)
+	DeleteWebhook(userId, id string) (found bool, err error)
+	AddWebhookDelivery(delivery WebhookDelivery) (err error)
+	GetWebhookDeliveries(webhookId string, limit int) (deliveries []WebhookDelivery, err error)
+	GetTombstone(kind, id string) (deleted int64, err error)
+	GetNonce() (string, error)
+	CheckNonce(nonce string) (bool, error)
+}
+
 // Storage abstration
 type Storage struct {
 	config   *util.MzConfig
@@ -46,6 +126,7 @@ type Position struct {
 	Accuracy  float64
 	Time      int64
 	Cmd       map[string]interface{}
+	Stale     bool `json:",omitempty"` // set when shown, never stored
 }
 
 // Device information
@@ -57,16 +138,181 @@ type Device struct {
 	HasPasscode       bool   // is device lockable
 	LoggedIn          bool   // is the device logged in
 	Secret            string // HAWK secret
-	PushUrl           string // SimplePush URL
+	PushUrl           string // SimplePush URL or Web Push endpoint
+	PushKey           string // Web Push p256dh key (base64url)
+	PushAuth          string // Web Push auth secret (base64url)
+	PushType          string // push provider, if not implied by PushUrl
 	Pending           string // pending command
 	LastExchange      int32  // last time we did anything
 	Accepts           string // commands the device accepts
 	AccessToken       string // OAuth Access token
+	Unreachable       bool   // push endpoint is gone, device must re-register
+
+	// Set while the device is in lost mode
+	Lost *LostMode
+
+	// When the device was sent an erase (UTC seconds), 0 if it hasn't been
+	Erasing int64
+	// The passcodes the device can set, nil if it didn't say
+	Passcode *PasscodePolicy
+	// The best known location, which may not be the last reported
+	Best *Position
+	// When the device was registered (UTC seconds)
+	Registered int64
+}
+
+// A command waiting for the device to collect it.
+type PendingCommand struct {
+	Cmd  string // JSON command
+	Type string
+	Time int64 // when it was queued (UTC seconds)
+}
+
+// The passcodes a device can set.
+type PasscodePolicy struct {
+	MinLen  int
+	MaxLen  int
+	Charset string // "digits", "alnum" or "any"
+}
+
+// What the device shows while lost.
+type LostMode struct {
+	Message string // for whoever finds the device
+	Phone   string // owner contact
+	Email   string // owner contact
+	Since   int64  // when lost mode was started (UTC seconds)
+}
+
+// What the device last reported about itself.
+type DeviceStatus struct {
+	Battery    int // percent, -1 if unknown
+	Charging   bool
+	Network    string // e.g. "wifi", "cell", "none"
+	Carrier    string
+	AppVersion string
+	OSVersion  string
+	Time       int64 // when it was reported (UTC seconds)
+}
+
+// A command to queue at a later time.
+type ScheduledCommand struct {
+	ID       string
+	DeviceId string
+	Cmd      string // command name
+	Args     string // JSON command arguments
+	Time     int64  // when to queue it (UTC seconds)
+	Created  int64
+	Attempts int    // failed attempts to queue it
+	By       string // user who scheduled it
+}
+
+// A device being tracked for the UI.
+type TrackingSession struct {
+	DeviceId  string
+	StartedBy string // user who started it
+	Started   int64
+	Expires   int64 // when the device stops reporting (UTC seconds)
+	Interval  int64 // seconds between reports, 0 for the device default
+	Unwatched int64 // when the last viewer left, 0 while someone is watching
+}
+
+// An area the owner wants to know the device entering or leaving.
+// Either a circle, or (if Polygon is set) a polygon.
+type Geofence struct {
+	ID        string
+	DeviceId  string
+	Name      string
+	Latitude  float64 // circle center
+	Longitude float64
+	Radius    float64      // circle radius, in meters
+	Polygon   [][2]float64 `json:",omitempty"` // [latitude, longitude] vertices
+	State     string       // "inside" or "outside", "" until known
+	Created   int64
+}
+
+// A link letting anyone with it watch the device's location until it
+// expires or is revoked.
+type Share struct {
+	ID        string
+	DeviceId  string
+	CreatedBy string // user who shared it
+	Created   int64
+	Expires   int64 // UTC seconds
+}
+
+// Another user's access to a device.
+type DeviceAccess struct {
+	DeviceId  string
+	UserId    string
+	Role      string // "viewer", "operator" or "owner"
+	GrantedBy string
+	Created   int64
+}
+
+// An invitation to access a device, for whoever signs in with Email.
+type Invitation struct {
+	ID        string
+	DeviceId  string
+	Role      string
+	Email     string
+	InvitedBy string
+	Created   int64
+	Expires   int64 // UTC seconds
+}
+
+// Something done to a device or account, for the audit log.
+type AuditEvent struct {
+	ID       int64
+	Time     int64  // UTC seconds
+	UserId   string // who did it, "" for the device itself
+	DeviceId string `json:",omitempty"`
+	Owner    string // the device's owner, or the user for account events
+	Action   string
+	Args     string `json:",omitempty"` // JSON, passcodes masked
+	Source   string `json:",omitempty"` // remote address
+	Result   string
+}
+
+// A user's subscription to events about their devices.
+type Webhook struct {
+	ID      string
+	UserId  string
+	URL     string
+	Secret  string   // signs each delivery
+	Events  []string // the events wanted, all of them if empty
+	Created int64    // UTC seconds
+}
+
+// One attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	ID        int64
+	WebhookId string
+	Delivery  string // the same for every attempt at an event
+	Event     string
+	DeviceId  string
+	Time      int64 // UTC seconds
+	Attempt   int
+	Status    int    // HTTP status, 0 if there was no response
+	Error     string `json:",omitempty"`
 }
 
+// How the user wants to be told about their devices.
+type NotifyPrefs struct {
+	Locale string   // e.g. "fr", "" for the server's default
+	Email  bool     // send notices by email
+	Muted  []string // notice events not to email
+}
+
+// The preferences of a user who hasn't chosen any.
+var DefaultNotifyPrefs = NotifyPrefs{Email: true}
+
 type DeviceList struct {
-	ID   string
-	Name string
+	ID          string
+	Name        string
+	Unreachable bool
+	Lost        bool
+	Tracking    bool
+	Role        string // for devices shared with the user
 }
 
 // Generic structure useful for JSON
@@ -82,6 +328,7 @@ type Unstructured map[string]interface{}
        deviceId UUID index
        time     timeStamp
        cmd      string
+       cmdId    string (set for commands also sent inline)
 
    table deviceInfo:
        deviceId       UUID index
@@ -90,8 +337,82 @@ type Unstructured map[string]interface{}
        lastExchange   time
        hawkSecret     string
        pushUrl        string
+       pushKey        string
+       pushAuth       string
+       pushType       string
        accepts        string
        accesstoken    string
+       unreachable    boolean
+       lostmode       string (JSON LostMode, null if not lost)
+       erasing        timeStamp (null unless an erase was sent)
+       passcodepolicy string (JSON PasscodePolicy, null if not reported)
+       bestposition   string (JSON Position, null until there is one)
+
+   table scheduledCommands:
+       id          bigserial
+       deviceId    UUID index
+       time        timeStamp index
+       created     timeStamp
+       cmd         string
+       args        string
+       attempts    int (failed attempts to queue it)
+       scheduledBy UUID (null for commands scheduled before it was kept)
+
+   table trackingSessions:
+       deviceId       UUID index
+       startedBy      UUID
+       started        timeStamp
+       expires        timeStamp
+       reportInterval int
+       unwatched      timeStamp (null while watched)
+
+   table geofences:
+       id        bigserial
+       deviceId  UUID index
+       name      string
+       latitude  float
+       longitude float
+       radius    float
+       polygon   string (JSON vertices, null for circles)
+       state     string
+       created   timeStamp
+
+   table shares:
+       id        string index
+       deviceId  UUID index
+       createdBy UUID
+       created   timeStamp
+       expires   timeStamp
+
+   table deviceAccess:
+       deviceId  UUID index
+       userId    UUID index
+       role      string
+       grantedBy UUID
+       created   timeStamp
+
+   table invitations:
+       id        string index
+       deviceId  UUID index
+       role      string
+       email     string
+       invitedBy UUID
+       created   timeStamp
+       expires   timeStamp
+
+   table deviceStatus:
+       deviceId   UUID index
+       time       timeStamp
+       battery    int
+       charging   boolean
+       network    string
+       carrier    string
+       appVersion string
+       osVersion  string
+
+   table userInfo:
+       userId UUID index
+       email  string
 
    table position:
        positionId UUID index
@@ -102,6 +423,47 @@ type Unstructured map[string]interface{}
        altitude   float
        accuracy   float
 
+   table auditLog:
+       id       bigserial
+       time     timeStamp
+       userId   UUID index
+       deviceId UUID index
+       owner    UUID index
+       action   string
+       args     string (JSON, passcodes masked)
+       source   string
+       result   string
+
+   table webhooks:
+       id       string unique
+       userId   UUID index
+       url      string
+       secret   string
+       events   string (comma separated)
+       created  timeStamp
+
+   table webhookDeliveries:
+       id        bigserial
+       webhookId string index
+       delivery  string
+       event     string
+       deviceId  UUID
+       time      timeStamp index
+       attempt   int
+       status    int
+       error     string
+
+   table notifyPrefs:
+       userId  UUID unique
+       locale  string
+       email   boolean
+       muted   string (comma separated)
+
+   table tombstones:
+       id      UUID index (user or device)
+       kind    string ("user" or "device")
+       deleted timeStamp
+
    // misc administrivia table.
    table meta:
        key        string
@@ -124,14 +486,32 @@ func dbNow() (ret string) {
 	return string(r)
 }
 
+// Open the storage backend specified by "db.type" (postgres or memory)
+func OpenStore(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store Store, err error) {
+	switch strings.ToLower(config.Get("db.type", "postgres")) {
+	case "memory":
+		return OpenMemory(config, logger, metrics)
+	default:
+		pg, err := Open(config, logger, metrics)
+		if err != nil {
+			return nil, err
+		}
+		return pg, nil
+	}
+}
+
 // Open the database.
 func Open(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store *Storage, err error) {
-	dsn := fmt.Sprintf("user=%s password=%s host=%s dbname=%s sslmode=%s",
-		config.Get("db.user", "user"),
-		config.Get("db.password", "password"),
-		config.Get("db.host", "localhost"),
-		config.Get("db.db", "wmf"),
-		config.Get("db.sslmode", "disable"))
+	// A full connection string overrides the separate settings.
+	dsn := config.Get("db.dsn", "")
+	if dsn == "" {
+		dsn = fmt.Sprintf("user=%s password=%s host=%s dbname=%s sslmode=%s",
+			config.Get("db.user", "user"),
+			config.Get("db.password", "password"),
+			config.Get("db.host", "localhost"),
+			config.Get("db.db", "wmf"),
+			config.Get("db.sslmode", "disable"))
+	}
 	logCat := "storage"
 	// default expry is 5 days
 	defExpry, err := strconv.ParseInt(config.Get("db.default_expry", "432000"), 0, 64)
@@ -237,20 +617,31 @@ func (self *Storage) RegisterDevice(userid string, dev Device) (devId string, er
 	if dev.ID == "" {
 		dev.ID, _ = util.GenUUID4()
 	}
+	var policy interface{}
+	if dev.Passcode != nil {
+		js, err := json.Marshal(dev.Passcode)
+		if err != nil {
+			return "", err
+		}
+		policy = string(js)
+	}
 	// if the device belongs to the user already...
 	err = dbh.QueryRow("select deviceid from userToDeviceMap where userId = $1 and deviceid=$2;", userid, dev.ID).Scan(&deviceId)
 	if err == nil && deviceId == dev.ID {
 		self.logger.Debug(self.logCat, "Updating db",
 			util.Fields{"userId": userid, "deviceid": dev.ID})
-		rows, err := dbh.Query("update deviceinfo set lockable=$1, loggedin=$2, lastExchange=$3, hawkSecret=$4, accepts=$5, pushUrl=$6 where deviceid=$7;",
+		_, err := dbh.Exec("update deviceinfo set lockable=$1, loggedin=$2, lastExchange=$3, hawkSecret=$4, accepts=$5, pushUrl=$6, pushKey=$7, pushAuth=$8, pushType=$9, passcodepolicy=$10, unreachable=false where deviceid=$11;",
 			dev.HasPasscode,
 			dev.LoggedIn,
 			dbNow(),
 			dev.Secret,
 			dev.Accepts,
 			dev.PushUrl,
+			dev.PushKey,
+			dev.PushAuth,
+			dev.PushType,
+			policy,
 			dev.ID)
-		defer rows.Close()
 		if err != nil {
 			self.logger.Warn(self.logCat, "Device Info Update error",
 				util.Fields{"error": err.Error()})
@@ -260,24 +651,26 @@ func (self *Storage) RegisterDevice(userid string, dev Device) (devId string, er
 		}
 	}
 	// otherwise insert it.
-	statement := "insert into deviceInfo (deviceId, lockable, loggedin, lastExchange, hawkSecret, accepts, pushUrl) values ($1, $2, $3, $4, $5, $6, $7);"
-	rows, err := dbh.Query(statement,
+	statement := "insert into deviceInfo (deviceId, lockable, loggedin, lastExchange, hawkSecret, accepts, pushUrl, pushKey, pushAuth, pushType, passcodepolicy) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
+	_, err = dbh.Exec(statement,
 		string(dev.ID),
 		dev.HasPasscode,
 		dev.LoggedIn,
 		dbNow(),
 		dev.Secret,
 		dev.Accepts,
-		dev.PushUrl)
-	defer rows.Close()
+		dev.PushUrl,
+		dev.PushKey,
+		dev.PushAuth,
+		dev.PushType,
+		policy)
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not create device",
 			util.Fields{"error": err.Error(),
 				"device": fmt.Sprintf("%+v", dev)})
 		return "", err
 	}
-	rows2, err := dbh.Query("insert into userToDeviceMap (userId, deviceId, name, date) values ($1, $2, $3, now());", userid, dev.ID, dev.Name)
-	defer rows2.Close()
+	_, err = dbh.Exec("insert into userToDeviceMap (userId, deviceId, name, date) values ($1, $2, $3, now());", userid, dev.ID, dev.Name)
 	if err != nil {
 		switch {
 		default:
@@ -291,6 +684,13 @@ func (self *Storage) RegisterDevice(userid string, dev Device) (devId string, er
 			return "", err
 		}
 	}
+	// The device is back, whatever happened to its last owner.
+	if _, err = dbh.Exec("delete from tombstones where id = $1 and kind = $2;",
+		dev.ID, TOMBSTONE_DEVICE); err != nil {
+		self.logger.Warn(self.logCat, "Could not clear device tombstone",
+			util.Fields{"error": err.Error(),
+				"deviceId": dev.ID})
+	}
 	return dev.ID, nil
 }
 
@@ -299,15 +699,16 @@ func (self *Storage) GetDeviceInfo(devId string) (devInfo *Device, err error) {
 
 	// collect the data for a given device for display
 
-	var deviceId, userId, pushUrl, name, secret, lestr, accesstoken []uint8
+	var deviceId, userId, pushUrl, pushKey, pushAuth, pushType, name, secret, lestr, accesstoken, lostmode, policy, best []uint8
 	var lastexchange float64
-	var hasPasscode, loggedIn bool
+	var erasing, registered int64
+	var hasPasscode, loggedIn, unreachable bool
 	var statement, accepts string
 
 	dbh := self.db
 
 	// verify that the device belongs to the user
-	statement = "select d.deviceId, u.userId, coalesce(u.name,d.deviceId), d.lockable, d.loggedin, d.pushUrl, d.accepts, d.hawksecret, extract(epoch from d.lastexchange), d.accesstoken from userToDeviceMap as u, deviceInfo as d where u.deviceId=$1 and u.deviceId=d.deviceId;"
+	statement = "select d.deviceId, u.userId, coalesce(u.name,d.deviceId), d.lockable, d.loggedin, d.pushUrl, d.pushKey, d.pushAuth, d.pushType, d.accepts, d.hawksecret, extract(epoch from d.lastexchange), d.accesstoken, coalesce(d.unreachable, false), d.lostmode, coalesce(extract(epoch from d.erasing)::bigint, 0), d.passcodepolicy, d.bestposition, coalesce(extract(epoch from u.date)::bigint, 0) from userToDeviceMap as u, deviceInfo as d where u.deviceId=$1 and u.deviceId=d.deviceId;"
 	stmt, err := dbh.Prepare(statement)
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not query device info",
@@ -316,7 +717,9 @@ func (self *Storage) GetDeviceInfo(devId string) (devInfo *Device, err error) {
 	}
 	defer stmt.Close()
 	err = stmt.QueryRow(devId).Scan(&deviceId, &userId, &name, &hasPasscode,
-		&loggedIn, &pushUrl, &accepts, &secret, &lestr, &accesstoken)
+		&loggedIn, &pushUrl, &pushKey, &pushAuth, &pushType, &accepts, &secret, &lestr,
+		&accesstoken, &unreachable, &lostmode, &erasing, &policy, &best,
+		&registered)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, ErrUnknownDevice
@@ -339,8 +742,40 @@ func (self *Storage) GetDeviceInfo(devId string) (devInfo *Device, err error) {
 		LoggedIn:     bloggedIn,
 		LastExchange: int32(lastexchange),
 		PushUrl:      string(pushUrl),
+		PushKey:      string(pushKey),
+		PushAuth:     string(pushAuth),
+		PushType:     string(pushType),
 		Accepts:      accepts,
 		AccessToken:  string(accesstoken),
+		Unreachable:  unreachable,
+		Erasing:      erasing,
+		Registered:   registered,
+	}
+	if len(lostmode) > 0 {
+		reply.Lost = &LostMode{}
+		if err = json.Unmarshal(lostmode, reply.Lost); err != nil {
+			self.logger.Warn(self.logCat, "Could not read lost mode",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+		}
+	}
+	if len(policy) > 0 {
+		reply.Passcode = &PasscodePolicy{}
+		if err = json.Unmarshal(policy, reply.Passcode); err != nil {
+			self.logger.Warn(self.logCat, "Could not read passcode policy",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			reply.Passcode = nil
+		}
+	}
+	if len(best) > 0 {
+		reply.Best = &Position{}
+		if err = json.Unmarshal(best, reply.Best); err != nil {
+			self.logger.Warn(self.logCat, "Could not read best position",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			reply.Best = nil
+		}
 	}
 
 	return reply, nil
@@ -385,6 +820,63 @@ func (self *Storage) GetPositions(devId string) (positions []Position, err error
 
 }
 
+// Every retained position for the device, oldest first.
+func (self *Storage) GetPositionHistory(devId string) (positions []Position, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select extract(epoch from time)::bigint, latitude, longitude, altitude, accuracy from position where deviceid=$1 order by time;", devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get position history",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pos Position
+		var latitude, longitude, altitude, accuracy float32
+		if err = rows.Scan(&pos.Time, &latitude, &longitude, &altitude,
+			&accuracy); err != nil {
+			self.logger.Error(self.logCat, "Could not read position history",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		pos.Latitude = float64(latitude)
+		pos.Longitude = float64(longitude)
+		pos.Altitude = float64(altitude)
+		pos.Accuracy = float64(accuracy)
+		positions = append(positions, pos)
+	}
+	return positions, rows.Err()
+}
+
+// The commands waiting for the device, oldest first. Unlike GetPending,
+// they're left for the device to collect.
+func (self *Storage) GetPendingCommands(devId string) (pending []PendingCommand, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select cmd, coalesce(type, ''), extract(epoch from time)::bigint from pendingCommands where deviceId = $1 order by time;", devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get pending commands",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec PendingCommand
+		if err = rows.Scan(&rec.Cmd, &rec.Type, &rec.Time); err != nil {
+			self.logger.Error(self.logCat, "Could not read pending command",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		pending = append(pending, rec)
+	}
+	return pending, rows.Err()
+}
+
 // Get pending commands.
 func (self *Storage) GetPending(devId string) (cmd, ctype string, err error) {
 	dbh := self.db
@@ -459,13 +951,14 @@ func (self *Storage) GetDevicesForUser(userId, oldUserId string) (devices []Devi
 			}
 		}
 	}
-	statement := "select deviceId, coalesce(name,deviceId) from userToDeviceMap where userId = $1 order by date desc limit $2;"
+	statement := "select u.deviceId, coalesce(u.name,u.deviceId), coalesce(d.unreachable, false), d.lostmode is not null, t.deviceId is not null from userToDeviceMap as u left join deviceInfo as d on u.deviceId = d.deviceId left join trackingSessions as t on u.deviceId = t.deviceId and t.expires > now() where u.userId = $1 order by u.date desc limit $2;"
 	rows, err := dbh.Query(statement, userId, limit)
 	defer rows.Close()
 	if err == nil {
 		for rows.Next() {
 			var id, name string
-			err = rows.Scan(&id, &name)
+			var unreachable, lost, tracking bool
+			err = rows.Scan(&id, &name, &unreachable, &lost, &tracking)
 			if err != nil {
 				self.logger.Error(self.logCat,
 					"Could not get list of devices for user",
@@ -473,20 +966,44 @@ func (self *Storage) GetDevicesForUser(userId, oldUserId string) (devices []Devi
 						"user": userId})
 				return nil, err
 			}
-			data = append(data, DeviceList{ID: id, Name: name})
+			data = append(data, DeviceList{ID: id, Name: name,
+				Unreachable: unreachable, Lost: lost, Tracking: tracking})
 		}
 	}
 	return data, err
 }
 
+// Every device the user owns, newest first. Unlike GetDevicesForUser,
+// there's no limit, and nothing is changed.
+func (self *Storage) GetOwnedDevices(userId string) (devIds []string, err error) {
+	rows, err := self.db.Query("select deviceId from userToDeviceMap where userId = $1 order by date desc;",
+		userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get owned devices",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var devId string
+		if err = rows.Scan(&devId); err != nil {
+			return nil, err
+		}
+		devIds = append(devIds, devId)
+	}
+	return devIds, rows.Err()
+}
+
 // Store a command into the list of pending commands for a device.
-func (self *Storage) StoreCommand(devId, command, cType string) (err error) {
+func (self *Storage) StoreCommand(devId, command, cType, cmdId string) (err error) {
 	//update device table to store command where devId = $1
 	dbh := self.db
 
-	result, err := dbh.Exec("update pendingCommands set time=$1, cmd=$2 where deviceid=$3 and type=$4;",
+	result, err := dbh.Exec("update pendingCommands set time=$1, cmd=$2, cmdId=$3 where deviceid=$4 and type=$5;",
 		dbNow(),
 		command,
+		cmdId,
 		devId,
 		cType)
 	if err != nil {
@@ -500,11 +1017,12 @@ func (self *Storage) StoreCommand(devId, command, cType string) (err error) {
 			"Storing Command",
 			util.Fields{"deviceId": devId,
 				"command": command})
-		if _, err = dbh.Exec("insert into pendingCommands (deviceid, time, cmd, type) values( $1, $2, $3, $4);",
+		if _, err = dbh.Exec("insert into pendingCommands (deviceid, time, cmd, type, cmdId) values( $1, $2, $3, $4, $5);",
 			devId,
 			dbNow(),
 			command,
-			cType); err != nil {
+			cType,
+			cmdId); err != nil {
 			self.logger.Error(self.logCat,
 				"Could not store pending command",
 				util.Fields{"error": fmt.Sprintf("%+v", err)})
@@ -514,6 +1032,21 @@ func (self *Storage) StoreCommand(devId, command, cType string) (err error) {
 	return nil
 }
 
+// Drop the device's pending command with the id, if it's still there.
+func (self *Storage) DeletePending(devId, cmdId string) (err error) {
+	if cmdId == "" {
+		return nil
+	}
+	if _, err = self.db.Exec("delete from pendingCommands where deviceId = $1 and cmdId = $2;",
+		devId, cmdId); err != nil {
+		self.logger.Error(self.logCat, "Could not delete pending command",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"cmdId":    cmdId})
+	}
+	return err
+}
+
 func (self *Storage) SetAccessToken(devId, token string) (err error) {
 	dbh := self.db
 
@@ -539,126 +1072,1296 @@ func (self *Storage) SetDeviceLock(devId string, state bool) (err error) {
 		self.logger.Error(self.logCat, "Could not set device lock state",
 			util.Fields{"error": err.Error(),
 				"device": devId,
-				"state":  fmt.Sprintf("%b", state)})
+				"state":  fmt.Sprintf("%t", state)})
 		return err
 	}
 	return nil
 }
 
-// Add the location information to the known set for a device.
-func (self *Storage) SetDeviceLocation(devId string, position Position) (err error) {
+// Forget the device's push endpoint (if it's still pushUrl). The device
+// can't be woken until it registers again.
+func (self *Storage) SetDeviceUnreachable(devId, pushUrl string) (err error) {
 	dbh := self.db
 
-	// Only keep the latest positon (changed requirements from original design)
-	self.PurgePosition(devId)
-
-	statement := "insert into position (deviceId, time, latitude, longitude, altitude, accuracy) values ($1, $2, $3, $4, $5, $6);"
-	st, err := dbh.Prepare(statement)
-	_, err = st.Exec(
-		devId,
-		dbNow(),
-		float32(position.Latitude),
-		float32(position.Longitude),
-		float32(position.Altitude),
-		float32(position.Accuracy))
-	st.Close()
-	if err != nil {
-		self.logger.Error(self.logCat, "Error inserting postion",
-			util.Fields{"error": err.Error()})
+	statement := "update deviceInfo set pushUrl = '', pushKey = '', pushAuth = '', unreachable = true where deviceId = $1 and pushUrl = $2;"
+	if _, err = dbh.Exec(statement, devId, pushUrl); err != nil {
+		self.logger.Error(self.logCat, "Could not mark device unreachable",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
 		return err
 	}
 	return nil
 }
 
-// Remove old postion information for devices.
-// This previously removed "expired" location records. We currently only
-// retain the latest record for a user.
-func (self *Storage) GcDatabase(devId, userId string) (err error) {
+// Record the device's lost mode, or clear it (lost is nil).
+func (self *Storage) SetLostMode(devId string, lost *LostMode) (err error) {
 	dbh := self.db
 
-	// because prepare doesn't like single quoted vars
-	// because calling dbh.Exec() causes a lock race condition.
-	// because I didn't have enough reasons to drink.
-	// Delete old records (except the latest one) so we always have
-	// at least one position record.
-	// Added bonus: The following string causes the var replacer to
-	// get confused and toss an error, so yes, currently this uses inline
-	// replacement.
-	//	statement := fmt.Sprintf("delete from position where id in (select id from (select id, row_number() over (order by time desc) RowNumber from position where time < (now() - interval '%d seconds') ) tt where RowNumber > 1);", self.defExpry)
-	statement := fmt.Sprintf("delete from position where time < (now() - interval '%d seconds');", self.defExpry)
-	st, err := dbh.Prepare(statement)
-	_, err = st.Exec()
-	st.Close()
-	if err != nil {
-		self.logger.Error(self.logCat, "Error gc'ing positions",
-			util.Fields{"error": err.Error()})
+	var val interface{}
+	if lost != nil {
+		js, err := json.Marshal(lost)
+		if err != nil {
+			return err
+		}
+		val = string(js)
+	}
+	statement := "update deviceInfo set lostmode = $1 where deviceId = $2;"
+	if _, err = dbh.Exec(statement, val, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not set lost mode",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
 		return err
 	}
-	// TODO: convert the following into statements
-	/*
-	   // remove "extra" devices registered to the user
-	   // check this sql
-	   delete from usertodevicemap where id in (select id from
-	       (select id, row_number() over (order by date desc) RowNumber from
-	       usertodevicemap) tt where RowNumber > 1);
+	return nil
+}
 
-	   // delete devices with no "owner".
-	   delete from deviceinfo where deviceinfo.deviceid in
-	       (select deviceinfo.deviceid from deviceinfo left join
-	        usertodevicemap on usertodevicemap.deviceid =
-	        deviceinfo.deviceid where usertodevicemap.deviceid is null);
-	*/
+// Record the device's best known location.
+func (self *Storage) SetBestPosition(devId string, position Position) (err error) {
+	dbh := self.db
 
+	position.Cmd = nil
+	position.Stale = false
+	js, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	statement := "update deviceInfo set bestposition = $1 where deviceId = $2;"
+	if _, err = dbh.Exec(statement, string(js), devId); err != nil {
+		self.logger.Error(self.logCat, "Could not set best position",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
 	return nil
 }
 
-// remove all tracking information for devId.
-func (self *Storage) PurgePosition(devId string) (err error) {
+// Record when the device was sent an erase, or clear it (when is 0).
+func (self *Storage) SetErasing(devId string, when int64) (err error) {
 	dbh := self.db
 
-	statement := "delete from position where deviceid = $1;"
-	if _, err = dbh.Exec(statement, devId); err != nil {
+	var val interface{}
+	if when > 0 {
+		val = time.Unix(when, 0).UTC()
+	}
+	statement := "update deviceInfo set erasing = $1 where deviceId = $2;"
+	if _, err = dbh.Exec(statement, val, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not set erase time",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
 		return err
 	}
 	return nil
 }
 
-func (self *Storage) Touch(devId string) (err error) {
+// Record the user's email address, for notifications.
+func (self *Storage) SetUserEmail(userId, email string) (err error) {
 	dbh := self.db
 
-	statement := "update deviceInfo set lastexchange = now() where deviceid = $1"
-	_, err = dbh.Exec(statement, devId)
+	result, err := dbh.Exec("update userInfo set email=$1 where userId=$2;",
+		email, userId)
 	if err != nil {
+		self.logger.Error(self.logCat, "Could not update user email",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
 		return err
 	}
-
+	if cnt, err := result.RowsAffected(); cnt == 0 || err != nil {
+		if _, err = dbh.Exec("insert into userInfo (userId, email) values ($1, $2);",
+			userId, email); err != nil {
+			self.logger.Error(self.logCat, "Could not store user email",
+				util.Fields{"error": err.Error(),
+					"userId": userId})
+			return err
+		}
+	}
 	return nil
 }
 
-func (self *Storage) DeleteDevice(devId string) (err error) {
+// Get the user's email address. Returns "" if it isn't known.
+func (self *Storage) GetUserEmail(userId string) (email string, err error) {
 	dbh := self.db
 
-	var tables = []string{"pendingcommands",
-		"position",
-		"usertodevicemap",
-		"deviceinfo"}
+	var val []uint8
+	err = dbh.QueryRow("select email from userInfo where userId = $1;",
+		userId).Scan(&val)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not fetch user email",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return "", err
+	}
+	return string(val), nil
+}
 
-	for t := range tables {
-		// BURN THE WITCH!
-		table := tables[t]
-		_, err = dbh.Exec("delete from "+table+" where deviceid=$1;", devId)
-		if err != nil {
-			self.logger.Error(self.logCat,
-				"Could not nuke data from table",
+// Replace the device's status record.
+func (self *Storage) SetDeviceStatus(devId string, status DeviceStatus) (err error) {
+	dbh := self.db
+
+	when := time.Unix(status.Time, 0).UTC()
+	result, err := dbh.Exec("update deviceStatus set time=$1, battery=$2, charging=$3, network=$4, carrier=$5, appVersion=$6, osVersion=$7 where deviceId=$8;",
+		when,
+		status.Battery,
+		status.Charging,
+		status.Network,
+		status.Carrier,
+		status.AppVersion,
+		status.OSVersion,
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not update device status",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	if cnt, err := result.RowsAffected(); cnt == 0 || err != nil {
+		if _, err = dbh.Exec("insert into deviceStatus (deviceId, time, battery, charging, network, carrier, appVersion, osVersion) values ($1, $2, $3, $4, $5, $6, $7, $8);",
+			devId,
+			when,
+			status.Battery,
+			status.Charging,
+			status.Network,
+			status.Carrier,
+			status.AppVersion,
+			status.OSVersion); err != nil {
+			self.logger.Error(self.logCat, "Could not store device status",
 				util.Fields{"error": err.Error(),
-					"device": devId,
-					"table":  table})
+					"deviceId": devId})
 			return err
 		}
 	}
 	return nil
 }
 
+// Get the device's last status. Returns nil if the device hasn't
+// reported one.
+func (self *Storage) GetDeviceStatus(devId string) (status *DeviceStatus, err error) {
+	dbh := self.db
+
+	var when time.Time
+	var network, carrier, appVersion, osVersion []uint8
+	status = &DeviceStatus{}
+	err = dbh.QueryRow("select time, battery, charging, network, carrier, appVersion, osVersion from deviceStatus where deviceId = $1;",
+		devId).Scan(&when, &status.Battery, &status.Charging, &network,
+		&carrier, &appVersion, &osVersion)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not fetch device status",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	status.Network = string(network)
+	status.Carrier = string(carrier)
+	status.AppVersion = string(appVersion)
+	status.OSVersion = string(osVersion)
+	status.Time = when.Unix()
+	return status, nil
+}
+
+// Store a command to queue later.
+func (self *Storage) ScheduleCommand(sched ScheduledCommand) (id string, err error) {
+	dbh := self.db
+
+	err = dbh.QueryRow("insert into scheduledCommands (deviceId, time, created, cmd, args, scheduledBy) values ($1, $2, $3, $4, $5, $6) returning id;",
+		sched.DeviceId,
+		time.Unix(sched.Time, 0).UTC(),
+		dbNow(),
+		sched.Cmd,
+		sched.Args,
+		sched.By).Scan(&id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not schedule command",
+			util.Fields{"error": err.Error(),
+				"deviceId": sched.DeviceId})
+		return "", err
+	}
+	return id, nil
+}
+
+func (self *Storage) readScheduled(rows *sql.Rows) (scheduled []ScheduledCommand, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var sched ScheduledCommand
+		var when, created time.Time
+		if err = rows.Scan(&sched.ID, &sched.DeviceId, &when, &created,
+			&sched.Cmd, &sched.Args, &sched.Attempts, &sched.By); err != nil {
+			self.logger.Error(self.logCat, "Could not read scheduled command",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		sched.Time = when.Unix()
+		sched.Created = created.Unix()
+		scheduled = append(scheduled, sched)
+	}
+	return scheduled, rows.Err()
+}
+
+// Get the commands scheduled for the device, soonest first.
+func (self *Storage) GetScheduled(devId string) (scheduled []ScheduledCommand, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select id, deviceId, time, created, cmd, args, coalesce(attempts, 0), coalesce(scheduledBy, '') from scheduledCommands where deviceId = $1 order by time;",
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get scheduled commands",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	return self.readScheduled(rows)
+}
+
+// Cancel a scheduled command.
+func (self *Storage) CancelScheduled(devId, id string) (found bool, err error) {
+	dbh := self.db
+
+	result, err := dbh.Exec("delete from scheduledCommands where deviceId = $1 and id = $2;",
+		devId, id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not cancel scheduled command",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"id":       id})
+		return false, err
+	}
+	cnt, err := result.RowsAffected()
+	return cnt > 0, err
+}
+
+// Remove and return up to limit commands due by now. Each command is
+// only returned once, even with several servers.
+func (self *Storage) TakeDueCommands(now int64, limit int) (due []ScheduledCommand, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("delete from scheduledCommands where id in (select id from scheduledCommands where time <= $1 order by time limit $2 for update skip locked) returning id, deviceId, time, created, cmd, args, coalesce(attempts, 0), coalesce(scheduledBy, '');",
+		time.Unix(now, 0).UTC(), limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get due commands",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	return self.readScheduled(rows)
+}
+
+// Put a command taken by TakeDueCommands back, keeping its id, to be
+// queued at sched.Time.
+func (self *Storage) RescheduleCommand(sched ScheduledCommand) (err error) {
+	_, err = self.db.Exec("insert into scheduledCommands (id, deviceId, time, created, cmd, args, attempts, scheduledBy) values ($1, $2, $3, $4, $5, $6, $7, $8);",
+		sched.ID,
+		sched.DeviceId,
+		time.Unix(sched.Time, 0).UTC(),
+		time.Unix(sched.Created, 0).UTC(),
+		sched.Cmd,
+		sched.Args,
+		sched.Attempts,
+		sched.By)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not reschedule command",
+			util.Fields{"error": err.Error(),
+				"deviceId": sched.DeviceId,
+				"id":       sched.ID})
+	}
+	return err
+}
+
+// Start tracking the device, replacing any earlier session.
+func (self *Storage) StartTracking(session TrackingSession) (err error) {
+	dbh := self.db
+
+	var unwatched interface{}
+	if session.Unwatched > 0 {
+		unwatched = time.Unix(session.Unwatched, 0).UTC()
+	}
+	if _, err = dbh.Exec("delete from trackingSessions where deviceId = $1;",
+		session.DeviceId); err == nil {
+		_, err = dbh.Exec("insert into trackingSessions (deviceId, startedBy, started, expires, reportInterval, unwatched) values ($1, $2, $3, $4, $5, $6);",
+			session.DeviceId,
+			session.StartedBy,
+			time.Unix(session.Started, 0).UTC(),
+			time.Unix(session.Expires, 0).UTC(),
+			session.Interval,
+			unwatched)
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not start tracking session",
+			util.Fields{"error": err.Error(),
+				"deviceId": session.DeviceId})
+		return err
+	}
+	return nil
+}
+
+func (self *Storage) readTracking(rows *sql.Rows) (sessions []TrackingSession, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var session TrackingSession
+		var started, expires time.Time
+		var unwatched int64
+		if err = rows.Scan(&session.DeviceId, &session.StartedBy, &started,
+			&expires, &session.Interval, &unwatched); err != nil {
+			self.logger.Error(self.logCat, "Could not read tracking session",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		session.Started = started.Unix()
+		session.Expires = expires.Unix()
+		session.Unwatched = unwatched
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// Get the device's tracking session. Returns nil if the device isn't
+// being tracked.
+func (self *Storage) GetTracking(devId string) (session *TrackingSession, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select deviceId, startedBy, started, expires, reportInterval, coalesce(extract(epoch from unwatched)::bigint, 0) from trackingSessions where deviceId = $1 and expires > now();",
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get tracking session",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	sessions, err := self.readTracking(rows)
+	if err != nil || len(sessions) == 0 {
+		return nil, err
+	}
+	return &sessions[0], nil
+}
+
+// Record when the last viewer left (0 when one comes back).
+func (self *Storage) SetTrackingUnwatched(devId string, since int64) (err error) {
+	dbh := self.db
+
+	var unwatched interface{}
+	if since > 0 {
+		unwatched = time.Unix(since, 0).UTC()
+	}
+	if _, err = dbh.Exec("update trackingSessions set unwatched = $1 where deviceId = $2;",
+		unwatched, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not update tracking session",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	return nil
+}
+
+// End the device's tracking session.
+func (self *Storage) StopTracking(devId string) (found bool, err error) {
+	dbh := self.db
+
+	result, err := dbh.Exec("delete from trackingSessions where deviceId = $1;",
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not stop tracking session",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return false, err
+	}
+	cnt, err := result.RowsAffected()
+	return cnt > 0, err
+}
+
+// Remove and return up to limit sessions that have expired by now, or
+// that nobody has watched since idleSince. Each session is only
+// returned once, even with several servers.
+func (self *Storage) TakeIdleTracking(now, idleSince int64, limit int) (idle []TrackingSession, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("delete from trackingSessions where deviceId in (select deviceId from trackingSessions where expires <= $1 or unwatched <= $2 limit $3 for update skip locked) returning deviceId, startedBy, started, expires, reportInterval, coalesce(extract(epoch from unwatched)::bigint, 0);",
+		time.Unix(now, 0).UTC(), time.Unix(idleSince, 0).UTC(), limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get idle tracking sessions",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	return self.readTracking(rows)
+}
+
+// Add a geofence for the device.
+func (self *Storage) AddGeofence(fence Geofence) (id string, err error) {
+	dbh := self.db
+
+	var polygon interface{}
+	if len(fence.Polygon) > 0 {
+		js, err := json.Marshal(fence.Polygon)
+		if err != nil {
+			return "", err
+		}
+		polygon = string(js)
+	}
+	err = dbh.QueryRow("insert into geofences (deviceId, name, latitude, longitude, radius, polygon, state, created) values ($1, $2, $3, $4, $5, $6, $7, $8) returning id;",
+		fence.DeviceId,
+		fence.Name,
+		fence.Latitude,
+		fence.Longitude,
+		fence.Radius,
+		polygon,
+		fence.State,
+		dbNow()).Scan(&id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not add geofence",
+			util.Fields{"error": err.Error(),
+				"deviceId": fence.DeviceId})
+		return "", err
+	}
+	return id, nil
+}
+
+// Get the device's geofences, oldest first.
+func (self *Storage) GetGeofences(devId string) (fences []Geofence, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select id, deviceId, name, latitude, longitude, radius, polygon, coalesce(state, ''), created from geofences where deviceId = $1 order by id;",
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get geofences",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fence Geofence
+		var polygon []uint8
+		var created time.Time
+		if err = rows.Scan(&fence.ID, &fence.DeviceId, &fence.Name,
+			&fence.Latitude, &fence.Longitude, &fence.Radius, &polygon,
+			&fence.State, &created); err != nil {
+			self.logger.Error(self.logCat, "Could not read geofence",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		if len(polygon) > 0 {
+			if err = json.Unmarshal(polygon, &fence.Polygon); err != nil {
+				self.logger.Warn(self.logCat, "Could not read geofence polygon",
+					util.Fields{"error": err.Error(),
+						"id": fence.ID})
+				continue
+			}
+		}
+		fence.Created = created.Unix()
+		fences = append(fences, fence)
+	}
+	return fences, rows.Err()
+}
+
+// Remove one of the device's geofences.
+func (self *Storage) DeleteGeofence(devId, id string) (found bool, err error) {
+	dbh := self.db
+
+	result, err := dbh.Exec("delete from geofences where deviceId = $1 and id = $2;",
+		devId, id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not delete geofence",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"id":       id})
+		return false, err
+	}
+	cnt, err := result.RowsAffected()
+	return cnt > 0, err
+}
+
+// Record whether the device was last seen inside the geofence.
+func (self *Storage) SetGeofenceState(id, state string) (err error) {
+	dbh := self.db
+
+	if _, err = dbh.Exec("update geofences set state = $1 where id = $2;",
+		state, id); err != nil {
+		self.logger.Error(self.logCat, "Could not update geofence",
+			util.Fields{"error": err.Error(),
+				"id": id})
+		return err
+	}
+	return nil
+}
+
+// Add the location information to the known set for a device.
+func (self *Storage) SetDeviceLocation(devId string, position Position) (err error) {
+	dbh := self.db
+
+	// Only keep the latest positon (changed requirements from original design)
+	self.PurgePosition(devId)
+
+	statement := "insert into position (deviceId, time, latitude, longitude, altitude, accuracy) values ($1, $2, $3, $4, $5, $6);"
+	st, err := dbh.Prepare(statement)
+	_, err = st.Exec(
+		devId,
+		dbNow(),
+		float32(position.Latitude),
+		float32(position.Longitude),
+		float32(position.Altitude),
+		float32(position.Accuracy))
+	st.Close()
+	if err != nil {
+		self.logger.Error(self.logCat, "Error inserting postion",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+// Add a share link for the device, clearing out its expired ones.
+func (self *Storage) AddShare(share Share) (err error) {
+	dbh := self.db
+
+	if _, err = dbh.Exec("delete from shares where deviceId = $1 and expires <= now();",
+		share.DeviceId); err == nil {
+		_, err = dbh.Exec("insert into shares (id, deviceId, createdBy, created, expires) values ($1, $2, $3, $4, $5);",
+			share.ID,
+			share.DeviceId,
+			share.CreatedBy,
+			time.Unix(share.Created, 0).UTC(),
+			time.Unix(share.Expires, 0).UTC())
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not add share",
+			util.Fields{"error": err.Error(),
+				"deviceId": share.DeviceId})
+		return err
+	}
+	return nil
+}
+
+func (self *Storage) readShares(rows *sql.Rows) (shares []Share, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var share Share
+		var created, expires time.Time
+		if err = rows.Scan(&share.ID, &share.DeviceId, &share.CreatedBy,
+			&created, &expires); err != nil {
+			self.logger.Error(self.logCat, "Could not read share",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		share.Created = created.Unix()
+		share.Expires = expires.Unix()
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// Get a share link. Returns nil if it has expired or been revoked.
+func (self *Storage) GetShare(id string) (share *Share, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select id, deviceId, createdBy, created, expires from shares where id = $1 and expires > now();",
+		id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get share",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	shares, err := self.readShares(rows)
+	if err != nil || len(shares) == 0 {
+		return nil, err
+	}
+	return &shares[0], nil
+}
+
+// Get the device's current share links, oldest first.
+func (self *Storage) GetShares(devId string) (shares []Share, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select id, deviceId, createdBy, created, expires from shares where deviceId = $1 and expires > now() order by created;",
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get shares",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	return self.readShares(rows)
+}
+
+// Revoke one of the device's share links.
+func (self *Storage) DeleteShare(devId, id string) (found bool, err error) {
+	dbh := self.db
+
+	result, err := dbh.Exec("delete from shares where deviceId = $1 and id = $2 and expires > now();",
+		devId, id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not delete share",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return false, err
+	}
+	cnt, err := result.RowsAffected()
+	return cnt > 0, err
+}
+
+// Invite someone to access the device, clearing out its expired
+// invitations.
+func (self *Storage) AddInvitation(invite Invitation) (err error) {
+	dbh := self.db
+
+	if _, err = dbh.Exec("delete from invitations where deviceId = $1 and expires <= now();",
+		invite.DeviceId); err == nil {
+		_, err = dbh.Exec("insert into invitations (id, deviceId, role, email, invitedBy, created, expires) values ($1, $2, $3, $4, $5, $6, $7);",
+			invite.ID,
+			invite.DeviceId,
+			invite.Role,
+			invite.Email,
+			invite.InvitedBy,
+			time.Unix(invite.Created, 0).UTC(),
+			time.Unix(invite.Expires, 0).UTC())
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not add invitation",
+			util.Fields{"error": err.Error(),
+				"deviceId": invite.DeviceId})
+		return err
+	}
+	return nil
+}
+
+func (self *Storage) readInvitations(rows *sql.Rows) (invites []Invitation, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var invite Invitation
+		var created, expires time.Time
+		if err = rows.Scan(&invite.ID, &invite.DeviceId, &invite.Role,
+			&invite.Email, &invite.InvitedBy, &created, &expires); err != nil {
+			self.logger.Error(self.logCat, "Could not read invitation",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		invite.Created = created.Unix()
+		invite.Expires = expires.Unix()
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// Get an invitation. Returns nil if it has expired, or was accepted or
+// withdrawn.
+func (self *Storage) GetInvitation(id string) (invite *Invitation, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select id, deviceId, role, email, invitedBy, created, expires from invitations where id = $1 and expires > now();",
+		id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get invitation",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	invites, err := self.readInvitations(rows)
+	if err != nil || len(invites) == 0 {
+		return nil, err
+	}
+	return &invites[0], nil
+}
+
+// Get the device's open invitations, oldest first.
+func (self *Storage) GetInvitations(devId string) (invites []Invitation, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select id, deviceId, role, email, invitedBy, created, expires from invitations where deviceId = $1 and expires > now() order by created;",
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get invitations",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	return self.readInvitations(rows)
+}
+
+// Remove an invitation, once accepted or withdrawn.
+func (self *Storage) DeleteInvitation(devId, id string) (found bool, err error) {
+	dbh := self.db
+
+	result, err := dbh.Exec("delete from invitations where deviceId = $1 and id = $2 and expires > now();",
+		devId, id)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not delete invitation",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return false, err
+	}
+	cnt, err := result.RowsAffected()
+	return cnt > 0, err
+}
+
+// Give the user access to the device, replacing any role they had.
+func (self *Storage) GrantAccess(access DeviceAccess) (err error) {
+	dbh := self.db
+
+	if _, err = dbh.Exec("insert into deviceAccess (deviceId, userId, role, grantedBy, created) values ($1, $2, $3, $4, $5) on conflict (deviceId, userId) do update set role = excluded.role, grantedBy = excluded.grantedBy, created = excluded.created;",
+		access.DeviceId,
+		access.UserId,
+		access.Role,
+		access.GrantedBy,
+		time.Unix(access.Created, 0).UTC()); err != nil {
+		self.logger.Error(self.logCat, "Could not grant access",
+			util.Fields{"error": err.Error(),
+				"deviceId": access.DeviceId})
+		return err
+	}
+	return nil
+}
+
+// Get who else can access the device, oldest first.
+func (self *Storage) GetAccess(devId string) (access []DeviceAccess, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select deviceId, userId, role, grantedBy, created from deviceAccess where deviceId = $1 order by created;",
+		devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get device access",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec DeviceAccess
+		var created time.Time
+		if err = rows.Scan(&rec.DeviceId, &rec.UserId, &rec.Role,
+			&rec.GrantedBy, &created); err != nil {
+			self.logger.Error(self.logCat, "Could not read device access",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		rec.Created = created.Unix()
+		access = append(access, rec)
+	}
+	return access, rows.Err()
+}
+
+// Take away the user's access to the device.
+func (self *Storage) RevokeAccess(devId, userId string) (found bool, err error) {
+	dbh := self.db
+
+	result, err := dbh.Exec("delete from deviceAccess where deviceId = $1 and userId = $2;",
+		devId, userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not revoke access",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return false, err
+	}
+	cnt, err := result.RowsAffected()
+	return cnt > 0, err
+}
+
+// Get the devices other users have given the user access to, newest
+// first.
+func (self *Storage) GetSharedDevices(userId string) (devices []DeviceList, err error) {
+	dbh := self.db
+
+	rows, err := dbh.Query("select a.deviceId, coalesce(u.name, a.deviceId), coalesce(d.unreachable, false), d.lostmode is not null, t.deviceId is not null, a.role from deviceAccess as a join userToDeviceMap as u on a.deviceId = u.deviceId left join deviceInfo as d on a.deviceId = d.deviceId left join trackingSessions as t on a.deviceId = t.deviceId and t.expires > now() where a.userId = $1 order by a.created desc;",
+		userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get shared devices",
+			util.Fields{"error": err.Error(),
+				"user": userId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dev DeviceList
+		if err = rows.Scan(&dev.ID, &dev.Name, &dev.Unreachable, &dev.Lost,
+			&dev.Tracking, &dev.Role); err != nil {
+			self.logger.Error(self.logCat, "Could not read shared device",
+				util.Fields{"error": err.Error(),
+					"user": userId})
+			return nil, err
+		}
+		devices = append(devices, dev)
+	}
+	return devices, rows.Err()
+}
+
+// Remove old postion information for devices.
+// This previously removed "expired" location records. We currently only
+// retain the latest record for a user.
+func (self *Storage) GcDatabase(devId, userId string) (err error) {
+	dbh := self.db
+
+	// because prepare doesn't like single quoted vars
+	// because calling dbh.Exec() causes a lock race condition.
+	// because I didn't have enough reasons to drink.
+	// Delete old records (except the latest one) so we always have
+	// at least one position record.
+	// Added bonus: The following string causes the var replacer to
+	// get confused and toss an error, so yes, currently this uses inline
+	// replacement.
+	//	statement := fmt.Sprintf("delete from position where id in (select id from (select id, row_number() over (order by time desc) RowNumber from position where time < (now() - interval '%d seconds') ) tt where RowNumber > 1);", self.defExpry)
+	statement := fmt.Sprintf("delete from position where time < (now() - interval '%d seconds');", self.defExpry)
+	st, err := dbh.Prepare(statement)
+	_, err = st.Exec()
+	st.Close()
+	if err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing positions",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	tombExpry, err := strconv.ParseInt(self.config.Get("db.tombstone_expry",
+		"2592000"), 0, 64)
+	if err != nil {
+		tombExpry = 2592000
+	}
+	if _, err = dbh.Exec("delete from tombstones where deleted < $1;",
+		time.Now().UTC().Add(-time.Duration(tombExpry)*time.Second)); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing tombstones",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	logExpry, err := strconv.ParseInt(self.config.Get("db.webhook_log_expry",
+		"604800"), 0, 64)
+	if err != nil {
+		logExpry = 604800
+	}
+	if _, err = dbh.Exec("delete from webhookDeliveries where time < $1;",
+		time.Now().UTC().Add(-time.Duration(logExpry)*time.Second)); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing webhook deliveries",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	// TODO: convert the following into statements
+	/*
+	   // remove "extra" devices registered to the user
+	   // check this sql
+	   delete from usertodevicemap where id in (select id from
+	       (select id, row_number() over (order by date desc) RowNumber from
+	       usertodevicemap) tt where RowNumber > 1);
+
+	   // delete devices with no "owner".
+	   delete from deviceinfo where deviceinfo.deviceid in
+	       (select deviceinfo.deviceid from deviceinfo left join
+	        usertodevicemap on usertodevicemap.deviceid =
+	        deviceinfo.deviceid where usertodevicemap.deviceid is null);
+	*/
+
+	return nil
+}
+
+// remove all tracking information for devId.
+func (self *Storage) PurgePosition(devId string) (err error) {
+	dbh := self.db
+
+	statement := "delete from position where deviceid = $1;"
+	if _, err = dbh.Exec(statement, devId); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (self *Storage) Touch(devId string) (err error) {
+	dbh := self.db
+
+	statement := "update deviceInfo set lastexchange = now() where deviceid = $1"
+	_, err = dbh.Exec(statement, devId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Either the database or a transaction.
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (self *Storage) DeleteDevice(devId string) (err error) {
+	return self.deleteDevice(self.db, devId)
+}
+
+func (self *Storage) deleteDevice(dbh dbExecer, devId string) (err error) {
+	var tables = []string{"pendingcommands",
+		"scheduledcommands",
+		"position",
+		"devicestatus",
+		"trackingsessions",
+		"geofences",
+		"shares",
+		"deviceaccess",
+		"invitations",
+		"usertodevicemap",
+		"deviceinfo"}
+
+	for t := range tables {
+		// BURN THE WITCH!
+		table := tables[t]
+		_, err = dbh.Exec("delete from "+table+" where deviceid=$1;", devId)
+		if err != nil {
+			self.logger.Error(self.logCat,
+				"Could not nuke data from table",
+				util.Fields{"error": err.Error(),
+					"device": devId,
+					"table":  table})
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the user and everything held for them: their devices (as
+// DeleteDevice does), their access to other people's devices, the
+// invitations and share links they made, and invitations sent to them.
+// Tombstones are left for the user and each device. Returns the devices
+// removed, as they were.
+func (self *Storage) DeleteUser(userId string) (devices []Device, err error) {
+	// All or nothing, so a failure part way doesn't leave the account
+	// half deleted (or deleted without its tombstones).
+	tx, err := self.db.Begin()
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not start deleting user",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var devIds []string
+	rows, err := tx.Query("select deviceId from userToDeviceMap where userId = $1;", userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get devices to delete",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	for rows.Next() {
+		var devId string
+		if err = rows.Scan(&devId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		devIds = append(devIds, devId)
+	}
+	rows.Close()
+	var email string
+	err = tx.QueryRow("select coalesce(email, '') from userInfo where userId = $1;",
+		userId).Scan(&email)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, devId := range devIds {
+		if devRec, err := self.GetDeviceInfo(devId); err == nil {
+			devices = append(devices, *devRec)
+		}
+	}
+	// Devices calling in afterwards are turned away by the tombstones.
+	if err = self.addTombstone(tx, TOMBSTONE_USER, userId); err != nil {
+		return nil, err
+	}
+	for _, devId := range devIds {
+		if err = self.addTombstone(tx, TOMBSTONE_DEVICE, devId); err != nil {
+			return nil, err
+		}
+		if err = self.deleteDevice(tx, devId); err != nil {
+			return nil, err
+		}
+	}
+	// OAuth nonces (the nonce table) are made before anyone signs in
+	// and hold no user id, and Hawk nonces aren't stored, so there are
+	// none to remove.
+	var statements = []string{
+		"delete from auditLog where userId = $1 or owner = $1;",
+		"delete from webhookDeliveries where webhookId in (select id from webhooks where userId = $1);",
+		"delete from webhooks where userId = $1;",
+		"delete from deviceAccess where userId = $1;",
+		"delete from invitations where invitedBy = $1;",
+		"delete from shares where createdBy = $1;",
+		"delete from notifyPrefs where userId = $1;",
+		"delete from userInfo where userId = $1;",
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement, userId); err != nil {
+			self.logger.Error(self.logCat, "Could not delete user data",
+				util.Fields{"error": err.Error(),
+					"userId":    userId,
+					"statement": statement})
+			return nil, err
+		}
+	}
+	if email != "" {
+		if _, err = tx.Exec("delete from invitations where lower(email) = lower($1);",
+			email); err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		self.logger.Error(self.logCat, "Could not delete user",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	return devices, nil
+}
+
+// The user's notification preferences, DefaultNotifyPrefs if they
+// haven't set any.
+func (self *Storage) GetNotifyPrefs(userId string) (prefs NotifyPrefs, err error) {
+	var muted string
+	err = self.db.QueryRow("select locale, email, muted from notifyPrefs where userId = $1;",
+		userId).Scan(&prefs.Locale, &prefs.Email, &muted)
+	switch {
+	case err == sql.ErrNoRows:
+		return DefaultNotifyPrefs, nil
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not get notification preferences",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return DefaultNotifyPrefs, err
+	}
+	if muted != "" {
+		prefs.Muted = strings.Split(muted, ",")
+	}
+	return prefs, nil
+}
+
+// Replace the user's notification preferences.
+func (self *Storage) SetNotifyPrefs(userId string, prefs NotifyPrefs) (err error) {
+	_, err = self.db.Exec("insert into notifyPrefs (userId, locale, email, muted) values ($1, $2, $3, $4) on conflict (userId) do update set locale = excluded.locale, email = excluded.email, muted = excluded.muted;",
+		userId, prefs.Locale, prefs.Email, strings.Join(prefs.Muted, ","))
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not set notification preferences",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+	}
+	return err
+}
+
+// Append an event to the audit log.
+func (self *Storage) AddAuditEvent(event AuditEvent) (err error) {
+	_, err = self.db.Exec("insert into auditLog (time, userId, deviceId, owner, action, args, source, result) values ($1, $2, $3, $4, $5, $6, $7, $8);",
+		time.Unix(event.Time, 0).UTC(),
+		event.UserId,
+		event.DeviceId,
+		event.Owner,
+		event.Action,
+		event.Args,
+		event.Source,
+		event.Result)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not add audit event",
+			util.Fields{"error": err.Error(),
+				"deviceId": event.DeviceId,
+				"action":   event.Action})
+	}
+	return err
+}
+
+// The device's audit events, newest first: up to limit of them (all if
+// limit is 0) from before the event with id before (0 for the latest).
+func (self *Storage) GetAuditEvents(devId string, before int64, limit int) (events []AuditEvent, err error) {
+	var max interface{}
+	if limit > 0 {
+		max = limit
+	}
+	rows, err := self.db.Query("select id, time, userId, deviceId, owner, action, args, source, result from auditLog where deviceId = $1 and ($2 = 0 or id < $2) order by id desc limit $3;",
+		devId, before, max)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get audit events",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	return self.readAuditEvents(rows)
+}
+
+// Every audit event the user did, or that happened to their devices or
+// account, oldest first.
+func (self *Storage) GetUserAuditEvents(userId string) (events []AuditEvent, err error) {
+	rows, err := self.db.Query("select id, time, userId, deviceId, owner, action, args, source, result from auditLog where userId = $1 or owner = $1 order by id;",
+		userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get user audit events",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	return self.readAuditEvents(rows)
+}
+
+func (self *Storage) readAuditEvents(rows *sql.Rows) (events []AuditEvent, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var event AuditEvent
+		var when time.Time
+		if err = rows.Scan(&event.ID, &when, &event.UserId, &event.DeviceId,
+			&event.Owner, &event.Action, &event.Args, &event.Source,
+			&event.Result); err != nil {
+			self.logger.Error(self.logCat, "Could not read audit event",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		event.Time = when.Unix()
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Subscribe to device events.
+func (self *Storage) AddWebhook(hook Webhook) (err error) {
+	_, err = self.db.Exec("insert into webhooks (id, userId, url, secret, events, created) values ($1, $2, $3, $4, $5, $6);",
+		hook.ID,
+		hook.UserId,
+		hook.URL,
+		hook.Secret,
+		strings.Join(hook.Events, ","),
+		time.Unix(hook.Created, 0).UTC())
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not add webhook",
+			util.Fields{"error": err.Error(),
+				"userId": hook.UserId})
+	}
+	return err
+}
+
+// Get the user's webhooks, oldest first.
+func (self *Storage) GetWebhooks(userId string) (hooks []Webhook, err error) {
+	rows, err := self.db.Query("select id, userId, url, secret, events, created from webhooks where userId = $1 order by created, id;",
+		userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get webhooks",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hook Webhook
+		var events string
+		var created time.Time
+		if err = rows.Scan(&hook.ID, &hook.UserId, &hook.URL, &hook.Secret,
+			&events, &created); err != nil {
+			self.logger.Error(self.logCat, "Could not read webhook",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		if events != "" {
+			hook.Events = strings.Split(events, ",")
+		}
+		hook.Created = created.Unix()
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// Remove one of the user's webhooks, and its delivery log.
+func (self *Storage) DeleteWebhook(userId, id string) (found bool, err error) {
+	dbh := self.db
+
+	var cnt int64
+	result, err := dbh.Exec("delete from webhooks where userId = $1 and id = $2;",
+		userId, id)
+	if err == nil {
+		cnt, err = result.RowsAffected()
+	}
+	if err == nil && cnt > 0 {
+		_, err = dbh.Exec("delete from webhookDeliveries where webhookId = $1;",
+			id)
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not delete webhook",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// Log an attempt to deliver an event.
+func (self *Storage) AddWebhookDelivery(delivery WebhookDelivery) (err error) {
+	_, err = self.db.Exec("insert into webhookDeliveries (webhookId, delivery, event, deviceId, time, attempt, status, error) values ($1, $2, $3, $4, $5, $6, $7, $8);",
+		delivery.WebhookId,
+		delivery.Delivery,
+		delivery.Event,
+		delivery.DeviceId,
+		time.Unix(delivery.Time, 0).UTC(),
+		delivery.Attempt,
+		delivery.Status,
+		delivery.Error)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not log webhook delivery",
+			util.Fields{"error": err.Error(),
+				"webhookId": delivery.WebhookId})
+	}
+	return err
+}
+
+// The webhook's most recent delivery attempts, newest first (all of
+// them if limit is 0).
+func (self *Storage) GetWebhookDeliveries(webhookId string, limit int) (deliveries []WebhookDelivery, err error) {
+	var max interface{}
+	if limit > 0 {
+		max = limit
+	}
+	rows, err := self.db.Query("select id, webhookId, delivery, event, deviceId, time, attempt, status, error from webhookDeliveries where webhookId = $1 order by id desc limit $2;",
+		webhookId, max)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get webhook deliveries",
+			util.Fields{"error": err.Error(),
+				"webhookId": webhookId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var when time.Time
+		if err = rows.Scan(&delivery.ID, &delivery.WebhookId,
+			&delivery.Delivery, &delivery.Event, &delivery.DeviceId, &when,
+			&delivery.Attempt, &delivery.Status, &delivery.Error); err != nil {
+			self.logger.Error(self.logCat, "Could not read webhook delivery",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		delivery.Time = when.Unix()
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (self *Storage) addTombstone(dbh dbExecer, kind, id string) (err error) {
+	_, err = dbh.Exec("insert into tombstones (id, kind, deleted) values ($1, $2, $3) on conflict (id) do update set kind = excluded.kind, deleted = excluded.deleted;",
+		id, kind, dbNow())
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not add tombstone",
+			util.Fields{"error": err.Error(),
+				"id":   id,
+				"kind": kind})
+	}
+	return err
+}
+
+// When the user or device was deleted (UTC seconds), 0 if it wasn't.
+func (self *Storage) GetTombstone(kind, id string) (deleted int64, err error) {
+	err = self.db.QueryRow("select extract(epoch from deleted)::bigint from tombstones where id = $1 and kind = $2;",
+		id, kind).Scan(&deleted)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get tombstone",
+			util.Fields{"error": err.Error(),
+				"id":   id,
+				"kind": kind})
+		return 0, err
+	}
+	return deleted, nil
+}
+
 func (self *Storage) getMeta(key string) (val string, err error) {
 	var row *sql.Row
 	dbh := self.db
@@ -698,7 +2401,7 @@ func (self *Storage) Close() {
    Anything that can be killed, can be overkilled.
 */
 
-func (self *Storage) genSig(key, val string) string {
+func genSig(key, val string) string {
 	// Yes, this is using woefully insecure MD5. That's ok.
 	// Collisions should be rare enough and this is more
 	// paranoid security than is really required.
@@ -719,7 +2422,7 @@ func (self *Storage) GetNonce() (string, error) {
 	if _, err := dbh.Exec(statement, key, val); err != nil {
 		return "", err
 	}
-	ret := key + "." + self.genSig(key, val)
+	ret := key + "." + genSig(key, val)
 	return ret, nil
 }
 
@@ -748,7 +2451,7 @@ func (self *Storage) CheckNonce(nonce string) (bool, error) {
 			err = rows.Scan(&val)
 			if err == nil {
 				dbh.Exec("delete from nonce where key = $1;", keysig[0])
-				sig := self.genSig(keysig[0], val)
+				sig := genSig(keysig[0], val)
 				return sig == keysig[1], nil
 			}
 			self.logger.Error(self.logCat,
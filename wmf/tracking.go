@@ -0,0 +1,155 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* Tracking sessions.
+   Tracking ("t") starts a session recording who started it, when it
+   expires (d seconds, cmd.t.max if not given) and how often the device
+   was asked to report (i seconds, if given). {"t": {"d": 0}} ends it.
+   Tracking is only useful while someone is watching, so once the last
+   viewer closes the page the device is told to stop after track.idle,
+   unless a viewer comes back first. (A track.idle of 0 stops it as soon
+   as the page is closed.) Idle and expired sessions are cleaned up by
+   the Scheduler. The owner can see or stop the session with
+   /1/tracking/<deviceid>
+*/
+
+// Start (or, with a d of 0, end) the device's tracking session.
+func trackQueue(self *Handler, devRec *storage.Device, userId string, args replyType) (replyType, error) {
+	if _, ok := args["d"]; !ok {
+		args["d"] = self.argLimit("cmd.t.max", 10500)
+	}
+	d, _ := args["d"].(int64)
+	if d <= 0 {
+		if _, err := self.store.StopTracking(devRec.ID); err != nil {
+			return nil, err
+		}
+		return args, nil
+	}
+	now := time.Now().UTC().Unix()
+	session := storage.TrackingSession{
+		DeviceId:  devRec.ID,
+		StartedBy: userId,
+		Started:   now,
+		Expires:   now + d,
+	}
+	session.Interval, _ = args["i"].(int64)
+	if !hasViewers(devRec.ID) {
+		session.Unwatched = now
+	}
+	if err := self.store.StartTracking(session); err != nil {
+		return nil, err
+	}
+	self.logger.Info(self.logCat, "Tracking started",
+		util.Fields{"deviceId": devRec.ID,
+			"userId":   userId,
+			"duration": strconv.FormatInt(d, 10)})
+	self.metrics.Increment("tracking.start")
+	return args, nil
+}
+
+// Is anyone watching the device on this server?
+func hasViewers(devId string) bool {
+	muClient.RLock()
+	defer muClient.RUnlock()
+	return len(Clients[devId]) > 0
+}
+
+// A viewer opened the device's page.
+func (self *Handler) trackingWatched(devId string, store storage.Store) {
+	store.SetTrackingUnwatched(devId, 0)
+}
+
+// The last viewer closed the device's page.
+func (self *Handler) trackingUnwatched(devId string, store storage.Store) {
+	if getDuration(self.config, "track.idle", "5m") <= 0 {
+		store.StopTracking(devId)
+		self.stopTracking(devId, store)
+		return
+	}
+	store.SetTrackingUnwatched(devId, time.Now().UTC().Unix())
+}
+
+// Show (GET) or stop (DELETE) the device's tracking session.
+func (self *Handler) Tracking(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Tracking"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	devRec, _, user := self.userDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	store := self.store
+	session, err := store.GetTracking(devRec.ID)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "DELETE":
+		found, err := store.StopTracking(devRec.ID)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if session == nil || !found {
+			http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+			return
+		}
+		self.logger.Info(self.logCat, "Tracking stopped by user",
+			util.Fields{"deviceId": devRec.ID,
+				"userId": user.ID})
+		self.metrics.Increment("tracking.stop")
+		self.stopTracking(devRec.ID, store)
+		session = nil
+	default:
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	output, _ := json.Marshal(replyType{"tracking": session})
+	resp.Write(output)
+}
+
+// End expired sessions, and stop devices nobody has watched for
+// track.idle.
+func (self *Scheduler) sweepTracking() {
+	handler := self.handler
+	store := handler.store
+	now := time.Now().UTC()
+	idleSince := now.Add(-getDuration(handler.config, "track.idle", "5m"))
+	for {
+		idle, err := store.TakeIdleTracking(now.Unix(), idleSince.Unix(),
+			self.batch)
+		if err != nil {
+			return
+		}
+		for _, session := range idle {
+			if session.Expires <= now.Unix() {
+				self.metrics.Increment("tracking.expired")
+				continue
+			}
+			self.logger.Info(self.logCat, "Stopping unwatched tracking",
+				util.Fields{"deviceId": session.DeviceId,
+					"userId": session.StartedBy})
+			self.metrics.Increment("tracking.idle")
+			handler.stopTracking(session.DeviceId, store)
+		}
+		if len(idle) < self.batch {
+			return
+		}
+	}
+}
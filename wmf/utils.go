@@ -8,12 +8,16 @@ import (
 	"github.com/mozilla-services/FindMyDevice/util"
 
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"html"
 	"io"
 	"io/ioutil"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
 
 	//	"fmt"
 )
@@ -37,6 +41,47 @@ func asciiOnly(r rune) rune {
 	}
 }
 
+func phoneFilter(r rune) rune {
+	if bytes.IndexRune([]byte("0123456789+-(). "), r) < 0 {
+		return rune(-1)
+	}
+	return r
+}
+
+func emailFilter(r rune) rune {
+	if r <= ' ' || r == 0x7f || bytes.IndexRune([]byte("<>\"(),;:[]\\"), r) >= 0 {
+		return rune(-1)
+	}
+	return r
+}
+
+var markupTag = regexp.MustCompile(`<[/!?]?[A-Za-z][^>]*>?|<!--.*?(-->|$)`)
+
+// Clean up text typed by the user (e.g. the lock screen message). Any
+// language is fine, markup isn't. Entities are decoded first, so escaped
+// tags go too, then tags, control characters and bidi overrides are
+// removed.
+func sanitizeText(s string) string {
+	s = html.UnescapeString(s)
+	// Removing one tag can make another.
+	for clean := ""; clean != s; {
+		clean, s = s, markupTag.ReplaceAllString(s, "")
+	}
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n':
+			return r
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r), r == unicode.ReplacementChar,
+			r >= 0x202a && r <= 0x202e, r >= 0x2066 && r <= 0x2069:
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
 func deviceIdFilter(r rune) rune {
 	if bytes.IndexRune([]byte("ABCDEFabcdef0123456789-"), r) < 0 {
 		return rune(-1)
@@ -82,6 +127,34 @@ func isTrue(val interface{}) bool {
 	}
 }
 
+// Decode a base64 assertion segment. Segments may be URL or standard
+// encoded and are usually unpadded.
+func decodeSegment(seg string) ([]byte, error) {
+	seg = strings.TrimRight(seg, "=")
+	if data, err := base64.RawURLEncoding.DecodeString(seg); err == nil {
+		return data, nil
+	}
+	return base64.RawStdEncoding.DecodeString(seg)
+}
+
+// collapse the device's accepts array (e.g. ["l", "r", "t"]) to a string
+// ("lrt"). Only the first letter of each entry is used.
+func collapseAccepts(val interface{}) string {
+	list, ok := val.([]interface{})
+	if !ok {
+		return ""
+	}
+	acc := make([]byte, 0, len(list))
+	for _, ke := range list {
+		if s, ok := ke.(string); ok && len(s) > 0 {
+			if c := s[0] | 0x20; c >= 'a' && c <= 'z' {
+				acc = append(acc, c)
+			}
+		}
+	}
+	return string(acc)
+}
+
 // There's no built in min function.
 // awesome.
 func minInt(x, y int) int {
@@ -91,6 +164,16 @@ func minInt(x, y int) int {
 	return y
 }
 
+// Is s in the list?
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 //filter
 // get the device id from the URL path
 func getDevFromUrl(u *url.URL) (devId string) {
@@ -0,0 +1,91 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+/* Webhook push provider, for carrier and partner wake gateways.
+   Each push is a POST of
+       {"deviceid": "...", "pushurl": "...", "time": 1400000000}
+   to push.webhook.<name>.url. pushurl is whatever address the device
+   registered (e.g. "sms:+15551234567"); the gateway knows how to use it.
+   If push.webhook.<name>.secret is set, the body is signed with
+       X-FMD-Signature: sha256=<hex HMAC-SHA256 of the body>
+   TLS options (ca_file, cert_file, key_file) are read from
+   push.webhook.<name>.tls.*
+*/
+
+type WebhookPush struct {
+	name   string
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookPush(config *util.MzConfig, logger *util.HekaLogger, name string) (self *WebhookPush, err error) {
+	prefix := "push.webhook." + name + "."
+	self = &WebhookPush{
+		name:   name,
+		url:    config.Get(prefix+"url", ""),
+		secret: []byte(config.Get(prefix+"secret", "")),
+	}
+	if self.url == "" {
+		return nil, errors.New("No url defined")
+	}
+	if self.client, err = NewPushClient(config, prefix+"tls."); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Sign the body with the shared secret.
+func hmacSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *WebhookPush) Send(devRec *storage.Device, payload []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"deviceid": devRec.ID,
+		"pushurl":  devRec.PushUrl,
+		"time":     time.Now().UTC().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", self.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(self.secret) > 0 {
+		req.Header.Set("X-FMD-Signature", hmacSignature(self.secret, body))
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Close the body, otherwise Memory leak!
+	defer resp.Body.Close()
+	return checkPushResponse(resp)
+}
+
+// Gateways only wake the device.
+func (self *WebhookPush) CanCarry(devRec *storage.Device) bool {
+	return false
+}
@@ -0,0 +1,569 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* Outbound webhooks.
+   Users can have events about their devices POSTed to their own
+   services (an MDM console, a ticketing system), and the deployment can
+   have everyone's sent to one of its own. The events are
+       device.registered   a device was registered (or registered again)
+       command.queued      a command was queued for the device
+       command.delivered   the device collected its commands
+       location.reported   the device reported where it is
+       erase.completed     the device confirmed it was erased
+       device.unreachable  the push service no longer knows the device
+   and the notices owners are sent (see notify.go), such as
+   erase.scheduled or geofence.enter.
+   Each is POSTed as
+       {"id": "<delivery id>", "event": "command.queued", "userid": "...",
+        "deviceid": "...", "time": 1400000000, "data": {"cmd": "l"}}
+   with X-FMD-Event, X-FMD-Delivery and, like the other webhooks,
+       X-FMD-Signature: sha256=<hex HMAC-SHA256 of the body>
+   Receivers should check the signature, and use the delivery id to
+   ignore the repeats that retries can cause. Passcodes are never sent.
+
+   Users manage theirs at /1/webhooks/. GET lists them, and POST
+   {"url": "https://...", "events": ["command.queued", ...]} adds one
+   (no events means all of them). The reply to the POST is the only time
+   the secret is shown. Adding a webhook needs a recent sign in (see
+   reauth.go), and its URL must be https unless webhook.allow_http is
+   set. GET /1/webhooks/<id> shows its latest delivery attempts, and
+   DELETE removes it. The deployment's webhook is webhook.url, signed
+   with webhook.secret, for webhook.events (all of them if not set).
+
+   Events are delivered in the background. Failures (no response, 429
+   or 5xx) are retried up to webhook.retries times, backing off from
+   webhook.backoff to webhook.max_backoff, or for as long as the
+   receiver's Retry-After asks. Every attempt is logged, and the log is
+   kept for db.webhook_log_expry seconds.
+
+   Users' webhooks may only reach public addresses: the address is
+   checked as each connection is made, so a name that later resolves to
+   a loopback, private or link local address is refused too (set
+   webhook.allow_private to lift this). Redirects aren't followed, and
+   the log only says why a delivery failed in general terms.
+*/
+
+var (
+	ErrWebhookAddress = errors.New("Webhook address not allowed")
+)
+
+// Webhook events
+const (
+	EVENT_DEVICE_REGISTERED  = "device.registered"
+	EVENT_COMMAND_QUEUED     = "command.queued"
+	EVENT_COMMAND_DELIVERED  = "command.delivered"
+	EVENT_LOCATION_REPORTED  = "location.reported"
+	EVENT_ERASE_COMPLETED    = "erase.completed"
+	EVENT_DEVICE_UNREACHABLE = "device.unreachable"
+
+	// The deployment's webhook, in the delivery log.
+	WEBHOOK_DEPLOYMENT = "deployment"
+)
+
+var webhookEvents = append([]string{
+	EVENT_DEVICE_REGISTERED,
+	EVENT_COMMAND_QUEUED,
+	EVENT_COMMAND_DELIVERED,
+	EVENT_LOCATION_REPORTED,
+	EVENT_ERASE_COMPLETED,
+	EVENT_DEVICE_UNREACHABLE,
+}, noticeEvents...)
+
+type WebhookEvent struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	UserId   string    `json:"userid"`
+	DeviceId string    `json:"deviceid"`
+	Time     int64     `json:"time"`
+	Data     replyType `json:"data,omitempty"`
+}
+
+type webhookJob struct {
+	hook    storage.Webhook
+	event   *WebhookEvent
+	body    []byte
+	attempt int
+}
+
+type WebhookDispatcher struct {
+	logger     *util.HekaLogger
+	metrics    *util.Metrics
+	logCat     string
+	store      storage.Store
+	client     *http.Client // for users' webhooks
+	deployment *storage.Webhook
+	deplClient *http.Client
+	queue      chan *webhookJob
+	retries    int
+	backoff    time.Duration // delay before the first retry
+	maxBackoff time.Duration
+	mux        sync.Mutex
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// Create and start the webhook dispatcher.
+func NewWebhookDispatcher(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics, store storage.Store) (self *WebhookDispatcher, err error) {
+	self = &WebhookDispatcher{
+		logger:     logger,
+		metrics:    metrics,
+		logCat:     "webhook",
+		store:      store,
+		queue:      make(chan *webhookJob, getInt(config, "webhook.queue_size", 1000)),
+		retries:    int(getInt(config, "webhook.retries", 5)),
+		backoff:    getDuration(config, "webhook.backoff", "10s"),
+		maxBackoff: getDuration(config, "webhook.max_backoff", "30m"),
+	}
+	if self.client, err = newWebhookClient(config,
+		!config.GetFlag("webhook.allow_private")); err != nil {
+		return nil, err
+	}
+	// The deployment's own webhook may well be on its network.
+	if self.deplClient, err = newWebhookClient(config, false); err != nil {
+		return nil, err
+	}
+	if hookUrl := config.Get("webhook.url", ""); hookUrl != "" {
+		self.deployment = &storage.Webhook{ID: WEBHOOK_DEPLOYMENT,
+			URL:    hookUrl,
+			Secret: config.Get("webhook.secret", ""),
+			Events: configList(config, "webhook.events")}
+	}
+	for workers := getInt(config, "webhook.workers", 4); workers > 0; workers-- {
+		self.wg.Add(1)
+		go self.worker()
+	}
+	return self, nil
+}
+
+// Is the address somewhere on the public internet?
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Refuse to connect anywhere but public addresses. Called with the
+// resolved address, just before connecting.
+func dialPublic(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return ErrWebhookAddress
+	}
+	return nil
+}
+
+// The client webhooks are sent with. It doesn't follow redirects and,
+// if public is set, only connects to public addresses (directly, since
+// a proxy would connect for it).
+func newWebhookClient(config *util.MzConfig, public bool) (client *http.Client, err error) {
+	if client, err = NewPushClient(config, "webhook.tls."); err != nil {
+		return nil, err
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	if public {
+		tr := client.Transport.(*http.Transport)
+		tr.Proxy = nil
+		tr.DialContext = (&net.Dialer{
+			Timeout: getDuration(config, "push.timeout", "10s"),
+			Control: dialPublic}).DialContext
+	}
+	return client, nil
+}
+
+// Why the delivery failed, for the user's delivery log. The details
+// (which can tell what's listening where) are only logged.
+func deliveryError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrWebhookAddress):
+		return ErrWebhookAddress.Error()
+	case errors.As(err, new(*PushError)):
+		return err.Error()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "Timed out"
+	}
+	return "Could not connect"
+}
+
+// Does the webhook want the event?
+func wantsEvent(hook *storage.Webhook, event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, want := range hook.Events {
+		if want == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue the event for the user's webhooks, and the deployment's.
+func (self *WebhookDispatcher) Publish(event *WebhookEvent) {
+	hooks, err := self.store.GetWebhooks(event.UserId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get webhooks",
+			util.Fields{"error": err.Error(),
+				"event":  event.Event,
+				"userId": event.UserId})
+		return
+	}
+	if self.deployment != nil {
+		hooks = append(hooks, *self.deployment)
+	}
+	var body []byte
+	for _, hook := range hooks {
+		if !wantsEvent(&hook, event.Event) {
+			continue
+		}
+		if body == nil {
+			if body, err = json.Marshal(event); err != nil {
+				return
+			}
+		}
+		job := &webhookJob{hook: hook, event: event, body: body}
+		if !self.enqueue(job) {
+			self.metrics.Increment("webhook.queue.full")
+			self.logger.Error(self.logCat, "Webhook queue full",
+				util.Fields{"event": event.Event,
+					"webhookId": hook.ID,
+					"deviceId":  event.DeviceId})
+			continue
+		}
+		self.metrics.Increment("webhook.queued")
+	}
+}
+
+func (self *WebhookDispatcher) enqueue(job *webhookJob) bool {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.closed {
+		return false
+	}
+	select {
+	case self.queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the workers. Queued events are abandoned after the timeout.
+func (self *WebhookDispatcher) Close(timeout time.Duration) {
+	self.mux.Lock()
+	if self.closed {
+		self.mux.Unlock()
+		return
+	}
+	self.closed = true
+	close(self.queue)
+	self.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		self.logger.Warn(self.logCat, "Abandoning queued webhook events",
+			util.Fields{"queued": strconv.FormatInt(int64(len(self.queue)), 10)})
+	}
+}
+
+func (self *WebhookDispatcher) worker() {
+	defer self.wg.Done()
+	for job := range self.queue {
+		self.process(job)
+	}
+}
+
+// POST the event, returning the receiver's status (0 if it didn't
+// answer).
+func (self *WebhookDispatcher) send(job *webhookJob) (status int, err error) {
+	req, err := http.NewRequest("POST", job.hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-FMD-Event", job.event.Event)
+	req.Header.Set("X-FMD-Delivery", job.event.ID)
+	if job.hook.Secret != "" {
+		req.Header.Set("X-FMD-Signature",
+			hmacSignature([]byte(job.hook.Secret), job.body))
+	}
+	client := self.client
+	if job.hook.ID == WEBHOOK_DEPLOYMENT {
+		client = self.deplClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, checkPushResponse(resp)
+}
+
+func (self *WebhookDispatcher) process(job *webhookJob) {
+	job.attempt++
+	self.metrics.Increment("webhook.attempt")
+	start := time.Now()
+	status, err := self.send(job)
+	self.metrics.Timer("webhook.send", time.Now().Sub(start).Nanoseconds()/1e6)
+	delivery := storage.WebhookDelivery{WebhookId: job.hook.ID,
+		Delivery: job.event.ID,
+		Event:    job.event.Event,
+		DeviceId: job.event.DeviceId,
+		Time:     time.Now().UTC().Unix(),
+		Attempt:  job.attempt,
+		Status:   status}
+	if err != nil {
+		delivery.Error = deliveryError(err)
+	}
+	self.store.AddWebhookDelivery(delivery)
+	if err == nil {
+		self.metrics.Increment("webhook.success")
+		return
+	}
+	fields := util.Fields{"error": err.Error(),
+		"event":     job.event.Event,
+		"webhookId": job.hook.ID,
+		"deviceId":  job.event.DeviceId,
+		"attempt":   strconv.FormatInt(int64(job.attempt), 10)}
+	if job.attempt > self.retries || !retryable(err) ||
+		errors.Is(err, ErrWebhookAddress) {
+		self.metrics.Increment("webhook.failed")
+		self.logger.Error(self.logCat, "Giving up on webhook", fields)
+		return
+	}
+	self.logger.Warn(self.logCat, "Webhook failed", fields)
+	self.metrics.Increment("webhook.retry")
+	delay := backoffDelay(self.backoff, self.maxBackoff, job.attempt)
+	if perr, ok := err.(*PushError); ok && perr.RetryAfter > delay {
+		delay = perr.RetryAfter
+	}
+	time.AfterFunc(delay, func() {
+		if !self.enqueue(job) {
+			self.metrics.Increment("webhook.failed")
+			self.logger.Error(self.logCat, "Giving up on webhook", fields)
+		}
+	})
+}
+
+// Tell the device owner's webhooks, and the deployment's, about the
+// event.
+func (self *Handler) emit(devRec *storage.Device, event string, data replyType) {
+	id, _ := util.GenUUID4()
+	self.webhooks.Publish(&WebhookEvent{ID: id,
+		Event:    event,
+		UserId:   devRec.User,
+		DeviceId: devRec.ID,
+		Time:     time.Now().UTC().Unix(),
+		Data:     data})
+}
+
+// The webhook, without its secret.
+func redactWebhook(hook storage.Webhook) storage.Webhook {
+	hook.Secret = ""
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+	return hook
+}
+
+// Check a new webhook's URL and events, returning why it can't be
+// added.
+func (self *Handler) checkWebhook(hookUrl string, events []string) (reason string) {
+	u, err := url.Parse(hookUrl)
+	switch {
+	case err != nil || u.Host == "" || len(hookUrl) > 2048:
+		return "A valid URL is required"
+	case u.Scheme != "https" &&
+		!(u.Scheme == "http" && self.config.GetFlag("webhook.allow_http")):
+		return "The URL must be https"
+	}
+	// Names are checked when they're connected to.
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicAddress(ip) &&
+		!self.config.GetFlag("webhook.allow_private") {
+		return "The URL must be a public address"
+	}
+	for _, event := range events {
+		known := false
+		for _, name := range webhookEvents {
+			known = known || name == event
+		}
+		if !known {
+			return "Unknown event " + event
+		}
+	}
+	return ""
+}
+
+// List (GET) or add (POST) the signed in user's webhooks, or show (GET)
+// or remove (DELETE) one of them at /1/webhooks/<id>.
+func (self *Handler) Webhooks(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Webhooks"
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Strict-Transport-Security", "max-age=86400")
+
+	session, err := sessionStore.Get(req, SESSION_NAME)
+	if err != nil || !self.checkToken(session, req) {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	userId, _, err := self.getUser(resp, req)
+	if err != nil || userId == "" {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	path := strings.TrimRight(req.URL.Path, "/")
+	id := path[strings.LastIndex(path, "/")+1:]
+	if id == "webhooks" {
+		id = ""
+	}
+	store := self.store
+	hooks, err := store.GetWebhooks(userId)
+	if err != nil {
+		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	var hook *storage.Webhook
+	for i := range hooks {
+		if hooks[i].ID == id {
+			hook = &hooks[i]
+		}
+	}
+	if id != "" && hook == nil {
+		http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+		return
+	}
+	switch {
+	case req.Method == "GET" && hook != nil:
+		deliveries, err := store.GetWebhookDeliveries(hook.ID, 50)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if deliveries == nil {
+			deliveries = []storage.WebhookDelivery{}
+		}
+		output, _ := json.Marshal(replyType{"webhook": redactWebhook(*hook),
+			"deliveries": deliveries})
+		resp.Write(output)
+		return
+	case req.Method == "GET":
+	case req.Method == "POST" && hook == nil:
+		if challenge := self.reauthChallenge(sessionAuthTime(session)); challenge != nil {
+			self.metrics.Increment("webhook.reauth")
+			output, _ := json.Marshal(challenge)
+			http.Error(resp, string(output), http.StatusForbidden)
+			return
+		}
+		var args struct {
+			URL    string
+			Events []string
+		}
+		if err := json.NewDecoder(io.LimitReader(req.Body,
+			4096)).Decode(&args); err != nil {
+			http.Error(resp, "\"Invalid Webhook\"", http.StatusBadRequest)
+			return
+		}
+		reason := self.checkWebhook(args.URL, args.Events)
+		if reason == "" && int64(len(hooks)) >= getInt(self.config, "webhook.max", 5) {
+			reason = "Too many webhooks"
+		}
+		if reason != "" {
+			output, _ := json.Marshal(replyType{"error": "Invalid webhook",
+				"reason": reason})
+			http.Error(resp, string(output), http.StatusBadRequest)
+			return
+		}
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		newHook := storage.Webhook{UserId: userId,
+			URL:     args.URL,
+			Secret:  hex.EncodeToString(secret),
+			Events:  args.Events,
+			Created: time.Now().UTC().Unix()}
+		newHook.ID, _ = util.GenUUID4()
+		if err = store.AddWebhook(newHook); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		self.audit(self.sourceAddr(req), userId, nil, AUDIT_WEBHOOK_ADD,
+			replyType{"url": newHook.URL}, AUDIT_OK)
+		self.logger.Info(self.logCat, "Webhook added",
+			util.Fields{"userId": userId,
+				"id": newHook.ID})
+		self.metrics.Increment("webhook.add")
+		// The only time the secret is shown.
+		if newHook.Events == nil {
+			newHook.Events = []string{}
+		}
+		output, _ := json.Marshal(newHook)
+		resp.Write(output)
+		return
+	case req.Method == "DELETE" && hook != nil:
+		found, err := store.DeleteWebhook(userId, hook.ID)
+		if err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+		if !found {
+			http.Error(resp, "\"Not Found\"", http.StatusNotFound)
+			return
+		}
+		self.audit(self.sourceAddr(req), userId, nil, AUDIT_WEBHOOK_DELETE,
+			replyType{"url": hook.URL}, AUDIT_OK)
+		self.logger.Info(self.logCat, "Webhook removed",
+			util.Fields{"userId": userId,
+				"id": hook.ID})
+		self.metrics.Increment("webhook.delete")
+		if hooks, err = store.GetWebhooks(userId); err != nil {
+			http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		http.Error(resp, "\"Method Not Allowed\"", http.StatusMethodNotAllowed)
+		return
+	}
+	list := []storage.Webhook{}
+	for _, rec := range hooks {
+		list = append(list, redactWebhook(rec))
+	}
+	output, _ := json.Marshal(replyType{"webhooks": list,
+		"events": webhookEvents})
+	resp.Write(output)
+}
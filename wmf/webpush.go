@@ -0,0 +1,298 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"github.com/mozilla-services/FindMyDevice/util"
+	"github.com/mozilla-services/FindMyDevice/wmf/storage"
+
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/* Web Push (RFC 8030) delivery.
+   Payloads are encrypted with aes128gcm (RFC 8291) and requests are
+   signed with the VAPID key (RFC 8292) specified by push.vapid.key_file.
+   Devices register a PushSubscription, the JSON of which looks like:
+   {"endpoint": "https://...", "keys": {"p256dh": "...", "auth": "..."}}
+*/
+
+var (
+	ErrInvalidSubscription = errors.New("Invalid push subscription")
+	ErrPayloadTooLarge     = errors.New("Push payload too large")
+)
+
+const (
+	// Record size for the single aes128gcm record we send.
+	WEBPUSH_RECORD_SIZE = 4096
+	// salt(16) + rs(4) + idlen(1) + keyid(65), plus the delimiter and
+	// GCM tag that are added to the plaintext.
+	WEBPUSH_MAX_PAYLOAD = WEBPUSH_RECORD_SIZE - 86 - 17
+)
+
+type WebPush struct {
+	config  *util.MzConfig
+	logger  *util.HekaLogger
+	logCat  string
+	client  *http.Client
+	key     *ecdsa.PrivateKey // VAPID signing key (may be nil)
+	pubKey  string            // VAPID public key (base64url)
+	subject string            // VAPID "sub" claim
+	ttl     int64
+}
+
+// Create a Web Push sender. VAPID is optional, but most push services
+// will refuse unsigned requests.
+func NewWebPush(config *util.MzConfig, logger *util.HekaLogger, client *http.Client) (wp *WebPush, err error) {
+	ttl, err := strconv.ParseInt(config.Get("push.ttl", "86400"), 10, 64)
+	if err != nil {
+		ttl = 86400
+	}
+	wp = &WebPush{
+		config:  config,
+		logger:  logger,
+		logCat:  "webpush",
+		client:  client,
+		subject: config.Get("push.vapid.subject", ""),
+		ttl:     ttl,
+	}
+	keyFile := config.Get("push.vapid.key_file", "")
+	if keyFile == "" {
+		logger.Warn(wp.logCat, "No VAPID key defined, Web Push requests will not be signed", nil)
+		return wp, nil
+	}
+	if wp.key, err = readVapidKey(keyFile); err != nil {
+		return nil, err
+	}
+	pub, err := wp.key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	wp.pubKey = base64.RawURLEncoding.EncodeToString(pub.Bytes())
+	return wp, nil
+}
+
+// Read a PEM encoded P-256 private key (as created by
+// "openssl ecparam -name prime256v1 -genkey -noout")
+func readVapidKey(keyFile string) (key *ecdsa.PrivateKey, err error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", keyFile)
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		var pkey interface{}
+		if pkey, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			var ok bool
+			if key, ok = pkey.(*ecdsa.PrivateKey); !ok {
+				err = fmt.Errorf("%s is not an EC key", keyFile)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%s is not a P-256 key", keyFile)
+	}
+	return key, nil
+}
+
+// The VAPID public key, as the applicationServerKey devices should
+// subscribe with.
+func (self *WebPush) PublicKey() string {
+	return self.pubKey
+}
+
+// Build the VAPID Authorization header for the push endpoint.
+func (self *WebPush) vapidHeader(endpoint string) (header string, err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+	}
+	if self.subject != "" {
+		claims["sub"] = self.subject
+	}
+	jclaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(jclaims)
+	hash := sha256.Sum256([]byte(token))
+	r, s, err := ecdsa.Sign(rand.Reader, self.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS wants the fixed width r||s, not ASN.1
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", token,
+		base64.RawURLEncoding.EncodeToString(sig), self.pubKey), nil
+}
+
+// Send a push to the device. An empty payload just wakes the device.
+func (self *WebPush) Send(devRec *storage.Device, payload []byte) (err error) {
+	var body []byte
+
+	if len(payload) > 0 {
+		if body, err = encryptPayload(devRec.PushKey, devRec.PushAuth,
+			payload); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest("POST", devRec.PushUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("TTL", strconv.FormatInt(self.ttl, 10))
+	// Commands are worth waking the device for.
+	req.Header.Set("Urgency", "high")
+	if len(body) > 0 {
+		req.Header.Set("Content-Encoding", "aes128gcm")
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if self.key != nil {
+		auth, err := self.vapidHeader(devRec.PushUrl)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Close the body, otherwise Memory leak!
+	defer resp.Body.Close()
+	return checkPushResponse(resp)
+}
+
+// Payloads need the subscription keys.
+func (self *WebPush) CanCarry(devRec *storage.Device) bool {
+	return devRec.PushKey != "" && devRec.PushAuth != ""
+}
+
+// Encrypt the payload for the subscription keys as a single aes128gcm
+// record (RFC 8188, RFC 8291).
+func encryptPayload(p256dh, auth string, plaintext []byte) (body []byte, err error) {
+	if len(plaintext) > WEBPUSH_MAX_PAYLOAD {
+		return nil, ErrPayloadTooLarge
+	}
+	uaBytes, err := decodeSegment(p256dh)
+	if err != nil {
+		return nil, ErrInvalidSubscription
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaBytes)
+	if err != nil {
+		return nil, ErrInvalidSubscription
+	}
+	authSecret, err := decodeSegment(auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, ErrInvalidSubscription
+	}
+	// A new key pair for every message.
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asBytes := asKey.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaBytes...)
+	keyInfo = append(keyInfo, asBytes...)
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt,
+		"Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt,
+		"Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// header: salt | rs | idlen | keyid
+	body = make([]byte, 0, 86+len(plaintext)+17)
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, WEBPUSH_RECORD_SIZE)
+	body = append(body, byte(len(asBytes)))
+	body = append(body, asBytes...)
+	// The last (and only) record ends with a 0x02 delimiter.
+	record := append(append([]byte{}, plaintext...), 2)
+	return gcm.Seal(body, nonce, record, nil), nil
+}
+
+// Pull the endpoint and keys out of a PushSubscription.
+func parseSubscription(sub map[string]interface{}) (endpoint, p256dh, auth string, err error) {
+	endpoint, _ = sub["endpoint"].(string)
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", "", "", ErrInvalidSubscription
+	}
+	keys, _ := sub["keys"].(map[string]interface{})
+	p256dh, _ = keys["p256dh"].(string)
+	auth, _ = keys["auth"].(string)
+	uaBytes, err := decodeSegment(p256dh)
+	if err != nil {
+		return "", "", "", ErrInvalidSubscription
+	}
+	if _, err = ecdh.P256().NewPublicKey(uaBytes); err != nil {
+		return "", "", "", ErrInvalidSubscription
+	}
+	if authSecret, err := decodeSegment(auth); err != nil || len(authSecret) != 16 {
+		return "", "", "", ErrInvalidSubscription
+	}
+	return endpoint, p256dh, auth, nil
+}
@@ -0,0 +1,257 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The user agent side of a push subscription.
+type testSubscriber struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func newTestSubscriber(t *testing.T) *testSubscriber {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	return &testSubscriber{key: key, auth: auth}
+}
+
+// The PushSubscription JSON, as the server decodes it.
+func (self *testSubscriber) subscription(endpoint string) map[string]interface{} {
+	return map[string]interface{}{"endpoint": endpoint,
+		"keys": map[string]interface{}{
+			"p256dh": base64.RawURLEncoding.EncodeToString(self.key.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(self.auth)}}
+}
+
+// Decrypt an aes128gcm push message, as the user agent would.
+func (self *testSubscriber) decrypt(t *testing.T, body []byte) []byte {
+	if len(body) < 21 || len(body) < 21+int(body[20]) {
+		t.Fatalf("Short push body %d", len(body))
+	}
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != WEBPUSH_RECORD_SIZE {
+		t.Errorf("Unexpected record size %d", rs)
+	}
+	keyId := body[21 : 21+int(body[20])]
+	asKey, err := ecdh.P256().NewPublicKey(keyId)
+	if err != nil {
+		t.Fatalf("Bad sender key: %s", err)
+	}
+	shared, _ := self.key.ECDH(asKey)
+	keyInfo := append([]byte("WebPush: info\x00"), self.key.PublicKey().Bytes()...)
+	ikm, _ := hkdf.Key(sha256.New, shared, self.auth, string(append(keyInfo, keyId...)), 32)
+	cek, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, nonce, body[21+len(keyId):], nil)
+	if err != nil {
+		t.Fatalf("Could not decrypt push: %s", err)
+	}
+	if len(plain) == 0 || plain[len(plain)-1] != 2 {
+		t.Fatalf("Missing record delimiter")
+	}
+	return plain[:len(plain)-1]
+}
+
+// Write a VAPID key for the server to use.
+func writeVapidKey(t *testing.T) (keyFile string, key *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	file, err := ioutil.TempFile("", "fmd_vapid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem.Encode(file, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	file.Close()
+	return file.Name(), key
+}
+
+// Check the VAPID header as a push service would.
+func checkVapid(t *testing.T, header string, key *ecdsa.PublicKey, aud string) {
+	var token, k string
+	for _, part := range strings.Split(strings.TrimPrefix(header, "vapid "), ", ") {
+		if strings.HasPrefix(part, "t=") {
+			token = part[2:]
+		} else if strings.HasPrefix(part, "k=") {
+			k = part[2:]
+		}
+	}
+	pub, _ := key.ECDH()
+	if k != base64.RawURLEncoding.EncodeToString(pub.Bytes()) {
+		t.Errorf("Unexpected VAPID key %q", k)
+	}
+	bits := strings.Split(token, ".")
+	if len(bits) != 3 {
+		t.Fatalf("Bad VAPID token %q", token)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(bits[2])
+	hash := sha256.Sum256([]byte(bits[0] + "." + bits[1]))
+	if len(sig) != 64 || !ecdsa.Verify(key, hash[:],
+		new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatalf("VAPID signature did not verify")
+	}
+	claims := make(replyType)
+	jclaims, _ := base64.RawURLEncoding.DecodeString(bits[1])
+	json.Unmarshal(jclaims, &claims)
+	if claims["aud"] != aud || claims["sub"] != "mailto:test@example.com" {
+		t.Errorf("Unexpected VAPID claims %v", claims)
+	}
+}
+
+func TestWebPushEncryption(t *testing.T) {
+	ua := newTestSubscriber(t)
+	sub := ua.subscription("https://push.example.com/abc")
+	endpoint, p256dh, auth, err := parseSubscription(sub)
+	if err != nil || endpoint != "https://push.example.com/abc" {
+		t.Fatalf("Could not parse subscription: %s", err)
+	}
+	body, err := encryptPayload(p256dh, auth, []byte(`{"r":{"d":10}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain := ua.decrypt(t, body); string(plain) != `{"r":{"d":10}}` {
+		t.Errorf("Unexpected payload %q", plain)
+	}
+	if _, err = encryptPayload(p256dh, auth,
+		make([]byte, WEBPUSH_MAX_PAYLOAD+1)); err != ErrPayloadTooLarge {
+		t.Errorf("Oversize payload accepted: %v", err)
+	}
+
+	sub["keys"].(map[string]interface{})["auth"] = "c2hvcnQ"
+	if _, _, _, err = parseSubscription(sub); err != ErrInvalidSubscription {
+		t.Errorf("Bad auth secret accepted: %v", err)
+	}
+	sub = ua.subscription("mailto:push@example.com")
+	if _, _, _, err = parseSubscription(sub); err != ErrInvalidSubscription {
+		t.Errorf("Bad endpoint accepted: %v", err)
+	}
+}
+
+func TestWebPushInline(t *testing.T) {
+	type push struct {
+		header http.Header
+		body   []byte
+	}
+	pushes := make(chan push, 10)
+	service := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			pushes <- push{req.Header, body}
+			resp.WriteHeader(http.StatusCreated)
+		}))
+	defer service.Close()
+
+	keyFile, key := writeVapidKey(t)
+	defer os.Remove(keyFile)
+	srv := newTestServer(t, "push.vapid.key_file="+keyFile,
+		"push.vapid.subject=mailto:test@example.com",
+		"push.inline_commands=true")
+	defer srv.Close()
+
+	resp, err := http.Get(srv.url("/1/pushkey/"))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Could not fetch push key: %v", err)
+	}
+	resp.Body.Close()
+
+	ua := newTestSubscriber(t)
+	devId := newDevId()
+	sub := ua.subscription(service.URL + "/" + devId)
+	resp, body := srv.post("/1/register/", replyType{
+		"assert":       "valid.alice",
+		"subscription": sub,
+		"deviceid":     devId,
+		"accepts":      []string{"l", "r", "t", "e"}}, nil, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Register failed %d: %s", resp.StatusCode, body)
+	}
+	cred := make(map[string]string)
+	json.Unmarshal(body, &cred)
+	dev := NewHawkClient(devId, cred["secret"], nil)
+	if devRec, _ := srv.handler.store.GetDeviceInfo(devId); devRec.PushKey == "" {
+		t.Fatalf("Subscription keys not stored: %+v", devRec)
+	}
+
+	user := srv.signin("alice")
+	var inline map[string]map[string]interface{}
+	if status := srv.queue(user, devId, replyType{"r": replyType{"d": 10}}); status != 200 {
+		t.Fatalf("Queue failed: %d", status)
+	}
+	select {
+	case got := <-pushes:
+		if got.header.Get("Content-Encoding") != "aes128gcm" || got.header.Get("TTL") == "" {
+			t.Errorf("Unexpected push headers %v", got.header)
+		}
+		checkVapid(t, got.header.Get("Authorization"), &key.PublicKey, service.URL)
+		plain := ua.decrypt(t, got.body)
+		if err := json.Unmarshal(plain, &inline); err != nil ||
+			inline["r"]["d"] != 10.0 || inline["r"]["id"] == nil {
+			t.Errorf("Unexpected inline command %q", plain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No push sent")
+	}
+	// The command is kept until the device replies to it.
+	if pending, _ := srv.handler.store.GetPendingCommands(devId); len(pending) != 1 {
+		t.Errorf("Inline command not stored: %+v", pending)
+	}
+	if command, _ := srv.cmd(dev, replyType{"r": replyType{"ok": true,
+		"id": inline["r"]["id"]}}); len(command) != 0 {
+		t.Errorf("Acknowledged inline command sent again: %v", command)
+	}
+	// Reports without the id don't acknowledge it.
+	srv.queue(user, devId, replyType{"t": replyType{"d": 60}})
+	<-pushes
+	if command, _ := srv.cmd(dev, replyType{"t": replyType{"ok": true,
+		"la": 45.52, "lo": -122.68, "ti": time.Now().Unix()}}); command["t"] == nil {
+		t.Errorf("Inline command dropped by a report: %v", command)
+	}
+	// A device that missed the push still gets the command.
+	srv.queue(user, devId, replyType{"r": replyType{"d": 20}})
+	<-pushes
+	if command, _ := srv.cmd(dev, nil); command["r"] == nil ||
+		command["r"].(map[string]interface{})["d"] != 20.0 {
+		t.Errorf("Unexpected command %v", command)
+	}
+
+	sub["endpoint"] = "nope"
+	if resp, _ = srv.post("/1/register/", replyType{
+		"assert":       "valid.alice",
+		"subscription": sub,
+		"deviceid":     devId}, nil, nil); resp.StatusCode != 400 {
+		t.Errorf("Bad subscription accepted: %d", resp.StatusCode)
+	}
+}
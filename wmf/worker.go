@@ -27,6 +27,17 @@ type WWS struct {
 	input   chan []byte
 	quitter chan bool
 	output  chan []byte
+
+	// The signed in user, and when they last signed in (UTC seconds)
+	UserId   string
+	AuthTime int64
+	// Where they connected from, for the audit log.
+	Source string
+
+	// For share viewers, the share they came in with and when it
+	// expires. Share viewers can't send commands.
+	Share   string
+	Expires time.Time
 }
 
 // Snif the incoming socket for data
@@ -77,13 +88,14 @@ func (self *WWS) sniffer() {
 // Workhorse function.
 func (self *WWS) Run() {
 	self.input = make(chan []byte)
-	self.quitter = make(chan bool)
+	// buffered, so the sniffer isn't left waiting if Run has already
+	// returned
+	self.quitter = make(chan bool, 1)
 	self.output = make(chan []byte)
 
 	defer func(sock *WWS) {
 		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
+			switch err, _ := r.(error); {
 			case err == io.EOF:
 				lived := int64(time.Now().Sub(self.Born).Seconds())
 				sock.Logger.Debug("worker", "Closing Socket",
@@ -91,7 +103,7 @@ func (self *WWS) Run() {
 			default:
 				sock.Logger.Error("worker",
 					"Unhandled error in Run",
-					util.Fields{"error": r.(error).Error()})
+					util.Fields{"error": fmt.Sprintf("%v", r)})
 			}
 		}
 		sock.Logger.Debug("worker", "Cleaning up...", nil)
@@ -101,8 +113,30 @@ func (self *WWS) Run() {
 
 	go self.sniffer()
 
+	// Share viewers are dropped once the share expires or is revoked.
+	var expired <-chan time.Time
+	var recheck <-chan time.Time
+	if self.Share != "" {
+		expired = time.After(self.Expires.Sub(time.Now()))
+		ticker := time.NewTicker(getDuration(self.Handler.config,
+			"share.check", "1m"))
+		defer ticker.Stop()
+		recheck = ticker.C
+	}
+
 	for {
 		select {
+		case <-expired:
+			self.Logger.Debug("worker", "Share expired",
+				util.Fields{"deviceId": self.Device.ID})
+			return
+		case <-recheck:
+			if share, err := self.Handler.store.GetShare(self.Share); err == nil &&
+				share == nil {
+				self.Logger.Debug("worker", "Share revoked",
+					util.Fields{"deviceId": self.Device.ID})
+				return
+			}
 		case <-self.quitter:
 			self.Quit = true
 			self.Logger.Debug("worker",
@@ -110,6 +144,12 @@ func (self *WWS) Run() {
 				util.Fields{"deviceId": self.Device.ID})
 			return
 		case input := <-self.input:
+			if self.Share != "" {
+				self.Logger.Warn("worker", "Command from share viewer ignored",
+					util.Fields{"deviceId": self.Device.ID})
+				self.Socket.Write([]byte("false"))
+				continue
+			}
 			msg := make(replyType)
 			if err := json.Unmarshal(input, &msg); err != nil {
 				self.Logger.Error("worker", "Unparsable cmd",
@@ -119,20 +159,46 @@ func (self *WWS) Run() {
 				continue
 			}
 			rep := make(replyType)
+			result := []byte("true")
 			for cmd, args := range msg {
-				rargs := args.(replyType)
-				_, err := self.Handler.Queue(self.Device, cmd, &rargs, &rep)
+				margs, ok := args.(map[string]interface{})
+				if !ok {
+					self.Logger.Error("worker", "Invalid cmd arguments",
+						util.Fields{"cmd": cmd,
+							"args": fmt.Sprintf("%+v", args)})
+					result = []byte("false")
+					break
+				}
+				rargs := replyType(margs)
+				if challenge := self.Handler.checkReauth(cmd, rargs,
+					self.AuthTime); challenge != nil {
+					result, _ = json.Marshal(challenge)
+					break
+				}
+				_, err := self.Handler.Queue(self.Device, self.UserId, self.Source, cmd, &rargs, &rep)
+				if err == ErrDeviceDeleted {
+					// An erase for a device that can't be reached.
+					if err = self.Handler.deleteDevice(self.Source, self.UserId,
+						self.Device, "unreachable"); err != nil {
+						self.Logger.Warn("worker", "Could not remove device",
+							util.Fields{"deviceId": self.Device.ID,
+								"userId": self.Device.User,
+								"error":  err.Error()})
+					}
+					break
+				}
 				if err != nil {
 					self.Logger.Error("worker", "Error processing command",
 						util.Fields{
 							"error": err.Error(),
 							"cmd":   cmd,
 							"args":  fmt.Sprintf("%+v", args)})
-					self.Socket.Write([]byte("false"))
+					result = []byte("false")
 					break
 				}
 			}
-			self.Socket.Write([]byte("true"))
+			// One reply per message.
+			self.Socket.Write(result)
 		case output := <-self.output:
 			_, err := self.Socket.Write(output)
 			if err != nil {